@@ -0,0 +1,68 @@
+// Command ipimport imports archived RIR delegation files, such as
+// delegated-ripencc-extended-20240131.bz2, for lookups as of a past date.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"ipservice/internal/config"
+	"ipservice/internal/repository"
+	"ipservice/internal/service"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to a YAML or TOML config file (default $CONFIG_FILE)")
+	format := flag.String("format", config.FormatExtended, "format of the archives, extended or standard")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] archive...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format != config.FormatExtended && *format != config.FormatStandard {
+		fmt.Fprintf(os.Stderr, "format must be %q or %q, got %q\n", config.FormatExtended, config.FormatStandard, *format)
+		os.Exit(2)
+	}
+
+	logConfig := zap.NewProductionConfig()
+	logConfig.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	logger, _ := logConfig.Build()
+	defer logger.Sync()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.Fatal("Failed to load configuration", zap.Error(err))
+	}
+
+	db, err := sqlx.Connect("postgres", cfg.PostgresURL)
+	if err != nil {
+		logger.Fatal("Failed to connect to PostgreSQL", zap.Error(err))
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	importer := service.NewArchiveImporter(
+		repository.NewPostgresRepository(db, logger),
+		service.NewRIRService(logger),
+		*format,
+		logger,
+	)
+	if err := importer.Import(ctx, flag.Args()); err != nil {
+		logger.Fatal("Failed to import delegation archives", zap.Error(err))
+	}
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
+	"flag"
 	"go.uber.org/zap/zapcore"
-	"os"
 	"os/signal"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	_ "time/tzdata" // for UPDATE_TIMEZONE on hosts without a zoneinfo database
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/recover"
@@ -32,6 +33,9 @@ func init() {
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to a YAML or TOML config file (default $CONFIG_FILE)")
+	flag.Parse()
+
 	// Initialize logger
 	logConfig := zap.NewProductionConfig()
 	logConfig.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
@@ -41,7 +45,7 @@ func main() {
 	logger.Info("Starting up server...")
 
 	// Load configuration
-	cfg, err := config.Load()
+	cfg, err := config.Load(*configPath)
 	if err != nil {
 		logger.Fatal("Failed to load configuration", zap.Error(err))
 	}
@@ -68,6 +72,7 @@ func main() {
 
 	// Initialize repositories
 	postgresRepo := repository.NewPostgresRepository(db, logger)
+	updateLocker := repository.NewPostgresLocker(db, logger)
 	redisRepo := repository.NewRedisRepository(redisClient, logger)
 
 	// Initialize services
@@ -76,13 +81,15 @@ func main() {
 		postgresRepo,
 		redisRepo,
 		rirService,
+		updateLocker,
 		cfg,
 		logger,
 	)
 
-	// Start IP service background tasks
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Start IP service background tasks; a shutdown signal cancels them,
+	// including the initial load
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
 	if err := ipService.Start(ctx); err != nil {
 		logger.Fatal("Failed to start IP service", zap.Error(err))
@@ -138,17 +145,20 @@ func main() {
 	h := handler.NewHandler(ipService, logger)
 	h.RegisterRoutes(app)
 
-	// Graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	if cfg.AdminToken == "" {
+		logger.Warn("ADMIN_TOKEN is not set, admin API disabled")
+	}
+	adminHandler := handler.NewAdminHandler(ipService, cfg.AdminToken, logger)
+	adminHandler.RegisterRoutes(app)
 
+	// Graceful shutdown
 	go func() {
 		if err := app.Listen(cfg.ServerPort); err != nil {
 			logger.Fatal("Failed to start server", zap.Error(err))
 		}
 	}()
 
-	<-sigChan
+	<-ctx.Done()
 	logger.Info("Shutting down server...")
 
 	if err := app.Shutdown(); err != nil {
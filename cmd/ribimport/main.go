@@ -0,0 +1,59 @@
+// Command ribimport imports BGP RIB dumps in MRT format, such as
+// rib.20240101.0000.bz2 from RouteViews or bview.20240101.0000.gz from RIPE
+// RIS, so that lookups report the AS originating each address.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"ipservice/internal/config"
+	"ipservice/internal/repository"
+	"ipservice/internal/service"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to a YAML or TOML config file (default $CONFIG_FILE)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] dump...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logConfig := zap.NewProductionConfig()
+	logConfig.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	logger, _ := logConfig.Build()
+	defer logger.Sync()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.Fatal("Failed to load configuration", zap.Error(err))
+	}
+
+	db, err := sqlx.Connect("postgres", cfg.PostgresURL)
+	if err != nil {
+		logger.Fatal("Failed to connect to PostgreSQL", zap.Error(err))
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	importer := service.NewRouteImporter(repository.NewPostgresRepository(db, logger), logger)
+	if err := importer.Import(ctx, flag.Args()); err != nil {
+		logger.Fatal("Failed to import RIB dumps", zap.Error(err))
+	}
+}
@@ -1,9 +1,14 @@
 package config
 
 import (
+	"errors"
 	"fmt"
-	"github.com/spf13/viper"
+	"net"
 	"net/url"
+	"time"
+
+	"github.com/spf13/viper"
+	"ipservice/internal/schedule"
 )
 
 type Config struct {
@@ -11,6 +16,40 @@ type Config struct {
 	RedisURL    string `mapstructure:"REDIS_URL"`
 	ServerPort  string `mapstructure:"SERVER_PORT"`
 	RIRs        []RIR  `mapstructure:"rirs"`
+	// Geofeeds are layered over the RIR data of the addresses they cover
+	Geofeeds []Geofeed `mapstructure:"geofeeds"`
+	// MaxBatchSize limits the number of addresses in a batch lookup
+	MaxBatchSize int `mapstructure:"BATCH_MAX_SIZE"`
+	// FetchConcurrency limits how many RIR sources are downloaded at once
+	FetchConcurrency int `mapstructure:"FETCH_CONCURRENCY"`
+	// FailurePolicy decides what happens to the data of a failing source
+	FailurePolicy string `mapstructure:"FAILURE_POLICY"`
+	// MaxStaleness flags sources not confirmed current for longer; zero
+	// disables it
+	MaxStaleness time.Duration `mapstructure:"MAX_STALENESS"`
+
+	// UpdateSchedule is an interval such as "24h" or a cron spec evaluated
+	// in UpdateTimezone; each run is delayed by up to UpdateJitter
+	UpdateSchedule string        `mapstructure:"UPDATE_SCHEDULE"`
+	UpdateTimezone string        `mapstructure:"UPDATE_TIMEZONE"`
+	UpdateJitter   time.Duration `mapstructure:"UPDATE_JITTER"`
+	// MaxDatasetAge refreshes a dataset older than this at startup; zero
+	// disables it
+	MaxDatasetAge time.Duration `mapstructure:"MAX_DATASET_AGE"`
+	// DatasetPollInterval is how often instances check for a dataset
+	// published by another instance
+	DatasetPollInterval time.Duration `mapstructure:"DATASET_POLL_INTERVAL"`
+	// DatasetHistory is how many published versions keep their ranges in
+	// the history table; zero disables it
+	DatasetHistory int `mapstructure:"DATASET_HISTORY"`
+
+	// Guardrails checked before a new dataset is published
+	MaxChangePercent    float64 `mapstructure:"MAX_CHANGE_PERCENT"`    // per source; zero disables it
+	MaxInvalidCountries int     `mapstructure:"MAX_INVALID_COUNTRIES"` // ranges outside ISO 3166
+	MaxConflicts        int     `mapstructure:"MAX_CONFLICTS"`         // ranges overlapping another source's
+
+	// AdminToken authorizes the admin API; it is disabled when empty
+	AdminToken string `mapstructure:"ADMIN_TOKEN"`
 }
 
 type PostgresConfig struct {
@@ -28,9 +67,111 @@ type RedisConfig struct {
 	Database string
 }
 
+// Delegation file formats published by the RIRs
+const (
+	FormatExtended = "extended" // delegated-*-extended, with an opaque-id column
+	FormatStandard = "standard" // delegated-*, without opaque ids
+)
+
+// Failure policies for sources that cannot be fetched during an update
+const (
+	PolicyFail      = "fail"       // abort the update, keeping the published dataset
+	PolicyKeepStale = "keep_stale" // publish the source's last known good ranges
+	PolicyDrop      = "drop"       // publish without the source
+)
+
+// ChecksumMD5 verifies downloads against the "<url>.md5" companion file the
+// RIRs publish next to each delegation file.
+const ChecksumMD5 = "md5"
+
 type RIR struct {
-	Name string `mapstructure:"name"`
-	URL  string `mapstructure:"url"`
+	Name    string        `mapstructure:"name"`
+	URL     string        `mapstructure:"url"`
+	Enabled bool          `mapstructure:"enabled"`
+	Mirrors []string      `mapstructure:"mirrors"` // tried in order when URL fails
+	Timeout time.Duration `mapstructure:"timeout"` // per attempt; zero uses the client default
+	Budget  time.Duration `mapstructure:"budget"`  // for all attempts and mirrors; zero is unlimited
+	Format  string        `mapstructure:"format"`  // FormatExtended or FormatStandard
+	// Checksum is ChecksumMD5 to verify downloads, or empty to skip it
+	Checksum string `mapstructure:"checksum"`
+	// MaxAge rejects files whose data ends longer ago; zero disables it
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// Fewer ranges per IP version reject a new dataset
+	MinIPv4Ranges int `mapstructure:"min_ipv4_ranges"`
+	MinIPv6Ranges int `mapstructure:"min_ipv6_ranges"`
+}
+
+// Geofeed is an RFC 8805 geolocation feed self-published by a network
+// operator, refreshed with every update.
+type Geofeed struct {
+	Name    string        `mapstructure:"name"`
+	URL     string        `mapstructure:"url"` // http(s):// URL or file:// path
+	Enabled bool          `mapstructure:"enabled"`
+	Timeout time.Duration `mapstructure:"timeout"` // zero uses the client default
+	// Allocations are the prefixes delegated to the publisher; entries
+	// outside them are ignored
+	Allocations []string `mapstructure:"allocations"`
+}
+
+// Networks parses the allocations of the publisher.
+func (g Geofeed) Networks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(g.Allocations))
+	for _, allocation := range g.Allocations {
+		_, network, err := net.ParseCIDR(allocation)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// geofeedFile is how a geofeed is read from the config file.
+type geofeedFile struct {
+	Name        string        `mapstructure:"name"`
+	URL         string        `mapstructure:"url"`
+	Enabled     *bool         `mapstructure:"enabled"`
+	Timeout     time.Duration `mapstructure:"timeout"`
+	Allocations []string      `mapstructure:"allocations"`
+}
+
+// rirFile is how a RIR source is read from the config file; omitted
+// options keep their defaults.
+type rirFile struct {
+	Name          string        `mapstructure:"name"`
+	URL           string        `mapstructure:"url"`
+	Enabled       *bool         `mapstructure:"enabled"`
+	Mirrors       []string      `mapstructure:"mirrors"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+	Budget        time.Duration `mapstructure:"budget"`
+	Format        string        `mapstructure:"format"`
+	Checksum      string        `mapstructure:"checksum"`
+	MaxAge        time.Duration `mapstructure:"max_age"`
+	MinIPv4Ranges int           `mapstructure:"min_ipv4_ranges"`
+	MinIPv6Ranges int           `mapstructure:"min_ipv6_ranges"`
+}
+
+// Minimum range counts of the built-in sources, well below what each RIR
+// publishes
+const (
+	defaultMinIPv4Ranges = 1000
+	defaultMinIPv6Ranges = 500
+)
+
+// DefaultRIRs are the sources used when the config file defines none.
+func DefaultRIRs() []RIR {
+	rirs := []RIR{
+		{Name: "ARIN", URL: "https://ftp.arin.net/pub/stats/arin/delegated-arin-extended-latest", Enabled: true, Format: FormatExtended, Checksum: ChecksumMD5},
+		{Name: "RIPE", URL: "https://ftp.ripe.net/pub/stats/ripencc/delegated-ripencc-latest", Enabled: true, Format: FormatStandard, Checksum: ChecksumMD5},
+		{Name: "APNIC", URL: "https://ftp.apnic.net/stats/apnic/delegated-apnic-latest", Enabled: true, Format: FormatStandard, Checksum: ChecksumMD5},
+		{Name: "LACNIC", URL: "https://ftp.lacnic.net/pub/stats/lacnic/delegated-lacnic-latest", Enabled: true, Format: FormatStandard, Checksum: ChecksumMD5},
+		{Name: "AFRINIC", URL: "https://ftp.afrinic.net/stats/afrinic/delegated-afrinic-latest", Enabled: true, Format: FormatStandard, Checksum: ChecksumMD5},
+	}
+	for i := range rirs {
+		rirs[i].MinIPv4Ranges = defaultMinIPv4Ranges
+		rirs[i].MinIPv6Ranges = defaultMinIPv6Ranges
+	}
+	return rirs
 }
 
 func buildPostgresURL(cfg PostgresConfig) string {
@@ -53,55 +194,314 @@ func buildRedisURL(cfg RedisConfig) string {
 	)
 }
 
-func Load() (*Config, error) {
+// Load builds the configuration from defaults, an optional YAML or TOML
+// config file and environment variables, in increasing order of precedence.
+// The file is read from path, or from CONFIG_FILE when path is empty. Keys
+// in the file are the environment variable names in any case, e.g. db_host,
+// plus a "rirs" list of sources and a "geofeeds" list of feeds.
+func Load(path string) (*Config, error) {
+	v := viper.New()
+
 	// PostgreSQL defaults
-	viper.SetDefault("DB_USER", "postgres")
-	viper.SetDefault("DB_PASSWORD", "postgres")
-	viper.SetDefault("DB_HOST", "localhost")
-	viper.SetDefault("DB_PORT", "5432")
-	viper.SetDefault("DB_NAME", "ipservice")
-	viper.SetDefault("DB_SSLMODE", "disable")
+	v.SetDefault("DB_USER", "postgres")
+	v.SetDefault("DB_PASSWORD", "postgres")
+	v.SetDefault("DB_HOST", "localhost")
+	v.SetDefault("DB_PORT", "5432")
+	v.SetDefault("DB_NAME", "ipservice")
+	v.SetDefault("DB_SSLMODE", "disable")
 
 	// Redis defaults
-	viper.SetDefault("REDIS_HOST", "localhost")
-	viper.SetDefault("REDIS_PORT", "6379")
-	viper.SetDefault("REDIS_DB", "0")
+	v.SetDefault("REDIS_HOST", "localhost")
+	v.SetDefault("REDIS_PORT", "6379")
+	v.SetDefault("REDIS_DB", "0")
 
 	// Server default
-	viper.SetDefault("SERVER_PORT", ":8080")
+	v.SetDefault("SERVER_PORT", ":8080")
+
+	// Batch lookup default
+	v.SetDefault("BATCH_MAX_SIZE", 1000)
+
+	// Update defaults
+	v.SetDefault("FETCH_CONCURRENCY", 3)
+	v.SetDefault("FAILURE_POLICY", PolicyKeepStale)
+	v.SetDefault("MAX_STALENESS", "72h")
+
+	// Schedule defaults
+	v.SetDefault("UPDATE_SCHEDULE", "24h")
+	v.SetDefault("UPDATE_TIMEZONE", "UTC")
+	v.SetDefault("UPDATE_JITTER", 0)
+	v.SetDefault("MAX_DATASET_AGE", "36h")
+	v.SetDefault("DATASET_POLL_INTERVAL", "30s")
+	v.SetDefault("DATASET_HISTORY", 0)
 
-	viper.AutomaticEnv()
+	// Guardrail defaults
+	v.SetDefault("MAX_CHANGE_PERCENT", 10)
+	v.SetDefault("MAX_INVALID_COUNTRIES", 0)
+	v.SetDefault("MAX_CONFLICTS", 100)
+
+	v.AutomaticEnv()
+
+	if path == "" {
+		path = v.GetString("CONFIG_FILE")
+	}
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("reading config file %s: %w", path, err)
+		}
+	}
 
 	// Build PostgreSQL URL
 	postgresConfig := PostgresConfig{
-		User:     viper.GetString("DB_USER"),
-		Password: viper.GetString("DB_PASSWORD"),
-		Host:     viper.GetString("DB_HOST"),
-		Port:     viper.GetString("DB_PORT"),
-		Database: viper.GetString("DB_NAME"),
-		SSLMode:  viper.GetString("DB_SSLMODE"),
+		User:     v.GetString("DB_USER"),
+		Password: v.GetString("DB_PASSWORD"),
+		Host:     v.GetString("DB_HOST"),
+		Port:     v.GetString("DB_PORT"),
+		Database: v.GetString("DB_NAME"),
+		SSLMode:  v.GetString("DB_SSLMODE"),
 	}
 
 	// Build Redis URL
 	redisConfig := RedisConfig{
-		Host:     viper.GetString("REDIS_HOST"),
-		Port:     viper.GetString("REDIS_PORT"),
-		Database: viper.GetString("REDIS_DB"),
+		Host:     v.GetString("REDIS_HOST"),
+		Port:     v.GetString("REDIS_PORT"),
+		Database: v.GetString("REDIS_DB"),
 	}
 
 	var config Config
 	config.PostgresURL = buildPostgresURL(postgresConfig)
 	config.RedisURL = buildRedisURL(redisConfig)
-	config.ServerPort = viper.GetString("SERVER_PORT")
+	config.ServerPort = v.GetString("SERVER_PORT")
+	config.MaxBatchSize = v.GetInt("BATCH_MAX_SIZE")
+	config.FetchConcurrency = v.GetInt("FETCH_CONCURRENCY")
+	config.FailurePolicy = v.GetString("FAILURE_POLICY")
+	config.MaxStaleness = v.GetDuration("MAX_STALENESS")
+	config.UpdateSchedule = v.GetString("UPDATE_SCHEDULE")
+	config.UpdateTimezone = v.GetString("UPDATE_TIMEZONE")
+	config.UpdateJitter = v.GetDuration("UPDATE_JITTER")
+	config.MaxDatasetAge = v.GetDuration("MAX_DATASET_AGE")
+	config.DatasetPollInterval = v.GetDuration("DATASET_POLL_INTERVAL")
+	config.DatasetHistory = v.GetInt("DATASET_HISTORY")
+	config.MaxChangePercent = v.GetFloat64("MAX_CHANGE_PERCENT")
+	config.MaxInvalidCountries = v.GetInt("MAX_INVALID_COUNTRIES")
+	config.MaxConflicts = v.GetInt("MAX_CONFLICTS")
+	config.AdminToken = v.GetString("ADMIN_TOKEN")
+
+	config.RIRs = DefaultRIRs()
+	if v.IsSet("rirs") {
+		var sources []rirFile
+		if err := v.UnmarshalKey("rirs", &sources); err != nil {
+			return nil, fmt.Errorf("parsing rirs: %w", err)
+		}
+
+		config.RIRs = make([]RIR, 0, len(sources))
+		for _, src := range sources {
+			rir := RIR{
+				Name:          src.Name,
+				URL:           src.URL,
+				Enabled:       src.Enabled == nil || *src.Enabled,
+				Mirrors:       src.Mirrors,
+				Timeout:       src.Timeout,
+				Budget:        src.Budget,
+				Format:        src.Format,
+				Checksum:      src.Checksum,
+				MaxAge:        src.MaxAge,
+				MinIPv4Ranges: src.MinIPv4Ranges,
+				MinIPv6Ranges: src.MinIPv6Ranges,
+			}
+			if rir.Format == "" {
+				rir.Format = FormatStandard
+			}
+
+			config.RIRs = append(config.RIRs, rir)
+		}
+	}
+
+	if v.IsSet("geofeeds") {
+		var feeds []geofeedFile
+		if err := v.UnmarshalKey("geofeeds", &feeds); err != nil {
+			return nil, fmt.Errorf("parsing geofeeds: %w", err)
+		}
 
-	// Default RIR configurations
-	config.RIRs = []RIR{
-		{Name: "ARIN", URL: "https://ftp.arin.net/pub/stats/arin/delegated-arin-extended-latest"},
-		{Name: "RIPE", URL: "https://ftp.ripe.net/pub/stats/ripencc/delegated-ripencc-latest"},
-		{Name: "APNIC", URL: "https://ftp.apnic.net/stats/apnic/delegated-apnic-latest"},
-		{Name: "LACNIC", URL: "https://ftp.lacnic.net/pub/stats/lacnic/delegated-lacnic-latest"},
-		{Name: "AFRINIC", URL: "https://ftp.afrinic.net/stats/afrinic/delegated-afrinic-latest"},
+		for _, feed := range feeds {
+			config.Geofeeds = append(config.Geofeeds, Geofeed{
+				Name:        feed.Name,
+				URL:         feed.URL,
+				Enabled:     feed.Enabled == nil || *feed.Enabled,
+				Timeout:     feed.Timeout,
+				Allocations: feed.Allocations,
+			})
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	return &config, nil
 }
+
+// Validate reports every problem with the configuration at once.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.ServerPort); err != nil {
+		errs = append(errs, fmt.Errorf("SERVER_PORT %q must be of the form [host]:port", c.ServerPort))
+	}
+	if c.MaxBatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("BATCH_MAX_SIZE must be positive, got %d", c.MaxBatchSize))
+	}
+	if c.FetchConcurrency <= 0 {
+		errs = append(errs, fmt.Errorf("FETCH_CONCURRENCY must be positive, got %d", c.FetchConcurrency))
+	}
+	switch c.FailurePolicy {
+	case PolicyFail, PolicyKeepStale, PolicyDrop:
+	default:
+		errs = append(errs, fmt.Errorf("FAILURE_POLICY must be %q, %q or %q, got %q", PolicyFail, PolicyKeepStale, PolicyDrop, c.FailurePolicy))
+	}
+	if c.MaxStaleness < 0 {
+		errs = append(errs, errors.New("MAX_STALENESS must not be negative"))
+	}
+	if _, err := c.Schedule(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.UpdateJitter < 0 {
+		errs = append(errs, errors.New("UPDATE_JITTER must not be negative"))
+	}
+	if c.MaxDatasetAge < 0 {
+		errs = append(errs, errors.New("MAX_DATASET_AGE must not be negative"))
+	}
+	if c.DatasetPollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("DATASET_POLL_INTERVAL must be positive, got %s", c.DatasetPollInterval))
+	}
+	if c.DatasetHistory < 0 {
+		errs = append(errs, errors.New("DATASET_HISTORY must not be negative"))
+	}
+	if c.MaxChangePercent < 0 {
+		errs = append(errs, errors.New("MAX_CHANGE_PERCENT must not be negative"))
+	}
+	if c.MaxInvalidCountries < 0 {
+		errs = append(errs, errors.New("MAX_INVALID_COUNTRIES must not be negative"))
+	}
+	if c.MaxConflicts < 0 {
+		errs = append(errs, errors.New("MAX_CONFLICTS must not be negative"))
+	}
+
+	enabled := 0
+	names := make(map[string]bool)
+	for i, rir := range c.RIRs {
+		label := fmt.Sprintf("rirs[%d]", i)
+		if rir.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", label))
+		} else {
+			label = fmt.Sprintf("rirs[%d] (%s)", i, rir.Name)
+			if names[rir.Name] {
+				errs = append(errs, fmt.Errorf("%s: duplicate name", label))
+			}
+			names[rir.Name] = true
+		}
+
+		if err := validateSourceURL(rir.URL); err != nil {
+			errs = append(errs, fmt.Errorf("%s: url: %w", label, err))
+		}
+		for j, mirror := range rir.Mirrors {
+			if err := validateSourceURL(mirror); err != nil {
+				errs = append(errs, fmt.Errorf("%s: mirrors[%d]: %w", label, j, err))
+			}
+		}
+		if rir.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: timeout must not be negative", label))
+		}
+		if rir.Budget < 0 {
+			errs = append(errs, fmt.Errorf("%s: budget must not be negative", label))
+		}
+		if rir.MaxAge < 0 {
+			errs = append(errs, fmt.Errorf("%s: max_age must not be negative", label))
+		}
+		if rir.MinIPv4Ranges < 0 || rir.MinIPv6Ranges < 0 {
+			errs = append(errs, fmt.Errorf("%s: min_ipv4_ranges and min_ipv6_ranges must not be negative", label))
+		}
+		if rir.Format != FormatExtended && rir.Format != FormatStandard {
+			errs = append(errs, fmt.Errorf("%s: format must be %q or %q, got %q", label, FormatExtended, FormatStandard, rir.Format))
+		}
+
+		if rir.Checksum != "" && rir.Checksum != ChecksumMD5 {
+			errs = append(errs, fmt.Errorf("%s: checksum must be %q or empty, got %q", label, ChecksumMD5, rir.Checksum))
+		}
+
+		if rir.Enabled {
+			enabled++
+		}
+	}
+	if enabled == 0 {
+		errs = append(errs, errors.New("at least one RIR source must be enabled"))
+	}
+
+	feeds := make(map[string]bool)
+	for i, feed := range c.Geofeeds {
+		label := fmt.Sprintf("geofeeds[%d]", i)
+		if feed.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", label))
+		} else {
+			label = fmt.Sprintf("geofeeds[%d] (%s)", i, feed.Name)
+			if feeds[feed.Name] {
+				errs = append(errs, fmt.Errorf("%s: duplicate name", label))
+			}
+			feeds[feed.Name] = true
+		}
+
+		if err := validateSourceURL(feed.URL); err != nil {
+			errs = append(errs, fmt.Errorf("%s: url: %w", label, err))
+		}
+		if feed.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: timeout must not be negative", label))
+		}
+		// RFC 8805 entries must fall within the publisher's allocations
+		if len(feed.Allocations) == 0 {
+			errs = append(errs, fmt.Errorf("%s: allocations are required", label))
+		}
+		for j, allocation := range feed.Allocations {
+			if _, _, err := net.ParseCIDR(allocation); err != nil {
+				errs = append(errs, fmt.Errorf("%s: allocations[%d]: %q is not a CIDR prefix", label, j, allocation))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Schedule parses UpdateSchedule in UpdateTimezone.
+func (c *Config) Schedule() (schedule.Schedule, error) {
+	loc, err := time.LoadLocation(c.UpdateTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("UPDATE_TIMEZONE %q: %w", c.UpdateTimezone, err)
+	}
+	sched, err := schedule.Parse(c.UpdateSchedule, loc)
+	if err != nil {
+		return nil, fmt.Errorf("UPDATE_SCHEDULE: %w", err)
+	}
+	return sched, nil
+}
+
+func validateSourceURL(raw string) error {
+	if raw == "" {
+		return errors.New("is required")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "file" {
+		if u.Path == "" && u.Opaque == "" {
+			return fmt.Errorf("missing path in %q", raw)
+		}
+		return nil
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in %q", raw)
+	}
+	return nil
+}
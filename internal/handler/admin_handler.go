@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"ipservice/internal/model"
+)
+
+// AdminService is the part of the IP service exposed to operators.
+type AdminService interface {
+	Status() model.ServiceStatus
+	TriggerUpdate() (*model.UpdateStatus, bool)
+	CancelUpdate() bool
+	DatasetVersions(ctx context.Context, limit int) ([]model.DatasetVersion, error)
+	DatasetDiff(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error)
+	RollbackIPRanges(ctx context.Context) error
+}
+
+// Caps on the dataset versions and range changes listed at once
+const (
+	maxVersionsLimit = 1000
+	maxChangesLimit  = 10000
+)
+
+type AdminHandler struct {
+	service AdminService
+	token   string
+	logger  *zap.Logger
+}
+
+// NewAdminHandler serves the admin API to requests carrying token as a
+// bearer token. Every request is refused when token is empty.
+func NewAdminHandler(service AdminService, token string, logger *zap.Logger) *AdminHandler {
+	return &AdminHandler{
+		service: service,
+		token:   token,
+		logger:  logger,
+	}
+}
+
+func (h *AdminHandler) RegisterRoutes(app *fiber.App) {
+	admin := app.Group("/api/v1/admin", h.authorize)
+	admin.Get("/status", h.Status)
+	admin.Post("/updates", h.TriggerUpdate)
+	admin.Delete("/updates/current", h.CancelUpdate)
+	admin.Get("/versions", h.DatasetVersions)
+	admin.Get("/diff", h.DatasetDiff)
+	admin.Post("/rollback", h.Rollback)
+}
+
+func (h *AdminHandler) authorize(c *fiber.Ctx) error {
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok || h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		h.logger.Warn("unauthorized admin request",
+			zap.String("path", c.Path()),
+			zap.String("ip", c.IP()))
+
+		return c.Status(fiber.StatusUnauthorized).JSON(model.Error{
+			Message: "A valid admin token is required",
+		})
+	}
+	return c.Next()
+}
+
+// Status reports the published dataset, the update in progress, the
+// outcome of the last update, including rejected guardrails, and stale
+// sources.
+func (h *AdminHandler) Status(c *fiber.Ctx) error {
+	return c.JSON(h.service.Status())
+}
+
+// TriggerUpdate starts an update in the background. While one is already
+// running the request joins it, reported by started being false.
+func (h *AdminHandler) TriggerUpdate(c *fiber.Ctx) error {
+	status, started := h.service.TriggerUpdate()
+
+	h.logger.Info("admin update requested",
+		zap.Bool("started", started),
+		zap.Time("update_started_at", status.StartedAt))
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"started": started,
+		"update":  status,
+	})
+}
+
+// CancelUpdate cancels the update in progress.
+func (h *AdminHandler) CancelUpdate(c *fiber.Ctx) error {
+	if !h.service.CancelUpdate() {
+		return c.Status(fiber.StatusConflict).JSON(model.Error{
+			Message: "No update in progress",
+		})
+	}
+
+	h.logger.Info("admin cancelled update")
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"cancelled": true,
+	})
+}
+
+// DatasetVersions lists the latest published dataset versions, newest
+// first, with the serial of each source they were built from.
+func (h *AdminHandler) DatasetVersions(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 20)
+	if limit < 1 || limit > maxVersionsLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(model.Error{
+			Message: fmt.Sprintf("limit must be between 1 and %d", maxVersionsLimit),
+		})
+	}
+
+	versions, err := h.service.DatasetVersions(c.Context(), limit)
+	if err != nil {
+		h.logger.Error("listing dataset versions failed", zap.Error(err))
+
+		return c.Status(fiber.StatusInternalServerError).JSON(model.Error{
+			Message: "Failed to list dataset versions",
+		})
+	}
+
+	return c.JSON(versions)
+}
+
+// DatasetDiff lists the ranges added, removed or moved to another country
+// between the versions from and to, by default those changed by the update
+// publishing to, or the served version. The changes can be filtered by old
+// or new country and by overlapping network.
+func (h *AdminHandler) DatasetDiff(c *fiber.Ctx) error {
+	var q model.DiffQuery
+	var err error
+	badRequest := func(message string) error {
+		return c.Status(fiber.StatusBadRequest).JSON(model.Error{
+			Message: message,
+		})
+	}
+
+	for param, version := range map[string]*int64{"from": &q.From, "to": &q.To} {
+		if value := c.Query(param); value != "" {
+			if *version, err = strconv.ParseInt(value, 10, 64); err != nil || *version <= 0 {
+				return badRequest(fmt.Sprintf("%s must be a dataset version", param))
+			}
+		}
+	}
+
+	if country := c.Query("country"); country != "" {
+		if len(country) != 2 {
+			return badRequest("country must be a two-letter country code")
+		}
+		q.CountryCode = strings.ToUpper(country)
+	}
+
+	if cidr := c.Query("cidr"); cidr != "" {
+		if _, q.Network, err = net.ParseCIDR(cidr); err != nil {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return badRequest(fmt.Sprintf("Invalid CIDR format: %s", cidr))
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			q.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+	}
+
+	q.Limit = c.QueryInt("limit", 1000)
+	if q.Limit < 1 || q.Limit > maxChangesLimit {
+		return badRequest(fmt.Sprintf("limit must be between 1 and %d", maxChangesLimit))
+	}
+
+	diff, err := h.service.DatasetDiff(c.Context(), q)
+	if err != nil {
+		if strings.Contains(err.Error(), "dataset version not found") {
+			return c.Status(fiber.StatusNotFound).JSON(model.Error{
+				Message: err.Error(),
+			})
+		}
+
+		h.logger.Error("dataset diff failed",
+			zap.Int64("from", q.From),
+			zap.Int64("to", q.To),
+			zap.Error(err))
+
+		return c.Status(fiber.StatusInternalServerError).JSON(model.Error{
+			Message: "Failed to compare dataset versions",
+		})
+	}
+
+	return c.JSON(diff)
+}
+
+// Rollback restores the dataset replaced by the last update and reports the
+// status once it is served. It is refused while an update is in progress on
+// any instance; rolling back twice serves the newer dataset again.
+func (h *AdminHandler) Rollback(c *fiber.Ctx) error {
+	if err := h.service.RollbackIPRanges(c.Context()); err != nil {
+		message := err.Error()
+		if strings.Contains(message, "no previous IP ranges dataset") ||
+			strings.Contains(message, "another instance is updating") ||
+			strings.Contains(message, "update of the IP ranges is in progress") {
+			return c.Status(fiber.StatusConflict).JSON(model.Error{
+				Message: message,
+			})
+		}
+
+		h.logger.Error("rollback failed", zap.Error(err))
+
+		return c.Status(fiber.StatusInternalServerError).JSON(model.Error{
+			Message: "Failed to roll back IP ranges",
+		})
+	}
+
+	status := h.service.Status()
+	h.logger.Info("admin rolled back IP ranges",
+		zap.Int64("dataset_version", status.DatasetVersion))
+
+	return c.JSON(status)
+}
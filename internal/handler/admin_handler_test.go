@@ -0,0 +1,376 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"ipservice/internal/model"
+)
+
+type mockAdminService struct {
+	statusFunc        func() model.ServiceStatus
+	triggerUpdateFunc func() (*model.UpdateStatus, bool)
+	cancelUpdateFunc  func() bool
+	versionsFunc      func(ctx context.Context, limit int) ([]model.DatasetVersion, error)
+	diffFunc          func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error)
+	rollbackFunc      func(ctx context.Context) error
+}
+
+func (m *mockAdminService) Status() model.ServiceStatus {
+	return m.statusFunc()
+}
+
+func (m *mockAdminService) TriggerUpdate() (*model.UpdateStatus, bool) {
+	return m.triggerUpdateFunc()
+}
+
+func (m *mockAdminService) CancelUpdate() bool {
+	return m.cancelUpdateFunc()
+}
+
+func (m *mockAdminService) DatasetVersions(ctx context.Context, limit int) ([]model.DatasetVersion, error) {
+	return m.versionsFunc(ctx, limit)
+}
+
+func (m *mockAdminService) DatasetDiff(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+	return m.diffFunc(ctx, q)
+}
+
+func (m *mockAdminService) RollbackIPRanges(ctx context.Context) error {
+	return m.rollbackFunc(ctx)
+}
+
+func TestAdminHandler_Status(t *testing.T) {
+	service := &mockAdminService{
+		statusFunc: func() model.ServiceStatus {
+			return model.ServiceStatus{
+				Ranges: 42,
+				LastUpdate: &model.UpdateStatus{
+					Error:      "dataset rejected by 1 guardrails",
+					Violations: []string{"RIPE: 10 IPv4 ranges, expected at least 1000"},
+				},
+			}
+		},
+	}
+
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		expectedCode  int
+	}{
+		{name: "valid token", token: "secret", authorization: "Bearer secret", expectedCode: 200},
+		{name: "wrong token", token: "secret", authorization: "Bearer guess", expectedCode: 401},
+		{name: "missing token", token: "secret", expectedCode: 401},
+		{name: "not a bearer token", token: "secret", authorization: "secret", expectedCode: 401},
+		{name: "admin API disabled", token: "", authorization: "Bearer ", expectedCode: 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := zap.NewDevelopment()
+			h := NewAdminHandler(service, tt.token, logger)
+
+			app := fiber.New()
+			h.RegisterRoutes(app)
+
+			req := httptest.NewRequest("GET", "/api/v1/admin/status", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+			if tt.expectedCode != 200 {
+				return
+			}
+
+			var body model.ServiceStatus
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Ranges != 42 || body.LastUpdate == nil || len(body.LastUpdate.Violations) != 1 {
+				t.Errorf("unexpected status %+v", body)
+			}
+		})
+	}
+}
+
+func TestAdminHandler_Updates(t *testing.T) {
+	running := false
+	service := &mockAdminService{
+		triggerUpdateFunc: func() (*model.UpdateStatus, bool) {
+			started := !running
+			running = true
+			return &model.UpdateStatus{State: model.UpdateRunning, Trigger: model.TriggerAdmin}, started
+		},
+		cancelUpdateFunc: func() bool {
+			cancelled := running
+			running = false
+			return cancelled
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	h := NewAdminHandler(service, "secret", logger)
+	app := fiber.New()
+	h.RegisterRoutes(app)
+
+	request := func(method, path, token string) (int, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	if code, _ := request("POST", "/api/v1/admin/updates", "guess"); code != 401 || running {
+		t.Fatalf("expected unauthorized trigger to be refused, got %d", code)
+	}
+
+	// A second trigger joins the running update
+	for _, expectStarted := range []bool{true, false} {
+		code, body := request("POST", "/api/v1/admin/updates", "secret")
+		if code != 202 || body["started"] != expectStarted {
+			t.Errorf("expected 202 with started %v, got %d %v", expectStarted, code, body)
+		}
+		if update, _ := body["update"].(map[string]any); update["state"] != model.UpdateRunning {
+			t.Errorf("expected running update, got %v", body["update"])
+		}
+	}
+
+	if code, _ := request("DELETE", "/api/v1/admin/updates/current", "secret"); code != 202 {
+		t.Errorf("expected cancel to be accepted, got %d", code)
+	}
+	if code, _ := request("DELETE", "/api/v1/admin/updates/current", "secret"); code != 409 {
+		t.Errorf("expected conflict without an update in progress, got %d", code)
+	}
+}
+
+func TestAdminHandler_DatasetVersions(t *testing.T) {
+	var requested int
+	service := &mockAdminService{
+		versionsFunc: func(ctx context.Context, limit int) ([]model.DatasetVersion, error) {
+			requested = limit
+			return []model.DatasetVersion{
+				{ID: 2, IPv4Ranges: 10, Sources: []model.SourceVersion{{Name: "ARIN", Serial: 20240102}}},
+				{ID: 1, IPv4Ranges: 9, Sources: []model.SourceVersion{{Name: "ARIN", Serial: 20240101}}},
+			}, nil
+		},
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		expectedCode  int
+		expectedLimit int
+	}{
+		{name: "default limit", expectedCode: 200, expectedLimit: 20},
+		{name: "explicit limit", query: "?limit=2", expectedCode: 200, expectedLimit: 2},
+		{name: "zero limit", query: "?limit=0", expectedCode: 400},
+		{name: "limit too large", query: "?limit=1001", expectedCode: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested = 0
+			logger, _ := zap.NewDevelopment()
+			h := NewAdminHandler(service, "secret", logger)
+			app := fiber.New()
+			h.RegisterRoutes(app)
+
+			req := httptest.NewRequest("GET", "/api/v1/admin/versions"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+			if requested != tt.expectedLimit {
+				t.Errorf("expected limit %d, got %d", tt.expectedLimit, requested)
+			}
+			if tt.expectedCode != 200 {
+				return
+			}
+
+			var body []model.DatasetVersion
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body) != 2 || body[0].ID != 2 || len(body[0].Sources) != 1 || body[0].Sources[0].Serial != 20240102 {
+				t.Errorf("unexpected versions %+v", body)
+			}
+		})
+	}
+}
+
+func TestAdminHandler_DatasetDiff(t *testing.T) {
+	var requested *model.DiffQuery
+	service := &mockAdminService{
+		diffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			requested = &q
+			if q.To == 99 {
+				return nil, errors.New("dataset version not found: 99")
+			}
+			return &model.DatasetDiff{
+				From:    q.From,
+				To:      q.To,
+				Sources: []model.SourceDiff{{Source: "RIPE", CountryChanged: 1}},
+				Changes: []model.RangeChange{{Network: "2.16.0.0/13", Source: "RIPE", Change: model.RangeCountryChanged, OldCountryCode: "DE", NewCountryCode: "FR"}},
+			}, nil
+		},
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		expectedCode  int
+		expectedQuery string
+	}{
+		{name: "served version", expectedCode: 200, expectedQuery: "{From:0 To:0 CountryCode: Network:<nil> Limit:1000}"},
+		{name: "recorded update", query: "?to=12", expectedCode: 200, expectedQuery: "{From:0 To:12 CountryCode: Network:<nil> Limit:1000}"},
+		{name: "between versions", query: "?from=3&to=12&country=fr&limit=5", expectedCode: 200, expectedQuery: "{From:3 To:12 CountryCode:FR Network:<nil> Limit:5}"},
+		{name: "network", query: "?cidr=2.16.0.0/16", expectedCode: 200, expectedQuery: "{From:0 To:0 CountryCode: Network:2.16.0.0/16 Limit:1000}"},
+		{name: "address", query: "?cidr=2.16.1.1", expectedCode: 200, expectedQuery: "{From:0 To:0 CountryCode: Network:2.16.1.1/32 Limit:1000}"},
+		{name: "unknown version", query: "?to=99", expectedCode: 404, expectedQuery: "{From:0 To:99 CountryCode: Network:<nil> Limit:1000}"},
+		{name: "invalid version", query: "?from=latest", expectedCode: 400},
+		{name: "invalid country", query: "?country=FRA", expectedCode: 400},
+		{name: "invalid network", query: "?cidr=2.16.0.0/33", expectedCode: 400},
+		{name: "limit too large", query: "?limit=10001", expectedCode: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested = nil
+			logger, _ := zap.NewDevelopment()
+			h := NewAdminHandler(service, "secret", logger)
+			app := fiber.New()
+			h.RegisterRoutes(app)
+
+			req := httptest.NewRequest("GET", "/api/v1/admin/diff"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+			if tt.expectedQuery == "" {
+				if requested != nil {
+					t.Errorf("expected the request to be refused, got query %+v", *requested)
+				}
+				return
+			}
+			if got := fmt.Sprintf("%+v", *requested); got != tt.expectedQuery {
+				t.Errorf("expected query %s, got %s", tt.expectedQuery, got)
+			}
+			if tt.expectedCode != 200 {
+				return
+			}
+
+			var body model.DatasetDiff
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Changes) != 1 || body.Changes[0].NewCountryCode != "FR" || len(body.Sources) != 1 {
+				t.Errorf("unexpected diff %+v", body)
+			}
+		})
+	}
+}
+
+func TestAdminHandler_Rollback(t *testing.T) {
+	version := int64(7)
+	var rollbackErr error
+	rolledBack := 0
+	service := &mockAdminService{
+		statusFunc: func() model.ServiceStatus {
+			return model.ServiceStatus{DatasetVersion: version}
+		},
+		rollbackFunc: func(ctx context.Context) error {
+			if rollbackErr != nil {
+				return rollbackErr
+			}
+			rolledBack++
+			version--
+			return nil
+		},
+	}
+
+	tests := []struct {
+		name            string
+		token           string
+		err             error
+		expectedCode    int
+		expectedVersion int64
+	}{
+		{name: "unauthorized", token: "guess", expectedCode: 401, expectedVersion: 7},
+		{name: "rolled back", token: "secret", expectedCode: 200, expectedVersion: 6},
+		{name: "no previous dataset", token: "secret", err: errors.New("rolling back IP ranges: no previous IP ranges dataset"), expectedCode: 409, expectedVersion: 6},
+		{name: "not the leader", token: "secret", err: errors.New("another instance is updating the IP ranges"), expectedCode: 409, expectedVersion: 6},
+		{name: "update in progress", token: "secret", err: errors.New("an update of the IP ranges is in progress"), expectedCode: 409, expectedVersion: 6},
+		{name: "failed", token: "secret", err: errors.New("connection refused"), expectedCode: 500, expectedVersion: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rollbackErr = tt.err
+			logger, _ := zap.NewDevelopment()
+			h := NewAdminHandler(service, "secret", logger)
+			app := fiber.New()
+			h.RegisterRoutes(app)
+
+			req := httptest.NewRequest("POST", "/api/v1/admin/rollback", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+			if version != tt.expectedVersion {
+				t.Errorf("expected version %d to be served, got %d", tt.expectedVersion, version)
+			}
+			if tt.expectedCode != 200 {
+				return
+			}
+
+			var body model.ServiceStatus
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.DatasetVersion != tt.expectedVersion {
+				t.Errorf("expected status of version %d, got %+v", tt.expectedVersion, body)
+			}
+		})
+	}
+
+	if rolledBack != 1 {
+		t.Errorf("expected 1 rollback, got %d", rolledBack)
+	}
+}
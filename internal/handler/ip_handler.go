@@ -2,15 +2,22 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 	"ipservice/internal/model"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type IPService interface {
 	LookupIP(ctx context.Context, ip string) (*model.IPResponse, error)
+	LookupIPAt(ctx context.Context, ip string, at time.Time) (*model.IPResponse, error)
+	LookupIPs(ctx context.Context, ips []string) ([]model.BatchLookupResult, error)
+	LookupASN(ctx context.Context, asn uint32) (*model.ASNResponse, error)
+	StaleSources() []string
 }
 
 type Handler struct {
@@ -27,9 +34,13 @@ func NewHandler(service IPService, logger *zap.Logger) *Handler {
 
 func (h *Handler) RegisterRoutes(app *fiber.App) {
 	app.Get("/api/v1/lookup/:ip", h.LookupIP)
+	app.Post("/api/v1/lookup", h.LookupIPs)
+	app.Get("/api/v1/asn/:asn", h.LookupASN)
 	app.Get("/api/v1/health", h.HealthCheck)
 }
 
+// LookupIP resolves an address, as delegated at the date in the at query
+// parameter when present.
 func (h *Handler) LookupIP(c *fiber.Ctx) error {
 	ip := c.Params("ip")
 	if ip == "" {
@@ -38,7 +49,19 @@ func (h *Handler) LookupIP(c *fiber.Ctx) error {
 		})
 	}
 
-	result, err := h.service.LookupIP(c.Context(), ip)
+	var result *model.IPResponse
+	var err error
+	if at := c.Query("at"); at != "" {
+		date, parseErr := time.Parse(time.DateOnly, at)
+		if parseErr != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(model.Error{
+				Message: fmt.Sprintf("Invalid date format, expected YYYY-MM-DD: %s", at),
+			})
+		}
+		result, err = h.service.LookupIPAt(c.Context(), ip, date)
+	} else {
+		result, err = h.service.LookupIP(c.Context(), ip)
+	}
 	if err != nil {
 		if strings.Contains(err.Error(), "invalid IP address") {
 			return c.Status(fiber.StatusBadRequest).JSON(model.Error{
@@ -64,7 +87,96 @@ func (h *Handler) LookupIP(c *fiber.Ctx) error {
 	return c.JSON(result)
 }
 
+// LookupIPs resolves a batch of addresses sent either as a JSON array of
+// strings or, for any other content type, as newline-delimited text.
+func (h *Handler) LookupIPs(c *fiber.Ctx) error {
+	var ips []string
+
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		if err := json.Unmarshal(c.Body(), &ips); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(model.Error{
+				Message: "Request body must be a JSON array of IP addresses",
+			})
+		}
+	} else {
+		for _, line := range strings.Split(string(c.Body()), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				ips = append(ips, line)
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(model.Error{
+			Message: "At least one IP address is required",
+		})
+	}
+
+	results, err := h.service.LookupIPs(c.Context(), ips)
+	if err != nil {
+		if strings.Contains(err.Error(), "batch too large") {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(model.Error{
+				Message: err.Error(),
+			})
+		}
+
+		h.logger.Error("batch IP lookup failed",
+			zap.Int("count", len(ips)),
+			zap.Error(err))
+
+		return c.Status(fiber.StatusInternalServerError).JSON(model.Error{
+			Message: "Failed to lookup IP addresses",
+		})
+	}
+
+	return c.JSON(model.BatchLookupResponse{Results: results})
+}
+
+// LookupASN resolves an AS number, given as 3333 or AS3333, to the registry
+// and country it is delegated to.
+func (h *Handler) LookupASN(c *fiber.Ctx) error {
+	param := c.Params("asn")
+	digits := param
+	if len(digits) > 2 && strings.EqualFold(digits[:2], "AS") {
+		digits = digits[2:]
+	}
+	asn, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(model.Error{
+			Message: fmt.Sprintf("Invalid AS number: %s", param),
+		})
+	}
+
+	result, err := h.service.LookupASN(c.Context(), uint32(asn))
+	if err != nil {
+		h.logger.Error("ASN lookup failed",
+			zap.Uint64("asn", asn),
+			zap.Error(err))
+
+		return c.Status(fiber.StatusInternalServerError).JSON(model.Error{
+			Message: "Failed to lookup AS number",
+		})
+	}
+
+	if result.CountryCode == "ZZ" {
+		return c.Status(fiber.StatusNotFound).JSON(model.Error{
+			Message: "No delegation found for this AS number",
+		})
+	}
+
+	return c.JSON(result)
+}
+
+// HealthCheck reports the service as degraded, while still answering
+// lookups, when the data of some RIR sources is stale.
 func (h *Handler) HealthCheck(c *fiber.Ctx) error {
+	if stale := h.service.StaleSources(); len(stale) > 0 {
+		return c.JSON(fiber.Map{
+			"status":        "degraded",
+			"stale_sources": stale,
+		})
+	}
+
 	return c.JSON(fiber.Map{
 		"status": "healthy",
 	})
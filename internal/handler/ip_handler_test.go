@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
@@ -13,13 +15,33 @@ import (
 )
 
 type mockIPService struct {
-	lookupIPFunc func(ctx context.Context, ip string) (*model.IPResponse, error)
+	lookupIPFunc     func(ctx context.Context, ip string) (*model.IPResponse, error)
+	lookupIPAtFunc   func(ctx context.Context, ip string, at time.Time) (*model.IPResponse, error)
+	lookupIPsFunc    func(ctx context.Context, ips []string) ([]model.BatchLookupResult, error)
+	lookupASNFunc    func(ctx context.Context, asn uint32) (*model.ASNResponse, error)
+	staleSourcesFunc func() []string
 }
 
 func (m *mockIPService) LookupIP(ctx context.Context, ip string) (*model.IPResponse, error) {
 	return m.lookupIPFunc(ctx, ip)
 }
 
+func (m *mockIPService) LookupIPAt(ctx context.Context, ip string, at time.Time) (*model.IPResponse, error) {
+	return m.lookupIPAtFunc(ctx, ip, at)
+}
+
+func (m *mockIPService) LookupIPs(ctx context.Context, ips []string) ([]model.BatchLookupResult, error) {
+	return m.lookupIPsFunc(ctx, ips)
+}
+
+func (m *mockIPService) LookupASN(ctx context.Context, asn uint32) (*model.ASNResponse, error) {
+	return m.lookupASNFunc(ctx, asn)
+}
+
+func (m *mockIPService) StaleSources() []string {
+	return m.staleSourcesFunc()
+}
+
 func TestHandler_LookupIP(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -91,6 +113,176 @@ func TestHandler_LookupIP(t *testing.T) {
 	}
 }
 
+func TestHandler_LookupASN(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "success",
+			path:         "/api/v1/asn/3333",
+			expectedCode: 200,
+			expectedBody: `{"asn":3333,"country_code":"NL","first_asn":3333,"last_asn":3333,"registry":"ripencc","status":"assigned","allocated_at":"1993-09-01"}`,
+		},
+		{
+			name:         "prefixed",
+			path:         "/api/v1/asn/AS3333",
+			expectedCode: 200,
+			expectedBody: `{"asn":3333,"country_code":"NL","first_asn":3333,"last_asn":3333,"registry":"ripencc","status":"assigned","allocated_at":"1993-09-01"}`,
+		},
+		{
+			name:         "not delegated",
+			path:         "/api/v1/asn/64512",
+			expectedCode: 404,
+			expectedBody: `{"message":"No delegation found for this AS number"}`,
+		},
+		{
+			name:         "invalid",
+			path:         "/api/v1/asn/AS",
+			expectedCode: 400,
+			expectedBody: `{"message":"Invalid AS number: AS"}`,
+		},
+		{
+			name:         "beyond 32 bits",
+			path:         "/api/v1/asn/4294967296",
+			expectedCode: 400,
+			expectedBody: `{"message":"Invalid AS number: 4294967296"}`,
+		},
+		{
+			name:         "service error",
+			path:         "/api/v1/asn/1",
+			expectedCode: 500,
+			expectedBody: `{"message":"Failed to lookup AS number"}`,
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockService := &mockIPService{
+				lookupASNFunc: func(ctx context.Context, asn uint32) (*model.ASNResponse, error) {
+					switch asn {
+					case 3333:
+						return model.NewASNResponse(asn, model.ASNDelegation{
+							FirstASN:    3333,
+							LastASN:     3333,
+							CountryCode: "NL",
+							Registry:    "ripencc",
+							Status:      "assigned",
+							AllocatedAt: time.Date(1993, 9, 1, 0, 0, 0, 0, time.UTC),
+						}), nil
+					case 1:
+						return nil, fmt.Errorf("connection refused")
+					}
+					return &model.ASNResponse{ASN: asn, CountryCode: "ZZ"}, nil
+				},
+			}
+
+			h := NewHandler(mockService, logger)
+			app := fiber.New()
+			h.RegisterRoutes(app)
+
+			resp, err := app.Test(httptest.NewRequest("GET", tt.path, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Errorf("expected status code %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+
+			var body, expectedBody map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.expectedBody), &expectedBody); err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(body, expectedBody) {
+				t.Errorf("expected body %v, got %v", expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestHandler_LookupIPAt(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		expectedAt   string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "delegated",
+			path:         "/api/v1/lookup/8.8.8.8?at=2024-01-31",
+			expectedAt:   "2024-01-31",
+			expectedCode: 200,
+			expectedBody: `{"ip":"8.8.8.8","country_code":"US","valid_from":"2023-12-01","valid_to":"2024-02-15"}`,
+		},
+		{
+			name:         "not delegated",
+			path:         "/api/v1/lookup/9.9.9.9?at=1990-01-01",
+			expectedAt:   "1990-01-01",
+			expectedCode: 404,
+			expectedBody: `{"message":"No country information found for this IP"}`,
+		},
+		{
+			name:         "invalid date",
+			path:         "/api/v1/lookup/8.8.8.8?at=31.01.2024",
+			expectedCode: 400,
+			expectedBody: `{"message":"Invalid date format, expected YYYY-MM-DD: 31.01.2024"}`,
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested string
+			mockService := &mockIPService{
+				lookupIPAtFunc: func(ctx context.Context, ip string, at time.Time) (*model.IPResponse, error) {
+					requested = at.Format(time.DateOnly)
+					if ip != "8.8.8.8" {
+						return &model.IPResponse{IP: ip, CountryCode: "ZZ"}, nil
+					}
+					return &model.IPResponse{IP: ip, CountryCode: "US", ValidFrom: "2023-12-01", ValidTo: "2024-02-15"}, nil
+				},
+			}
+
+			h := NewHandler(mockService, logger)
+			app := fiber.New()
+			h.RegisterRoutes(app)
+
+			resp, err := app.Test(httptest.NewRequest("GET", tt.path, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Errorf("expected status code %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+			if requested != tt.expectedAt {
+				t.Errorf("expected lookup at %q, got %q", tt.expectedAt, requested)
+			}
+
+			var body, expectedBody map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.expectedBody), &expectedBody); err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(body, expectedBody) {
+				t.Errorf("expected body %v, got %v", expectedBody, body)
+			}
+		})
+	}
+}
+
 func jsonEqual(a, b map[string]interface{}) bool {
 	if len(a) != len(b) {
 		return false
@@ -103,29 +295,145 @@ func jsonEqual(a, b map[string]interface{}) bool {
 	return true
 }
 
-func TestHandler_HealthCheck(t *testing.T) {
+func TestHandler_LookupIPs(t *testing.T) {
+	tests := []struct {
+		name         string
+		contentType  string
+		body         string
+		mockError    error
+		expectedIPs  []string
+		expectedCode int
+	}{
+		{
+			name:         "json array",
+			contentType:  "application/json",
+			body:         `["8.8.8.8","invalid"]`,
+			expectedIPs:  []string{"8.8.8.8", "invalid"},
+			expectedCode: 200,
+		},
+		{
+			name:         "newline-delimited text",
+			contentType:  "text/plain",
+			body:         "8.8.8.8\r\n\n  2001:db8::1 \n",
+			expectedIPs:  []string{"8.8.8.8", "2001:db8::1"},
+			expectedCode: 200,
+		},
+		{
+			name:         "malformed json",
+			contentType:  "application/json",
+			body:         `{"ip":"8.8.8.8"}`,
+			expectedCode: 400,
+		},
+		{
+			name:         "empty batch",
+			contentType:  "text/plain",
+			body:         "\n\n",
+			expectedCode: 400,
+		},
+		{
+			name:         "batch too large",
+			contentType:  "application/json",
+			body:         `["8.8.8.8","1.1.1.1"]`,
+			mockError:    fmt.Errorf("batch too large: 2 addresses, maximum is 1"),
+			expectedIPs:  []string{"8.8.8.8", "1.1.1.1"},
+			expectedCode: 413,
+		},
+	}
+
 	logger, _ := zap.NewDevelopment()
-	h := NewHandler(nil, logger)
 
-	app := fiber.New()
-	h.RegisterRoutes(app)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockService := &mockIPService{
+				lookupIPsFunc: func(ctx context.Context, ips []string) ([]model.BatchLookupResult, error) {
+					if strings.Join(ips, ",") != strings.Join(tt.expectedIPs, ",") {
+						t.Errorf("expected IPs %v, got %v", tt.expectedIPs, ips)
+					}
+					if tt.mockError != nil {
+						return nil, tt.mockError
+					}
+					results := make([]model.BatchLookupResult, len(ips))
+					for i, ip := range ips {
+						results[i].IP = ip
+						results[i].CountryCode = "US"
+					}
+					return results, nil
+				},
+			}
 
-	req := httptest.NewRequest("GET", "/api/v1/health", nil)
-	resp, err := app.Test(req)
-	if err != nil {
-		t.Fatal(err)
-	}
+			h := NewHandler(mockService, logger)
+			app := fiber.New()
+			h.RegisterRoutes(app)
 
-	if resp.StatusCode != 200 {
-		t.Errorf("expected status code 200, got %d", resp.StatusCode)
+			req := httptest.NewRequest("POST", "/api/v1/lookup", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Errorf("expected status code %d, got %d", tt.expectedCode, resp.StatusCode)
+			}
+			if tt.expectedCode != 200 {
+				return
+			}
+
+			var body model.BatchLookupResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Results) != len(tt.expectedIPs) {
+				t.Errorf("expected %d results, got %d", len(tt.expectedIPs), len(body.Results))
+			}
+		})
 	}
+}
 
-	var body map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		t.Fatal(err)
+func TestHandler_HealthCheck(t *testing.T) {
+	tests := []struct {
+		name           string
+		stale          []string
+		expectedStatus string
+	}{
+		{name: "healthy", expectedStatus: "healthy"},
+		{name: "stale sources", stale: []string{"RIPE"}, expectedStatus: "degraded"},
 	}
 
-	if body["status"] != "healthy" {
-		t.Errorf("expected status 'healthy', got %v", body["status"])
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := zap.NewDevelopment()
+			h := NewHandler(&mockIPService{
+				staleSourcesFunc: func() []string { return tt.stale },
+			}, logger)
+
+			app := fiber.New()
+			h.RegisterRoutes(app)
+
+			req := httptest.NewRequest("GET", "/api/v1/health", nil)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != 200 {
+				t.Errorf("expected status code 200, got %d", resp.StatusCode)
+			}
+
+			var body struct {
+				Status       string   `json:"status"`
+				StaleSources []string `json:"stale_sources"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if body.Status != tt.expectedStatus {
+				t.Errorf("expected status %q, got %q", tt.expectedStatus, body.Status)
+			}
+			if len(body.StaleSources) != len(tt.stale) {
+				t.Errorf("expected stale sources %v, got %v", tt.stale, body.StaleSources)
+			}
+		})
 	}
 }
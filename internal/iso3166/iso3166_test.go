@@ -0,0 +1,29 @@
+package iso3166
+
+import "testing"
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{code: "US", valid: true},
+		{code: "ZW", valid: true},
+		{code: "EU", valid: true},
+		{code: "AP", valid: true},
+		{code: "ZZ", valid: false},
+		{code: "UK", valid: false},
+		{code: "us", valid: false},
+		{code: "", valid: false},
+	}
+
+	for _, tt := range tests {
+		if got := Valid(tt.code); got != tt.valid {
+			t.Errorf("Valid(%q) = %v, expected %v", tt.code, got, tt.valid)
+		}
+	}
+
+	if len(codes) != 249+2 {
+		t.Errorf("expected 249 assigned codes and 2 registry codes, got %d", len(codes))
+	}
+}
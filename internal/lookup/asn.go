@@ -0,0 +1,58 @@
+package lookup
+
+import (
+	"sort"
+
+	"ipservice/internal/model"
+)
+
+// ASNTable is an immutable index over AS number delegations. Delegated
+// ranges do not overlap, so a lookup is a single binary search for the last
+// range starting at or before the AS number.
+type ASNTable struct {
+	delegations []model.ASNDelegation
+}
+
+// NewASNTable builds a table from delegations. When several start at the
+// same AS number the narrowest wins.
+func NewASNTable(delegations []model.ASNDelegation) *ASNTable {
+	sorted := make([]model.ASNDelegation, len(delegations))
+	copy(sorted, delegations)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].FirstASN != sorted[j].FirstASN {
+			return sorted[i].FirstASN < sorted[j].FirstASN
+		}
+		return sorted[i].LastASN < sorted[j].LastASN
+	})
+
+	unique := sorted[:0]
+	for _, delegation := range sorted {
+		if len(unique) > 0 && unique[len(unique)-1].FirstASN == delegation.FirstASN {
+			continue
+		}
+		unique = append(unique, delegation)
+	}
+
+	return &ASNTable{delegations: unique}
+}
+
+// Lookup returns the delegation containing asn.
+func (t *ASNTable) Lookup(asn uint32) (model.ASNDelegation, bool) {
+	i := sort.Search(len(t.delegations), func(i int) bool {
+		return t.delegations[i].FirstASN > asn
+	})
+	if i == 0 || t.delegations[i-1].LastASN < asn {
+		return model.ASNDelegation{}, false
+	}
+	return t.delegations[i-1], true
+}
+
+// Delegations returns the delegations of the table in ascending order.
+func (t *ASNTable) Delegations() []model.ASNDelegation {
+	return t.delegations
+}
+
+// Len returns the number of delegations in the table.
+func (t *ASNTable) Len() int {
+	return len(t.delegations)
+}
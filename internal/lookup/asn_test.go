@@ -0,0 +1,57 @@
+package lookup
+
+import (
+	"math"
+	"testing"
+
+	"ipservice/internal/model"
+)
+
+func TestASNTable_Lookup(t *testing.T) {
+	table := NewASNTable([]model.ASNDelegation{
+		{FirstASN: 3333, LastASN: 3333, CountryCode: "NL"},
+		{FirstASN: 701, LastASN: 705, CountryCode: "US"},
+		{FirstASN: 64512, LastASN: 65534, CountryCode: "ZZ"},
+		{FirstASN: 701, LastASN: 701, CountryCode: "CA"},
+		{FirstASN: math.MaxUint32, LastASN: math.MaxUint32, CountryCode: "JP"},
+	})
+
+	tests := []struct {
+		asn      uint32
+		expected string
+	}{
+		{asn: 0, expected: ""},
+		{asn: 700, expected: ""},
+		{asn: 701, expected: "CA"}, // narrowest of the ranges starting there
+		{asn: 702, expected: ""},
+		{asn: 3333, expected: "NL"},
+		{asn: 3334, expected: ""},
+		{asn: 64512, expected: "ZZ"},
+		{asn: 65534, expected: "ZZ"},
+		{asn: 65535, expected: ""},
+		{asn: math.MaxUint32, expected: "JP"},
+	}
+
+	for _, tt := range tests {
+		delegation, ok := table.Lookup(tt.asn)
+		if tt.expected == "" {
+			if ok {
+				t.Errorf("AS%d: expected no match, got %+v", tt.asn, delegation)
+			}
+			continue
+		}
+		if !ok || delegation.CountryCode != tt.expected {
+			t.Errorf("AS%d: expected %s, got %+v (found %v)", tt.asn, tt.expected, delegation, ok)
+		}
+	}
+
+	if table.Len() != 4 {
+		t.Errorf("expected 4 delegations, got %d", table.Len())
+	}
+}
+
+func TestASNTable_Empty(t *testing.T) {
+	if _, ok := NewASNTable(nil).Lookup(701); ok {
+		t.Error("expected no match in empty table")
+	}
+}
@@ -0,0 +1,38 @@
+package lookup
+
+import (
+	"net"
+
+	"ipservice/internal/model"
+)
+
+// GeofeedTable is an immutable longest-prefix-match index over geofeed
+// entries, flattened like Table. Entries of different feeds may overlap;
+// the most specific wins.
+type GeofeedTable struct {
+	entries []model.GeofeedEntry
+	v4      []segment
+	v6      []segment
+}
+
+// NewGeofeedTable builds a table from entries. When the same prefix appears
+// more than once the last occurrence wins.
+func NewGeofeedTable(entries []model.GeofeedEntry) *GeofeedTable {
+	t := &GeofeedTable{entries: entries}
+	t.v4, t.v6 = index(len(entries), func(i int) net.IPNet { return entries[i].Prefix })
+	return t
+}
+
+// Lookup returns the most specific entry containing ip.
+func (t *GeofeedTable) Lookup(ip net.IP) (model.GeofeedEntry, bool) {
+	i, ok := find(t.v4, t.v6, ip)
+	if !ok {
+		return model.GeofeedEntry{}, false
+	}
+	return t.entries[i], true
+}
+
+// Len returns the number of entries the table was built from.
+func (t *GeofeedTable) Len() int {
+	return len(t.entries)
+}
@@ -0,0 +1,48 @@
+package lookup
+
+import (
+	"net"
+	"testing"
+
+	"ipservice/internal/model"
+)
+
+func TestGeofeedTable_Lookup(t *testing.T) {
+	entry := func(cidr, city string) model.GeofeedEntry {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return model.GeofeedEntry{Prefix: *network, CountryCode: "US", City: city}
+	}
+	table := NewGeofeedTable([]model.GeofeedEntry{
+		entry("192.0.2.0/24", "Los Angeles"),
+		entry("192.0.2.128/25", "Oakland"),
+		entry("2001:db8::/48", "San Jose"),
+		entry("192.0.2.128/25", "Fresno"), // last occurrence wins
+	})
+
+	tests := []struct {
+		ip   string
+		city string
+	}{
+		{ip: "192.0.2.1", city: "Los Angeles"},
+		{ip: "192.0.2.200", city: "Fresno"},
+		{ip: "198.51.100.1"},
+		{ip: "2001:db8::1", city: "San Jose"},
+		{ip: "2001:db8:1::1"},
+	}
+
+	for _, tt := range tests {
+		got, ok := table.Lookup(net.ParseIP(tt.ip))
+		if tt.city == "" {
+			if ok {
+				t.Errorf("%s: expected no entry, got %+v", tt.ip, got)
+			}
+			continue
+		}
+		if !ok || got.City != tt.city {
+			t.Errorf("%s: expected %s, got %+v (found %v)", tt.ip, tt.city, got, ok)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package lookup
+
+import (
+	"net"
+
+	"ipservice/internal/model"
+)
+
+// RouteTable is an immutable longest-prefix-match index over BGP routes,
+// flattened like Table.
+type RouteTable struct {
+	routes []model.Route
+	v4     []segment
+	v6     []segment
+}
+
+// NewRouteTable builds a table from routes. When the same prefix appears
+// more than once the last occurrence wins.
+func NewRouteTable(routes []model.Route) *RouteTable {
+	t := &RouteTable{routes: routes}
+	t.v4, t.v6 = index(len(routes), func(i int) net.IPNet { return routes[i].Prefix })
+	return t
+}
+
+// Lookup returns the most specific route to ip.
+func (t *RouteTable) Lookup(ip net.IP) (model.Route, bool) {
+	i, ok := find(t.v4, t.v6, ip)
+	if !ok {
+		return model.Route{}, false
+	}
+	return t.routes[i], true
+}
+
+// Len returns the number of routes the table was built from.
+func (t *RouteTable) Len() int {
+	return len(t.routes)
+}
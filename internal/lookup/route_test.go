@@ -0,0 +1,55 @@
+package lookup
+
+import (
+	"net"
+	"testing"
+
+	"ipservice/internal/model"
+)
+
+func TestRouteTable_Lookup(t *testing.T) {
+	route := func(cidr string, asn uint32) model.Route {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return model.Route{Prefix: *network, OriginASN: asn}
+	}
+	table := NewRouteTable([]model.Route{
+		route("8.0.0.0/9", 3356),
+		route("8.8.8.0/24", 15169),
+		route("2001:4860::/32", 15169),
+		route("2001:4860:4860::/48", 64496),
+	})
+
+	tests := []struct {
+		ip     string
+		prefix string
+		asn    uint32
+	}{
+		{ip: "8.8.8.8", prefix: "8.8.8.0/24", asn: 15169},
+		{ip: "8.8.9.1", prefix: "8.0.0.0/9", asn: 3356},
+		{ip: "::ffff:8.8.8.8", prefix: "8.8.8.0/24", asn: 15169},
+		{ip: "9.9.9.9"},
+		{ip: "2001:4860:4860::8888", prefix: "2001:4860:4860::/48", asn: 64496},
+		{ip: "2001:4860:1::1", prefix: "2001:4860::/32", asn: 15169},
+		{ip: "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		got, ok := table.Lookup(net.ParseIP(tt.ip))
+		if tt.prefix == "" {
+			if ok {
+				t.Errorf("%s: expected no route, got %+v", tt.ip, got)
+			}
+			continue
+		}
+		if !ok || got.Prefix.String() != tt.prefix || got.OriginASN != tt.asn {
+			t.Errorf("%s: expected %s AS%d, got %+v (found %v)", tt.ip, tt.prefix, tt.asn, got, ok)
+		}
+	}
+
+	if table.Len() != 4 {
+		t.Errorf("expected 4 routes, got %d", table.Len())
+	}
+}
@@ -0,0 +1,241 @@
+package lookup
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+
+	"ipservice/internal/model"
+)
+
+// Table is an immutable longest-prefix-match index over a set of IP ranges.
+// Overlapping ranges are flattened at build time into non-overlapping
+// address intervals, each owned by the most specific range covering it, so
+// a lookup is a single binary search.
+type Table struct {
+	ranges []model.IPRange
+	v4     []segment
+	v6     []segment
+}
+
+type segment struct {
+	start uint128
+	end   uint128
+	index int32
+}
+
+type prefix struct {
+	start uint128
+	end   uint128
+	index int32
+}
+
+// NewTable builds a table from ranges. When the same network appears more
+// than once the last occurrence wins.
+func NewTable(ranges []model.IPRange) *Table {
+	t := &Table{ranges: ranges}
+	t.v4, t.v6 = index(len(ranges), func(i int) net.IPNet { return ranges[i].Network })
+	return t
+}
+
+// Lookup returns the most specific range containing ip.
+func (t *Table) Lookup(ip net.IP) (model.IPRange, bool) {
+	i, ok := find(t.v4, t.v6, ip)
+	if !ok {
+		return model.IPRange{}, false
+	}
+	return t.ranges[i], true
+}
+
+// index flattens the networks of n items, network(i) being that of item i,
+// into the segments of each address family.
+func index(n int, network func(i int) net.IPNet) (v4, v6 []segment) {
+	var v4Prefixes, v6Prefixes []prefix
+	for i := 0; i < n; i++ {
+		start, end, isV4, ok := bounds(network(i))
+		if !ok {
+			continue
+		}
+		p := prefix{start: start, end: end, index: int32(i)}
+		if isV4 {
+			v4Prefixes = append(v4Prefixes, p)
+		} else {
+			v6Prefixes = append(v6Prefixes, p)
+		}
+	}
+	return flatten(v4Prefixes), flatten(v6Prefixes)
+}
+
+// find returns the index of the item owning the segment containing ip.
+func find(v4, v6 []segment, ip net.IP) (int32, bool) {
+	addr, isV4, ok := toUint128(ip)
+	if !ok {
+		return 0, false
+	}
+	if isV4 {
+		return search(v4, addr)
+	}
+	return search(v6, addr)
+}
+
+// search returns the index of the prefix owning the segment containing
+// addr.
+func search(segments []segment, addr uint128) (int32, bool) {
+	// Find the last segment starting at or before addr
+	lo, hi := 0, len(segments)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if addr.less(segments[mid].start) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if lo == 0 {
+		return 0, false
+	}
+
+	seg := &segments[lo-1]
+	if seg.end.less(addr) {
+		return 0, false
+	}
+	return seg.index, true
+}
+
+// Interval is a contiguous address span owned by the most specific range
+// covering it. Intervals never overlap.
+type Interval struct {
+	Start net.IP
+	End   net.IP
+	Range model.IPRange
+}
+
+// Intervals returns the flattened address intervals, IPv4 first, each in
+// ascending order. IPv4 bounds are 4-byte addresses.
+func (t *Table) Intervals() []Interval {
+	intervals := make([]Interval, 0, len(t.v4)+len(t.v6))
+	t.EachInterval(func(interval Interval) error {
+		intervals = append(intervals, interval)
+		return nil
+	})
+	return intervals
+}
+
+// EachInterval calls fn for each interval in the order of Intervals without
+// materialising them, stopping at the first error.
+func (t *Table) EachInterval(fn func(Interval) error) error {
+	for _, seg := range t.v4 {
+		err := fn(Interval{
+			Start: seg.start.ipv4(),
+			End:   seg.end.ipv4(),
+			Range: t.ranges[seg.index],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, seg := range t.v6 {
+		err := fn(Interval{
+			Start: seg.start.ipv6(),
+			End:   seg.end.ipv6(),
+			Range: t.ranges[seg.index],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of ranges the table was built from.
+func (t *Table) Len() int {
+	return len(t.ranges)
+}
+
+// flatten turns possibly nested prefixes into sorted, non-overlapping
+// segments attributed to the innermost prefix.
+func flatten(prefixes []prefix) []segment {
+	// Outer prefixes sort before the prefixes nested inside them
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		if prefixes[i].start != prefixes[j].start {
+			return prefixes[i].start.less(prefixes[j].start)
+		}
+		return prefixes[j].end.less(prefixes[i].end)
+	})
+
+	segments := make([]segment, 0, len(prefixes))
+	stack := make([]prefix, 0, 8)
+	var cursor uint128
+	exhausted := false
+
+	closeTop := func() {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if exhausted || top.end.less(cursor) {
+			return
+		}
+		segments = append(segments, segment{start: cursor, end: top.end, index: top.index})
+		if top.end == maxUint128 {
+			exhausted = true
+			return
+		}
+		cursor = top.end.add1()
+	}
+
+	for _, p := range prefixes {
+		for len(stack) > 0 && stack[len(stack)-1].end.less(p.start) {
+			closeTop()
+		}
+		if len(stack) > 0 && cursor.less(p.start) {
+			top := stack[len(stack)-1]
+			segments = append(segments, segment{start: cursor, end: p.start.sub1(), index: top.index})
+		}
+		cursor = p.start
+		stack = append(stack, p)
+	}
+	for len(stack) > 0 {
+		closeTop()
+	}
+
+	return segments
+}
+
+func bounds(network net.IPNet) (start, end uint128, isV4, ok bool) {
+	start, isV4, ok = toUint128(network.IP)
+	if !ok {
+		return
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits == 0 {
+		ok = false
+		return
+	}
+	if isV4 && bits == 128 {
+		ones -= 96
+	}
+	width := 128
+	if isV4 {
+		width = 32
+	}
+
+	hostMask := maxUint128.rsh(uint(ones + 128 - width))
+	start = start.and(hostMask.not())
+	end = start.or(hostMask)
+	return
+}
+
+// toUint128 converts ip to an integer. IPv4 and IPv4-mapped IPv6 addresses
+// use the low 32 bits.
+func toUint128(ip net.IP) (uint128, bool, bool) {
+	if v4 := ip.To4(); v4 != nil {
+		return uint128{lo: uint64(binary.BigEndian.Uint32(v4))}, true, true
+	}
+	if v6 := ip.To16(); v6 != nil {
+		return uint128{
+			hi: binary.BigEndian.Uint64(v6[:8]),
+			lo: binary.BigEndian.Uint64(v6[8:]),
+		}, false, true
+	}
+	return uint128{}, false, false
+}
@@ -0,0 +1,252 @@
+package lookup
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"ipservice/internal/model"
+	"ipservice/tests/conformance"
+)
+
+func mustRange(t testing.TB, cidr, countryCode string) model.IPRange {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := 4
+	if network.IP.To4() == nil {
+		version = 6
+	}
+	return model.IPRange{Network: *network, CountryCode: countryCode, Version: version}
+}
+
+func TestTable_Lookup(t *testing.T) {
+	table := NewTable([]model.IPRange{
+		mustRange(t, "10.0.0.0/8", "US"),
+		mustRange(t, "10.1.0.0/16", "CA"),
+		mustRange(t, "10.1.2.0/24", "MX"),
+		mustRange(t, "10.2.0.0/16", "BR"),
+		mustRange(t, "192.0.2.0/24", "DE"),
+		mustRange(t, "2001:db8::/32", "FR"),
+		mustRange(t, "2001:db8:1::/48", "NL"),
+		mustRange(t, "255.255.255.0/24", "ZZ"),
+		mustRange(t, "ffff:ffff:ffff:ffff::/64", "JP"),
+	})
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "10.0.0.1", expected: "US"},
+		{ip: "10.1.0.1", expected: "CA"},
+		{ip: "10.1.2.3", expected: "MX"},
+		{ip: "10.1.3.0", expected: "CA"},
+		{ip: "10.1.255.255", expected: "CA"},
+		{ip: "10.2.0.0", expected: "BR"},
+		{ip: "10.3.0.0", expected: "US"},
+		{ip: "10.255.255.255", expected: "US"},
+		{ip: "11.0.0.0", expected: ""},
+		{ip: "9.255.255.255", expected: ""},
+		{ip: "192.0.2.255", expected: "DE"},
+		{ip: "::ffff:192.0.2.1", expected: "DE"},
+		{ip: "255.255.255.255", expected: "ZZ"},
+		{ip: "2001:db8::1", expected: "FR"},
+		{ip: "2001:db8:1::1", expected: "NL"},
+		{ip: "2001:db8:2::1", expected: "FR"},
+		{ip: "2001:db9::", expected: ""},
+		{ip: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", expected: "JP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			r, ok := table.Lookup(net.ParseIP(tt.ip))
+			if tt.expected == "" {
+				if ok {
+					t.Errorf("expected no match, got %s", r.Network.String())
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected %s, got no match", tt.expected)
+			}
+			if r.CountryCode != tt.expected {
+				t.Errorf("expected %s, got %s (%s)", tt.expected, r.CountryCode, r.Network.String())
+			}
+		})
+	}
+}
+
+func TestTable_DuplicateNetworkLastWins(t *testing.T) {
+	table := NewTable([]model.IPRange{
+		mustRange(t, "10.0.0.0/8", "US"),
+		mustRange(t, "10.0.0.0/8", "CA"),
+	})
+
+	r, ok := table.Lookup(net.ParseIP("10.1.1.1"))
+	if !ok || r.CountryCode != "CA" {
+		t.Errorf("expected CA, got %v (found %v)", r.CountryCode, ok)
+	}
+}
+
+func TestTable_Empty(t *testing.T) {
+	table := NewTable(nil)
+	if _, ok := table.Lookup(net.ParseIP("8.8.8.8")); ok {
+		t.Error("expected no match in empty table")
+	}
+	if _, ok := table.Lookup(nil); ok {
+		t.Error("expected no match for nil IP")
+	}
+}
+
+// syntheticDataset returns a dataset shaped like the combined five-RIR
+// delegation files: roughly 250k IPv4 blocks and 100k IPv6 blocks.
+func syntheticDataset(tb testing.TB) []model.IPRange {
+	rnd := rand.New(rand.NewSource(1))
+	countries := []string{"US", "DE", "BR", "JP", "ZA", "AU", "CN", "FR", "GB", "IN"}
+
+	ranges := make([]model.IPRange, 0, 350000)
+	for i := 0; i < 250000; i++ {
+		ones := 16 + rnd.Intn(9)
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, rnd.Uint32())
+		mask := net.CIDRMask(ones, 32)
+		ranges = append(ranges, model.IPRange{
+			Network:     net.IPNet{IP: ip.Mask(mask), Mask: mask},
+			CountryCode: countries[rnd.Intn(len(countries))],
+			Version:     4,
+		})
+	}
+	for i := 0; i < 100000; i++ {
+		ones := 29 + rnd.Intn(20)
+		ip := make(net.IP, net.IPv6len)
+		binary.BigEndian.PutUint64(ip, 0x2000000000000000|rnd.Uint64()>>4)
+		mask := net.CIDRMask(ones, 128)
+		ranges = append(ranges, model.IPRange{
+			Network:     net.IPNet{IP: ip.Mask(mask), Mask: mask},
+			CountryCode: countries[rnd.Intn(len(countries))],
+			Version:     6,
+		})
+	}
+	return ranges
+}
+
+func randomIPs(n int, v6 bool) []net.IP {
+	rnd := rand.New(rand.NewSource(2))
+	ips := make([]net.IP, n)
+	for i := range ips {
+		if v6 {
+			ip := make(net.IP, net.IPv6len)
+			binary.BigEndian.PutUint64(ip, 0x2000000000000000|rnd.Uint64()>>4)
+			binary.BigEndian.PutUint64(ip[8:], rnd.Uint64())
+			ips[i] = ip
+		} else {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, rnd.Uint32())
+			ips[i] = ip
+		}
+	}
+	return ips
+}
+
+func BenchmarkTable_Build(b *testing.B) {
+	ranges := syntheticDataset(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewTable(ranges)
+	}
+}
+
+func BenchmarkTable_LookupIPv4(b *testing.B) {
+	table := NewTable(syntheticDataset(b))
+	ips := randomIPs(1<<16, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Lookup(ips[i&(len(ips)-1)])
+	}
+}
+
+func BenchmarkTable_LookupIPv6(b *testing.B) {
+	table := NewTable(syntheticDataset(b))
+	ips := randomIPs(1<<16, true)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Lookup(ips[i&(len(ips)-1)])
+	}
+}
+
+func TestTable_MatchesLinearScan(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	var ranges []model.IPRange
+	for i := 0; i < 2000; i++ {
+		ones := 8 + rnd.Intn(17)
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, 0x0a000000|rnd.Uint32()>>8)
+		mask := net.CIDRMask(ones, 32)
+		ranges = append(ranges, model.IPRange{
+			Network:     net.IPNet{IP: ip.Mask(mask), Mask: mask},
+			CountryCode: string(rune('A'+i%26)) + string(rune('A'+i/26%26)),
+			Version:     4,
+		})
+	}
+	table := NewTable(ranges)
+
+	for _, ip := range randomIPs(5000, false) {
+		ip[0] = 10
+		var best *model.IPRange
+		bestOnes := -1
+		for i := range ranges {
+			ones, _ := ranges[i].Network.Mask.Size()
+			if ranges[i].Network.Contains(ip) && ones >= bestOnes {
+				best, bestOnes = &ranges[i], ones
+			}
+		}
+
+		got, ok := table.Lookup(ip)
+		if best == nil {
+			if ok {
+				t.Fatalf("%s: expected no match, got %s", ip, got.Network.String())
+			}
+			continue
+		}
+		if !ok || got.Network.String() != best.Network.String() || got.CountryCode != best.CountryCode {
+			t.Fatalf("%s: expected %s %s, got %s %s", ip, best.Network.String(), best.CountryCode, got.Network.String(), got.CountryCode)
+		}
+	}
+}
+
+func TestTable_Conformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T, ranges []model.IPRange) conformance.LookupFunc {
+		table := NewTable(ranges)
+		return func(ctx context.Context, ip net.IP) (string, error) {
+			r, _ := table.Lookup(ip)
+			return r.CountryCode, nil
+		}
+	})
+}
+
+func TestTable_Intervals(t *testing.T) {
+	table := NewTable([]model.IPRange{
+		mustRange(t, "10.0.0.0/8", "US"),
+		mustRange(t, "10.1.0.0/16", "CA"),
+		mustRange(t, "2001:db8::/32", "FR"),
+	})
+
+	var got []string
+	for _, interval := range table.Intervals() {
+		got = append(got, interval.Start.String()+"-"+interval.End.String()+" "+interval.Range.CountryCode)
+	}
+
+	expected := []string{
+		"10.0.0.0-10.0.255.255 US",
+		"10.1.0.0-10.1.255.255 CA",
+		"10.2.0.0-10.255.255.255 US",
+		"2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff FR",
+	}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,73 @@
+package lookup
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+type uint128 struct {
+	hi uint64
+	lo uint64
+}
+
+var maxUint128 = uint128{hi: ^uint64(0), lo: ^uint64(0)}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u uint128) add1() uint128 {
+	lo := u.lo + 1
+	hi := u.hi
+	if lo == 0 {
+		hi++
+	}
+	return uint128{hi: hi, lo: lo}
+}
+
+func (u uint128) sub1() uint128 {
+	lo := u.lo - 1
+	hi := u.hi
+	if u.lo == 0 {
+		hi--
+	}
+	return uint128{hi: hi, lo: lo}
+}
+
+func (u uint128) and(v uint128) uint128 {
+	return uint128{hi: u.hi & v.hi, lo: u.lo & v.lo}
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{hi: u.hi | v.hi, lo: u.lo | v.lo}
+}
+
+func (u uint128) not() uint128 {
+	return uint128{hi: ^u.hi, lo: ^u.lo}
+}
+
+func (u uint128) rsh(n uint) uint128 {
+	switch {
+	case n >= 128:
+		return uint128{}
+	case n >= 64:
+		return uint128{lo: u.hi >> (n - 64)}
+	case n == 0:
+		return u
+	default:
+		return uint128{hi: u.hi >> n, lo: u.lo>>n | u.hi<<(64-n)}
+	}
+}
+
+func (u uint128) ipv4() net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(u.lo))
+	return ip
+}
+
+func (u uint128) ipv6() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], u.hi)
+	binary.BigEndian.PutUint64(ip[8:], u.lo)
+	return ip
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"net"
+	"time"
 )
 
 type IPRange struct {
@@ -9,11 +10,313 @@ type IPRange struct {
 	Network     net.IPNet `db:"network"`
 	CountryCode string    `db:"country_code"`
 	Version     int       `db:"ip_version"` // 4 or 6
+	Registry    string    `db:"registry"`
+	Status      string    `db:"status"`       // allocated or assigned
+	AllocatedAt time.Time `db:"allocated_at"` // zero when not published
+	OpaqueID    string    `db:"opaque_id"`
+	Source      string    `db:"source"` // name of the configured RIR source
+	// DatasetVersion is the version of the dataset the range was published in
+	DatasetVersion int64 `db:"dataset_version"`
+}
+
+// ASNDelegation is a range of AS numbers delegated by a registry.
+type ASNDelegation struct {
+	FirstASN    uint32    `db:"first_asn"`
+	LastASN     uint32    `db:"last_asn"`
+	CountryCode string    `db:"country_code"`
+	Registry    string    `db:"registry"`
+	Status      string    `db:"status"`       // allocated or assigned
+	AllocatedAt time.Time `db:"allocated_at"` // zero when not published
+	OpaqueID    string    `db:"opaque_id"`
+	Source      string    `db:"source"` // name of the configured RIR source
+}
+
+// Route is a prefix announced in BGP by OriginASN, as seen by Peers of the
+// route collectors whose RIB dumps were imported.
+type Route struct {
+	Prefix    net.IPNet
+	OriginASN uint32
+	Peers     int // seeing this origin; the origin most peers see wins
+}
+
+// RouteImport records an import of RIB dumps, which replaces all routes.
+type RouteImport struct {
+	ID         int64
+	ImportedAt time.Time
+	Files      []string
+	Routes     int64 // prefixes with an origin
+}
+
+// GeofeedEntry is a prefix located by its operator in an RFC 8805
+// geofeed. Fields the feed leaves empty are unknown.
+type GeofeedEntry struct {
+	Prefix      net.IPNet
+	CountryCode string // ISO 3166-1 alpha-2
+	Region      string // ISO 3166-2, such as US-CA
+	City        string
+	PostalCode  string
+	Feed        string // name of the configured geofeed
+}
+
+// GeofeedUpdate records a refresh of the geofeeds.
+type GeofeedUpdate struct {
+	ID        int64
+	UpdatedAt time.Time
+	Feeds     []string // fetched; the others kept their entries
+	Entries   int64    // of all feeds
+}
+
+// HistoricalRange is a range delegated the same way from ValidFrom until
+// ValidTo (exclusive), according to archived delegation files. ValidTo is
+// zero while the latest archive still delegates it that way.
+type HistoricalRange struct {
+	IPRange
+	ValidFrom time.Time
+	ValidTo   time.Time
+}
+
+// DelegationArchive is an archived delegation file of a registry.
+type DelegationArchive struct {
+	Source string    // registry that published it
+	Date   time.Time // the data is current as of
+	Serial int64
+}
+
+// ArchiveImport is the outcome of importing a DelegationArchive.
+type ArchiveImport struct {
+	Ranges int64 // in the archive
+	Opened int64 // intervals starting at its date
+	Closed int64 // intervals ending at its date
+}
+
+// SourceState is what was last published from a RIR source, used to skip
+// downloading and reloading unchanged delegation files.
+type SourceState struct {
+	Name         string    `db:"name"`
+	Location     string    `db:"location"` // URL or mirror the data came from
+	ETag         string    `db:"etag"`
+	LastModified string    `db:"last_modified"`
+	Checksum     string    `db:"checksum"` // MD5 of the delegation file
+	Serial       int64     `db:"serial"`   // from the file's version line
+	StartDate    time.Time `db:"start_date"`
+	EndDate      time.Time `db:"end_date"`
+	UpdatedAt    time.Time `db:"updated_at"` // when the data was last confirmed current
+}
+
+// DatasetInfo describes the published dataset.
+type DatasetInfo struct {
+	Version     int64     `db:"version" json:"version"` // of the dataset, see DatasetVersion
+	PublishedAt time.Time `db:"published_at" json:"published_at"`
+	CheckedAt   time.Time `db:"checked_at" json:"checked_at"` // when the sources last had nothing newer
+	Ranges      int64     `db:"ranges" json:"ranges"`
+}
+
+// DatasetVersion records a published dataset.
+type DatasetVersion struct {
+	ID          int64           `db:"id" json:"id"`
+	BaseVersion int64           `db:"base_version" json:"base_version,omitempty"` // the version it replaced
+	PublishedAt time.Time       `db:"published_at" json:"published_at"`
+	IPv4Ranges  int64           `db:"ipv4_ranges" json:"ipv4_ranges"`
+	IPv6Ranges  int64           `db:"ipv6_ranges" json:"ipv6_ranges"`
+	Checksum    string          `db:"checksum" json:"checksum"` // MD5 of the dataset's ranges
+	Sources     []SourceVersion `json:"sources"`
+}
+
+// SourceVersion is what a RIR source contributed to a dataset version.
+type SourceVersion struct {
+	Name       string `db:"name" json:"name"`
+	Serial     int64  `db:"serial" json:"serial"`
+	Checksum   string `db:"checksum" json:"checksum,omitempty"` // MD5 of the delegation file
+	IPv4Ranges int64  `db:"ipv4_ranges" json:"ipv4_ranges"`
+	IPv6Ranges int64  `db:"ipv6_ranges" json:"ipv6_ranges"`
+}
+
+// RangeCount is the number of ranges in a dataset with the same source, IP
+// version and country code.
+type RangeCount struct {
+	Source      string `db:"source"`
+	Version     int    `db:"ip_version"`
+	CountryCode string `db:"country_code"`
+	Count       int64  `db:"count"`
+}
+
+// RangeConflict is a range containing a more specific range delegated by
+// another source.
+type RangeConflict struct {
+	Network          string `db:"network"`
+	Source           string `db:"source"`
+	CountryCode      string `db:"country_code"`
+	InnerNetwork     string `db:"inner_network"`
+	InnerSource      string `db:"inner_source"`
+	InnerCountryCode string `db:"inner_country_code"`
+}
+
+// Changes of a range between two datasets
+const (
+	RangeAdded          = "added"
+	RangeRemoved        = "removed"
+	RangeCountryChanged = "country_changed"
+)
+
+// RangeChange is a range added, removed or moved to another country between
+// two datasets. Source is the one delegating it in the newer dataset, if
+// any.
+type RangeChange struct {
+	Network        string `db:"network" json:"network"`
+	Source         string `db:"source" json:"source"`
+	Change         string `db:"change" json:"change"`
+	OldCountryCode string `db:"old_country_code" json:"old_country_code,omitempty"`
+	NewCountryCode string `db:"new_country_code" json:"new_country_code,omitempty"`
+}
+
+// SourceDiff counts the changes of the ranges of one source.
+type SourceDiff struct {
+	Source         string `db:"source" json:"source"`
+	Added          int64  `db:"added" json:"added"`
+	Removed        int64  `db:"removed" json:"removed"`
+	CountryChanged int64  `db:"country_changed" json:"country_changed"`
+}
+
+// DiffQuery selects the changes between two dataset versions.
+type DiffQuery struct {
+	From        int64      // zero for the changes recorded when To was published
+	To          int64      // zero for the published version
+	CountryCode string     // old or new country of the range
+	Network     *net.IPNet // ranges overlapping it
+	Limit       int        // changes listed; the sources count all of them
+}
+
+// DatasetDiff is the changes between two dataset versions.
+type DatasetDiff struct {
+	From      int64         `json:"from"`
+	To        int64         `json:"to"`
+	Sources   []SourceDiff  `json:"sources"`
+	Changes   []RangeChange `json:"changes"`
+	Truncated bool          `json:"truncated"` // more changes than listed
+}
+
+// Update states and triggers reported in UpdateStatus
+const (
+	UpdateRunning   = "running"
+	UpdateSucceeded = "succeeded"
+	UpdateFailed    = "failed"
+	UpdateCancelled = "cancelled"
+	UpdateSkipped   = "skipped" // another instance holds the update lock
+
+	TriggerStartup  = "startup"  // initial load, or refresh of an old dataset
+	TriggerSchedule = "schedule" // periodic update
+	TriggerAdmin    = "admin"    // requested through the admin API
+)
+
+// UpdateStatus describes an update in progress or finished.
+type UpdateStatus struct {
+	State      string         `json:"state"`
+	Trigger    string         `json:"trigger"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Violations []string       `json:"violations,omitempty"` // guardrails that rejected the dataset
+	Sources    []SourceUpdate `json:"sources,omitempty"`
+	Changes    []SourceDiff   `json:"changes,omitempty"` // made to the published dataset
+}
+
+// SourceUpdate is the outcome of one RIR source in an update.
+type SourceUpdate struct {
+	Name       string `json:"name"`
+	Changed    bool   `json:"changed"`
+	Kept       bool   `json:"kept,omitempty"` // last known good ranges kept after an error
+	Serial     int64  `json:"serial,omitempty"`
+	StartDate  string `json:"start_date,omitempty"` // YYYY-MM-DD, from the file's version line
+	EndDate    string `json:"end_date,omitempty"`   // YYYY-MM-DD
+	IPv4Ranges int    `json:"ipv4_ranges"`
+	IPv6Ranges int    `json:"ipv6_ranges"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ServiceStatus is reported by the admin status endpoint.
+type ServiceStatus struct {
+	DatasetVersion int64         `json:"dataset_version"` // served by this instance
+	Ranges         int           `json:"ranges"`          // in the in-memory index
+	CurrentUpdate  *UpdateStatus `json:"current_update,omitempty"`
+	LastUpdate     *UpdateStatus `json:"last_update,omitempty"`
+	StaleSources   []string      `json:"stale_sources,omitempty"`
 }
 
 type IPResponse struct {
 	IP          string `json:"ip"`
 	CountryCode string `json:"country_code"`
+	Network     string `json:"network,omitempty"`
+	Registry    string `json:"registry,omitempty"`
+	Status      string `json:"status,omitempty"`
+	AllocatedAt string `json:"allocated_at,omitempty"` // YYYY-MM-DD
+	// DatasetVersion is the version of the dataset that answered
+	DatasetVersion int64 `json:"dataset_version,omitempty"`
+	// ValidFrom and ValidTo bound historical answers, see HistoricalRange
+	ValidFrom string `json:"valid_from,omitempty"` // YYYY-MM-DD
+	ValidTo   string `json:"valid_to,omitempty"`   // YYYY-MM-DD
+	// ASN originates ASPrefix, the most specific route to the address
+	ASN      uint32 `json:"asn,omitempty"`
+	ASPrefix string `json:"as_prefix,omitempty"`
+	// Region, City and PostalCode come from geofeeds, see GeofeedEntry
+	Region     string `json:"region,omitempty"`
+	City       string `json:"city,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+}
+
+// NewIPResponse describes the range that answered a lookup for ip.
+func NewIPResponse(ip string, ipRange IPRange) *IPResponse {
+	resp := &IPResponse{
+		IP:             ip,
+		CountryCode:    ipRange.CountryCode,
+		Registry:       ipRange.Registry,
+		Status:         ipRange.Status,
+		DatasetVersion: ipRange.DatasetVersion,
+	}
+	if ipRange.Network.IP != nil {
+		resp.Network = ipRange.Network.String()
+	}
+	if !ipRange.AllocatedAt.IsZero() {
+		resp.AllocatedAt = ipRange.AllocatedAt.Format(time.DateOnly)
+	}
+	return resp
+}
+
+type ASNResponse struct {
+	ASN         uint32 `json:"asn"`
+	CountryCode string `json:"country_code"`
+	FirstASN    uint32 `json:"first_asn,omitempty"` // of the delegated range
+	LastASN     uint32 `json:"last_asn,omitempty"`
+	Registry    string `json:"registry,omitempty"`
+	Status      string `json:"status,omitempty"`
+	AllocatedAt string `json:"allocated_at,omitempty"` // YYYY-MM-DD
+}
+
+// NewASNResponse describes the delegation that answered a lookup for asn.
+func NewASNResponse(asn uint32, delegation ASNDelegation) *ASNResponse {
+	resp := &ASNResponse{
+		ASN:         asn,
+		CountryCode: delegation.CountryCode,
+		FirstASN:    delegation.FirstASN,
+		LastASN:     delegation.LastASN,
+		Registry:    delegation.Registry,
+		Status:      delegation.Status,
+	}
+	if !delegation.AllocatedAt.IsZero() {
+		resp.AllocatedAt = delegation.AllocatedAt.Format(time.DateOnly)
+	}
+	return resp
+}
+
+// BatchLookupResult is the per-address outcome of a batch lookup. Error is
+// set instead of a country code when the address could not be resolved.
+type BatchLookupResult struct {
+	IPResponse
+	Error string `json:"error,omitempty"`
+}
+
+type BatchLookupResponse struct {
+	Results []BatchLookupResult `json:"results"`
 }
 
 type Error struct {
@@ -0,0 +1,319 @@
+// Package mrt reads BGP routing tables dumped in the MRT TABLE_DUMP_V2
+// format (RFC 6396), as published by RouteViews and RIPE RIS.
+package mrt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// MRT record types and TABLE_DUMP_V2 subtypes
+const (
+	TypeTableDumpV2 = 13
+
+	SubtypePeerIndexTable        = 1
+	SubtypeRIBIPv4Unicast        = 2
+	SubtypeRIBIPv6Unicast        = 4
+	SubtypeRIBIPv4UnicastAddPath = 8 // RFC 8050
+	SubtypeRIBIPv6UnicastAddPath = 10
+)
+
+// AS_PATH segment types
+const (
+	SegmentSet      = 1
+	SegmentSequence = 2
+)
+
+const (
+	headerLen = 12
+	// maxRecordLen bounds the memory a corrupt length field can claim
+	maxRecordLen = 16 << 20
+
+	attrASPath      = 2
+	flagExtendedLen = 0x10
+)
+
+// ErrMalformed is wrapped by the errors Next returns for records whose
+// contents cannot be parsed. The reader is positioned at the following
+// record, so reading may continue.
+var ErrMalformed = errors.New("malformed MRT record")
+
+// Peer is an entry of the peer index table that RIB entries refer to.
+type Peer struct {
+	BGPID   net.IP
+	Address net.IP
+	AS      uint32
+}
+
+// Segment is a segment of an AS_PATH.
+type Segment struct {
+	Type uint8 // SegmentSet or SegmentSequence, or a confederation type
+	ASNs []uint32
+}
+
+// RIBEntry is the route to a prefix learned from one peer.
+type RIBEntry struct {
+	PeerIndex    uint16
+	OriginatedAt time.Time
+	PathID       uint32 // with ADD-PATH only
+	ASPath       []Segment
+}
+
+// OriginAS returns the AS originating the route: the last AS of the path,
+// or the only member of a final AS_SET. It reports false for paths ending
+// in a larger AS_SET, whose origin is ambiguous, and for empty paths of
+// routes originated by the peer itself.
+func (e RIBEntry) OriginAS() (uint32, bool) {
+	if len(e.ASPath) == 0 {
+		return 0, false
+	}
+	last := e.ASPath[len(e.ASPath)-1]
+	switch {
+	case last.Type == SegmentSequence && len(last.ASNs) > 0:
+		return last.ASNs[len(last.ASNs)-1], true
+	case last.Type == SegmentSet && len(last.ASNs) == 1:
+		return last.ASNs[0], true
+	}
+	return 0, false
+}
+
+// RIB is a prefix with the routes to it, from a RIB_IPV4_UNICAST or
+// RIB_IPV6_UNICAST record.
+type RIB struct {
+	Timestamp time.Time // of the dump
+	Sequence  uint32
+	Prefix    net.IPNet
+	Entries   []RIBEntry
+}
+
+// Reader reads the unicast RIB records of a TABLE_DUMP_V2 file, skipping
+// records of other types.
+type Reader struct {
+	r     *bufio.Reader
+	peers []Peer
+	buf   []byte
+}
+
+// NewReader returns a reader of the MRT records in r, which must not be
+// compressed.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 1<<16)}
+}
+
+// Peers returns the peer index table read so far.
+func (r *Reader) Peers() []Peer {
+	return r.peers
+}
+
+// Next returns the next RIB record, or io.EOF at the end of the input. A
+// file cut short in a record gives io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*RIB, error) {
+	for {
+		var header [headerLen]byte
+		if _, err := io.ReadFull(r.r, header[:]); err != nil {
+			return nil, err
+		}
+		timestamp := time.Unix(int64(binary.BigEndian.Uint32(header[0:4])), 0).UTC()
+		recordType := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+
+		if length > maxRecordLen {
+			return nil, fmt.Errorf("MRT record of %d bytes exceeds %d", length, maxRecordLen)
+		}
+		if cap(r.buf) < int(length) {
+			r.buf = make([]byte, length)
+		}
+		body := r.buf[:length]
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if recordType != TypeTableDumpV2 {
+			continue
+		}
+
+		var err error
+		switch subtype {
+		case SubtypePeerIndexTable:
+			r.peers, err = parsePeerIndex(body)
+		case SubtypeRIBIPv4Unicast, SubtypeRIBIPv4UnicastAddPath:
+			var rib *RIB
+			rib, err = parseRIB(body, net.IPv4len, subtype == SubtypeRIBIPv4UnicastAddPath)
+			if err == nil {
+				rib.Timestamp = timestamp
+				return rib, nil
+			}
+		case SubtypeRIBIPv6Unicast, SubtypeRIBIPv6UnicastAddPath:
+			var rib *RIB
+			rib, err = parseRIB(body, net.IPv6len, subtype == SubtypeRIBIPv6UnicastAddPath)
+			if err == nil {
+				rib.Timestamp = timestamp
+				return rib, nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: subtype %d: %v", ErrMalformed, subtype, err)
+		}
+	}
+}
+
+// decoder consumes a record body, remembering the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uint8() uint8 {
+	if v := d.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if v := d.take(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if v := d.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (d *decoder) ip(n int) net.IP {
+	if v := d.take(n); v != nil {
+		return append(net.IP(nil), v...)
+	}
+	return nil
+}
+
+// parsePeerIndex parses a PEER_INDEX_TABLE record.
+func parsePeerIndex(body []byte) ([]Peer, error) {
+	d := &decoder{b: body}
+	d.take(4) // collector BGP ID
+	d.take(int(d.uint16()))
+	count := d.uint16()
+
+	peers := make([]Peer, 0, count)
+	for i := 0; i < int(count) && d.err == nil; i++ {
+		peerType := d.uint8()
+		peer := Peer{BGPID: d.ip(net.IPv4len)}
+		if peerType&0x01 != 0 {
+			peer.Address = d.ip(net.IPv6len)
+		} else {
+			peer.Address = d.ip(net.IPv4len)
+		}
+		if peerType&0x02 != 0 {
+			peer.AS = d.uint32()
+		} else {
+			peer.AS = uint32(d.uint16())
+		}
+		peers = append(peers, peer)
+	}
+	return peers, d.err
+}
+
+// parseRIB parses a RIB record of an address family with addrLen byte
+// addresses.
+func parseRIB(body []byte, addrLen int, addPath bool) (*RIB, error) {
+	d := &decoder{b: body}
+	rib := &RIB{Sequence: d.uint32()}
+
+	bits := int(d.uint8())
+	if bits > addrLen*8 {
+		return nil, fmt.Errorf("prefix length %d", bits)
+	}
+	ip := make(net.IP, addrLen)
+	copy(ip, d.take((bits+7)/8))
+	rib.Prefix = net.IPNet{IP: ip, Mask: net.CIDRMask(bits, addrLen*8)}
+	rib.Prefix.IP = rib.Prefix.IP.Mask(rib.Prefix.Mask)
+
+	count := d.uint16()
+	rib.Entries = make([]RIBEntry, 0, count)
+	for i := 0; i < int(count) && d.err == nil; i++ {
+		entry := RIBEntry{
+			PeerIndex:    d.uint16(),
+			OriginatedAt: time.Unix(int64(d.uint32()), 0).UTC(),
+		}
+		if addPath {
+			entry.PathID = d.uint32()
+		}
+		attrs := d.take(int(d.uint16()))
+		if d.err != nil {
+			break
+		}
+
+		var err error
+		if entry.ASPath, err = parseASPath(attrs); err != nil {
+			return nil, err
+		}
+		rib.Entries = append(rib.Entries, entry)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return rib, nil
+}
+
+// parseASPath finds the AS_PATH among BGP path attributes. TABLE_DUMP_V2
+// always encodes AS numbers in four bytes.
+func parseASPath(attrs []byte) ([]Segment, error) {
+	d := &decoder{b: attrs}
+	for len(d.b) > 0 && d.err == nil {
+		flags := d.uint8()
+		attrType := d.uint8()
+		var length int
+		if flags&flagExtendedLen != 0 {
+			length = int(d.uint16())
+		} else {
+			length = int(d.uint8())
+		}
+		value := d.take(length)
+		if d.err != nil || attrType != attrASPath {
+			continue
+		}
+
+		var path []Segment
+		p := &decoder{b: value}
+		for len(p.b) > 0 && p.err == nil {
+			segment := Segment{Type: p.uint8()}
+			count := int(p.uint8())
+			segment.ASNs = make([]uint32, 0, count)
+			for j := 0; j < count && p.err == nil; j++ {
+				segment.ASNs = append(segment.ASNs, p.uint32())
+			}
+			path = append(path, segment)
+		}
+		if p.err != nil {
+			return nil, fmt.Errorf("AS_PATH: %w", p.err)
+		}
+		return path, nil
+	}
+	return nil, d.err
+}
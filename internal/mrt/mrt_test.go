@@ -0,0 +1,274 @@
+package mrt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var dumpTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// record encodes an MRT record.
+func record(recordType, subtype uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(dumpTime.Unix()))
+	b = binary.BigEndian.AppendUint16(b, recordType)
+	b = binary.BigEndian.AppendUint16(b, subtype)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+// peerIndex encodes a PEER_INDEX_TABLE record, with four byte AS numbers
+// for peers above 65535.
+func peerIndex(peers ...Peer) []byte {
+	b := append([]byte{192, 0, 2, 1}, 0, 4)
+	b = append(b, "test"...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(peers)))
+	for _, peer := range peers {
+		var peerType byte
+		address := peer.Address.To4()
+		if address == nil {
+			peerType |= 0x01
+			address = peer.Address.To16()
+		}
+		if peer.AS > 0xffff {
+			peerType |= 0x02
+		}
+		b = append(b, peerType)
+		b = append(b, peer.BGPID.To4()...)
+		b = append(b, address...)
+		if peer.AS > 0xffff {
+			b = binary.BigEndian.AppendUint32(b, peer.AS)
+		} else {
+			b = binary.BigEndian.AppendUint16(b, uint16(peer.AS))
+		}
+	}
+	return record(TypeTableDumpV2, SubtypePeerIndexTable, b)
+}
+
+// attributes encodes an ORIGIN, an AS_PATH of segments, with the extended
+// length flag when extended is set, and a NEXT_HOP.
+func attributes(extended bool, segments ...Segment) []byte {
+	var path []byte
+	for _, segment := range segments {
+		path = append(path, segment.Type, byte(len(segment.ASNs)))
+		for _, asn := range segment.ASNs {
+			path = binary.BigEndian.AppendUint32(path, asn)
+		}
+	}
+
+	b := []byte{0x40, 1, 1, 0} // ORIGIN IGP
+	if extended {
+		b = append(b, 0x40|flagExtendedLen, attrASPath)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(path)))
+	} else {
+		b = append(b, 0x40, attrASPath, byte(len(path)))
+	}
+	b = append(b, path...)
+	return append(b, 0x40, 3, 4, 192, 0, 2, 1) // NEXT_HOP
+}
+
+type entry struct {
+	peer   uint16
+	pathID uint32
+	attrs  []byte
+}
+
+// rib encodes a RIB record of subtype for cidr.
+func rib(subtype uint16, sequence uint32, cidr string, entries ...entry) []byte {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ones, _ := network.Mask.Size()
+	ip := network.IP
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, sequence)
+	b = append(b, byte(ones))
+	b = append(b, ip[:(ones+7)/8]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, e.peer)
+		b = binary.BigEndian.AppendUint32(b, uint32(dumpTime.Unix()))
+		if subtype == SubtypeRIBIPv4UnicastAddPath || subtype == SubtypeRIBIPv6UnicastAddPath {
+			b = binary.BigEndian.AppendUint32(b, e.pathID)
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(e.attrs)))
+		b = append(b, e.attrs...)
+	}
+	return record(TypeTableDumpV2, subtype, b)
+}
+
+func sequence(asns ...uint32) Segment {
+	return Segment{Type: SegmentSequence, ASNs: asns}
+}
+
+// synthetic is a small dump with both address families, four byte AS
+// numbers, ADD-PATH, AS_SETs and a record of another type.
+func synthetic() []byte {
+	var b bytes.Buffer
+	b.Write(peerIndex(
+		Peer{BGPID: net.ParseIP("192.0.2.1"), Address: net.ParseIP("192.0.2.1"), AS: 64496},
+		Peer{BGPID: net.ParseIP("192.0.2.2"), Address: net.ParseIP("2001:db8::2"), AS: 4200000000},
+	))
+	b.Write(rib(SubtypeRIBIPv4Unicast, 0, "8.8.8.0/24",
+		entry{peer: 0, attrs: attributes(false, sequence(64496, 3356, 15169))},
+		entry{peer: 1, attrs: attributes(true, sequence(4200000000, 15169))}))
+	b.Write(record(16, 4, []byte{1, 2, 3})) // BGP4MP, skipped
+	b.Write(rib(SubtypeRIBIPv4Unicast, 1, "0.0.0.0/0",
+		entry{peer: 0, attrs: attributes(false)}))
+	b.Write(rib(SubtypeRIBIPv4UnicastAddPath, 2, "193.0.0.0/21",
+		entry{peer: 0, pathID: 7, attrs: attributes(false, sequence(64496), Segment{Type: SegmentSet, ASNs: []uint32{3333}})}))
+	b.Write(rib(SubtypeRIBIPv6Unicast, 3, "2001:4860::/32",
+		entry{peer: 1, attrs: attributes(false, sequence(4200000000, 6939), Segment{Type: SegmentSet, ASNs: []uint32{15169, 36040}})}))
+	return b.Bytes()
+}
+
+// route summarises a RIB as "<prefix> <origin of each entry>", with "-" for
+// entries without one.
+func route(r *RIB) string {
+	s := r.Prefix.String()
+	for _, e := range r.Entries {
+		if asn, ok := e.OriginAS(); ok {
+			s += fmt.Sprintf(" %d", asn)
+		} else {
+			s += " -"
+		}
+	}
+	return s
+}
+
+func readAll(t *testing.T, r *Reader) []string {
+	t.Helper()
+	var routes []string
+	for {
+		rib, err := r.Next()
+		if err == io.EOF {
+			return routes
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		routes = append(routes, route(rib))
+	}
+}
+
+var syntheticRoutes = []string{
+	"8.8.8.0/24 15169 15169",
+	"0.0.0.0/0 -",
+	"193.0.0.0/21 3333",
+	"2001:4860::/32 -",
+}
+
+func TestReader(t *testing.T) {
+	r := NewReader(bytes.NewReader(synthetic()))
+	if routes := readAll(t, r); !reflect.DeepEqual(routes, syntheticRoutes) {
+		t.Errorf("expected %v, got %v", syntheticRoutes, routes)
+	}
+
+	peers := r.Peers()
+	if len(peers) != 2 || peers[0].AS != 64496 || peers[1].AS != 4200000000 || !peers[1].Address.Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("unexpected peers %+v", peers)
+	}
+}
+
+func TestReader_Details(t *testing.T) {
+	r := NewReader(bytes.NewReader(synthetic()))
+	for i := 0; i < 3; i++ {
+		if _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rib, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rib.Sequence != 3 || !rib.Timestamp.Equal(dumpTime) {
+		t.Errorf("unexpected record %+v", rib)
+	}
+	want := []Segment{sequence(4200000000, 6939), {Type: SegmentSet, ASNs: []uint32{15169, 36040}}}
+	if len(rib.Entries) != 1 || !reflect.DeepEqual(rib.Entries[0].ASPath, want) || !rib.Entries[0].OriginatedAt.Equal(dumpTime) {
+		t.Errorf("unexpected entries %+v", rib.Entries)
+	}
+}
+
+// TestReader_File reads testdata/rib.synthetic.mrt, the output of
+// synthetic() checked in as a file.
+func TestReader_File(t *testing.T) {
+	f, err := os.Open("testdata/rib.synthetic.mrt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if routes := readAll(t, NewReader(f)); !reflect.DeepEqual(routes, syntheticRoutes) {
+		t.Errorf("expected %v, got %v", syntheticRoutes, routes)
+	}
+}
+
+func TestReader_Malformed(t *testing.T) {
+	good := rib(SubtypeRIBIPv4Unicast, 1, "8.8.8.0/24", entry{attrs: attributes(false, sequence(15169))})
+
+	badPrefix := rib(SubtypeRIBIPv4Unicast, 0, "10.0.0.0/8")
+	badPrefix[headerLen+4] = 33
+
+	badPath := rib(SubtypeRIBIPv4Unicast, 0, "10.0.0.0/8", entry{attrs: attributes(false, sequence(1, 2))})
+	badPath[len(badPath)-7-8-1] = 9 // the segment of two AS numbers claims nine
+
+	for name, data := range map[string][]byte{"prefix length": badPrefix, "AS_PATH": badPath} {
+		t.Run(name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(append(data, good...)))
+			if _, err := r.Next(); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("expected ErrMalformed, got %v", err)
+			}
+			// The next record is still read
+			if rib, err := r.Next(); err != nil || route(rib) != "8.8.8.0/24 15169" {
+				t.Errorf("expected the following record, got %v %v", rib, err)
+			}
+		})
+	}
+}
+
+func TestReader_Truncated(t *testing.T) {
+	data := synthetic()
+	r := NewReader(bytes.NewReader(data[:len(data)-3]))
+	for i := 0; i < 3; i++ {
+		if _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestRIBEntry_OriginAS(t *testing.T) {
+	tests := []struct {
+		path   []Segment
+		origin uint32
+		ok     bool
+	}{
+		{path: nil},
+		{path: []Segment{sequence(64496, 15169)}, origin: 15169, ok: true},
+		{path: []Segment{sequence(64496), {Type: SegmentSet, ASNs: []uint32{3333}}}, origin: 3333, ok: true},
+		{path: []Segment{sequence(64496), {Type: SegmentSet, ASNs: []uint32{3333, 1103}}}},
+		{path: []Segment{{Type: 3, ASNs: []uint32{65001}}}},
+	}
+
+	for _, tt := range tests {
+		origin, ok := RIBEntry{ASPath: tt.path}.OriginAS()
+		if origin != tt.origin || ok != tt.ok {
+			t.Errorf("%+v: expected %d %v, got %d %v", tt.path, tt.origin, tt.ok, origin, ok)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+
+	"ipservice/internal/model"
+)
+
+// ErrArchiveOutOfOrder is returned by ImportArchive for an archive not newer
+// than the last one imported from its source.
+var ErrArchiveOutOfOrder = errors.New("delegation archive is not newer than the last one imported")
+
+// sameDelegation matches a temporal range t with a loaded range l delegated
+// the same way.
+const sameDelegation = `l.network = t.network
+    AND l.country_code = t.country_code
+    AND l.registry = t.registry
+    AND l.status = t.status
+    AND l.allocated_at IS NOT DISTINCT FROM t.allocated_at`
+
+// LatestArchiveDate returns the date of the last archive imported from
+// source, or a zero time when there is none.
+func (r *PostgresRepository) LatestArchiveDate(ctx context.Context, source string) (time.Time, error) {
+	var date sql.NullTime
+	err := r.db.GetContext(ctx, &date, "SELECT max(data_date) FROM delegation_archives WHERE source = $1", source)
+	return date.Time, err
+}
+
+// ImportArchive records the ranges that load passes to emit as the
+// delegations of archive.Source as of archive.Date: intervals of ranges no
+// longer delegated the same way end at that date, and new ones start.
+// Archives must be imported in date order, and one without ranges is
+// refused.
+func (r *PostgresRepository) ImportArchive(ctx context.Context, archive model.DelegationArchive, load func(emit func(model.IPRange) error) error) (*model.ArchiveImport, error) {
+	startTime := time.Now()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serializes imports of the same source
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('delegation_archives'), hashtext($1))", archive.Source); err != nil {
+		return nil, err
+	}
+	var latest sql.NullTime
+	if err := tx.QueryRowContext(ctx, "SELECT max(data_date) FROM delegation_archives WHERE source = $1", archive.Source).Scan(&latest); err != nil {
+		return nil, err
+	}
+	if latest.Valid && !archive.Date.After(latest.Time) {
+		return nil, fmt.Errorf("%w: %s archive of %s, last imported %s", ErrArchiveOutOfOrder,
+			archive.Source, archive.Date.Format(time.DateOnly), latest.Time.Format(time.DateOnly))
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        CREATE TEMP TABLE archive_load (
+            network CIDR NOT NULL,
+            country_code CHAR(2) NOT NULL,
+            ip_version INT NOT NULL,
+            registry TEXT NOT NULL,
+            status TEXT NOT NULL,
+            allocated_at DATE
+        ) ON COMMIT DROP
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("archive_load",
+		"network", "country_code", "ip_version", "registry", "status", "allocated_at"))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	result := &model.ArchiveImport{}
+	err = load(func(ipRange model.IPRange) error {
+		_, err := stmt.ExecContext(ctx,
+			ipRange.Network.String(),
+			ipRange.CountryCode,
+			ipRange.Version,
+			ipRange.Registry,
+			ipRange.Status,
+			nullDate(ipRange.AllocatedAt))
+		if err != nil {
+			return err
+		}
+		result.Ranges++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := stmt.Close(); err != nil {
+		return nil, err
+	}
+
+	// Would end every open interval of the source
+	if result.Ranges == 0 {
+		return nil, errors.New("refusing to import a delegation archive without IP ranges")
+	}
+
+	if _, err := tx.ExecContext(ctx, "CREATE INDEX ON archive_load (network); ANALYZE archive_load"); err != nil {
+		return nil, err
+	}
+
+	closed, err := tx.ExecContext(ctx, `
+        UPDATE ip_ranges_temporal t SET valid_to = $2
+        WHERE t.source = $1 AND t.valid_to IS NULL
+          AND NOT EXISTS (SELECT 1 FROM archive_load l WHERE `+sameDelegation+`)
+    `, archive.Source, archive.Date)
+	if err != nil {
+		return nil, err
+	}
+	if result.Closed, err = closed.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	opened, err := tx.ExecContext(ctx, `
+        INSERT INTO ip_ranges_temporal
+            (network, country_code, ip_version, registry, status, allocated_at, source, valid_from)
+        SELECT DISTINCT ON (l.network)
+            l.network, l.country_code, l.ip_version, l.registry, l.status, l.allocated_at, $1::text, $2::date
+        FROM archive_load l
+        WHERE NOT EXISTS (
+            SELECT 1 FROM ip_ranges_temporal t
+            WHERE t.source = $1 AND t.valid_to IS NULL AND `+sameDelegation+`
+        )
+        ORDER BY l.network
+    `, archive.Source, archive.Date)
+	if err != nil {
+		return nil, err
+	}
+	if result.Opened, err = opened.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO delegation_archives (source, data_date, serial, ranges)
+        VALUES ($1, $2, $3, $4)
+    `, archive.Source, archive.Date, archive.Serial, result.Ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	r.logger.Info("Imported delegation archive",
+		zap.String("source", archive.Source),
+		zap.Time("date", archive.Date),
+		zap.Int64("ranges", result.Ranges),
+		zap.Int64("opened", result.Opened),
+		zap.Int64("closed", result.Closed),
+		zap.Duration("duration", time.Since(startTime)))
+
+	return result, nil
+}
+
+// FindRangeForIPAt returns the most specific range delegated to ip at the
+// given date according to the imported archives, or nil when none was.
+func (r *PostgresRepository) FindRangeForIPAt(ctx context.Context, ip net.IP, at time.Time) (*model.HistoricalRange, error) {
+	var (
+		historical  model.HistoricalRange
+		network     string
+		allocatedAt sql.NullTime
+		validTo     sql.NullTime
+	)
+	err := r.db.QueryRowContext(ctx, `
+        SELECT network, country_code, ip_version, registry, status, allocated_at, source, valid_from, valid_to
+        FROM ip_ranges_temporal
+        WHERE network >>= $1
+          AND valid_from <= $2
+          AND (valid_to IS NULL OR valid_to > $2)
+        ORDER BY masklen(network) DESC
+        LIMIT 1
+    `, ip.String(), at.Format(time.DateOnly)).Scan(&network, &historical.CountryCode, &historical.Version,
+		&historical.Registry, &historical.Status, &allocatedAt, &historical.Source, &historical.ValidFrom, &validTo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		r.logger.Error("failed to find historical range for IP",
+			zap.String("ip", ip.String()),
+			zap.Time("at", at),
+			zap.Error(err))
+		return nil, err
+	}
+
+	_, parsed, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, err
+	}
+	historical.Network = *parsed
+	historical.AllocatedAt = allocatedAt.Time
+	historical.ValidTo = validTo.Time
+
+	return &historical, nil
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"ipservice/internal/model"
+)
+
+func TestPostgresRepository_ImportArchive(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	delegation := func(cidr, country string) model.IPRange {
+		_, network, _ := net.ParseCIDR(cidr)
+		return model.IPRange{Network: *network, CountryCode: country, Version: 4, Registry: "ripencc", Status: "allocated"}
+	}
+	date := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+
+	archives := []struct {
+		date   string
+		ranges []model.IPRange
+		want   model.ArchiveImport
+	}{
+		{date: "2024-01-01", ranges: []model.IPRange{delegation("193.0.0.0/24", "DE"), delegation("194.0.0.0/23", "FR")}, want: model.ArchiveImport{Ranges: 2, Opened: 2}},
+		// 193.0.0.0/24 moves, 194.0.0.0/23 is returned, 195.0.0.0/24 is new
+		{date: "2024-02-01", ranges: []model.IPRange{delegation("193.0.0.0/24", "GB"), delegation("195.0.0.0/24", "SE")}, want: model.ArchiveImport{Ranges: 2, Opened: 2, Closed: 2}},
+		{date: "2024-03-01", ranges: []model.IPRange{delegation("193.0.0.0/24", "GB"), delegation("195.0.0.0/24", "SE")}, want: model.ArchiveImport{Ranges: 2}},
+	}
+	for _, archive := range archives {
+		result, err := repo.ImportArchive(ctx, model.DelegationArchive{Source: "ripencc", Date: date(archive.date), Serial: 1}, emitAll(archive.ranges))
+		if err != nil {
+			t.Fatalf("importing %s: %v", archive.date, err)
+		}
+		if *result != archive.want {
+			t.Errorf("importing %s: expected %+v, got %+v", archive.date, archive.want, *result)
+		}
+	}
+
+	if latest, err := repo.LatestArchiveDate(ctx, "ripencc"); err != nil || !latest.Equal(date("2024-03-01")) {
+		t.Errorf("expected the latest archive of 2024-03-01, got %s %v", latest, err)
+	}
+	_, err := repo.ImportArchive(ctx, model.DelegationArchive{Source: "ripencc", Date: date("2024-02-15")}, emitAll(nil))
+	if !errors.Is(err, ErrArchiveOutOfOrder) {
+		t.Errorf("expected ErrArchiveOutOfOrder, got %v", err)
+	}
+
+	// An empty archive would end every open interval
+	if _, err := repo.ImportArchive(ctx, model.DelegationArchive{Source: "ripencc", Date: date("2024-04-01")}, emitAll(nil)); err == nil {
+		t.Error("expected an archive without ranges to be refused")
+	}
+	if latest, _ := repo.LatestArchiveDate(ctx, "ripencc"); !latest.Equal(date("2024-03-01")) {
+		t.Errorf("expected the refused archive not to be recorded, got %s", latest)
+	}
+
+	tests := []struct {
+		ip        string
+		at        string
+		country   string
+		validFrom string
+		validTo   string
+	}{
+		{ip: "193.0.0.1", at: "2023-12-31"},
+		{ip: "193.0.0.1", at: "2024-01-31", country: "DE", validFrom: "2024-01-01", validTo: "2024-02-01"},
+		{ip: "193.0.0.1", at: "2024-02-01", country: "GB", validFrom: "2024-02-01"},
+		{ip: "194.0.1.1", at: "2024-01-15", country: "FR", validFrom: "2024-01-01", validTo: "2024-02-01"},
+		{ip: "194.0.1.1", at: "2024-02-15"},
+		{ip: "195.0.0.1", at: "2024-06-01", country: "SE", validFrom: "2024-02-01"},
+	}
+	for _, tt := range tests {
+		found, err := repo.FindRangeForIPAt(ctx, net.ParseIP(tt.ip), date(tt.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var country, validFrom, validTo string
+		if found != nil {
+			country, validFrom = found.CountryCode, found.ValidFrom.Format(time.DateOnly)
+			if !found.ValidTo.IsZero() {
+				validTo = found.ValidTo.Format(time.DateOnly)
+			}
+		}
+		if country != tt.country || validFrom != tt.validFrom || validTo != tt.validTo {
+			t.Errorf("%s at %s: expected %q from %q to %q, got %q from %q to %q",
+				tt.ip, tt.at, tt.country, tt.validFrom, tt.validTo, country, validFrom, validTo)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+
+	"ipservice/internal/model"
+)
+
+// asnColumns lists the asn_delegations columns read by scanASN.
+const asnColumns = "first_asn, last_asn, country_code, registry, status, allocated_at, opaque_id, source"
+
+func scanASN(row rowScanner) (model.ASNDelegation, error) {
+	var (
+		delegation  model.ASNDelegation
+		allocatedAt sql.NullTime
+	)
+	err := row.Scan(
+		&delegation.FirstASN,
+		&delegation.LastASN,
+		&delegation.CountryCode,
+		&delegation.Registry,
+		&delegation.Status,
+		&allocatedAt,
+		&delegation.OpaqueID,
+		&delegation.Source)
+	delegation.AllocatedAt = allocatedAt.Time
+	return delegation, err
+}
+
+// SaveASNDelegations replaces the AS number delegations of every source but
+// those in kept, whose published delegations are left unchanged, with
+// delegations. When a range appears more than once for a source the last
+// occurrence wins.
+func (r *PostgresRepository) SaveASNDelegations(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+	startTime := time.Now()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM asn_delegations WHERE source <> ALL(coalesce($1::text[], '{}'))", pq.Array(kept)); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        CREATE TEMP TABLE asn_delegations_load (
+            seq BIGSERIAL,
+            first_asn BIGINT NOT NULL,
+            last_asn BIGINT NOT NULL,
+            country_code CHAR(2) NOT NULL,
+            registry TEXT NOT NULL,
+            status TEXT NOT NULL,
+            allocated_at DATE,
+            opaque_id TEXT NOT NULL,
+            source TEXT NOT NULL
+        ) ON COMMIT DROP
+    `)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("asn_delegations_load",
+		"first_asn", "last_asn", "country_code", "registry", "status", "allocated_at", "opaque_id", "source"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, delegation := range delegations {
+		_, err := stmt.ExecContext(ctx,
+			int64(delegation.FirstASN),
+			int64(delegation.LastASN),
+			delegation.CountryCode,
+			delegation.Registry,
+			delegation.Status,
+			nullDate(delegation.AllocatedAt),
+			delegation.OpaqueID,
+			delegation.Source)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	saved, err := tx.ExecContext(ctx, `
+        INSERT INTO asn_delegations (`+asnColumns+`)
+        SELECT DISTINCT ON (source, first_asn) `+asnColumns+`
+        FROM asn_delegations_load
+        ORDER BY source, first_asn, seq DESC
+    `)
+	if err != nil {
+		return err
+	}
+	rows, err := saved.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.logger.Info("Saved ASN delegations",
+		zap.Int64("delegations", rows),
+		zap.Strings("kept_sources", kept),
+		zap.Duration("duration", time.Since(startTime)))
+
+	return nil
+}
+
+// LoadASNDelegations returns all published AS number delegations.
+func (r *PostgresRepository) LoadASNDelegations(ctx context.Context) ([]model.ASNDelegation, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+asnColumns+" FROM asn_delegations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var delegations []model.ASNDelegation
+	for rows.Next() {
+		delegation, err := scanASN(rows)
+		if err != nil {
+			return nil, err
+		}
+		delegations = append(delegations, delegation)
+	}
+
+	return delegations, rows.Err()
+}
+
+// FindASNDelegation returns the delegation containing asn, or nil when none
+// does. Like the in-memory index, it is the last range starting at or before
+// asn, the narrowest when several start there.
+func (r *PostgresRepository) FindASNDelegation(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+	query := `
+        SELECT ` + asnColumns + `
+        FROM (
+            SELECT ` + asnColumns + `
+            FROM asn_delegations
+            WHERE first_asn <= $1
+            ORDER BY first_asn DESC, last_asn
+            LIMIT 1
+        ) d
+        WHERE last_asn >= $1
+    `
+
+	delegation, err := scanASN(r.db.QueryRowContext(ctx, query, int64(asn)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		r.logger.Error("failed to find ASN delegation",
+			zap.Uint32("asn", asn),
+			zap.Error(err))
+		return nil, err
+	}
+
+	return &delegation, nil
+}
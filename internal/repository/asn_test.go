@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"ipservice/internal/model"
+)
+
+func TestPostgresRepository_ASNDelegations(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	err := repo.SaveASNDelegations(ctx, nil, []model.ASNDelegation{
+		{FirstASN: 701, LastASN: 705, CountryCode: "US", Registry: "arin", Status: "allocated", Source: "ARIN"},
+		{FirstASN: 3333, LastASN: 3333, CountryCode: "DE", Registry: "ripencc", Status: "assigned", Source: "RIPE"},
+		{FirstASN: 3333, LastASN: 3333, CountryCode: "NL", Registry: "ripencc", Status: "assigned", Source: "RIPE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ARIN failed and keeps its delegations, RIPE is replaced
+	err = repo.SaveASNDelegations(ctx, []string{"ARIN"}, []model.ASNDelegation{
+		{FirstASN: 3333, LastASN: 3334, CountryCode: "NL", Registry: "ripencc", Status: "assigned", Source: "RIPE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delegations, err := repo.LoadASNDelegations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delegations) != 2 {
+		t.Errorf("expected 2 delegations, got %+v", delegations)
+	}
+
+	for asn, want := range map[uint32]string{700: "", 701: "US", 705: "US", 706: "", 3333: "NL", 3334: "NL", 3335: ""} {
+		delegation, err := repo.FindASNDelegation(ctx, asn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if delegation != nil {
+			got = delegation.CountryCode
+		}
+		if got != want {
+			t.Errorf("AS%d: expected %q, got %q", asn, want, got)
+		}
+	}
+
+	// Nothing kept drops every source
+	if err := repo.SaveASNDelegations(ctx, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if delegations, err := repo.LoadASNDelegations(ctx); err != nil || len(delegations) != 0 {
+		t.Errorf("expected no delegations, got %+v %v", delegations, err)
+	}
+}
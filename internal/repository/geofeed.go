@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+
+	"ipservice/internal/model"
+)
+
+// SaveGeofeeds replaces the entries of every feed but those in kept, whose
+// entries are left unchanged, with entries. When a prefix appears more than
+// once in a feed the last occurrence wins.
+func (r *PostgresRepository) SaveGeofeeds(ctx context.Context, kept []string, entries []model.GeofeedEntry) (*model.GeofeedUpdate, error) {
+	startTime := time.Now()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM geofeed_entries WHERE feed <> ALL(coalesce($1::text[], '{}'))", pq.Array(kept)); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        CREATE TEMP TABLE geofeed_entries_load (
+            seq BIGSERIAL,
+            network CIDR NOT NULL,
+            country_code TEXT NOT NULL,
+            region TEXT NOT NULL,
+            city TEXT NOT NULL,
+            postal_code TEXT NOT NULL,
+            feed TEXT NOT NULL
+        ) ON COMMIT DROP
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("geofeed_entries_load",
+		"network", "country_code", "region", "city", "postal_code", "feed"))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	feeds := make(map[string]bool)
+	for _, entry := range entries {
+		_, err := stmt.ExecContext(ctx,
+			entry.Prefix.String(),
+			entry.CountryCode,
+			entry.Region,
+			entry.City,
+			entry.PostalCode,
+			entry.Feed)
+		if err != nil {
+			return nil, err
+		}
+		feeds[entry.Feed] = true
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := stmt.Close(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO geofeed_entries (network, country_code, region, city, postal_code, feed)
+        SELECT DISTINCT ON (feed, network) network, country_code, region, city, postal_code, feed
+        FROM geofeed_entries_load
+        ORDER BY feed, network, seq DESC
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &model.GeofeedUpdate{Feeds: make([]string, 0, len(feeds))}
+	for feed := range feeds {
+		update.Feeds = append(update.Feeds, feed)
+	}
+	sort.Strings(update.Feeds)
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO geofeed_updates (feeds, entries)
+        SELECT $1::text[], count(*) FROM geofeed_entries
+        RETURNING id, updated_at, entries
+    `, pq.Array(update.Feeds)).Scan(&update.ID, &update.UpdatedAt, &update.Entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	r.logger.Info("Saved geofeeds",
+		zap.Int64("update", update.ID),
+		zap.Int64("entries", update.Entries),
+		zap.Strings("kept_feeds", kept),
+		zap.Duration("duration", time.Since(startTime)))
+
+	return update, nil
+}
+
+// LatestGeofeedUpdate describes the last refresh of the geofeeds, or
+// returns nil when there was none.
+func (r *PostgresRepository) LatestGeofeedUpdate(ctx context.Context) (*model.GeofeedUpdate, error) {
+	var update model.GeofeedUpdate
+	err := r.db.QueryRowContext(ctx,
+		"SELECT id, updated_at, feeds, entries FROM geofeed_updates ORDER BY id DESC LIMIT 1").
+		Scan(&update.ID, &update.UpdatedAt, pq.Array(&update.Feeds), &update.Entries)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &update, nil
+}
+
+// LoadGeofeeds returns the entries of all geofeeds.
+func (r *PostgresRepository) LoadGeofeeds(ctx context.Context) ([]model.GeofeedEntry, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT network, country_code, region, city, postal_code, feed FROM geofeed_entries")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []model.GeofeedEntry
+	for rows.Next() {
+		var (
+			entry   model.GeofeedEntry
+			network string
+		)
+		err := rows.Scan(&network, &entry.CountryCode, &entry.Region, &entry.City, &entry.PostalCode, &entry.Feed)
+		if err != nil {
+			return nil, err
+		}
+		_, parsed, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		entry.Prefix = *parsed
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
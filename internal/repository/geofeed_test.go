@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"ipservice/internal/model"
+)
+
+func TestPostgresRepository_Geofeeds(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	if latest, err := repo.LatestGeofeedUpdate(ctx); err != nil || latest != nil {
+		t.Fatalf("expected no update, got %+v %v", latest, err)
+	}
+
+	entry := func(cidr, city, feed string) model.GeofeedEntry {
+		_, network, _ := net.ParseCIDR(cidr)
+		return model.GeofeedEntry{Prefix: *network, CountryCode: "US", Region: "US-CA", City: city, Feed: feed}
+	}
+
+	_, err := repo.SaveGeofeeds(ctx, nil, []model.GeofeedEntry{
+		entry("192.0.2.0/24", "Los Angeles", "alpha"),
+		entry("198.51.100.0/24", "San Jose", "beta"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// beta failed and keeps its entries, alpha is replaced
+	update, err := repo.SaveGeofeeds(ctx, []string{"beta"}, []model.GeofeedEntry{
+		entry("192.0.2.0/25", "Oakland", "alpha"),
+		entry("192.0.2.128/25", "Fresno", "alpha"),
+		entry("192.0.2.128/25", "San Diego", "alpha"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Entries != 3 || !reflect.DeepEqual(update.Feeds, []string{"alpha"}) {
+		t.Errorf("unexpected update %+v", update)
+	}
+
+	latest, err := repo.LatestGeofeedUpdate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.ID != update.ID || latest.Entries != 3 {
+		t.Errorf("expected %+v, got %+v", update, latest)
+	}
+
+	entries, err := repo.LoadGeofeeds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cities := make(map[string]string)
+	for _, entry := range entries {
+		cities[entry.Prefix.String()] = entry.City
+	}
+	want := map[string]string{"192.0.2.0/25": "Oakland", "192.0.2.128/25": "San Diego", "198.51.100.0/24": "San Jose"}
+	if !reflect.DeepEqual(cities, want) {
+		t.Errorf("expected %v, got %v", want, cities)
+	}
+}
@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// updateLockKey identifies the advisory lock guarding updates ("ipservic"
+// in ASCII).
+const updateLockKey int64 = 0x6970736572766963
+
+// lockCheckInterval is how often a held lock's connection is checked.
+const lockCheckInterval = 10 * time.Second
+
+// PostgresLocker elects the instance that updates the shared dataset with
+// a session-level advisory lock, held on a dedicated connection for as long
+// as the update runs. The lock is lost with that connection.
+type PostgresLocker struct {
+	db     *sqlx.DB
+	logger *zap.Logger
+}
+
+func NewPostgresLocker(db *sqlx.DB, logger *zap.Logger) *PostgresLocker {
+	return &PostgresLocker{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// TryLock takes the update lock, or returns a nil context while another
+// instance holds it. The returned context is cancelled when the lock's
+// connection fails, and release gives the lock up.
+func (l *PostgresLocker) TryLock(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	conn, err := l.db.Connx(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var locked bool
+	if err := conn.GetContext(ctx, &locked, "SELECT pg_try_advisory_lock($1)", updateLockKey); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, nil, nil
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+
+		ticker := time.NewTicker(lockCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+				if err := conn.PingContext(lockCtx); err != nil && lockCtx.Err() == nil {
+					l.logger.Error("Lost update lock", zap.Error(err))
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	release := func() {
+		cancel()
+		<-checked
+
+		unlockCtx, cancelUnlock := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelUnlock()
+		if _, err := conn.ExecContext(unlockCtx, "SELECT pg_advisory_unlock($1)", updateLockKey); err != nil {
+			// Closing the session releases the lock instead
+			l.logger.Error("Failed to release update lock", zap.Error(err))
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+
+	return lockCtx, release, nil
+}
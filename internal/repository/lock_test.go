@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPostgresLocker_TryLock(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	// Two instances sharing the database
+	first, second := NewPostgresLocker(repo.db, zap.NewNop()), NewPostgresLocker(repo.db, zap.NewNop())
+
+	lockCtx, release, err := first.TryLock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockCtx == nil {
+		t.Fatal("expected to take the free lock")
+	}
+
+	if other, _, err := second.TryLock(ctx); err != nil || other != nil {
+		t.Fatalf("expected the lock to be held, got %v %v", other, err)
+	}
+
+	release()
+	if lockCtx.Err() == nil {
+		t.Error("expected released lock's context to be cancelled")
+	}
+
+	lockCtx, release, err = second.TryLock(ctx)
+	if err != nil || lockCtx == nil {
+		t.Fatalf("expected to take the released lock, got %v", err)
+	}
+	release()
+}
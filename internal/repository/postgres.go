@@ -4,10 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 
 	"ipservice/internal/model"
@@ -25,76 +28,833 @@ func NewPostgresRepository(db *sqlx.DB, logger *zap.Logger) *PostgresRepository
 	}
 }
 
-func (r *PostgresRepository) SaveIPRanges(ctx context.Context, ranges []model.IPRange) error {
+// ErrNoPreviousDataset is returned by RollbackIPRanges when there is no
+// retained dataset to restore.
+var ErrNoPreviousDataset = errors.New("no previous IP ranges dataset")
+
+// ErrDatasetChanged is returned by SwapIPRanges when another dataset was
+// published since the one the update started from.
+var ErrDatasetChanged = errors.New("IP ranges dataset changed during update")
+
+// ErrVersionNotFound is returned by GetDatasetDiff for unknown dataset
+// versions and those whose ranges are no longer kept.
+var ErrVersionNotFound = errors.New("dataset version not found")
+
+// BeginStaging creates an empty shadow copy of ip_ranges that subsequent
+// SaveIPRanges calls write to. Lookups keep using ip_ranges until
+// SwapIPRanges publishes the staged data.
+func (r *PostgresRepository) BeginStaging(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `
+        DROP TABLE IF EXISTS ip_ranges_staging;
+        CREATE TABLE ip_ranges_staging (LIKE ip_ranges INCLUDING ALL);
+    `)
+	return err
+}
+
+// copyProgressInterval is how many rows are streamed between progress logs.
+const copyProgressInterval = 50000
+
+// sourceRank orders the source of a row by its position in the priority
+// array parameter; sources missing from it rank last.
+func sourceRank(param, source string) string {
+	return "coalesce(array_position(" + param + "::text[], " + source + "), 2147483647)"
+}
+
+// SaveIPRanges writes the ranges passed to emit by load into the staging
+// table created by BeginStaging. Rows are streamed with COPY into a
+// temporary load table and then merged into the staging table with a single
+// set-based statement; when a network appears more than once in a load the
+// last occurrence wins. A network already staged by another source is only
+// replaced when the new source comes first in priority, so the result does
+// not depend on the order concurrent loads finish in; sources of equal rank
+// replace each other. Everything happens in one transaction, so nothing is
+// staged when load or the merge fails.
+func (r *PostgresRepository) SaveIPRanges(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error {
+	startTime := time.Now()
+
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	query := `
-        INSERT INTO ip_ranges (network, country_code, ip_version)
-        VALUES ($1, $2, $3)
-        ON CONFLICT (network)
-        DO UPDATE SET 
-            country_code = EXCLUDED.country_code,
-            ip_version = EXCLUDED.ip_version
-    `
+	_, err = tx.ExecContext(ctx, `
+        CREATE TEMP TABLE ip_ranges_load (
+            seq BIGSERIAL,
+            network CIDR NOT NULL,
+            country_code CHAR(2) NOT NULL,
+            ip_version INT NOT NULL,
+            registry TEXT NOT NULL,
+            status TEXT NOT NULL,
+            allocated_at DATE,
+            opaque_id TEXT NOT NULL,
+            source TEXT NOT NULL
+        ) ON COMMIT DROP
+    `)
+	if err != nil {
+		return err
+	}
 
-	stmt, err := tx.PrepareContext(ctx, query)
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("ip_ranges_load",
+		"network", "country_code", "ip_version", "registry", "status", "allocated_at", "opaque_id", "source"))
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for _, ipRange := range ranges {
-		_, err = stmt.ExecContext(ctx,
+	copied := 0
+	err = load(func(ipRange model.IPRange) error {
+		_, err := stmt.ExecContext(ctx,
 			ipRange.Network.String(),
 			ipRange.CountryCode,
-			ipRange.Version)
+			ipRange.Version,
+			ipRange.Registry,
+			ipRange.Status,
+			nullDate(ipRange.AllocatedAt),
+			ipRange.OpaqueID,
+			ipRange.Source)
 		if err != nil {
-			r.logger.Error("failed to insert IP range",
+			r.logger.Error("failed to copy IP range",
 				zap.String("network", ipRange.Network.String()),
 				zap.Error(err))
 			return err
 		}
+
+		copied++
+		if copied%copyProgressInterval == 0 {
+			r.logger.Info("Copying IP ranges",
+				zap.Int("rows_loaded", copied),
+				zap.Duration("elapsed", time.Since(startTime)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return tx.Commit()
+	// Flush buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	copyDuration := time.Since(startTime)
+
+	// Merges of concurrent loads are serialised, so the networks this load
+	// wins on priority can be counted before merging. The copy above still
+	// runs concurrently.
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE ip_ranges_staging IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+
+	var distinct, winning int64
+	err = tx.QueryRowContext(ctx, `
+        SELECT count(*),
+            count(*) FILTER (WHERE s.network IS NULL OR `+sourceRank("$1", "l.source")+` <= `+sourceRank("$1", "s.source")+`)
+        FROM (
+            SELECT DISTINCT ON (network) network, source
+            FROM ip_ranges_load
+            ORDER BY network, seq DESC
+        ) l
+        LEFT JOIN ip_ranges_staging s ON s.network = l.network
+    `, pq.Array(priority)).Scan(&distinct, &winning)
+	if err != nil {
+		return err
+	}
+
+	merged, err := tx.ExecContext(ctx, `
+        INSERT INTO ip_ranges_staging
+            (network, country_code, ip_version, registry, status, allocated_at, opaque_id, source)
+        SELECT DISTINCT ON (network)
+            network, country_code, ip_version, registry, status, allocated_at, opaque_id, source
+        FROM ip_ranges_load
+        ORDER BY network, seq DESC
+        ON CONFLICT (network)
+        DO UPDATE SET
+            country_code = EXCLUDED.country_code,
+            ip_version = EXCLUDED.ip_version,
+            registry = EXCLUDED.registry,
+            status = EXCLUDED.status,
+            allocated_at = EXCLUDED.allocated_at,
+            opaque_id = EXCLUDED.opaque_id,
+            source = EXCLUDED.source
+        WHERE `+sourceRank("$1", "EXCLUDED.source")+` <= `+sourceRank("$1", "ip_ranges_staging.source")+`
+    `, pq.Array(priority))
+	if err != nil {
+		return err
+	}
+
+	rows, err := merged.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// Every network not held by a source of higher priority is merged
+	if rows != winning {
+		return fmt.Errorf("merged %d of %d ranges, expected %d not outranked by staged ones", rows, distinct, winning)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.logger.Info("Loaded IP ranges",
+		zap.Int("rows_copied", copied),
+		zap.Int64("rows_merged", rows),
+		zap.Int64("rows_outranked", distinct-winning),
+		zap.Duration("copy_time", copyDuration),
+		zap.Duration("total_time", time.Since(startTime)))
+
+	return nil
+}
+
+// KeepIPRanges copies the published ranges of sources into the staging
+// table unchanged and returns how many were kept. It runs after the fresh
+// sources are saved, whose ranges take precedence for the same network
+// unless the kept source comes first in priority, as it would had it been
+// saved again. Without priority, staged ranges always take precedence.
+func (r *PostgresRepository) KeepIPRanges(ctx context.Context, sources []string, priority []string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `
+        INSERT INTO ip_ranges_staging
+            (network, country_code, ip_version, registry, status, allocated_at, opaque_id, source)
+        SELECT network, country_code, ip_version, registry, status, allocated_at, opaque_id, source
+        FROM ip_ranges
+        WHERE source = ANY($1)
+        ON CONFLICT (network)
+        DO UPDATE SET
+            country_code = EXCLUDED.country_code,
+            ip_version = EXCLUDED.ip_version,
+            registry = EXCLUDED.registry,
+            status = EXCLUDED.status,
+            allocated_at = EXCLUDED.allocated_at,
+            opaque_id = EXCLUDED.opaque_id,
+            source = EXCLUDED.source
+        WHERE `+sourceRank("$2", "EXCLUDED.source")+` < `+sourceRank("$2", "ip_ranges_staging.source")+`
+    `, pq.Array(sources), pq.Array(priority))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// CountIPRanges counts the published ranges by source, IP version and
+// country code.
+func (r *PostgresRepository) CountIPRanges(ctx context.Context) ([]model.RangeCount, error) {
+	return r.countRanges(ctx, "ip_ranges")
+}
+
+// CountStagedIPRanges counts the staged ranges like CountIPRanges.
+func (r *PostgresRepository) CountStagedIPRanges(ctx context.Context) ([]model.RangeCount, error) {
+	return r.countRanges(ctx, "ip_ranges_staging")
+}
+
+func (r *PostgresRepository) countRanges(ctx context.Context, table string) ([]model.RangeCount, error) {
+	var counts []model.RangeCount
+	err := r.db.SelectContext(ctx, &counts, `
+        SELECT source, ip_version, country_code, count(*) AS count
+        FROM `+table+`
+        GROUP BY source, ip_version, country_code
+    `)
+	return counts, err
 }
 
-func (r *PostgresRepository) FindCountryForIP(ctx context.Context, ip net.IP) (string, error) {
+// FindStagedConflicts returns up to limit staged ranges that contain a
+// range of another source.
+func (r *PostgresRepository) FindStagedConflicts(ctx context.Context, limit int) ([]model.RangeConflict, error) {
+	var conflicts []model.RangeConflict
+	err := r.db.SelectContext(ctx, &conflicts, `
+        SELECT
+            outer_range.network::text AS network,
+            outer_range.source,
+            outer_range.country_code,
+            inner_range.network::text AS inner_network,
+            inner_range.source AS inner_source,
+            inner_range.country_code AS inner_country_code
+        FROM ip_ranges_staging outer_range
+        JOIN ip_ranges_staging inner_range ON outer_range.network >> inner_range.network
+        WHERE outer_range.source <> inner_range.source
+        ORDER BY outer_range.network, inner_range.network
+        LIMIT $1
+    `, limit)
+	return conflicts, err
+}
+
+// rangeColumns lists the ip_ranges columns read by scanRange.
+const rangeColumns = "id, network, country_code, ip_version, registry, status, allocated_at, opaque_id, source, dataset_version"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRange(row rowScanner, extra ...any) (model.IPRange, error) {
+	var (
+		ipRange     model.IPRange
+		network     string
+		allocatedAt sql.NullTime
+	)
+
+	dest := append(extra,
+		&ipRange.ID,
+		&network,
+		&ipRange.CountryCode,
+		&ipRange.Version,
+		&ipRange.Registry,
+		&ipRange.Status,
+		&allocatedAt,
+		&ipRange.OpaqueID,
+		&ipRange.Source,
+		&ipRange.DatasetVersion)
+	if err := row.Scan(dest...); err != nil {
+		return ipRange, err
+	}
+
+	_, parsed, err := net.ParseCIDR(network)
+	if err != nil {
+		return ipRange, fmt.Errorf("invalid network %q: %w", network, err)
+	}
+	ipRange.Network = *parsed
+	ipRange.AllocatedAt = allocatedAt.Time
+
+	return ipRange, nil
+}
+
+// FindRangeForIP returns the most specific range containing ip, or nil when
+// none does.
+func (r *PostgresRepository) FindRangeForIP(ctx context.Context, ip net.IP) (*model.IPRange, error) {
 	query := `
-        SELECT country_code 
-        FROM ip_ranges 
-        WHERE network >> $1
-        ORDER BY network ASC 
+        SELECT ` + rangeColumns + `
+        FROM ip_ranges
+        WHERE network >>= $1
+        ORDER BY masklen(network) DESC
         LIMIT 1
     `
 
-	var countryCode string
-	err := r.db.GetContext(ctx, &countryCode, query, ip.String())
+	ipRange, err := scanRange(r.db.QueryRowContext(ctx, query, ip.String()))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "ZZ", nil // ZZ for unknown/not found
+			return nil, nil
 		}
 
-		r.logger.Error("failed to find country for IP",
+		r.logger.Error("failed to find range for IP",
 			zap.String("ip", ip.String()),
 			zap.Error(err))
-		return "", err
+		return nil, err
 	}
 
-	return countryCode, nil
+	return &ipRange, nil
 }
 
-func (r *PostgresRepository) ClearIPRanges(ctx context.Context) error {
-	_, err := r.db.ExecContext(ctx, "TRUNCATE TABLE ip_ranges")
-	return err
+// FindRangesForIPs resolves many addresses with a single set-based query.
+// The result is aligned with ips; unknown addresses get nil.
+func (r *PostgresRepository) FindRangesForIPs(ctx context.Context, ips []net.IP) ([]*model.IPRange, error) {
+	query := `
+        SELECT q.ord, m.*
+        FROM unnest($1::inet[]) WITH ORDINALITY AS q(ip, ord)
+        CROSS JOIN LATERAL (
+            SELECT ` + rangeColumns + `
+            FROM ip_ranges
+            WHERE network >>= q.ip
+            ORDER BY masklen(network) DESC
+            LIMIT 1
+        ) m
+    `
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(addrs))
+	if err != nil {
+		r.logger.Error("failed to find ranges for IPs",
+			zap.Int("count", len(ips)),
+			zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	ranges := make([]*model.IPRange, len(ips))
+	for rows.Next() {
+		var ord int
+		ipRange, err := scanRange(rows, &ord)
+		if err != nil {
+			return nil, err
+		}
+		ranges[ord-1] = &ipRange
+	}
+
+	return ranges, rows.Err()
 }
 
-func (r *PostgresRepository) GetRangesCount(ctx context.Context) (int64, error) {
+func (r *PostgresRepository) LoadIPRanges(ctx context.Context) ([]model.IPRange, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+rangeColumns+" FROM ip_ranges")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ranges []model.IPRange
+	for rows.Next() {
+		ipRange, err := scanRange(rows)
+		if err != nil {
+			r.logger.Warn("skipping invalid range", zap.Error(err))
+			continue
+		}
+		ranges = append(ranges, ipRange)
+	}
+
+	return ranges, rows.Err()
+}
+
+func (r *PostgresRepository) GetStagedCount(ctx context.Context) (int64, error) {
 	var count int64
-	err := r.db.GetContext(ctx, &count, "SELECT count(*) FROM ip_ranges LIMIT 1")
+	err := r.db.GetContext(ctx, &count, "SELECT count(*) FROM ip_ranges_staging")
 	return count, err
 }
+
+// datasetChecksum is the MD5 of a table's ranges in network order.
+const datasetChecksum = `md5(coalesce(string_agg(
+    concat_ws('|', network, country_code, registry, status, allocated_at, source),
+    ',' ORDER BY network), ''))`
+
+// diffRanges lists the changes from the ranges of table old to those of
+// table new, both with network, source and country_code columns.
+func diffRanges(old, new string) string {
+	return `
+        SELECT coalesce(n.network, o.network) AS network,
+            coalesce(n.source, o.source) AS source,
+            CASE
+                WHEN o.network IS NULL THEN 'added'
+                WHEN n.network IS NULL THEN 'removed'
+                ELSE 'country_changed'
+            END AS change,
+            coalesce(o.country_code, '') AS old_country_code,
+            coalesce(n.country_code, '') AS new_country_code
+        FROM ` + old + ` o
+        FULL JOIN ` + new + ` n ON n.network = o.network
+        WHERE o.network IS NULL OR n.network IS NULL OR n.country_code <> o.country_code
+    `
+}
+
+// versionRanges selects the ranges of the dataset version in parameter
+// param, from the history or the published dataset.
+func versionRanges(param string) string {
+	return `(
+        SELECT network, source, country_code FROM ip_ranges_history WHERE dataset_version = ` + param + `
+        UNION ALL
+        SELECT network, source, country_code FROM ip_ranges WHERE dataset_version = ` + param + `
+            AND NOT EXISTS (SELECT 1 FROM ip_ranges_history WHERE dataset_version = ` + param + `)
+    )`
+}
+
+// SwapIPRanges publishes the staging table as a new dataset version built
+// from sources and returns its id. base is the published version the staged
+// dataset is based on, zero for none; a different one fails with
+// ErrDatasetChanged so that an instance that lost the update lock cannot
+// overwrite a newer dataset. The changes from the base version are recorded
+// for GetDatasetDiff, and the replaced dataset is kept as
+// ip_ranges_previous for RollbackIPRanges.
+func (r *PostgresRepository) SwapIPRanges(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Serializes swaps until the version is bumped
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE dataset_metadata IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return 0, err
+	}
+	var current int64
+	if err := tx.GetContext(ctx, &current, "SELECT coalesce((SELECT version FROM dataset_metadata), 0)"); err != nil {
+		return 0, err
+	}
+	if current != base {
+		return 0, fmt.Errorf("%w: expected version %d, found %d", ErrDatasetChanged, base, current)
+	}
+
+	var staged int64
+	if err := tx.GetContext(ctx, &staged, "SELECT count(*) FROM ip_ranges_staging"); err != nil {
+		return 0, err
+	}
+	if staged == 0 {
+		return 0, errors.New("refusing to publish empty IP ranges dataset")
+	}
+
+	var version int64
+	err = tx.GetContext(ctx, &version, `
+        INSERT INTO dataset_versions (base_version, ipv4_ranges, ipv6_ranges, checksum)
+        SELECT nullif($1::bigint, 0), count(*) FILTER (WHERE ip_version = 4), count(*) FILTER (WHERE ip_version = 6), `+datasetChecksum+`
+        FROM ip_ranges_staging
+        RETURNING id
+    `, base)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE ip_ranges_staging SET dataset_version = $1", version); err != nil {
+		return 0, err
+	}
+
+	names := make([]string, len(sources))
+	serials := make([]int64, len(sources))
+	checksums := make([]string, len(sources))
+	for i, src := range sources {
+		names[i], serials[i], checksums[i] = src.Name, src.Serial, src.Checksum
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO dataset_version_sources (version, name, serial, checksum, ipv4_ranges, ipv6_ranges)
+        SELECT $1::bigint, s.name, s.serial, s.checksum,
+            count(r.network) FILTER (WHERE r.ip_version = 4),
+            count(r.network) FILTER (WHERE r.ip_version = 6)
+        FROM unnest($2::text[], $3::bigint[], $4::text[]) AS s (name, serial, checksum)
+        LEFT JOIN ip_ranges_staging r ON r.source = s.name
+        GROUP BY s.name, s.serial, s.checksum
+    `, version, pq.Array(names), pq.Array(serials), pq.Array(checksums))
+	if err != nil {
+		return 0, err
+	}
+
+	// The first dataset is all additions, which are not worth recording
+	if base != 0 {
+		_, err = tx.ExecContext(ctx, `
+            INSERT INTO dataset_diffs (version, network, source, change, old_country_code, new_country_code)
+            SELECT $1::bigint, d.* FROM (`+diffRanges("ip_ranges", "ip_ranges_staging")+`) d
+        `, version)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        DROP TABLE IF EXISTS ip_ranges_previous;
+        ALTER TABLE ip_ranges RENAME TO ip_ranges_previous;
+        ALTER TABLE ip_ranges_staging RENAME TO ip_ranges;
+    `)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO dataset_metadata (version, published_at, checked_at, ranges)
+        VALUES ($1, now(), now(), $2)
+        ON CONFLICT (id) DO UPDATE SET
+            version = EXCLUDED.version,
+            published_at = EXCLUDED.published_at,
+            checked_at = EXCLUDED.checked_at,
+            ranges = EXCLUDED.ranges
+    `, version, staged)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, tx.Commit()
+}
+
+// RollbackIPRanges swaps ip_ranges with ip_ranges_previous. Rolling back
+// twice restores the original state.
+func (r *PostgresRepository) RollbackIPRanges(ctx context.Context) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Renaming the tables waits for queries reading them; give up rather
+	// than hold the admin request past its timeout
+	if _, err := tx.ExecContext(ctx, "SET LOCAL lock_timeout = '5s'"); err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, "SELECT to_regclass('ip_ranges_previous') IS NOT NULL"); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoPreviousDataset
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        DROP TABLE IF EXISTS ip_ranges_staging;
+        ALTER TABLE ip_ranges RENAME TO ip_ranges_staging;
+        ALTER TABLE ip_ranges_previous RENAME TO ip_ranges;
+        ALTER TABLE ip_ranges_staging RENAME TO ip_ranges_previous;
+    `)
+	if err != nil {
+		return err
+	}
+
+	// The restored dataset is served under its own version but keeps the
+	// dates of the one it replaces
+	_, err = tx.ExecContext(ctx, `
+        UPDATE dataset_metadata SET
+            version = coalesce((SELECT max(dataset_version) FROM ip_ranges), 0),
+            ranges = (SELECT count(*) FROM ip_ranges)
+    `)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetDatasetInfo returns the published dataset's metadata, or nil when
+// nothing was published yet.
+func (r *PostgresRepository) GetDatasetInfo(ctx context.Context) (*model.DatasetInfo, error) {
+	var info model.DatasetInfo
+	err := r.db.GetContext(ctx, &info, "SELECT version, published_at, checked_at, ranges FROM dataset_metadata")
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ListDatasetVersions returns the latest limit dataset versions, newest
+// first.
+func (r *PostgresRepository) ListDatasetVersions(ctx context.Context, limit int) ([]model.DatasetVersion, error) {
+	var versions []model.DatasetVersion
+	err := r.db.SelectContext(ctx, &versions, `
+        SELECT id, coalesce(base_version, 0) AS base_version, published_at, ipv4_ranges, ipv6_ranges, checksum
+        FROM dataset_versions
+        ORDER BY id DESC
+        LIMIT $1
+    `, limit)
+	if err != nil || len(versions) == 0 {
+		return versions, err
+	}
+
+	ids := make([]int64, len(versions))
+	byID := make(map[int64]*model.DatasetVersion, len(versions))
+	for i := range versions {
+		ids[i] = versions[i].ID
+		byID[ids[i]] = &versions[i]
+		versions[i].Sources = []model.SourceVersion{}
+	}
+
+	var sources []struct {
+		Version int64 `db:"version"`
+		model.SourceVersion
+	}
+	err = r.db.SelectContext(ctx, &sources, `
+        SELECT version, name, serial, checksum, ipv4_ranges, ipv6_ranges
+        FROM dataset_version_sources
+        WHERE version = ANY($1)
+        ORDER BY version, name
+    `, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		byID[src.Version].Sources = append(byID[src.Version].Sources, src.SourceVersion)
+	}
+
+	return versions, nil
+}
+
+// GetDatasetDiff returns the changes between two dataset versions matching
+// q. Without q.From, these are the changes recorded when q.To was published;
+// otherwise the ranges of both versions must still be published or kept in
+// the history.
+func (r *PostgresRepository) GetDatasetDiff(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+	// Both queries see the same datasets
+	tx, err := r.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	diff := &model.DatasetDiff{From: q.From, To: q.To, Sources: []model.SourceDiff{}, Changes: []model.RangeChange{}}
+
+	var changes string
+	var args []any
+	if q.From == 0 {
+		var base sql.NullInt64
+		err := tx.GetContext(ctx, &base, "SELECT base_version FROM dataset_versions WHERE id = $1", q.To)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %d", ErrVersionNotFound, q.To)
+		}
+		if err != nil {
+			return nil, err
+		}
+		diff.From = base.Int64
+
+		changes = "SELECT network, source, change, old_country_code, new_country_code FROM dataset_diffs WHERE version = $1"
+		args = []any{q.To}
+	} else {
+		for _, version := range []int64{q.From, q.To} {
+			var kept bool
+			err := tx.GetContext(ctx, &kept, `
+                SELECT EXISTS (SELECT 1 FROM ip_ranges_history WHERE dataset_version = $1)
+                    OR EXISTS (SELECT 1 FROM ip_ranges WHERE dataset_version = $1)
+            `, version)
+			if err != nil {
+				return nil, err
+			}
+			if !kept {
+				return nil, fmt.Errorf("%w: the ranges of version %d are not kept", ErrVersionNotFound, version)
+			}
+		}
+
+		changes = diffRanges(versionRanges("$1"), versionRanges("$2"))
+		args = []any{q.From, q.To}
+	}
+
+	var filters []string
+	if q.CountryCode != "" {
+		args = append(args, q.CountryCode)
+		filters = append(filters, fmt.Sprintf("$%d IN (old_country_code, new_country_code)", len(args)))
+	}
+	if q.Network != nil {
+		args = append(args, q.Network.String())
+		filters = append(filters, fmt.Sprintf("network && $%d::inet", len(args)))
+	}
+	query := "WITH changes AS (" + changes + ") SELECT %s FROM changes"
+	if len(filters) > 0 {
+		query += " WHERE " + strings.Join(filters, " AND ")
+	}
+
+	err = tx.SelectContext(ctx, &diff.Sources, fmt.Sprintf(query, `source,
+        count(*) FILTER (WHERE change = 'added') AS added,
+        count(*) FILTER (WHERE change = 'removed') AS removed,
+        count(*) FILTER (WHERE change = 'country_changed') AS country_changed`)+" GROUP BY source ORDER BY source", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Limit > 0 {
+		query = fmt.Sprintf(query, "*") + fmt.Sprintf(" ORDER BY network LIMIT $%d", len(args)+1)
+		if err := tx.SelectContext(ctx, &diff.Changes, query, append(args, q.Limit)...); err != nil {
+			return nil, err
+		}
+	}
+
+	var total int64
+	for _, source := range diff.Sources {
+		total += source.Added + source.Removed + source.CountryChanged
+	}
+	diff.Truncated = total > int64(len(diff.Changes))
+
+	return diff, nil
+}
+
+// SaveDatasetHistory copies the ranges of the published version into the
+// history and keeps only the latest keep versions there.
+func (r *PostgresRepository) SaveDatasetHistory(ctx context.Context, version int64, keep int) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if keep > 0 {
+		_, err = tx.ExecContext(ctx, `
+            INSERT INTO ip_ranges_history (`+rangeColumns+`)
+            SELECT `+rangeColumns+`
+            FROM ip_ranges
+            WHERE dataset_version = $1
+              AND NOT EXISTS (SELECT 1 FROM ip_ranges_history WHERE dataset_version = $1)
+        `, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        DELETE FROM ip_ranges_history
+        WHERE dataset_version NOT IN (SELECT id FROM dataset_versions ORDER BY id DESC LIMIT $1)
+    `, keep)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkDatasetChecked records that the published dataset is still current.
+func (r *PostgresRepository) MarkDatasetChecked(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE dataset_metadata SET checked_at = now()")
+	return err
+}
+
+// GetSourceStates returns the recorded state of each RIR source by name.
+func (r *PostgresRepository) GetSourceStates(ctx context.Context) (map[string]model.SourceState, error) {
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT name, location, etag, last_modified, checksum, serial, start_date, end_date, updated_at
+        FROM rir_sources
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]model.SourceState)
+	for rows.Next() {
+		var (
+			state              model.SourceState
+			startDate, endDate sql.NullTime
+		)
+		err := rows.Scan(&state.Name, &state.Location, &state.ETag, &state.LastModified,
+			&state.Checksum, &state.Serial, &startDate, &endDate, &state.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		state.StartDate = startDate.Time
+		state.EndDate = endDate.Time
+		states[state.Name] = state
+	}
+
+	return states, rows.Err()
+}
+
+// SaveSourceStates records the state of the sources of a published dataset.
+func (r *PostgresRepository) SaveSourceStates(ctx context.Context, states []model.SourceState) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, state := range states {
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO rir_sources
+                (name, location, etag, last_modified, checksum, serial, start_date, end_date, updated_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+            ON CONFLICT (name)
+            DO UPDATE SET
+                location = EXCLUDED.location,
+                etag = EXCLUDED.etag,
+                last_modified = EXCLUDED.last_modified,
+                checksum = EXCLUDED.checksum,
+                serial = EXCLUDED.serial,
+                start_date = EXCLUDED.start_date,
+                end_date = EXCLUDED.end_date,
+                updated_at = EXCLUDED.updated_at
+        `, state.Name, state.Location, state.ETag, state.LastModified, state.Checksum,
+			state.Serial, nullDate(state.StartDate), nullDate(state.EndDate), state.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// nullDate stores a zero time as NULL.
+func nullDate(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// ClearSourceStates forgets all source states so the next update reloads
+// every source.
+func (r *PostgresRepository) ClearSourceStates(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM rir_sources")
+	return err
+}
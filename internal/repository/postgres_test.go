@@ -0,0 +1,719 @@
+package repository
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+
+	"ipservice/internal/model"
+	"ipservice/tests/conformance"
+)
+
+// testPostgres connects to the database named by IPSERVICE_TEST_POSTGRES_URL,
+// recreates the public schema and applies the migrations. Tests using it are
+// skipped when the variable is unset. The database is wiped, so never point
+// it at real data.
+func testPostgres(tb testing.TB) *PostgresRepository {
+	url := os.Getenv("IPSERVICE_TEST_POSTGRES_URL")
+	if url == "" {
+		tb.Skip("IPSERVICE_TEST_POSTGRES_URL not set")
+	}
+
+	db, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public;"); err != nil {
+		tb.Fatal(err)
+	}
+
+	migrations, err := filepath.Glob("../../migrations/*.sql")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sort.Strings(migrations)
+	for _, path := range migrations {
+		script, err := os.ReadFile(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := db.Exec(string(script)); err != nil {
+			tb.Fatalf("applying %s: %v", path, err)
+		}
+	}
+
+	return NewPostgresRepository(db, zap.NewNop())
+}
+
+func syntheticRanges(n int) []model.IPRange {
+	ranges := make([]model.IPRange, n)
+	for i := range ranges {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(i)<<8)
+		ranges[i] = model.IPRange{
+			Network:     net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)},
+			CountryCode: "US",
+			Version:     4,
+		}
+	}
+	return ranges
+}
+
+// emitAll streams ranges to SaveIPRanges.
+func emitAll(ranges []model.IPRange) func(emit func(model.IPRange) error) error {
+	return func(emit func(model.IPRange) error) error {
+		for _, ipRange := range ranges {
+			if err := emit(ipRange); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// publishedVersion returns the version of the published dataset, which
+// SwapIPRanges expects.
+func publishedVersion(t *testing.T, repo *PostgresRepository) int64 {
+	t.Helper()
+
+	info, err := repo.GetDatasetInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil {
+		return 0
+	}
+	return info.Version
+}
+
+func TestPostgresRepository_StageAndSwap(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	publish := func(ranges []model.IPRange) {
+		t.Helper()
+		if err := repo.BeginStaging(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveIPRanges(ctx, nil, emitAll(ranges)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := syntheticRanges(10)
+	publish(first)
+
+	// Duplicates are merged with the last occurrence winning
+	second := syntheticRanges(5)
+	second = append(second, second[0])
+	second[5].CountryCode = "DE"
+	publish(second)
+
+	info, err := repo.GetDatasetInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Ranges != 5 {
+		t.Errorf("expected 5 ranges, got %+v", info)
+	}
+
+	ipRange, err := repo.FindRangeForIP(ctx, net.ParseIP("0.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipRange == nil || ipRange.CountryCode != "DE" {
+		t.Errorf("expected DE, got %+v", ipRange)
+	}
+
+	if err := repo.RollbackIPRanges(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := repo.GetDatasetInfo(ctx); info == nil || info.Ranges != 10 {
+		t.Errorf("expected 10 ranges after rollback, got %+v", info)
+	}
+
+	// A failed load stages nothing
+	if err := repo.BeginStaging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SaveIPRanges(ctx, nil, func(emit func(model.IPRange) error) error {
+		if err := emit(first[0]); err != nil {
+			return err
+		}
+		return errors.New("download interrupted")
+	})
+	if err == nil {
+		t.Error("expected load error")
+	}
+	if staged, _ := repo.GetStagedCount(ctx); staged != 0 {
+		t.Errorf("expected nothing staged after failed load, got %d", staged)
+	}
+
+	// An empty staging table is never published
+	if _, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil); err == nil {
+		t.Error("expected error publishing empty dataset")
+	}
+}
+
+func TestPostgresRepository_DatasetInfo(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	info, err := repo.GetDatasetInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != nil {
+		t.Fatalf("expected no dataset, got %+v", info)
+	}
+
+	for _, n := range []int{10, 4} {
+		if err := repo.BeginStaging(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveIPRanges(ctx, nil, emitAll(syntheticRanges(n))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	published, err := repo.GetDatasetInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published == nil || published.Version != 2 || published.Ranges != 4 || published.CheckedAt.Before(published.PublishedAt) {
+		t.Fatalf("unexpected dataset info %+v", published)
+	}
+
+	// An update started from an older version is not published
+	if err := repo.BeginStaging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveIPRanges(ctx, nil, emitAll(syntheticRanges(3))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.SwapIPRanges(ctx, 1, nil); !errors.Is(err, ErrDatasetChanged) {
+		t.Errorf("expected ErrDatasetChanged, got %v", err)
+	}
+
+	if err := repo.MarkDatasetChecked(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checked, _ := repo.GetDatasetInfo(ctx)
+	if !checked.PublishedAt.Equal(published.PublishedAt) || checked.CheckedAt.Before(published.CheckedAt) {
+		t.Errorf("expected only the check time to move, got %+v", checked)
+	}
+
+	if err := repo.RollbackIPRanges(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := repo.GetDatasetInfo(ctx); info.Version != 1 || info.Ranges != 10 {
+		t.Errorf("expected 10 ranges after rollback, got %+v", info)
+	}
+}
+
+func TestPostgresRepository_DatasetVersions(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	publish := func(ranges []model.IPRange, sources []model.SourceVersion) int64 {
+		t.Helper()
+		if err := repo.BeginStaging(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveIPRanges(ctx, nil, emitAll(ranges)); err != nil {
+			t.Fatal(err)
+		}
+		version, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveDatasetHistory(ctx, version, 2); err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+
+	ranges := syntheticRanges(4)
+	for i := range ranges {
+		ranges[i].Source = []string{"ARIN", "RIPE"}[i%2]
+	}
+	sources := []model.SourceVersion{{Name: "ARIN", Serial: 20240101, Checksum: "a1"}, {Name: "RIPE", Serial: 20240101}}
+	first := publish(ranges, sources)
+
+	ranges[0].CountryCode = "CA"
+	sources[0].Serial = 20240102
+	second := publish(ranges, sources)
+
+	published, err := repo.LoadIPRanges(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ipRange := range published {
+		if ipRange.DatasetVersion != second {
+			t.Errorf("expected range tagged with version %d, got %+v", second, ipRange)
+		}
+	}
+
+	versions, err := repo.ListDatasetVersions(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].ID != second || versions[1].ID != first {
+		t.Fatalf("expected versions %d and %d, newest first, got %+v", second, first, versions)
+	}
+	latest := versions[0]
+	if latest.IPv4Ranges != 4 || latest.IPv6Ranges != 0 || latest.Checksum == "" || latest.Checksum == versions[1].Checksum {
+		t.Errorf("unexpected version %+v", latest)
+	}
+	want := []model.SourceVersion{
+		{Name: "ARIN", Serial: 20240102, Checksum: "a1", IPv4Ranges: 2},
+		{Name: "RIPE", Serial: 20240101, IPv4Ranges: 2},
+	}
+	if fmt.Sprint(latest.Sources) != fmt.Sprint(want) {
+		t.Errorf("expected sources %+v, got %+v", want, latest.Sources)
+	}
+
+	// Only the ranges of the latest two versions are kept
+	third := publish(syntheticRanges(1), nil)
+	var history []int64
+	if err := repo.db.SelectContext(ctx, &history, "SELECT DISTINCT dataset_version FROM ip_ranges_history ORDER BY 1"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(history) != fmt.Sprint([]int64{second, third}) {
+		t.Errorf("expected history of versions %d and %d, got %v", second, third, history)
+	}
+}
+
+func TestPostgresRepository_DatasetDiff(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	publish := func(ranges []model.IPRange) int64 {
+		t.Helper()
+		if err := repo.BeginStaging(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveIPRanges(ctx, nil, emitAll(ranges)); err != nil {
+			t.Fatal(err)
+		}
+		version, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveDatasetHistory(ctx, version, 2); err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+
+	ranges := syntheticRanges(5)
+	for i := range ranges {
+		ranges[i].Source = []string{"ARIN", "RIPE"}[i%2]
+	}
+	first := publish(ranges[:4])
+	ranges[2].CountryCode = "CA"
+	second := publish(ranges[1:])
+
+	_, firstBlocks, _ := net.ParseCIDR("0.0.0.0/23")
+	tests := []struct {
+		name          string
+		query         model.DiffQuery
+		expectedFrom  int64
+		expected      []model.RangeChange
+		expectedTotal int64
+	}{
+		{
+			name:         "recorded update",
+			query:        model.DiffQuery{To: second, Limit: 10},
+			expectedFrom: first,
+			expected: []model.RangeChange{
+				{Network: "0.0.0.0/24", Source: "ARIN", Change: model.RangeRemoved, OldCountryCode: "US"},
+				{Network: "0.0.2.0/24", Source: "ARIN", Change: model.RangeCountryChanged, OldCountryCode: "US", NewCountryCode: "CA"},
+				{Network: "0.0.4.0/24", Source: "ARIN", Change: model.RangeAdded, NewCountryCode: "US"},
+			},
+			expectedTotal: 3,
+		},
+		{
+			name:  "first dataset",
+			query: model.DiffQuery{To: first, Limit: 10},
+		},
+		{
+			name:          "by country",
+			query:         model.DiffQuery{From: first, To: second, CountryCode: "CA", Limit: 10},
+			expectedFrom:  first,
+			expected:      []model.RangeChange{{Network: "0.0.2.0/24", Source: "ARIN", Change: model.RangeCountryChanged, OldCountryCode: "US", NewCountryCode: "CA"}},
+			expectedTotal: 1,
+		},
+		{
+			name:          "by network, backwards",
+			query:         model.DiffQuery{From: second, To: first, Network: firstBlocks, Limit: 10},
+			expectedFrom:  second,
+			expected:      []model.RangeChange{{Network: "0.0.0.0/24", Source: "ARIN", Change: model.RangeAdded, NewCountryCode: "US"}},
+			expectedTotal: 1,
+		},
+		{
+			name:          "truncated",
+			query:         model.DiffQuery{To: second, Limit: 1},
+			expectedFrom:  first,
+			expected:      []model.RangeChange{{Network: "0.0.0.0/24", Source: "ARIN", Change: model.RangeRemoved, OldCountryCode: "US"}},
+			expectedTotal: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff, err := repo.GetDatasetDiff(ctx, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff.From != tt.expectedFrom || diff.To != tt.query.To {
+				t.Errorf("expected diff from %d to %d, got %d to %d", tt.expectedFrom, tt.query.To, diff.From, diff.To)
+			}
+			if fmt.Sprint(diff.Changes) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected changes %+v, got %+v", tt.expected, diff.Changes)
+			}
+
+			var total int64
+			for _, source := range diff.Sources {
+				total += source.Added + source.Removed + source.CountryChanged
+			}
+			if total != tt.expectedTotal || diff.Truncated != (tt.expectedTotal > int64(len(tt.expected))) {
+				t.Errorf("expected %d changes in total, got %+v truncated %v", tt.expectedTotal, diff.Sources, diff.Truncated)
+			}
+		})
+	}
+
+	// The ranges of the first version leave the history with the third
+	third := publish(ranges[:1])
+	if _, err := repo.GetDatasetDiff(ctx, model.DiffQuery{From: first, To: third}); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected ErrVersionNotFound, got %v", err)
+	}
+	if _, err := repo.GetDatasetDiff(ctx, model.DiffQuery{To: third + 1}); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected ErrVersionNotFound, got %v", err)
+	}
+}
+
+func TestPostgresRepository_KeepIPRanges(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	ranges := syntheticRanges(6)
+	for i := range ranges {
+		ranges[i].Source = []string{"ARIN", "RIPE", "APNIC"}[i%3]
+	}
+	if err := repo.BeginStaging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveIPRanges(ctx, nil, emitAll(ranges)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// ARIN is reloaded with a range that RIPE published before
+	fresh := []model.IPRange{ranges[0], ranges[1]}
+	fresh[1].Source, fresh[1].CountryCode = "ARIN", "CA"
+	if err := repo.BeginStaging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveIPRanges(ctx, nil, emitAll(fresh)); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := repo.KeepIPRanges(ctx, []string{"RIPE"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept != 1 {
+		t.Errorf("expected 1 kept range, got %d", kept)
+	}
+	if _, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	published, err := repo.LoadIPRanges(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[string]string)
+	for _, ipRange := range published {
+		sources[ipRange.Network.String()] = ipRange.Source + " " + ipRange.CountryCode
+	}
+	expected := map[string]string{
+		"0.0.0.0/24": "ARIN US",
+		"0.0.1.0/24": "ARIN CA",
+		"0.0.4.0/24": "RIPE US",
+	}
+	if len(sources) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, sources)
+	}
+	for network, source := range expected {
+		if sources[network] != source {
+			t.Errorf("%s: expected %s, got %s", network, source, sources[network])
+		}
+	}
+}
+
+func TestPostgresRepository_SourcePriority(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	ranges := syntheticRanges(2)
+	arin := []model.IPRange{ranges[0]}
+	arin[0].Source = "ARIN"
+	ripe := []model.IPRange{ranges[0], ranges[1]}
+	ripe[0].Source, ripe[0].CountryCode = "RIPE", "DE"
+	ripe[1].Source = "RIPE"
+	priority := []string{"ARIN", "RIPE"}
+
+	published := func() map[string]string {
+		t.Helper()
+		if _, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := repo.LoadIPRanges(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources := make(map[string]string)
+		for _, ipRange := range loaded {
+			sources[ipRange.Network.String()] = ipRange.Source + " " + ipRange.CountryCode
+		}
+		return sources
+	}
+
+	// The shared network goes to ARIN whichever source is staged first
+	for _, order := range [][][]model.IPRange{{arin, ripe}, {ripe, arin}} {
+		if err := repo.BeginStaging(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, source := range order {
+			if err := repo.SaveIPRanges(ctx, priority, emitAll(source)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sources := published()
+		if sources["0.0.0.0/24"] != "ARIN US" || sources["0.0.1.0/24"] != "RIPE US" {
+			t.Errorf("expected the shared network to be ARIN's, got %v", sources)
+		}
+	}
+
+	// A kept source is ranked like a saved one
+	if err := repo.BeginStaging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveIPRanges(ctx, priority, emitAll(ripe)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.KeepIPRanges(ctx, []string{"ARIN"}, priority); err != nil {
+		t.Fatal(err)
+	}
+	if sources := published(); sources["0.0.0.0/24"] != "ARIN US" {
+		t.Errorf("expected the kept ARIN range to win, got %v", sources)
+	}
+}
+
+func TestPostgresRepository_GuardrailQueries(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	network := func(cidr string) net.IPNet {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *n
+	}
+	ranges := []model.IPRange{
+		{Network: network("8.0.0.0/8"), CountryCode: "US", Version: 4, Source: "ARIN"},
+		{Network: network("8.8.8.0/24"), CountryCode: "US", Version: 4, Source: "ARIN"},
+		{Network: network("8.8.4.0/24"), CountryCode: "DE", Version: 4, Source: "RIPE"},
+		{Network: network("2001:db8::/32"), CountryCode: "DE", Version: 6, Source: "RIPE"},
+	}
+	if err := repo.BeginStaging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveIPRanges(ctx, nil, emitAll(ranges)); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := repo.CountStagedIPRanges(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byKey := make(map[string]int64)
+	for _, count := range counts {
+		byKey[fmt.Sprintf("%s/%d/%s", count.Source, count.Version, count.CountryCode)] = count.Count
+	}
+	if len(byKey) != 3 || byKey["ARIN/4/US"] != 2 || byKey["RIPE/4/DE"] != 1 || byKey["RIPE/6/DE"] != 1 {
+		t.Errorf("unexpected staged counts %v", byKey)
+	}
+
+	// Nested ranges of the same source are not conflicts
+	conflicts, err := repo.FindStagedConflicts(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("expected 1 conflict, got %+v", conflicts)
+	}
+	if c := conflicts[0]; c.Network != "8.0.0.0/8" || c.Source != "ARIN" || c.InnerNetwork != "8.8.4.0/24" || c.InnerSource != "RIPE" || c.InnerCountryCode != "DE" {
+		t.Errorf("unexpected conflict %+v", c)
+	}
+
+	if _, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil); err != nil {
+		t.Fatal(err)
+	}
+	if counts, err := repo.CountIPRanges(ctx); err != nil || len(counts) != 3 {
+		t.Errorf("expected published counts, got %v %v", counts, err)
+	}
+}
+
+func TestPostgresRepository_SourceStates(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	updated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	arin := model.SourceState{
+		Name:      "ARIN",
+		Location:  "https://example.net/arin",
+		ETag:      `"v1"`,
+		Checksum:  "abc",
+		Serial:    20240501,
+		EndDate:   time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC),
+		UpdatedAt: updated,
+	}
+	ripe := model.SourceState{Name: "RIPE", Location: "file:///data/ripe", LastModified: "Wed, 01 May 2024 00:00:00 GMT", UpdatedAt: updated}
+	if err := repo.SaveSourceStates(ctx, []model.SourceState{arin, ripe}); err != nil {
+		t.Fatal(err)
+	}
+
+	arin.ETag = `"v2"`
+	if err := repo.SaveSourceStates(ctx, []model.SourceState{arin}); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := repo.GetSourceStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected 2 states, got %v", states)
+	}
+	if got := states["ARIN"]; got.ETag != `"v2"` || got.Checksum != "abc" || got.Serial != arin.Serial ||
+		!got.EndDate.Equal(arin.EndDate) || !got.StartDate.IsZero() || !got.UpdatedAt.Equal(updated) {
+		t.Errorf("unexpected ARIN state %+v", got)
+	}
+	if got := states["RIPE"]; got.LastModified != ripe.LastModified || got.Location != ripe.Location {
+		t.Errorf("unexpected RIPE state %+v", got)
+	}
+
+	if err := repo.ClearSourceStates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if states, _ := repo.GetSourceStates(ctx); len(states) != 0 {
+		t.Errorf("expected no states after clear, got %v", states)
+	}
+}
+
+func BenchmarkPostgresRepository_SaveIPRanges(b *testing.B) {
+	repo := testPostgres(b)
+	ctx := context.Background()
+	ranges := syntheticRanges(200000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := repo.BeginStaging(ctx); err != nil {
+			b.Fatal(err)
+		}
+		if err := repo.SaveIPRanges(ctx, nil, emitAll(ranges)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(ranges)*b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// BenchmarkPostgresRepository_InsertBaseline measures the previous
+// row-by-row prepared INSERT loader for comparison.
+func BenchmarkPostgresRepository_InsertBaseline(b *testing.B) {
+	repo := testPostgres(b)
+	ctx := context.Background()
+	ranges := syntheticRanges(200000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := repo.BeginStaging(ctx); err != nil {
+			b.Fatal(err)
+		}
+
+		tx, err := repo.db.BeginTx(ctx, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		stmt, err := tx.PrepareContext(ctx, `
+            INSERT INTO ip_ranges_staging (network, country_code, ip_version)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (network)
+            DO UPDATE SET
+                country_code = EXCLUDED.country_code,
+                ip_version = EXCLUDED.ip_version
+        `)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, ipRange := range ranges {
+			if _, err := stmt.ExecContext(ctx, ipRange.Network.String(), ipRange.CountryCode, ipRange.Version); err != nil {
+				b.Fatal(err)
+			}
+		}
+		stmt.Close()
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(ranges)*b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+func TestPostgresRepository_Conformance(t *testing.T) {
+	repo := testPostgres(t)
+
+	conformance.Run(t, func(t *testing.T, ranges []model.IPRange) conformance.LookupFunc {
+		ctx := context.Background()
+		if err := repo.BeginStaging(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveIPRanges(ctx, nil, emitAll(ranges)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.SwapIPRanges(ctx, publishedVersion(t, repo), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		return func(ctx context.Context, ip net.IP) (string, error) {
+			ipRange, err := repo.FindRangeForIP(ctx, ip)
+			if err != nil || ipRange == nil {
+				return "", err
+			}
+			return ipRange.CountryCode, nil
+		}
+	})
+}
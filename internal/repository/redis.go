@@ -2,9 +2,12 @@ package repository
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"ipservice/internal/lookup"
 	"ipservice/internal/model"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,97 +27,442 @@ func NewRedisRepository(client *redis.Client, logger *zap.Logger) *RedisReposito
 	}
 }
 
-func (r *RedisRepository) SetCountry(ctx context.Context, ip, countryCode string) error {
-	err := r.client.Set(ctx, "ip:"+ip, countryCode, 24*time.Hour).Err()
+// encodeRange serialises the lookup-relevant fields of a range as
+// "<country>|<network>|<registry>|<status>|<YYYYMMDD>|<dataset version>".
+func encodeRange(ipRange model.IPRange) string {
+	var network, date, version string
+	if ipRange.Network.IP != nil {
+		network = ipRange.Network.String()
+	}
+	if !ipRange.AllocatedAt.IsZero() {
+		date = ipRange.AllocatedAt.Format("20060102")
+	}
+	if ipRange.DatasetVersion != 0 {
+		version = strconv.FormatInt(ipRange.DatasetVersion, 10)
+	}
+	return strings.Join([]string{ipRange.CountryCode, network, ipRange.Registry, ipRange.Status, date, version}, "|")
+}
+
+// decodeRange parses a value written by encodeRange. A bare country code, as
+// cached before ranges carried delegation details, and values cached before
+// they carried the dataset version are accepted too.
+func decodeRange(value string) (*model.IPRange, error) {
+	parts := strings.Split(value, "|")
+	ipRange := &model.IPRange{CountryCode: parts[0]}
+	if len(parts) == 1 {
+		return ipRange, nil
+	}
+	if len(parts) != 5 && len(parts) != 6 {
+		return nil, fmt.Errorf("invalid cached range: %q", value)
+	}
+
+	if parts[1] != "" {
+		_, network, err := net.ParseCIDR(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cached network: %w", err)
+		}
+		ipRange.Network = *network
+		ipRange.Version = 6
+		if network.IP.To4() != nil {
+			ipRange.Version = 4
+		}
+	}
+	ipRange.Registry = parts[2]
+	ipRange.Status = parts[3]
+	if parts[4] != "" {
+		date, err := time.Parse("20060102", parts[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cached date: %w", err)
+		}
+		ipRange.AllocatedAt = date
+	}
+	if len(parts) == 6 && parts[5] != "" {
+		version, err := strconv.ParseInt(parts[5], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cached dataset version: %w", err)
+		}
+		ipRange.DatasetVersion = version
+	}
+
+	return ipRange, nil
+}
+
+// ipKey returns the key caching the answer for ip in the given dataset
+// version. Keying by version means publishing or rolling back a dataset
+// never serves an answer cached from another one; entries of replaced
+// versions simply expire.
+func ipKey(version int64, ip string) string {
+	return "ip:" + strconv.FormatInt(version, 10) + ":" + ip
+}
+
+// SetIPRange caches the range that answered a lookup for ip in version.
+func (r *RedisRepository) SetIPRange(ctx context.Context, version int64, ip string, ipRange model.IPRange) error {
+	err := r.client.Set(ctx, ipKey(version, ip), encodeRange(ipRange), 24*time.Hour).Err()
 	if err != nil {
-		r.logger.Error("failed to set country in cache",
+		r.logger.Error("failed to set range in cache",
 			zap.String("ip", ip),
 			zap.Error(err))
 	}
 	return err
 }
 
-func (r *RedisRepository) GetCountry(ctx context.Context, ip string) (string, error) {
-	countryCode, err := r.client.Get(ctx, "ip:"+ip).Result()
+// GetIPRange returns the range cached for ip in version, or nil on a miss.
+func (r *RedisRepository) GetIPRange(ctx context.Context, version int64, ip string) (*model.IPRange, error) {
+	value, err := r.client.Get(ctx, ipKey(version, ip)).Result()
 	if err == redis.Nil {
-		return "", nil
+		return nil, nil
 	}
 	if err != nil {
-		r.logger.Error("failed to get country from cache",
+		r.logger.Error("failed to get range from cache",
 			zap.String("ip", ip),
 			zap.Error(err))
-		return "", err
+		return nil, err
 	}
-	return countryCode, nil
+	return decodeRange(value)
 }
 
-func ipToInt(ip net.IP) uint32 {
-	ip = ip.To4()
-	if ip == nil {
-		return 0
+// GetIPRanges returns the range cached for each address in version, or nil
+// on a miss, using a single pipelined round trip.
+func (r *RedisRepository) GetIPRanges(ctx context.Context, version int64, ips []string) ([]*model.IPRange, error) {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(ips))
+	for i, ip := range ips {
+		cmds[i] = pipe.Get(ctx, ipKey(version, ip))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		r.logger.Error("failed to get ranges from cache",
+			zap.Int("count", len(ips)),
+			zap.Error(err))
+		return nil, err
+	}
+
+	ranges := make([]*model.IPRange, len(ips))
+	for i, cmd := range cmds {
+		value, err := cmd.Result()
+		if err != nil {
+			continue
+		}
+		if ranges[i], err = decodeRange(value); err != nil {
+			r.logger.Warn("ignoring invalid cached range",
+				zap.String("ip", ips[i]),
+				zap.Error(err))
+		}
 	}
-	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	return ranges, nil
 }
 
-func (r *RedisRepository) CacheIPRanges(ctx context.Context, ranges []model.IPRange) error {
+// SetIPRanges caches a range for each address in version in a single
+// pipeline.
+func (r *RedisRepository) SetIPRanges(ctx context.Context, version int64, ranges map[string]model.IPRange) error {
 	pipe := r.client.Pipeline()
+	for ip, ipRange := range ranges {
+		pipe.Set(ctx, ipKey(version, ip), encodeRange(ipRange), 24*time.Hour)
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		r.logger.Error("failed to set ranges in cache",
+			zap.Int("count", len(ranges)),
+			zap.Error(err))
+	}
+	return err
+}
 
-	// Clear existing data
-	pipe.Del(ctx, "ipranges")
+const (
+	rangesKeyV4 = "ipranges:v4"
+	rangesKeyV6 = "ipranges:v6"
+)
 
-	// Store ranges sorted by start IP
-	for _, ipRange := range ranges {
-		startIP := ipToInt(ipRange.Network.IP)
-		// Store as: startIP countryCode|mask
-		pipe.ZAdd(ctx, "ipranges", redis.Z{
-			Score:  float64(startIP),
-			Member: fmt.Sprintf("%s|%s", ipRange.CountryCode, ipRange.Network.Mask.String()),
-		})
+// rangeKey returns the sorted set holding ranges of the address family of ip
+// and the fixed-width hex form of ip used to order its members. IPv4-mapped
+// IPv6 addresses are treated as IPv4.
+func rangeKey(ip net.IP) (string, string, bool) {
+	if v4 := ip.To4(); v4 != nil {
+		return rangesKeyV4, hex.EncodeToString(v4), true
+	}
+	if v6 := ip.To16(); v6 != nil {
+		return rangesKeyV6, hex.EncodeToString(v6), true
 	}
+	return "", "", false
+}
 
-	pipe.Expire(ctx, "ipranges", 24*time.Hour)
+// encodeRangeMember encodes a flattened interval as
+// "<hex start>|<hex end>|<range>", with the range encoded by encodeRange.
+// All members share the same score so the set is ordered lexicographically,
+// which for fixed-width hex matches numeric order of the start address.
+// Intervals never overlap, so the member with the greatest start at or below
+// an address is the only candidate containing it.
+func encodeRangeMember(interval lookup.Interval) (string, string, error) {
+	key, start, ok := rangeKey(interval.Start)
+	if !ok {
+		return "", "", fmt.Errorf("invalid interval start: %v", interval.Start)
+	}
 
-	_, err := pipe.Exec(ctx)
+	endKey, end, ok := rangeKey(interval.End)
+	if !ok || endKey != key {
+		return "", "", fmt.Errorf("invalid interval end: %v", interval.End)
+	}
+
+	return key, start + "|" + end + "|" + encodeRange(interval.Range), nil
+}
+
+func decodeRangeMember(member string) (string, string, *model.IPRange, error) {
+	parts := strings.SplitN(member, "|", 3)
+	if len(parts) != 3 {
+		return "", "", nil, fmt.Errorf("invalid range format")
+	}
+
+	for _, bound := range parts[:2] {
+		if _, err := hex.DecodeString(bound); err != nil || (len(bound) != 2*net.IPv4len && len(bound) != 2*net.IPv6len) {
+			return "", "", nil, fmt.Errorf("invalid range bound: %s", bound)
+		}
+	}
+	if len(parts[0]) != len(parts[1]) {
+		return "", "", nil, fmt.Errorf("mismatched range bounds")
+	}
+
+	ipRange, err := decodeRange(parts[2])
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return parts[0], parts[1], ipRange, nil
+}
+
+// cacheBatchSize is how many members are sent per pipeline while building
+// the range cache, which bounds the memory held by buffered commands.
+const cacheBatchSize = 10000
+
+// CacheIPRanges builds the range sets from the flattened intervals of table
+// under staging keys and then renames them over the live keys in a single
+// transaction, so readers never observe a partially built cache. Using the
+// flattened intervals makes the cache answer with the most specific range,
+// like the other lookup tiers. The sets do not expire: updates that find
+// nothing changed leave them in place, and each publish replaces them.
+func (r *RedisRepository) CacheIPRanges(ctx context.Context, table *lookup.Table) error {
+	staging := map[string]string{
+		rangesKeyV4: rangesKeyV4 + ":staging",
+		rangesKeyV6: rangesKeyV6 + ":staging",
+	}
+	populated := make(map[string]bool)
+
+	if err := r.client.Del(ctx, staging[rangesKeyV4], staging[rangesKeyV6]).Err(); err != nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	err := table.EachInterval(func(interval lookup.Interval) error {
+		key, member, err := encodeRangeMember(interval)
+		if err != nil {
+			r.logger.Warn("skipping range in cache",
+				zap.String("network", interval.Range.Network.String()),
+				zap.Error(err))
+			return nil
+		}
+		pipe.ZAdd(ctx, staging[key], redis.Z{Score: 0, Member: member})
+		populated[key] = true
+
+		if pipe.Len() >= cacheBatchSize {
+			_, err := pipe.Exec(ctx)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	tx := r.client.TxPipeline()
+	for key, stagingKey := range staging {
+		if !populated[key] {
+			tx.Del(ctx, key)
+			continue
+		}
+		tx.Rename(ctx, stagingKey, key)
+	}
+
+	_, err = tx.Exec(ctx)
 	return err
 }
 
-func (r *RedisRepository) GetCachedRange(ctx context.Context, ip net.IP) (string, error) {
-	ipInt := ipToInt(ip)
+// GetCachedRange returns the most specific cached range containing ip, or
+// nil when there is none.
+func (r *RedisRepository) GetCachedRange(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+	key, start, ok := rangeKey(ip)
+	if !ok {
+		return nil, fmt.Errorf("invalid IP address: %v", ip)
+	}
 
-	// Find the largest range start that's less than or equal to our IP
-	ranges, err := r.client.ZRevRangeByScore(ctx, "ipranges", &redis.ZRangeBy{
-		Min:    "0",
-		Max:    fmt.Sprintf("%d", ipInt),
+	// Find the member with the largest start that's less than or equal to our IP.
+	// '~' sorts after every character used in the member suffix.
+	ranges, err := r.client.ZRevRangeByLex(ctx, key, &redis.ZRangeBy{
+		Min:    "-",
+		Max:    "[" + start + "|~",
 		Offset: 0,
 		Count:  1,
 	}).Result()
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(ranges) == 0 {
-		return "", nil
+		return nil, nil
 	}
 
-	// Parse the stored range
-	parts := strings.Split(ranges[0], "|")
-	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid range format")
+	_, end, ipRange, err := decodeRangeMember(ranges[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if start <= end {
+		return ipRange, nil
+	}
+
+	return nil, nil
+}
+
+// encodeASN serialises a delegation as
+// "<first>|<last>|<country>|<registry>|<status>|<YYYYMMDD>".
+func encodeASN(delegation model.ASNDelegation) string {
+	var date string
+	if !delegation.AllocatedAt.IsZero() {
+		date = delegation.AllocatedAt.Format("20060102")
 	}
+	return strings.Join([]string{
+		strconv.FormatUint(uint64(delegation.FirstASN), 10),
+		strconv.FormatUint(uint64(delegation.LastASN), 10),
+		delegation.CountryCode,
+		delegation.Registry,
+		delegation.Status,
+		date,
+	}, "|")
+}
 
-	countryCode := parts[0]
-	mask := parts[1]
+// decodeASN parses a value written by encodeASN.
+func decodeASN(value string) (*model.ASNDelegation, error) {
+	parts := strings.Split(value, "|")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("invalid cached ASN delegation: %q", value)
+	}
 
-	// Verify IP is in range
-	_, network, err := net.ParseCIDR(fmt.Sprintf("%s/%s", ip.String(), mask))
+	first, err := strconv.ParseUint(parts[0], 10, 32)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("invalid cached AS number: %w", err)
 	}
+	last, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || last < first {
+		return nil, fmt.Errorf("invalid cached AS number range: %q", value)
+	}
+
+	delegation := &model.ASNDelegation{
+		FirstASN:    uint32(first),
+		LastASN:     uint32(last),
+		CountryCode: parts[2],
+		Registry:    parts[3],
+		Status:      parts[4],
+	}
+	if parts[5] != "" {
+		date, err := time.Parse("20060102", parts[5])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cached date: %w", err)
+		}
+		delegation.AllocatedAt = date
+	}
+	return delegation, nil
+}
 
-	if network.Contains(ip) {
-		return countryCode, nil
+func asnKey(asn uint32) string {
+	return "asn:" + strconv.FormatUint(uint64(asn), 10)
+}
+
+// SetASN caches the delegation that answered a lookup for asn.
+func (r *RedisRepository) SetASN(ctx context.Context, asn uint32, delegation model.ASNDelegation) error {
+	err := r.client.Set(ctx, asnKey(asn), encodeASN(delegation), 24*time.Hour).Err()
+	if err != nil {
+		r.logger.Error("failed to set ASN delegation in cache",
+			zap.Uint32("asn", asn),
+			zap.Error(err))
 	}
+	return err
+}
 
-	return "", nil
+// GetASN returns the cached delegation for asn, or nil on a miss.
+func (r *RedisRepository) GetASN(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+	value, err := r.client.Get(ctx, asnKey(asn)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		r.logger.Error("failed to get ASN delegation from cache",
+			zap.Uint32("asn", asn),
+			zap.Error(err))
+		return nil, err
+	}
+	return decodeASN(value)
+}
+
+const asnRangesKey = "asnranges"
+
+// CacheASNDelegations builds the sorted set of the delegations of table,
+// scored by their first AS number, under a staging key and renames it over
+// the live key, like CacheIPRanges. It does not expire either.
+func (r *RedisRepository) CacheASNDelegations(ctx context.Context, table *lookup.ASNTable) error {
+	stagingKey := asnRangesKey + ":staging"
+	if err := r.client.Del(ctx, stagingKey).Err(); err != nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	for _, delegation := range table.Delegations() {
+		pipe.ZAdd(ctx, stagingKey, redis.Z{Score: float64(delegation.FirstASN), Member: encodeASN(delegation)})
+		if pipe.Len() >= cacheBatchSize {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	tx := r.client.TxPipeline()
+	if table.Len() == 0 {
+		tx.Del(ctx, asnRangesKey)
+	} else {
+		tx.Rename(ctx, stagingKey, asnRangesKey)
+	}
+	_, err := tx.Exec(ctx)
+	return err
+}
+
+// GetCachedASN returns the cached delegation containing asn, or nil when
+// there is none. Delegations in the set start at distinct AS numbers, so the
+// one with the greatest start at or below asn is the only candidate.
+func (r *RedisRepository) GetCachedASN(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+	members, err := r.client.ZRevRangeByScore(ctx, asnRangesKey, &redis.ZRangeBy{
+		Min:    "-inf",
+		Max:    strconv.FormatUint(uint64(asn), 10),
+		Offset: 0,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	delegation, err := decodeASN(members[0])
+	if err != nil {
+		return nil, err
+	}
+	if delegation.LastASN < asn {
+		return nil, nil
+	}
+	return delegation, nil
 }
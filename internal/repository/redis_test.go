@@ -0,0 +1,304 @@
+package repository
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	"ipservice/internal/lookup"
+	"ipservice/internal/model"
+	"ipservice/tests/conformance"
+)
+
+// testRedis connects to the Redis database named by IPSERVICE_TEST_REDIS_URL
+// and flushes it. Tests using it are skipped when the variable is unset.
+func testRedis(tb testing.TB) *RedisRepository {
+	url := os.Getenv("IPSERVICE_TEST_REDIS_URL")
+	if url == "" {
+		tb.Skip("IPSERVICE_TEST_REDIS_URL not set")
+	}
+
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	client := redis.NewClient(opt)
+	tb.Cleanup(func() { client.Close() })
+
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		tb.Fatal(err)
+	}
+
+	return NewRedisRepository(client, zap.NewNop())
+}
+
+func TestRangeKey(t *testing.T) {
+	tests := []struct {
+		ip          string
+		expectedKey string
+		expectedHex string
+	}{
+		{ip: "8.8.8.8", expectedKey: rangesKeyV4, expectedHex: "08080808"},
+		{ip: "::ffff:8.8.8.8", expectedKey: rangesKeyV4, expectedHex: "08080808"},
+		{ip: "2001:db8::1", expectedKey: rangesKeyV6, expectedHex: "20010db8000000000000000000000001"},
+		{ip: "::1", expectedKey: rangesKeyV6, expectedHex: "00000000000000000000000000000001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			key, start, ok := rangeKey(net.ParseIP(tt.ip))
+			if !ok {
+				t.Fatal("expected valid key")
+			}
+			if key != tt.expectedKey || start != tt.expectedHex {
+				t.Errorf("expected %s %s, got %s %s", tt.expectedKey, tt.expectedHex, key, start)
+			}
+		})
+	}
+
+	if _, _, ok := rangeKey(nil); ok {
+		t.Error("expected nil IP to be rejected")
+	}
+}
+
+func TestRangeMemberRoundTrip(t *testing.T) {
+	tests := []struct {
+		start       string
+		end         string
+		expectedKey string
+		member      string
+	}{
+		{
+			start:       "192.0.2.0",
+			end:         "192.0.2.255",
+			expectedKey: rangesKeyV4,
+			member:      "c0000200|c00002ff|US|||||",
+		},
+		{
+			start:       "::ffff:10.0.0.0",
+			end:         "::ffff:10.255.255.255",
+			expectedKey: rangesKeyV4,
+			member:      "0a000000|0affffff|US|||||",
+		},
+		{
+			start:       "2001:db8::",
+			end:         "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff",
+			expectedKey: rangesKeyV6,
+			member:      "20010db8000000000000000000000000|20010db8ffffffffffffffffffffffff|US|||||",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.start, func(t *testing.T) {
+			key, member, err := encodeRangeMember(lookup.Interval{
+				Start: net.ParseIP(tt.start),
+				End:   net.ParseIP(tt.end),
+				Range: model.IPRange{CountryCode: "US"},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if key != tt.expectedKey || member != tt.member {
+				t.Errorf("expected %s %s, got %s %s", tt.expectedKey, tt.member, key, member)
+			}
+
+			_, _, ipRange, err := decodeRangeMember(member)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ipRange.CountryCode != "US" {
+				t.Errorf("expected US, got %s", ipRange.CountryCode)
+			}
+		})
+	}
+}
+
+func TestEncodeRangeMember_MixedFamilies(t *testing.T) {
+	_, _, err := encodeRangeMember(lookup.Interval{
+		Start: net.ParseIP("10.0.0.0"),
+		End:   net.ParseIP("2001:db8::"),
+	})
+	if err == nil {
+		t.Error("expected error for interval spanning address families")
+	}
+}
+
+func TestDecodeRangeMember_Invalid(t *testing.T) {
+	for _, member := range []string{"", "US|ffffff00", "zz|0a0000ff|US", "0a000000|0a00|US", "0a000000|20010db8000000000000000000000000|US"} {
+		if _, _, _, err := decodeRangeMember(member); err == nil {
+			t.Errorf("expected error for %q", member)
+		}
+	}
+}
+
+func TestRangeEncoding(t *testing.T) {
+	_, network, _ := net.ParseCIDR("2001:db8::/32")
+	ipRange := model.IPRange{
+		Network:     *network,
+		CountryCode: "DE",
+		Version:     6,
+		Registry:    "ripencc",
+		Status:      "allocated",
+		AllocatedAt: time.Date(2004, 7, 1, 0, 0, 0, 0, time.UTC),
+
+		DatasetVersion: 42,
+	}
+
+	encoded := encodeRange(ipRange)
+	if encoded != "DE|2001:db8::/32|ripencc|allocated|20040701|42" {
+		t.Errorf("unexpected encoding %q", encoded)
+	}
+
+	decoded, err := decodeRange(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded.Network.String() != ipRange.Network.String() ||
+		decoded.CountryCode != ipRange.CountryCode ||
+		decoded.Version != ipRange.Version ||
+		decoded.Registry != ipRange.Registry ||
+		decoded.Status != ipRange.Status ||
+		!decoded.AllocatedAt.Equal(ipRange.AllocatedAt) ||
+		decoded.DatasetVersion != ipRange.DatasetVersion {
+		t.Errorf("expected %+v, got %+v", ipRange, *decoded)
+	}
+
+	// Values cached before ranges carried details hold only a country code
+	legacy, err := decodeRange("US")
+	if err != nil || legacy.CountryCode != "US" {
+		t.Errorf("expected legacy value to decode, got %+v, %v", legacy, err)
+	}
+
+	// Values cached before ranges carried the dataset version
+	if older, err := decodeRange("DE|2001:db8::/32|ripencc|allocated|20040701"); err != nil || older.DatasetVersion != 0 {
+		t.Errorf("expected value without version to decode, got %+v, %v", older, err)
+	}
+
+	for _, value := range []string{"US|x", "US|bad|arin|allocated|", "US||arin|allocated|2004", "US||arin|allocated||v1"} {
+		if _, err := decodeRange(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestRedisRepository_Conformance(t *testing.T) {
+	repo := testRedis(t)
+
+	conformance.Run(t, func(t *testing.T, ranges []model.IPRange) conformance.LookupFunc {
+		if err := repo.CacheIPRanges(context.Background(), lookup.NewTable(ranges)); err != nil {
+			t.Fatal(err)
+		}
+		return func(ctx context.Context, ip net.IP) (string, error) {
+			ipRange, err := repo.GetCachedRange(ctx, ip)
+			if err != nil || ipRange == nil {
+				return "", err
+			}
+			return ipRange.CountryCode, nil
+		}
+	})
+}
+
+func TestASNEncoding(t *testing.T) {
+	delegation := model.ASNDelegation{
+		FirstASN:    4200000000,
+		LastASN:     4294967294,
+		CountryCode: "ZZ",
+		Registry:    "iana",
+		Status:      "assigned",
+		AllocatedAt: time.Date(2009, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	encoded := encodeASN(delegation)
+	if encoded != "4200000000|4294967294|ZZ|iana|assigned|20090501" {
+		t.Errorf("unexpected encoding %q", encoded)
+	}
+
+	decoded, err := decodeASN(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *decoded != delegation {
+		t.Errorf("expected %+v, got %+v", delegation, *decoded)
+	}
+
+	for _, value := range []string{"US", "x|1|US|arin|allocated|", "2|1|US|arin|allocated|", "1|4294967296|US|arin|allocated|", "1|1|US|arin|allocated|2004"} {
+		if _, err := decodeASN(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestRedisRepository_ASN(t *testing.T) {
+	repo := testRedis(t)
+	ctx := context.Background()
+
+	table := lookup.NewASNTable([]model.ASNDelegation{
+		{FirstASN: 701, LastASN: 705, CountryCode: "US", Registry: "arin", Status: "allocated"},
+		{FirstASN: 3333, LastASN: 3333, CountryCode: "NL", Registry: "ripencc", Status: "assigned"},
+	})
+	if err := repo.CacheASNDelegations(ctx, table); err != nil {
+		t.Fatal(err)
+	}
+
+	for asn, want := range map[uint32]string{700: "", 701: "US", 705: "US", 706: "", 3333: "NL", 3334: ""} {
+		delegation, err := repo.GetCachedASN(ctx, asn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if delegation != nil {
+			got = delegation.CountryCode
+		}
+		if got != want {
+			t.Errorf("AS%d: expected %q, got %q", asn, want, got)
+		}
+	}
+
+	if cached, err := repo.GetASN(ctx, 3333); err != nil || cached != nil {
+		t.Errorf("expected a miss, got %+v %v", cached, err)
+	}
+	if err := repo.SetASN(ctx, 3333, table.Delegations()[1]); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := repo.GetASN(ctx, 3333); err != nil || cached == nil || cached.Registry != "ripencc" {
+		t.Errorf("expected the cached delegation, got %+v %v", cached, err)
+	}
+}
+
+func TestRedisRepository_IPRangeVersions(t *testing.T) {
+	repo := testRedis(t)
+	ctx := context.Background()
+
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	old := model.IPRange{Network: *network, CountryCode: "US", Version: 4, DatasetVersion: 1}
+	if err := repo.SetIPRange(ctx, 1, "192.0.2.1", old); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetIPRanges(ctx, 1, map[string]model.IPRange{"192.0.2.2": old}); err != nil {
+		t.Fatal(err)
+	}
+
+	if cached, err := repo.GetIPRange(ctx, 1, "192.0.2.1"); err != nil || cached == nil || cached.CountryCode != "US" {
+		t.Fatalf("expected the cached range in version 1, got %+v %v", cached, err)
+	}
+
+	// After version 2 is published, or a rollback to version 0, answers
+	// cached for version 1 are not served
+	for _, version := range []int64{2, 0} {
+		if cached, err := repo.GetIPRange(ctx, version, "192.0.2.1"); err != nil || cached != nil {
+			t.Errorf("version %d: expected a miss, got %+v %v", version, cached, err)
+		}
+		cached, err := repo.GetIPRanges(ctx, version, []string{"192.0.2.1", "192.0.2.2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached[0] != nil || cached[1] != nil {
+			t.Errorf("version %d: expected batch misses, got %+v", version, cached)
+		}
+	}
+}
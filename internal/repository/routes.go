@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+
+	"ipservice/internal/model"
+)
+
+// ReplaceRoutes replaces all routes with those load passes to emit, from
+// the RIB dumps at files. A prefix seen with several origins is attributed
+// to the one the most peers see across the files, the lowest AS number on
+// a tie.
+func (r *PostgresRepository) ReplaceRoutes(ctx context.Context, files []string, load func(emit func(model.Route) error) error) (*model.RouteImport, error) {
+	startTime := time.Now()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+        CREATE TEMP TABLE bgp_routes_load (
+            network CIDR NOT NULL,
+            origin_asn BIGINT NOT NULL,
+            peers INT NOT NULL
+        ) ON COMMIT DROP
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("bgp_routes_load", "network", "origin_asn", "peers"))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	err = load(func(route model.Route) error {
+		_, err := stmt.ExecContext(ctx, route.Prefix.String(), int64(route.OriginASN), route.Peers)
+		if err != nil {
+			r.logger.Error("failed to copy route",
+				zap.String("prefix", route.Prefix.String()),
+				zap.Error(err))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := stmt.Close(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM bgp_routes"); err != nil {
+		return nil, err
+	}
+	saved, err := tx.ExecContext(ctx, `
+        INSERT INTO bgp_routes (network, origin_asn)
+        SELECT DISTINCT ON (network) network, origin_asn
+        FROM (
+            SELECT network, origin_asn, sum(peers) AS peers
+            FROM bgp_routes_load
+            GROUP BY network, origin_asn
+        ) o
+        ORDER BY network, peers DESC, origin_asn
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &model.RouteImport{Files: files}
+	if result.Routes, err = saved.RowsAffected(); err != nil {
+		return nil, err
+	}
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO bgp_route_imports (files, routes) VALUES ($1, $2) RETURNING id, imported_at",
+		pq.Array(files), result.Routes).Scan(&result.ID, &result.ImportedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	r.logger.Info("Replaced BGP routes",
+		zap.Int64("import", result.ID),
+		zap.Int64("routes", result.Routes),
+		zap.Duration("duration", time.Since(startTime)))
+
+	return result, nil
+}
+
+// LatestRouteImport describes the import the routes come from, or returns
+// nil when none was imported.
+func (r *PostgresRepository) LatestRouteImport(ctx context.Context) (*model.RouteImport, error) {
+	var result model.RouteImport
+	err := r.db.QueryRowContext(ctx,
+		"SELECT id, imported_at, files, routes FROM bgp_route_imports ORDER BY id DESC LIMIT 1").
+		Scan(&result.ID, &result.ImportedAt, pq.Array(&result.Files), &result.Routes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// LoadRoutes returns all routes.
+func (r *PostgresRepository) LoadRoutes(ctx context.Context) ([]model.Route, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT network, origin_asn FROM bgp_routes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var routes []model.Route
+	for rows.Next() {
+		var (
+			route   model.Route
+			network string
+		)
+		if err := rows.Scan(&network, &route.OriginASN); err != nil {
+			return nil, err
+		}
+		_, parsed, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		route.Prefix = *parsed
+		routes = append(routes, route)
+	}
+
+	return routes, rows.Err()
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"ipservice/internal/model"
+)
+
+func TestPostgresRepository_Routes(t *testing.T) {
+	repo := testPostgres(t)
+	ctx := context.Background()
+
+	if latest, err := repo.LatestRouteImport(ctx); err != nil || latest != nil {
+		t.Fatalf("expected no import, got %+v %v", latest, err)
+	}
+
+	route := func(cidr string, asn uint32, peers int) model.Route {
+		_, network, _ := net.ParseCIDR(cidr)
+		return model.Route{Prefix: *network, OriginASN: asn, Peers: peers}
+	}
+	replace := func(files []string, routes ...model.Route) *model.RouteImport {
+		t.Helper()
+		result, err := repo.ReplaceRoutes(ctx, files, func(emit func(model.Route) error) error {
+			for _, route := range routes {
+				if err := emit(route); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	replace([]string{"old.mrt"}, route("10.0.0.0/8", 64496, 1))
+	result := replace([]string{"rrc00.mrt", "route-views2.mrt"},
+		route("8.8.8.0/24", 15169, 1),
+		route("8.8.8.0/24", 64496, 2),
+		route("193.0.0.0/21", 64511, 1), // tie, the lowest wins
+		route("193.0.0.0/21", 3333, 1),
+		route("2001:4860::/32", 15169, 1),
+		route("8.8.8.0/24", 15169, 2), // from the second file, 3 peers in all
+	)
+	if result.Routes != 3 {
+		t.Errorf("expected 3 routes, got %d", result.Routes)
+	}
+
+	latest, err := repo.LatestRouteImport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.ID != result.ID || latest.Routes != 3 || !reflect.DeepEqual(latest.Files, result.Files) {
+		t.Errorf("expected %+v, got %+v", result, latest)
+	}
+
+	routes, err := repo.LoadRoutes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := make(map[string]uint32)
+	for _, route := range routes {
+		origins[route.Prefix.String()] = route.OriginASN
+	}
+	want := map[string]uint32{"8.8.8.0/24": 15169, "193.0.0.0/21": 3333, "2001:4860::/32": 15169}
+	if !reflect.DeepEqual(origins, want) {
+		t.Errorf("expected %v, got %v", want, origins)
+	}
+}
@@ -0,0 +1,205 @@
+// Package schedule parses update schedules: fixed intervals such as "24h"
+// and standard five-field cron specs such as "30 3 * * *".
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the first activation after t.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// Interval activates at a fixed period after the previous activation.
+type Interval time.Duration
+
+func (i Interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+// descriptors are the cron shorthands accepted in place of five fields.
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse returns the schedule for spec, which is either a duration accepted
+// by time.ParseDuration or a cron spec evaluated in loc: minute, hour, day
+// of month, month and day of week, each a "*", a value, a range or a list,
+// optionally with a "/step", or one of the @daily style shorthands.
+func Parse(spec string, loc *time.Location) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, errors.New("empty schedule")
+	}
+
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("interval %s must be positive", d)
+		}
+		return Interval(d), nil
+	}
+
+	if expanded, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+	return parseCron(spec, loc)
+}
+
+// field is a set of allowed values as a bit mask.
+type field uint64
+
+func (f field) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+type bounds struct {
+	name     string
+	min, max int
+	names    []string // names[i] stands for min+i
+}
+
+var (
+	minutes  = bounds{name: "minute", min: 0, max: 59}
+	hours    = bounds{name: "hour", min: 0, max: 23}
+	days     = bounds{name: "day of month", min: 1, max: 31}
+	months   = bounds{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	weekdays = bounds{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+type cron struct {
+	minute, hour, dom, month, dow field
+	// A restricted day of month or day of week matches either, as in cron
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+func parseCron(spec string, loc *time.Location) (*cron, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q must have 5 fields, got %d", spec, len(fields))
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	c := &cron{loc: loc, domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	for i, b := range []struct {
+		dst *field
+		bounds
+	}{
+		{&c.minute, minutes},
+		{&c.hour, hours},
+		{&c.dom, days},
+		{&c.month, months},
+		{&c.dow, weekdays},
+	} {
+		if *b.dst, err = parseField(fields[i], b.bounds); err != nil {
+			return nil, fmt.Errorf("cron spec %q: %w", spec, err)
+		}
+	}
+
+	// 7 is another name for Sunday
+	if c.dow.has(7) {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func parseField(s string, b bounds) (field, error) {
+	var f field
+	for _, item := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("%s: invalid step %q", b.name, stepStr)
+			}
+		}
+
+		lo, hi := b.min, b.max
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = b.value(first); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = b.value(last); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = b.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("%s: range %q ends before it starts", b.name, rng)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+func (b bounds) value(s string) (int, error) {
+	for i, name := range b.names {
+		if strings.EqualFold(s, name) {
+			return b.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < b.min || v > b.max {
+		return 0, fmt.Errorf("%s: %q is not between %d and %d", b.name, s, b.min, b.max)
+	}
+	return v, nil
+}
+
+// searchYears bounds the search for specs that can never match, such as
+// February 30th.
+const searchYears = 5
+
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(searchYears, 0, 0)
+
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		switch {
+		case !c.month.has(int(month)):
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, c.loc)
+		case !c.hour.has(t.Hour()):
+			t = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, c.loc)
+		case !c.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom, dow := c.dom.has(t.Day()), c.dow.has(int(t.Weekday()))
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,138 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse_Next(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("loading time zone: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		loc  *time.Location
+		from string
+		want []string
+	}{
+		{
+			name: "interval",
+			spec: "6h",
+			from: "2024-05-01T10:17:00Z",
+			want: []string{"2024-05-01T16:17:00Z", "2024-05-01T22:17:00Z"},
+		},
+		{
+			name: "daily",
+			spec: "30 3 * * *",
+			from: "2024-05-01T03:30:00Z",
+			want: []string{"2024-05-02T03:30:00Z", "2024-05-03T03:30:00Z"},
+		},
+		{
+			name: "steps and lists",
+			spec: "*/20 1,13 * * *",
+			from: "2024-05-01T01:50:00Z",
+			want: []string{"2024-05-01T13:00:00Z", "2024-05-01T13:20:00Z", "2024-05-01T13:40:00Z", "2024-05-02T01:00:00Z"},
+		},
+		{
+			name: "weekdays by name",
+			spec: "0 6 * * mon-fri",
+			from: "2024-05-03T07:00:00Z", // Friday
+			want: []string{"2024-05-06T06:00:00Z", "2024-05-07T06:00:00Z"},
+		},
+		{
+			name: "sunday as 7",
+			spec: "0 0 * * 7",
+			from: "2024-05-01T00:00:00Z",
+			want: []string{"2024-05-05T00:00:00Z", "2024-05-12T00:00:00Z"},
+		},
+		{
+			name: "day of month or day of week",
+			spec: "0 0 15 * 1",
+			from: "2024-05-10T00:00:00Z",
+			want: []string{"2024-05-13T00:00:00Z", "2024-05-15T00:00:00Z", "2024-05-20T00:00:00Z"},
+		},
+		{
+			name: "shorthand",
+			spec: "@monthly",
+			from: "2024-01-31T12:00:00Z",
+			want: []string{"2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z"},
+		},
+		{
+			name: "leap day",
+			spec: "0 12 29 2 *",
+			from: "2024-03-01T00:00:00Z",
+			want: []string{"2028-02-29T12:00:00Z"},
+		},
+		{
+			name: "time zone",
+			spec: "0 3 * * *",
+			loc:  berlin,
+			from: "2024-03-30T12:00:00Z",
+			// Clocks move forward on March 31st
+			want: []string{"2024-03-31T01:00:00Z", "2024-04-01T01:00:00Z"},
+		},
+		{
+			name: "skipped hour",
+			spec: "30 2 * * *",
+			loc:  berlin,
+			from: "2024-03-30T12:00:00Z",
+			// 02:30 does not exist on March 31st
+			want: []string{"2024-04-01T00:30:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched, err := Parse(tt.spec, tt.loc)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			next, err := time.Parse(time.RFC3339, tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				next = sched.Next(next)
+				if got := next.UTC().Format(time.RFC3339); got != want {
+					t.Fatalf("expected %s, got %s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParse_Never(t *testing.T) {
+	sched, err := Parse("0 0 30 2 *", time.UTC)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next := sched.Next(time.Now()); !next.IsZero() {
+		t.Errorf("expected no activation, got %s", next)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"-1h",
+		"0s",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@fortnightly",
+	} {
+		if _, err := Parse(spec, time.UTC); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
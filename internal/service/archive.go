@@ -0,0 +1,214 @@
+package service
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/model"
+)
+
+// ArchiveRepository stores archived delegation files as dated intervals.
+type ArchiveRepository interface {
+	LatestArchiveDate(ctx context.Context, source string) (time.Time, error)
+	ImportArchive(ctx context.Context, archive model.DelegationArchive, load func(emit func(model.IPRange) error) error) (*model.ArchiveImport, error)
+}
+
+// ArchiveImporter imports the dated delegation files the RIRs archive, so
+// that lookups can be answered as of a past date.
+type ArchiveImporter struct {
+	repo   ArchiveRepository
+	rirSvc *RIRService
+	format string
+	logger *zap.Logger
+}
+
+// NewArchiveImporter imports archives in format, config.FormatExtended or
+// config.FormatStandard.
+func NewArchiveImporter(repo ArchiveRepository, rirSvc *RIRService, format string, logger *zap.Logger) *ArchiveImporter {
+	return &ArchiveImporter{
+		repo:   repo,
+		rirSvc: rirSvc,
+		format: format,
+		logger: logger,
+	}
+}
+
+// archiveDate finds the date in archive file names such as
+// delegated-ripencc-extended-20240131.bz2.
+var archiveDate = regexp.MustCompile(`(\d{8})(\.[a-z0-9]+)?$`)
+
+type archiveFile struct {
+	path    string
+	archive model.DelegationArchive
+}
+
+// Import imports the archives at paths, which may be gzip or bzip2
+// compressed. They are imported in date order, and archives not newer than
+// the last one imported from their registry are skipped.
+func (i *ArchiveImporter) Import(ctx context.Context, paths []string) error {
+	files := make([]archiveFile, 0, len(paths))
+	for _, path := range paths {
+		archive, err := i.readArchive(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		files = append(files, archiveFile{path: path, archive: archive})
+	}
+	sort.SliceStable(files, func(a, b int) bool {
+		return files[a].archive.Date.Before(files[b].archive.Date)
+	})
+
+	latest := make(map[string]time.Time)
+	for _, file := range files {
+		source := file.archive.Source
+		if _, ok := latest[source]; !ok {
+			date, err := i.repo.LatestArchiveDate(ctx, source)
+			if err != nil {
+				return fmt.Errorf("loading imported archives of %s: %w", source, err)
+			}
+			latest[source] = date
+		}
+		if !file.archive.Date.After(latest[source]) {
+			i.logger.Info("Skipping delegation archive, a newer one was imported",
+				zap.String("path", file.path),
+				zap.String("source", source),
+				zap.Time("date", file.archive.Date))
+			continue
+		}
+
+		var stats RIRStats
+		result, err := i.repo.ImportArchive(ctx, file.archive, func(emit func(model.IPRange) error) error {
+			r, err := openArchive(file.path)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			src := config.RIR{Name: source, Format: i.format}
+			stats, err = i.rirSvc.ParseArchive(r, src, emit)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("importing %s: %w", file.path, err)
+		}
+		latest[source] = file.archive.Date
+
+		i.logger.Info("Imported delegation archive",
+			zap.String("path", file.path),
+			zap.String("source", source),
+			zap.Time("date", file.archive.Date),
+			zap.Int64("ranges", result.Ranges),
+			zap.Int64("opened", result.Opened),
+			zap.Int64("closed", result.Closed),
+			zap.Int("parse_errors", stats.ParseErrors))
+	}
+
+	return nil
+}
+
+// readArchive describes the archive at path from its version line. The
+// date is the end date of its data, or else the date in its file name.
+func (i *ArchiveImporter) readArchive(path string) (model.DelegationArchive, error) {
+	r, err := openArchive(path)
+	if err != nil {
+		return model.DelegationArchive{}, err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || len(line) == 0 {
+			continue
+		}
+
+		header, err := parseHeader(strings.Split(line, "|"))
+		if err != nil {
+			return model.DelegationArchive{}, err
+		}
+		archive := model.DelegationArchive{Source: header.Registry, Date: header.EndDate, Serial: header.Serial}
+		if archive.Date.IsZero() {
+			match := archiveDate.FindStringSubmatch(filepath.Base(path))
+			if match == nil {
+				return model.DelegationArchive{}, fmt.Errorf("no date in version line or file name")
+			}
+			if archive.Date, err = time.Parse("20060102", match[1]); err != nil {
+				return model.DelegationArchive{}, fmt.Errorf("invalid date in file name: %w", err)
+			}
+		}
+		return archive, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return model.DelegationArchive{}, err
+	}
+	return model.DelegationArchive{}, fmt.Errorf("missing version line")
+}
+
+// openArchive opens the file at path, decompressing .gz and .bz2 files.
+func openArchive(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{gz, f}, nil
+	case ".bz2":
+		return struct {
+			io.Reader
+			io.Closer
+		}{bzip2.NewReader(f), f}, nil
+	}
+	return f, nil
+}
+
+// maxArchiveParseErrors is the share of the records of an archive that may
+// fail to parse. Beyond it the archive is most likely of another format.
+const maxArchiveParseErrors = 0.01
+
+// ParseArchive parses an archived delegation file of src from r and passes
+// each range to emit. Its version line and declared record counts are
+// verified like those of downloads, but archives are not checked for age.
+// An archive without IP ranges, or with too many records that fail to
+// parse, is rejected, as importing it would end the intervals of every
+// range of the source.
+func (s *RIRService) ParseArchive(r io.Reader, src config.RIR, emit func(model.IPRange) error) (RIRStats, error) {
+	src.MaxAge = 0
+
+	var stats RIRStats
+	if _, _, err := s.parse(r, src, model.SourceState{}, &stats, emit, nil); err != nil {
+		return stats, err
+	}
+
+	ranges := stats.IPv4Count + stats.IPv6Count
+	if ranges == 0 {
+		return stats, fmt.Errorf("no IP ranges parsed, %d records do not match the %s format", stats.ParseErrors, src.Format)
+	}
+	records := ranges + stats.ASNCount + stats.ParseErrors
+	if float64(stats.ParseErrors) > maxArchiveParseErrors*float64(records) {
+		return stats, fmt.Errorf("%d of %d records failed to parse, more than %g%%; check the %s format",
+			stats.ParseErrors, records, 100*maxArchiveParseErrors, src.Format)
+	}
+	return stats, nil
+}
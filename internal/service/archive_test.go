@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/model"
+	"ipservice/tests/mocks"
+)
+
+func TestArchiveImporter_Import(t *testing.T) {
+	var imported []string
+	var ranges [][]string
+	mockRepo := &mocks.MockRepository{
+		LatestArchiveDateFunc: func(ctx context.Context, source string) (time.Time, error) {
+			if source != "ripencc" {
+				t.Errorf("unexpected source %s", source)
+			}
+			return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), nil
+		},
+		ImportArchiveFunc: func(ctx context.Context, archive model.DelegationArchive, load func(emit func(model.IPRange) error) error) (*model.ArchiveImport, error) {
+			imported = append(imported, fmt.Sprintf("%s %s %d", archive.Source, archive.Date.Format(time.DateOnly), archive.Serial))
+			var networks []string
+			err := load(func(ipRange model.IPRange) error {
+				networks = append(networks, ipRange.Network.String()+" "+ipRange.CountryCode)
+				return nil
+			})
+			ranges = append(ranges, networks)
+			return &model.ArchiveImport{Ranges: int64(len(networks))}, err
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	importer := NewArchiveImporter(mockRepo, NewRIRService(logger), config.FormatExtended, logger)
+
+	// Imported in date order, skipping the one already imported
+	err := importer.Import(context.Background(), []string{
+		"testdata/archive/delegated-ripencc-extended-20240301.gz",
+		"testdata/archive/delegated-ripencc-extended-20240101",
+		"testdata/archive/delegated-ripencc-extended-20240201",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantImported := []string{"ripencc 2024-02-01 20240201", "ripencc 2024-03-01 20240301"}
+	if fmt.Sprint(imported) != fmt.Sprint(wantImported) {
+		t.Fatalf("expected imports %v, got %v", wantImported, imported)
+	}
+	wantRanges := [][]string{
+		{"193.0.0.0/24 GB", "194.0.0.0/23 FR", "195.0.0.0/24 SE"},
+		{"193.0.0.0/24 GB", "194.0.0.0/23 FR", "195.0.0.0/24 SE", "2001:67c::/32 NL"},
+	}
+	if fmt.Sprint(ranges) != fmt.Sprint(wantRanges) {
+		t.Errorf("expected ranges %v, got %v", wantRanges, ranges)
+	}
+}
+
+func TestArchiveImporter_Import_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	truncated := filepath.Join(dir, "delegated-ripencc-extended-20240401")
+	content := "2|ripencc|20240401|2|19830705|20240401|+0100\nripencc|DE|ipv4|193.0.0.0|256|19930901|assigned|org-1\n"
+	if err := os.WriteFile(truncated, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	garbled := filepath.Join(dir, "delegated-ripencc-extended-20240402")
+	content = "2|ripencc|20240402|3|19830705|20240402|+0100\n" +
+		"ripencc|DE|ipv4|193.0.0.0|256|19930901|assigned|org-1\n" +
+		"ripencc|FR|ipv4|194.0.0.0|512|19940101|allocated|org-2\n" +
+		"ripencc|SE|ipv4|195.0.0.0|256|20240115|allocated\n"
+	if err := os.WriteFile(garbled, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	undated := filepath.Join(dir, "delegated-ripencc-extended-latest")
+	if err := os.WriteFile(undated, []byte("2|ripencc|1|0|19830705||+0100\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mockRepo := &mocks.MockRepository{
+		LatestArchiveDateFunc: func(ctx context.Context, source string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+		ImportArchiveFunc: func(ctx context.Context, archive model.DelegationArchive, load func(emit func(model.IPRange) error) error) (*model.ArchiveImport, error) {
+			return &model.ArchiveImport{}, load(func(model.IPRange) error { return nil })
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	importer := NewArchiveImporter(mockRepo, NewRIRService(logger), config.FormatExtended, logger)
+
+	tests := []struct {
+		path   string
+		errMsg string
+	}{
+		{path: truncated, errMsg: "header declares 2 records, found 1"},
+		{path: garbled, errMsg: "1 of 3 records failed to parse"},
+		{path: undated, errMsg: "no date in version line or file name"},
+		{path: filepath.Join(dir, "missing"), errMsg: "no such file"},
+	}
+	for _, tt := range tests {
+		err := importer.Import(context.Background(), []string{tt.path})
+		if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", filepath.Base(tt.path), tt.errMsg, err)
+		}
+	}
+}
+
+func TestArchiveImporter_Import_Format(t *testing.T) {
+	var imported []int64
+	mockRepo := &mocks.MockRepository{
+		LatestArchiveDateFunc: func(ctx context.Context, source string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+		ImportArchiveFunc: func(ctx context.Context, archive model.DelegationArchive, load func(emit func(model.IPRange) error) error) (*model.ArchiveImport, error) {
+			var count int64
+			if err := load(func(model.IPRange) error { count++; return nil }); err != nil {
+				return nil, err
+			}
+			imported = append(imported, count)
+			return &model.ArchiveImport{Ranges: count}, nil
+		},
+	}
+	logger, _ := zap.NewDevelopment()
+	path := "testdata/archive/delegated-ripencc-20240401"
+
+	// Every record of a standard archive lacks the opaque id of the
+	// extended format
+	extended := NewArchiveImporter(mockRepo, NewRIRService(logger), config.FormatExtended, logger)
+	err := extended.Import(context.Background(), []string{path})
+	if err == nil || !strings.Contains(err.Error(), "no IP ranges parsed, 4 records do not match the extended format") {
+		t.Errorf("expected the archive to be rejected, got %v", err)
+	}
+	if len(imported) != 0 {
+		t.Fatalf("expected nothing to be imported, got %v", imported)
+	}
+
+	standard := NewArchiveImporter(mockRepo, NewRIRService(logger), config.FormatStandard, logger)
+	if err := standard.Import(context.Background(), []string{path}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(imported) != 1 || imported[0] != 4 {
+		t.Errorf("expected 4 ranges to be imported, got %v", imported)
+	}
+}
+
+func TestIPService_LookupIPAt(t *testing.T) {
+	_, network, _ := net.ParseCIDR("193.0.0.0/24")
+	mockRepo := &mocks.MockRepository{
+		FindRangeForIPAtFunc: func(ctx context.Context, ip net.IP, at time.Time) (*model.HistoricalRange, error) {
+			if !network.Contains(ip) {
+				return nil, nil
+			}
+			return &model.HistoricalRange{
+				IPRange:   model.IPRange{Network: *network, CountryCode: "GB", Registry: "ripencc", Status: "assigned"},
+				ValidFrom: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			}, nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, &mocks.MockCache{}, NewRIRService(logger), NewMemoryLocker(), &config.Config{}, logger)
+	at := time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)
+
+	resp, err := svc.LookupIPAt(context.Background(), "193.0.0.1", at)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := model.IPResponse{IP: "193.0.0.1", CountryCode: "GB", Network: "193.0.0.0/24", Registry: "ripencc", Status: "assigned", ValidFrom: "2024-02-01"}
+	if *resp != want {
+		t.Errorf("expected %+v, got %+v", want, *resp)
+	}
+
+	if resp, err := svc.LookupIPAt(context.Background(), "10.0.0.1", at); err != nil || resp.CountryCode != "ZZ" {
+		t.Errorf("expected ZZ for an address never delegated, got %+v %v", resp, err)
+	}
+	if _, err := svc.LookupIPAt(context.Background(), "invalid", at); err == nil || !strings.Contains(err.Error(), "invalid IP address") {
+		t.Errorf("expected an invalid address error, got %v", err)
+	}
+}
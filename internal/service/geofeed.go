@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/iso3166"
+	"ipservice/internal/model"
+)
+
+// GeofeedStats counts the entries of a geofeed.
+type GeofeedStats struct {
+	Entries int // valid and within the publisher's allocations
+	Invalid int // not RFC 8805 conformant
+	// OutsideAllocation counts entries for prefixes not delegated to the
+	// publisher, which RFC 8805 tells consumers to ignore
+	OutsideAllocation int
+	// Undelegated counts entries within the configured allocations but not
+	// within a range of the published dataset
+	Undelegated int
+}
+
+// region matches ISO 3166-2 subdivision codes such as US-CA.
+var region = regexp.MustCompile(`^[A-Z]{2}-[A-Z0-9]{1,3}$`)
+
+// FetchGeofeed downloads and parses the RFC 8805 geofeed of feed, from an
+// http(s):// URL or a file:// path. Entries that are invalid or outside
+// the publisher's allocations are skipped; a feed without valid entries is
+// an error.
+func (s *RIRService) FetchGeofeed(ctx context.Context, feed config.Geofeed) ([]model.GeofeedEntry, GeofeedStats, error) {
+	var stats GeofeedStats
+
+	allocations, err := feed.Networks()
+	if err != nil {
+		return nil, stats, fmt.Errorf("parsing allocations: %w", err)
+	}
+
+	if feed.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, feed.Timeout)
+		defer cancel()
+	}
+
+	body, _, err := s.open(ctx, feed.URL, model.SourceState{})
+	if err != nil {
+		return nil, stats, err
+	}
+	defer body.Close()
+
+	entries, err := s.parseGeofeed(body, feed.Name, allocations, &stats)
+	if err != nil {
+		return nil, stats, err
+	}
+	if len(entries) == 0 {
+		return nil, stats, fmt.Errorf("no valid entries, %d invalid and %d outside the allocations", stats.Invalid, stats.OutsideAllocation)
+	}
+	return entries, stats, nil
+}
+
+// parseGeofeed reads the CSV lines of an RFC 8805 geofeed: prefix, country,
+// region, city and postal code, of which all but the prefix may be empty or
+// missing. Lines starting with # are comments.
+func (s *RIRService) parseGeofeed(r io.Reader, feed string, allocations []*net.IPNet, stats *GeofeedStats) ([]model.GeofeedEntry, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	var entries []model.GeofeedEntry
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			stats.Invalid++
+			s.logger.Debug("Skipping invalid geofeed line", zap.String("feed", feed), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry, err := parseGeofeedEntry(fields)
+		if err != nil {
+			stats.Invalid++
+			line, _ := reader.FieldPos(0)
+			s.logger.Debug("Skipping invalid geofeed entry",
+				zap.String("feed", feed),
+				zap.Int("line", line),
+				zap.Error(err))
+			continue
+		}
+		if !within(entry.Prefix, allocations) {
+			stats.OutsideAllocation++
+			s.logger.Debug("Skipping geofeed entry outside the publisher's allocations",
+				zap.String("feed", feed),
+				zap.String("prefix", entry.Prefix.String()))
+			continue
+		}
+
+		entry.Feed = feed
+		entries = append(entries, entry)
+		stats.Entries++
+	}
+}
+
+func parseGeofeedEntry(fields []string) (model.GeofeedEntry, error) {
+	var entry model.GeofeedEntry
+
+	field := func(i int) string {
+		if i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	ip, network, err := net.ParseCIDR(field(0))
+	if err != nil {
+		return entry, fmt.Errorf("invalid prefix %q", field(0))
+	}
+	if !ip.Equal(network.IP) {
+		return entry, fmt.Errorf("prefix %q has host bits set", field(0))
+	}
+	entry.Prefix = *network
+
+	entry.CountryCode = strings.ToUpper(field(1))
+	if entry.CountryCode != "" && !iso3166.Valid(entry.CountryCode) {
+		return entry, fmt.Errorf("invalid country code %q", field(1))
+	}
+
+	entry.Region = strings.ToUpper(field(2))
+	if entry.Region != "" {
+		if !region.MatchString(entry.Region) {
+			return entry, fmt.Errorf("invalid region %q", field(2))
+		}
+		if !strings.HasPrefix(entry.Region, entry.CountryCode+"-") {
+			return entry, fmt.Errorf("region %q is not in country %q", field(2), entry.CountryCode)
+		}
+	}
+
+	entry.City = field(3)
+	entry.PostalCode = field(4)
+	return entry, nil
+}
+
+// within reports whether prefix lies entirely inside one of networks.
+func within(prefix net.IPNet, networks []*net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	for _, network := range networks {
+		networkOnes, networkBits := network.Mask.Size()
+		if bits == networkBits && ones >= networkOnes && network.Contains(prefix.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegatedEntries returns the entries whose prefix lies within a single
+// range of the published dataset in index, and how many did not. The
+// configured allocations are only what the operator was told; checking the
+// RIR data as well keeps a wrong allocation from relabelling address space
+// that was never delegated.
+func delegatedEntries(index RangeIndex, entries []model.GeofeedEntry) ([]model.GeofeedEntry, int) {
+	delegated := entries[:0]
+	for _, entry := range entries {
+		ipRange, ok := index.Lookup(entry.Prefix.IP)
+		if ok && within(entry.Prefix, []*net.IPNet{&ipRange.Network}) {
+			delegated = append(delegated, entry)
+		}
+	}
+	return delegated, len(entries) - len(delegated)
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/lookup"
+	"ipservice/internal/model"
+	"ipservice/tests/mocks"
+)
+
+var testGeofeed = config.Geofeed{
+	Name:        "example",
+	Enabled:     true,
+	Allocations: []string{"192.0.2.0/24", "2001:db8::/32"},
+}
+
+func TestRIRService_FetchGeofeed(t *testing.T) {
+	content, err := os.ReadFile("testdata/geofeed/geofeed.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	path, err := filepath.Abs("testdata/geofeed/geofeed.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"192.0.2.0/24 US US-CA Los Angeles ",
+		"192.0.2.128/25 US US-CA San Francisco, Mission District 94110",
+		"2001:db8::/32 NL NL-NH Amsterdam ",
+		"2001:db8:1::/48 NL   ",
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewRIRService(logger)
+	for _, location := range []string{server.URL, "file://" + path} {
+		t.Run(location, func(t *testing.T) {
+			feed := testGeofeed
+			feed.URL = location
+
+			entries, stats, err := svc.FetchGeofeed(context.Background(), feed)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, entry := range entries {
+				if entry.Feed != "example" {
+					t.Errorf("unexpected feed %q", entry.Feed)
+				}
+				got = append(got, fmt.Sprintf("%s %s %s %s %s", entry.Prefix.String(), entry.CountryCode, entry.Region, entry.City, entry.PostalCode))
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+				t.Errorf("expected entries %q, got %q", want, got)
+			}
+			if stats.Entries != 4 || stats.Invalid != 8 || stats.OutsideAllocation != 2 {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestRIRService_FetchGeofeed_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "198.51.100.0/24,US,US-NY,New York,")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		err  string
+	}{
+		{name: "not found", url: server.URL + "/missing", err: "unexpected status code: 404"},
+		{name: "nothing within the allocations", url: server.URL + "/geofeed.csv", err: "no valid entries, 0 invalid and 1 outside the allocations"},
+		{name: "missing file", url: "file://" + filepath.Join(t.TempDir(), "geofeed.csv"), err: "no such file"},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewRIRService(logger)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed := testGeofeed
+			feed.URL = tt.url
+			_, _, err := svc.FetchGeofeed(context.Background(), feed)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestIPService_Geofeeds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/broken":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "/undelegated":
+			fmt.Fprintln(w, "2001:db8:5::/48,NL,,,")
+		default:
+			fmt.Fprintln(w, "192.0.2.128/25,CA,CA-ON,Toronto,")
+			fmt.Fprintln(w, "2001:db8:5::/48,NL,,,")
+		}
+	}))
+	defer server.Close()
+
+	var saved []model.GeofeedEntry
+	var kept []string
+	saves := 0
+	mockRepo := &mocks.MockRepository{
+		SaveGeofeedsFunc: func(ctx context.Context, keptFeeds []string, entries []model.GeofeedEntry) (*model.GeofeedUpdate, error) {
+			saves++
+			kept, saved = keptFeeds, entries
+			return &model.GeofeedUpdate{ID: 7, Entries: int64(len(entries))}, nil
+		},
+		LatestGeofeedUpdateFunc: func(ctx context.Context) (*model.GeofeedUpdate, error) {
+			return &model.GeofeedUpdate{ID: 7}, nil
+		},
+		LoadGeofeedsFunc: func(ctx context.Context) ([]model.GeofeedEntry, error) {
+			return saved, nil
+		},
+	}
+
+	feed := testGeofeed
+	feed.URL = server.URL
+	broken := testGeofeed
+	broken.Name = "broken"
+	broken.URL = server.URL + "/broken"
+	undelegated := testGeofeed
+	undelegated.Name = "undelegated"
+	undelegated.URL = server.URL + "/undelegated"
+	disabled := testGeofeed
+	disabled.Name = "disabled"
+	disabled.Enabled = false
+	cfg := &config.Config{Geofeeds: []config.Geofeed{feed, broken, undelegated, disabled}}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, &mocks.MockCache{}, NewRIRService(logger), NewMemoryLocker(), cfg, logger)
+
+	// Without a published dataset the entries cannot be checked
+	svc.updateGeofeeds(context.Background())
+	if saves != 0 {
+		t.Fatalf("expected no geofeeds to be saved without a dataset, got %+v", saved)
+	}
+
+	// Only 192.0.2.0/24 is delegated, so the IPv6 entries within the
+	// configured allocations are rejected
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	svc.setIndex(lookup.NewTable([]model.IPRange{{Network: *network, CountryCode: "US", Registry: "arin", Version: 4}}))
+	svc.updateGeofeeds(context.Background())
+
+	if fmt.Sprint(kept) != "[broken undelegated]" {
+		t.Errorf("expected the broken and undelegated feeds to be kept, got %v", kept)
+	}
+	if len(saved) != 1 || saved[0].Feed != "example" || saved[0].Prefix.String() != "192.0.2.128/25" {
+		t.Errorf("unexpected entries %+v", saved)
+	}
+
+	// The geofeed is layered over the RIR data where it has an entry
+	tests := []struct {
+		ip      string
+		country string
+		region  string
+		city    string
+	}{
+		{ip: "192.0.2.200", country: "CA", region: "CA-ON", city: "Toronto"},
+		{ip: "192.0.2.1", country: "US"},
+	}
+	for _, tt := range tests {
+		resp, err := svc.LookupIP(context.Background(), tt.ip)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.CountryCode != tt.country || resp.Region != tt.region || resp.City != tt.city || resp.Registry != "arin" {
+			t.Errorf("%s: expected %s %s %s, got %+v", tt.ip, tt.country, tt.region, tt.city, resp)
+		}
+	}
+
+	// Entries left over from a previous dataset do not locate addresses
+	// the RIR data no longer has
+	_, stale, _ := net.ParseCIDR("198.51.100.0/24")
+	svc.geofeeds.Store(lookup.NewGeofeedTable(append(saved, model.GeofeedEntry{
+		Prefix: *stale, CountryCode: "DE", Region: "DE-BE", City: "Berlin", Feed: "example",
+	})))
+	resp, err := svc.LookupIP(context.Background(), "198.51.100.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.CountryCode != "ZZ" || resp.Region != "" || resp.City != "" {
+		t.Errorf("expected ZZ without a location for an unallocated address, got %+v", resp)
+	}
+	results, err := svc.LookupIPs(context.Background(), []string{"198.51.100.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if results[0].CountryCode != "" || results[0].City != "" {
+		t.Errorf("expected no location for an unallocated address in a batch, got %+v", results[0])
+	}
+}
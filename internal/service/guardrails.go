@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/iso3166"
+	"ipservice/internal/model"
+)
+
+// maxLoggedConflicts limits how many overlapping ranges are logged.
+const maxLoggedConflicts = 10
+
+// checkGuardrails compares the staged dataset with the published one and
+// describes every guardrail it violates. sources are the sources expected
+// in the staged dataset; failed sources that were dropped are not checked.
+func (s *IPService) checkGuardrails(ctx context.Context, sources []string) ([]string, error) {
+	staged, err := s.repo.CountStagedIPRanges(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("counting staged IP ranges: %w", err)
+	}
+	published, err := s.repo.CountIPRanges(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("counting published IP ranges: %w", err)
+	}
+
+	var violations []string
+
+	rirs := make(map[string]config.RIR)
+	for _, rir := range s.config.RIRs {
+		rirs[rir.Name] = rir
+	}
+	stagedCounts, publishedCounts := countBySource(staged), countBySource(published)
+
+	for _, name := range sources {
+		rir, counts := rirs[name], stagedCounts[name]
+		if counts[4] < int64(rir.MinIPv4Ranges) {
+			violations = append(violations, fmt.Sprintf("%s: %d IPv4 ranges, expected at least %d", name, counts[4], rir.MinIPv4Ranges))
+		}
+		if counts[6] < int64(rir.MinIPv6Ranges) {
+			violations = append(violations, fmt.Sprintf("%s: %d IPv6 ranges, expected at least %d", name, counts[6], rir.MinIPv6Ranges))
+		}
+
+		before := publishedCounts[name][4] + publishedCounts[name][6]
+		after := counts[4] + counts[6]
+		if s.config.MaxChangePercent > 0 && before > 0 {
+			change := 100 * float64(after-before) / float64(before)
+			if change > s.config.MaxChangePercent || -change > s.config.MaxChangePercent {
+				violations = append(violations, fmt.Sprintf("%s: %d ranges, %+.1f%% from %d exceeds %g%%", name, after, change, before, s.config.MaxChangePercent))
+			}
+		}
+	}
+
+	invalid := make(map[string]int64)
+	var invalidRanges int64
+	for _, count := range staged {
+		if !iso3166.Valid(count.CountryCode) {
+			invalid[count.CountryCode] += count.Count
+			invalidRanges += count.Count
+		}
+	}
+	if invalidRanges > 0 {
+		var codes []string
+		for code, n := range invalid {
+			codes = append(codes, fmt.Sprintf("%q: %d", code, n))
+		}
+		sort.Strings(codes)
+
+		s.logger.Warn("Staged IP ranges with invalid country codes",
+			zap.Int64("ranges", invalidRanges),
+			zap.Strings("country_codes", codes))
+		if invalidRanges > int64(s.config.MaxInvalidCountries) {
+			violations = append(violations, fmt.Sprintf("%d ranges with country codes outside ISO 3166 (%s), at most %d allowed",
+				invalidRanges, strings.Join(codes, ", "), s.config.MaxInvalidCountries))
+		}
+	}
+
+	conflicts, err := s.repo.FindStagedConflicts(ctx, s.config.MaxConflicts+1)
+	if err != nil {
+		return nil, fmt.Errorf("finding conflicting IP ranges: %w", err)
+	}
+	for i, conflict := range conflicts {
+		if i == maxLoggedConflicts {
+			break
+		}
+		s.logger.Warn("Staged IP range overlaps another source",
+			zap.String("network", conflict.Network),
+			zap.String("source", conflict.Source),
+			zap.String("country_code", conflict.CountryCode),
+			zap.String("inner_network", conflict.InnerNetwork),
+			zap.String("inner_source", conflict.InnerSource),
+			zap.String("inner_country_code", conflict.InnerCountryCode))
+	}
+	if len(conflicts) > s.config.MaxConflicts {
+		first := conflicts[0]
+		violations = append(violations, fmt.Sprintf("more than %d ranges overlap another source's, e.g. %s (%s) contains %s (%s)",
+			s.config.MaxConflicts, first.Network, first.Source, first.InnerNetwork, first.InnerSource))
+	}
+
+	return violations, nil
+}
+
+// countBySource totals counts by source and IP version.
+func countBySource(counts []model.RangeCount) map[string]map[int]int64 {
+	totals := make(map[string]map[int]int64)
+	for _, count := range counts {
+		if totals[count.Source] == nil {
+			totals[count.Source] = make(map[int]int64)
+		}
+		totals[count.Source][count.Version] += count.Count
+	}
+	return totals
+}
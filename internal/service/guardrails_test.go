@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/lookup"
+	"ipservice/internal/model"
+	"ipservice/tests/mocks"
+)
+
+func TestIPService_CheckGuardrails(t *testing.T) {
+	valid := []model.RangeCount{
+		{Source: "ARIN", Version: 4, CountryCode: "US", Count: 90},
+		{Source: "ARIN", Version: 6, CountryCode: "CA", Count: 10},
+		{Source: "RIPE", Version: 4, CountryCode: "EU", Count: 5},
+	}
+	conflict := model.RangeConflict{Network: "8.0.0.0/8", Source: "ARIN", InnerNetwork: "8.8.8.0/24", InnerSource: "RIPE"}
+
+	tests := []struct {
+		name       string
+		sources    []string
+		staged     []model.RangeCount
+		published  []model.RangeCount
+		conflicts  []model.RangeConflict
+		violations []string
+	}{
+		{name: "valid", sources: []string{"ARIN", "RIPE"}, staged: valid, published: valid},
+		{name: "first dataset", sources: []string{"ARIN", "RIPE"}, staged: valid},
+		{
+			name:    "too few ranges",
+			sources: []string{"ARIN"},
+			staged: []model.RangeCount{
+				{Source: "ARIN", Version: 4, CountryCode: "US", Count: 49},
+				{Source: "ARIN", Version: 6, CountryCode: "US", Count: 10},
+			},
+			violations: []string{"ARIN: 49 IPv4 ranges, expected at least 50"},
+		},
+		{
+			name:       "missing IP version",
+			sources:    []string{"ARIN"},
+			staged:     valid[:1],
+			violations: []string{"ARIN: 0 IPv6 ranges, expected at least 1"},
+		},
+		{
+			name:    "large change",
+			sources: []string{"ARIN", "RIPE"},
+			staged:  valid,
+			published: []model.RangeCount{
+				{Source: "ARIN", Version: 4, CountryCode: "US", Count: 200},
+				{Source: "RIPE", Version: 4, CountryCode: "EU", Count: 5},
+			},
+			violations: []string{"ARIN: 100 ranges, -50.0% from 200 exceeds 10%"},
+		},
+		{name: "dropped source", sources: []string{"RIPE"}, staged: valid[2:], published: valid},
+		{
+			name:       "invalid country codes",
+			sources:    []string{"ARIN", "RIPE"},
+			staged:     append([]model.RangeCount{{Source: "RIPE", Version: 4, CountryCode: "ZZ", Count: 3}}, valid...),
+			violations: []string{`3 ranges with country codes outside ISO 3166 ("ZZ": 3), at most 2 allowed`},
+		},
+		{
+			name:      "tolerated invalid country codes",
+			sources:   []string{"ARIN", "RIPE"},
+			staged:    append([]model.RangeCount{{Source: "RIPE", Version: 4, CountryCode: "UK", Count: 2}}, valid...),
+			conflicts: []model.RangeConflict{conflict},
+		},
+		{
+			name:       "conflicts",
+			sources:    []string{"ARIN", "RIPE"},
+			staged:     valid,
+			conflicts:  []model.RangeConflict{conflict, conflict},
+			violations: []string{"more than 1 ranges overlap another source's, e.g. 8.0.0.0/8 (ARIN) contains 8.8.8.0/24 (RIPE)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo := &mocks.MockRepository{
+				CountStagedIPRangesFunc: func(ctx context.Context) ([]model.RangeCount, error) {
+					return tt.staged, nil
+				},
+				CountIPRangesFunc: func(ctx context.Context) ([]model.RangeCount, error) {
+					return tt.published, nil
+				},
+				FindStagedConflictsFunc: func(ctx context.Context, limit int) ([]model.RangeConflict, error) {
+					if limit != 2 {
+						t.Errorf("expected to look for 2 conflicts, got %d", limit)
+					}
+					return tt.conflicts, nil
+				},
+			}
+			cfg := &config.Config{
+				MaxChangePercent:    10,
+				MaxInvalidCountries: 2,
+				MaxConflicts:        1,
+				RIRs: []config.RIR{
+					{Name: "ARIN", MinIPv4Ranges: 50, MinIPv6Ranges: 1},
+					{Name: "RIPE"},
+				},
+			}
+
+			logger, _ := zap.NewDevelopment()
+			svc := NewIPService(mockRepo, nil, nil, NewMemoryLocker(), cfg, logger)
+
+			violations, err := svc.checkGuardrails(context.Background(), tt.sources)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(violations, "\n") != strings.Join(tt.violations, "\n") {
+				t.Errorf("expected violations %q, got %q", tt.violations, violations)
+			}
+		})
+	}
+}
+
+func TestIPService_UpdateIPRanges_GuardrailsReject(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(delegationFile("arin|US|ipv4|8.8.8.0|256|20100101|allocated")))
+	}))
+	defer server.Close()
+
+	var saved []model.IPRange
+	var swapped bool
+	mockRepo := &mocks.MockRepository{
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return nil, nil
+		},
+		BeginStagingFunc: func(ctx context.Context) error {
+			return nil
+		},
+		SaveIPRangesFunc: saveInto(&saved),
+		GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+			return int64(len(saved)), nil
+		},
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return nil, nil
+		},
+		SaveASNDelegationsFunc: func(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+			return nil
+		},
+		SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+			swapped = true
+			return base + 1, nil
+		},
+		SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+			return nil
+		},
+		GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			return &model.DatasetDiff{To: q.To}, nil
+		},
+	}
+	guardStaged(mockRepo, &saved, nil)
+	mockCache := &mocks.MockCache{
+		CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+			return nil
+		},
+		CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+			return nil
+		},
+	}
+
+	cfg := &config.Config{RIRs: []config.RIR{{Name: "ARIN", URL: server.URL, Enabled: true, MinIPv4Ranges: 1000}}}
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), cfg, logger)
+
+	err := svc.UpdateIPRanges(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "rejected by 1 guardrails") {
+		t.Fatalf("expected guardrail error, got %v", err)
+	}
+	if swapped {
+		t.Error("expected the dataset not to be published")
+	}
+
+	status := svc.Status()
+	if status.LastUpdate == nil || status.LastUpdate.Error != err.Error() || status.LastUpdate.FinishedAt == nil || status.LastUpdate.State != model.UpdateFailed {
+		t.Fatalf("expected the failed update in the status, got %+v", status.LastUpdate)
+	}
+	if violations := status.LastUpdate.Violations; len(violations) != 1 || !strings.Contains(violations[0], "1 IPv4 ranges, expected at least 1000") {
+		t.Errorf("unexpected violations %v", violations)
+	}
+}
@@ -2,43 +2,104 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 	"ipservice/internal/config"
+	"ipservice/internal/lookup"
 	"ipservice/internal/model"
+	"ipservice/internal/schedule"
 )
 
 type Repository interface {
-	SaveIPRanges(ctx context.Context, ranges []model.IPRange) error
-	FindCountryForIP(ctx context.Context, ip net.IP) (string, error)
-	ClearIPRanges(ctx context.Context) error
-	GetRangesCount(ctx context.Context) (int64, error)
+	BeginStaging(ctx context.Context) error
+	SaveIPRanges(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error
+	KeepIPRanges(ctx context.Context, sources []string, priority []string) (int64, error)
+	CountIPRanges(ctx context.Context) ([]model.RangeCount, error)
+	CountStagedIPRanges(ctx context.Context) ([]model.RangeCount, error)
+	FindStagedConflicts(ctx context.Context, limit int) ([]model.RangeConflict, error)
+	GetStagedCount(ctx context.Context) (int64, error)
+	SwapIPRanges(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error)
+	RollbackIPRanges(ctx context.Context) error
+	FindRangeForIP(ctx context.Context, ip net.IP) (*model.IPRange, error)
+	FindRangesForIPs(ctx context.Context, ips []net.IP) ([]*model.IPRange, error)
+	GetDatasetInfo(ctx context.Context) (*model.DatasetInfo, error)
+	MarkDatasetChecked(ctx context.Context) error
+	ListDatasetVersions(ctx context.Context, limit int) ([]model.DatasetVersion, error)
+	SaveDatasetHistory(ctx context.Context, version int64, keep int) error
+	GetDatasetDiff(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error)
+	FindRangeForIPAt(ctx context.Context, ip net.IP, at time.Time) (*model.HistoricalRange, error)
+	SaveASNDelegations(ctx context.Context, kept []string, delegations []model.ASNDelegation) error
+	LoadASNDelegations(ctx context.Context) ([]model.ASNDelegation, error)
+	FindASNDelegation(ctx context.Context, asn uint32) (*model.ASNDelegation, error)
+	LatestRouteImport(ctx context.Context) (*model.RouteImport, error)
+	LoadRoutes(ctx context.Context) ([]model.Route, error)
+	SaveGeofeeds(ctx context.Context, kept []string, entries []model.GeofeedEntry) (*model.GeofeedUpdate, error)
+	LatestGeofeedUpdate(ctx context.Context) (*model.GeofeedUpdate, error)
+	LoadGeofeeds(ctx context.Context) ([]model.GeofeedEntry, error)
+	LoadIPRanges(ctx context.Context) ([]model.IPRange, error)
+	GetSourceStates(ctx context.Context) (map[string]model.SourceState, error)
+	SaveSourceStates(ctx context.Context, states []model.SourceState) error
+	ClearSourceStates(ctx context.Context) error
 }
 
 type Cache interface {
-	SetCountry(ctx context.Context, ip, countryCode string) error
-	GetCountry(ctx context.Context, ip string) (string, error)
-	CacheIPRanges(ctx context.Context, ranges []model.IPRange) error
-	GetCachedRange(ctx context.Context, ip net.IP) (string, error)
+	// Answers for single addresses are cached per dataset version
+	SetIPRange(ctx context.Context, version int64, ip string, ipRange model.IPRange) error
+	GetIPRange(ctx context.Context, version int64, ip string) (*model.IPRange, error)
+	GetIPRanges(ctx context.Context, version int64, ips []string) ([]*model.IPRange, error)
+	SetIPRanges(ctx context.Context, version int64, ranges map[string]model.IPRange) error
+	CacheIPRanges(ctx context.Context, table *lookup.Table) error
+	GetCachedRange(ctx context.Context, ip net.IP) (*model.IPRange, error)
+	SetASN(ctx context.Context, asn uint32, delegation model.ASNDelegation) error
+	GetASN(ctx context.Context, asn uint32) (*model.ASNDelegation, error)
+	CacheASNDelegations(ctx context.Context, table *lookup.ASNTable) error
+	GetCachedASN(ctx context.Context, asn uint32) (*model.ASNDelegation, error)
+}
+
+// RangeIndex is an in-process longest-prefix-match index consulted before
+// the Redis and PostgreSQL tiers.
+type RangeIndex interface {
+	Lookup(ip net.IP) (model.IPRange, bool)
+	Len() int
 }
 
 type IPService struct {
-	repo      Repository
-	cache     Cache
-	rirSvc    *RIRService
-	config    *config.Config
-	logger    *zap.Logger
-	updateMux sync.Mutex
+	repo       Repository
+	cache      Cache
+	rirSvc     *RIRService
+	locker     Locker
+	config     *config.Config
+	logger     *zap.Logger
+	updateMux  sync.Mutex
+	index      atomic.Pointer[RangeIndex]
+	asnIndex   atomic.Pointer[lookup.ASNTable]
+	routes     atomic.Pointer[lookup.RouteTable]
+	routesFrom atomic.Int64 // import the routes come from
+	geofeeds   atomic.Pointer[lookup.GeofeedTable]
+	feedsFrom  atomic.Int64                                 // update the geofeeds come from
+	states     atomic.Pointer[map[string]model.SourceState] // of the published dataset
+	version    atomic.Int64                                 // of the dataset in the index
+	lastUpdate atomic.Pointer[model.UpdateStatus]
+
+	runMux     sync.Mutex
+	running    *updateRun
+	background context.Context // parent of triggered updates, set by Start
 }
 
 func NewIPService(
 	repo Repository,
 	cache Cache,
 	rirSvc *RIRService,
+	locker Locker,
 	config *config.Config,
 	logger *zap.Logger,
 ) *IPService {
@@ -46,181 +107,1196 @@ func NewIPService(
 		repo:   repo,
 		cache:  cache,
 		rirSvc: rirSvc,
+		locker: locker,
 		config: config,
 		logger: logger,
 	}
 }
 
 func (s *IPService) Start(ctx context.Context) error {
-	// Quick check if data exists
-	exists, err := s.checkDataExists(ctx)
+	s.runMux.Lock()
+	s.background = ctx
+	s.runMux.Unlock()
+
+	sched, err := s.config.Schedule()
 	if err != nil {
-		return fmt.Errorf("checking data existence: %w", err)
+		return err
 	}
 
-	if !exists {
+	info, err := s.repo.GetDatasetInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("loading dataset metadata: %w", err)
+	}
+
+	if info == nil {
 		s.logger.Info("No IP ranges found in database, performing initial load")
-		if err := s.UpdateIPRanges(ctx); err != nil {
+		if err := s.initialLoad(ctx); err != nil {
 			return fmt.Errorf("initial IP ranges update failed: %w", err)
 		}
 	} else {
-		s.logger.Info("Existing IP ranges found in database, skipping initial load")
-	}
-
-	// Schedule periodic updates
-	ticker := time.NewTicker(24 * time.Hour)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				if err := s.UpdateIPRanges(ctx); err != nil {
-					s.logger.Error("scheduled IP ranges update failed", zap.Error(err))
+		s.logger.Info("Existing IP ranges found in database, skipping initial load",
+			zap.Int64("version", info.Version),
+			zap.Int64("ranges", info.Ranges),
+			zap.Time("published_at", info.PublishedAt),
+			zap.Time("checked_at", info.CheckedAt))
+		s.reload(ctx, info)
+
+		// Serve the old dataset while a fresh one is fetched
+		if age := time.Since(info.CheckedAt); s.config.MaxDatasetAge > 0 && age > s.config.MaxDatasetAge {
+			s.logger.Warn("IP ranges dataset is too old, refreshing",
+				zap.Duration("age", age),
+				zap.Duration("max_age", s.config.MaxDatasetAge))
+			run, _ := s.startUpdate(ctx, false, model.TriggerStartup)
+			go func() {
+				<-run.done
+				if run.err != nil && !errors.Is(run.err, ErrNotLeader) {
+					s.logger.Error("startup IP ranges refresh failed", zap.Error(run.err))
 				}
-			}
+			}()
 		}
-	}()
+	}
+
+	if err := s.syncRoutes(ctx); err != nil {
+		s.logger.Error("Failed to load BGP routes, lookups will not report origin AS",
+			zap.Error(err))
+	}
+	if err := s.syncGeofeeds(ctx); err != nil {
+		s.logger.Error("Failed to load geofeeds, lookups will not report regions and cities",
+			zap.Error(err))
+	}
+
+	go s.runSchedule(ctx, sched)
+	go s.watchDataset(ctx)
 
 	return nil
 }
 
+// initialLoad loads the first dataset, or waits for the instance holding
+// the update lock to publish it.
+func (s *IPService) initialLoad(ctx context.Context) error {
+	for {
+		err := s.update(ctx, true, model.TriggerStartup)
+		if !errors.Is(err, ErrNotLeader) {
+			return err
+		}
+		s.logger.Info("Another instance is loading IP ranges, waiting for it")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.config.DatasetPollInterval):
+		}
+
+		info, err := s.repo.GetDatasetInfo(ctx)
+		if err != nil {
+			return fmt.Errorf("loading dataset metadata: %w", err)
+		}
+		if info != nil {
+			s.reload(ctx, info)
+			return nil
+		}
+	}
+}
+
+// reload serves the published dataset described by info.
+func (s *IPService) reload(ctx context.Context, info *model.DatasetInfo) {
+	if err := s.loadIndex(ctx); err != nil {
+		s.logger.Error("Failed to build in-memory index, falling back to cache and database",
+			zap.Error(err))
+	} else {
+		s.version.Store(info.Version)
+	}
+	if _, err := s.loadASNIndex(ctx); err != nil {
+		s.logger.Error("Failed to build in-memory ASN index, falling back to cache and database",
+			zap.Error(err))
+	}
+	if states, err := s.repo.GetSourceStates(ctx); err != nil {
+		s.logger.Error("Failed to load RIR source states", zap.Error(err))
+	} else {
+		s.setSourceStates(states)
+	}
+}
+
+// watchDataset reloads datasets published by other instances, newly
+// imported BGP routes and refreshed geofeeds until ctx is done.
+func (s *IPService) watchDataset(ctx context.Context) {
+	ticker := time.NewTicker(s.config.DatasetPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.syncDataset(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("Failed to check for a new IP ranges dataset", zap.Error(err))
+		}
+		if err := s.syncRoutes(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("Failed to check for newly imported BGP routes", zap.Error(err))
+		}
+		if err := s.syncGeofeeds(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("Failed to check for refreshed geofeeds", zap.Error(err))
+		}
+	}
+}
+
+// syncDataset reloads the published dataset if it is not the one served.
+func (s *IPService) syncDataset(ctx context.Context) error {
+	// Waits for an update of this instance to publish first
+	s.updateMux.Lock()
+	defer s.updateMux.Unlock()
+
+	info, err := s.repo.GetDatasetInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("loading dataset metadata: %w", err)
+	}
+	if info == nil || info.Version == s.version.Load() {
+		return nil
+	}
+
+	s.logger.Info("IP ranges dataset published by another instance, reloading",
+		zap.Int64("version", info.Version),
+		zap.Int64("served_version", s.version.Load()))
+	s.reload(ctx, info)
+	return nil
+}
+
+// syncRoutes loads the BGP routes into memory if they were imported since
+// they were last loaded.
+func (s *IPService) syncRoutes(ctx context.Context) error {
+	latest, err := s.repo.LatestRouteImport(ctx)
+	if err != nil {
+		return fmt.Errorf("loading route import: %w", err)
+	}
+	if latest == nil || latest.ID == s.routesFrom.Load() {
+		return nil
+	}
+
+	startTime := time.Now()
+	routes, err := s.repo.LoadRoutes(ctx)
+	if err != nil {
+		return fmt.Errorf("loading BGP routes: %w", err)
+	}
+	s.routes.Store(lookup.NewRouteTable(routes))
+	s.routesFrom.Store(latest.ID)
+
+	s.logger.Info("Built in-memory route index",
+		zap.Int64("import", latest.ID),
+		zap.Time("imported_at", latest.ImportedAt),
+		zap.Int("routes", len(routes)),
+		zap.Duration("duration", time.Since(startTime)))
+	return nil
+}
+
+// syncGeofeeds loads the geofeed entries into memory if they were refreshed
+// since they were last loaded. Without configured geofeeds it does nothing.
+func (s *IPService) syncGeofeeds(ctx context.Context) error {
+	if len(s.config.Geofeeds) == 0 {
+		return nil
+	}
+
+	latest, err := s.repo.LatestGeofeedUpdate(ctx)
+	if err != nil {
+		return fmt.Errorf("loading geofeed update: %w", err)
+	}
+	if latest == nil || latest.ID == s.feedsFrom.Load() {
+		return nil
+	}
+
+	entries, err := s.repo.LoadGeofeeds(ctx)
+	if err != nil {
+		return fmt.Errorf("loading geofeeds: %w", err)
+	}
+	s.geofeeds.Store(lookup.NewGeofeedTable(entries))
+	s.feedsFrom.Store(latest.ID)
+
+	s.logger.Info("Built in-memory geofeed index",
+		zap.Int64("update", latest.ID),
+		zap.Time("updated_at", latest.UpdatedAt),
+		zap.Int("entries", len(entries)))
+	return nil
+}
+
+// updateGeofeeds fetches the enabled geofeeds and saves their entries,
+// replacing those of disabled feeds too. Entries must also lie within a
+// range of the published dataset. Feeds that fail keep their previous
+// entries; errors are only logged, as the geofeeds are layered over the
+// dataset rather than part of it.
+func (s *IPService) updateGeofeeds(ctx context.Context) {
+	index := s.currentIndex()
+	if index == nil || index.Len() == 0 {
+		s.logger.Warn("No published dataset to check geofeeds against, keeping their entries")
+		return
+	}
+
+	var entries []model.GeofeedEntry
+	var kept []string
+	for _, feed := range s.config.Geofeeds {
+		if !feed.Enabled {
+			continue
+		}
+
+		feedEntries, stats, err := s.rirSvc.FetchGeofeed(ctx, feed)
+		if err == nil {
+			feedEntries, stats.Undelegated = delegatedEntries(index, feedEntries)
+			stats.Entries = len(feedEntries)
+			if len(feedEntries) == 0 {
+				err = fmt.Errorf("no entries within the published ranges, %d outside them", stats.Undelegated)
+			}
+		}
+		if err != nil {
+			s.logger.Error("failed to fetch geofeed, keeping its previous entries",
+				zap.String("feed", feed.Name),
+				zap.Error(err))
+			kept = append(kept, feed.Name)
+			continue
+		}
+		s.logger.Info("Fetched geofeed",
+			zap.String("feed", feed.Name),
+			zap.Int("entries", stats.Entries),
+			zap.Int("invalid_entries", stats.Invalid),
+			zap.Int("outside_allocation", stats.OutsideAllocation),
+			zap.Int("undelegated", stats.Undelegated))
+		entries = append(entries, feedEntries...)
+	}
+
+	if _, err := s.repo.SaveGeofeeds(ctx, kept, entries); err != nil {
+		s.logger.Error("Failed to save geofeeds", zap.Error(err))
+		return
+	}
+	if err := s.syncGeofeeds(ctx); err != nil {
+		s.logger.Error("Failed to load geofeeds", zap.Error(err))
+	}
+}
+
+// runSchedule runs updates as scheduled, each delayed by up to the
+// configured jitter, until ctx is done.
+func (s *IPService) runSchedule(ctx context.Context, sched schedule.Schedule) {
+	for {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			s.logger.Warn("Update schedule has no further runs")
+			return
+		}
+		if s.config.UpdateJitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(s.config.UpdateJitter))))
+		}
+		s.logger.Info("Next IP ranges update scheduled", zap.Time("at", next))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := s.UpdateIPRanges(ctx)
+		switch {
+		case errors.Is(err, ErrNotLeader):
+			s.logger.Info("Another instance is updating IP ranges, skipping scheduled update")
+		case err != nil:
+			s.logger.Error("scheduled IP ranges update failed", zap.Error(err))
+		}
+	}
+}
+
 func (s *IPService) UpdateIPRanges(ctx context.Context) error {
+	return s.update(ctx, false, model.TriggerSchedule)
+}
+
+// updateIPRanges with force set reloads every source even if unchanged. Its
+// progress is recorded in the status of run.
+func (s *IPService) updateIPRanges(ctx context.Context, force bool, run *updateRun) (err error) {
 	s.updateMux.Lock()
 	defer s.updateMux.Unlock()
 
-	var allRanges []model.IPRange
-	var errors []error
+	// Only one instance updates the shared dataset; the others reload it
+	lockCtx, release, err := s.locker.TryLock(ctx)
+	if err != nil {
+		return fmt.Errorf("taking update lock: %w", err)
+	}
+	if lockCtx == nil {
+		return ErrNotLeader
+	}
+	defer release()
+	defer func(parent context.Context) {
+		if err != nil && lockCtx.Err() != nil && parent.Err() == nil {
+			err = fmt.Errorf("update lock lost: %w", err)
+		}
+	}(ctx)
+	ctx = lockCtx
+
+	// The dataset the update builds on; publishing fails if another
+	// instance replaced it in the meantime
+	var version int64
+	info, err := s.repo.GetDatasetInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("loading dataset metadata: %w", err)
+	}
+	if info != nil {
+		version = info.Version
+	}
+
+	var fetchErrs []error
 	totalStats := struct {
 		TotalRanges   int
 		IPv4Ranges    int
 		IPv6Ranges    int
 		SkippedRanges int
+		ASNRanges     int
 		ParseErrors   int
+		SplitRecords  int
+		Decomposed    int
 	}{}
 
 	s.logger.Info("Starting IP ranges update")
+	startTime := time.Now()
+
+	// Geofeeds are refreshed once the run ends, so their entries are
+	// checked against the dataset it leaves published
+	if len(s.config.Geofeeds) > 0 {
+		defer s.updateGeofeeds(ctx)
+	}
+
+	prevStates := map[string]model.SourceState{}
+	if !force {
+		if prevStates, err = s.repo.GetSourceStates(ctx); err != nil {
+			return fmt.Errorf("loading RIR source states: %w", err)
+		}
+	}
 
+	// Where sources delegate the same network, the one listed first wins
+	var sources []config.RIR
+	var priority []string
 	for _, rir := range s.config.RIRs {
-		ranges, stats, err := s.rirSvc.FetchIPRanges(ctx, rir.URL)
-		if err != nil {
+		if !rir.Enabled {
+			s.logger.Info("Skipping disabled RIR", zap.String("rir", rir.Name))
+			continue
+		}
+		sources = append(sources, rir)
+		priority = append(priority, rir.Name)
+	}
+
+	// Ranges are streamed from each download straight into the staging
+	// table, one transaction per attempt. The table is only created once a
+	// source is actually loaded, so an update that finds nothing changed
+	// leaves the database alone.
+	var stagingMux sync.Mutex
+	staging := false
+	stage := func(ctx context.Context, load func(emit func(model.IPRange) error) error) error {
+		stagingMux.Lock()
+		if !staging {
+			if err := s.repo.BeginStaging(ctx); err != nil {
+				stagingMux.Unlock()
+				return fmt.Errorf("preparing staging table: %w", err)
+			}
+			staging = true
+		}
+		stagingMux.Unlock()
+
+		return s.repo.SaveIPRanges(ctx, priority, load)
+	}
+
+	results := s.rirSvc.FetchAll(ctx, sources, prevStates, s.config.FetchConcurrency, stage)
+
+	// Disabling or removing a published source changes the dataset even
+	// when every remaining source is unchanged
+	removed := removedSources(prevStates, results)
+	if len(removed) > 0 {
+		s.logger.Info("Dropping IP ranges of sources removed from the configuration",
+			zap.Strings("rirs", removed))
+	}
+	changed := len(removed) > 0
+	for _, result := range results {
+		if result.Err != nil {
 			s.logger.Error("failed to fetch IP ranges",
-				zap.String("rir", rir.Name),
-				zap.Error(err))
-			errors = append(errors, fmt.Errorf("%s: %w", rir.Name, err))
+				zap.String("rir", result.Name),
+				zap.Duration("duration", result.Duration),
+				zap.Error(result.Err))
+			fetchErrs = append(fetchErrs, fmt.Errorf("%s: %w", result.Name, result.Err))
+
+			// Dropping a published source changes the dataset
+			if published(prevStates, result.Name) && s.config.FailurePolicy == config.PolicyDrop {
+				changed = true
+			}
 			continue
 		}
-		allRanges = append(allRanges, ranges...)
+		if !result.Result.NotModified {
+			changed = true
+		}
+	}
+
+	s.recordSources(run, results, prevStates)
+
+	if len(fetchErrs) > 0 && s.config.FailurePolicy == config.PolicyFail {
+		return fmt.Errorf("update aborted, %d RIR sources failed: %w", len(fetchErrs), errors.Join(fetchErrs...))
+	}
+
+	if !changed {
+		// The published dataset and the Redis cache are left alone. Only the
+		// check times are recorded: the source states so their data is not
+		// flagged stale, and the dataset's so startup does not refresh it.
+		s.saveSourceStates(ctx, prevStates, results)
+		if len(fetchErrs) > 0 && len(fetchErrs) == len(results) {
+			return fmt.Errorf("no IP ranges fetched: %w", errors.Join(fetchErrs...))
+		}
+		// Failed sources keep their published ranges, as they would next
+		// to changed sources; the failures are reported with the sources
+		if kept := s.keptSources(prevStates, results); len(kept) > 0 {
+			s.logger.Warn("Kept last known good IP ranges of failed sources",
+				zap.Strings("rirs", kept))
+		}
+		if err := s.repo.MarkDatasetChecked(ctx); err != nil {
+			s.logger.Error("Failed to record dataset check", zap.Error(err))
+		}
+		s.logger.Info("RIR sources unchanged, skipping update")
+		return nil
+	}
+
+	// Only changed sources were loaded; the others keep their published
+	// ranges below, so the staging table may still have to be created
+	if !staging {
+		if err := s.repo.BeginStaging(ctx); err != nil {
+			return fmt.Errorf("preparing staging table: %w", err)
+		}
+		staging = true
+	}
+
+	var present, kept, unchanged []string
+	var versionSources []model.SourceVersion
+	var asns []model.ASNDelegation
+	for _, sourceResult := range results {
+		if sourceResult.Err != nil {
+			if prev := prevStates[sourceResult.Name]; published(prevStates, sourceResult.Name) && s.config.FailurePolicy == config.PolicyKeepStale {
+				kept = append(kept, sourceResult.Name)
+				versionSources = append(versionSources, model.SourceVersion{Name: prev.Name, Serial: prev.Serial, Checksum: prev.Checksum})
+			}
+			continue
+		}
+		rir, result := sourceResult.Name, sourceResult.Result
+		present = append(present, rir)
+		versionSources = append(versionSources, model.SourceVersion{Name: rir, Serial: result.State.Serial, Checksum: result.State.Checksum})
+		if !result.Loaded {
+			unchanged = append(unchanged, rir)
+			continue
+		}
+		asns = append(asns, result.ASNs...)
+
+		stats := result.Stats
 
 		// Update total statistics
 		totalStats.IPv4Ranges += stats.IPv4Count
 		totalStats.IPv6Ranges += stats.IPv6Count
+		totalStats.ASNRanges += stats.ASNCount
 		totalStats.SkippedRanges += stats.SkippedCount
 		totalStats.ParseErrors += stats.ParseErrors
-		totalStats.TotalRanges += len(ranges)
+		totalStats.SplitRecords += stats.SplitRecords
+		totalStats.Decomposed += stats.DecomposedBlocks
+		totalStats.TotalRanges += stats.IPv4Count + stats.IPv6Count
 
 		s.logger.Info("Fetched IP ranges",
-			zap.String("rir", rir.Name),
-			zap.Int("total_ranges", len(ranges)),
+			zap.String("rir", rir),
+			zap.Bool("changed", !result.NotModified),
+			zap.Duration("duration", sourceResult.Duration),
+			zap.Int64("serial", stats.Header.Serial),
+			zap.Time("data_end", stats.Header.EndDate),
+			zap.Int("total_ranges", stats.IPv4Count+stats.IPv6Count),
 			zap.Int("ipv4_ranges", stats.IPv4Count),
 			zap.Int("ipv6_ranges", stats.IPv6Count),
+			zap.Int("asn_ranges", stats.ASNCount),
 			zap.Int("skipped_ranges", stats.SkippedCount),
-			zap.Int("parse_errors", stats.ParseErrors))
+			zap.Int("parse_errors", stats.ParseErrors),
+			zap.Int("split_records", stats.SplitRecords),
+			zap.Int("decomposed_blocks", stats.DecomposedBlocks))
+	}
+
+	if len(present) == 0 {
+		return fmt.Errorf("no IP ranges fetched: %w", errors.Join(fetchErrs...))
+	}
+
+	// Unchanged sources whose download was skipped keep their published
+	// ranges rather than being fetched and parsed again, ranked like the
+	// fresh ones
+	if len(unchanged) > 0 {
+		count, err := s.repo.KeepIPRanges(ctx, unchanged, priority)
+		if err != nil {
+			return fmt.Errorf("keeping IP ranges of unchanged sources: %w", err)
+		}
+		s.logger.Info("Kept published IP ranges of unchanged sources",
+			zap.Strings("rirs", unchanged),
+			zap.Int64("kept_ranges", count))
 	}
 
-	if len(allRanges) == 0 {
-		return fmt.Errorf("no IP ranges fetched: %v", errors)
+	// Failed sources keep their last published ranges; fresh data from
+	// other sources wins where they overlap
+	if len(kept) > 0 {
+		count, err := s.repo.KeepIPRanges(ctx, kept, nil)
+		if err != nil {
+			return fmt.Errorf("keeping IP ranges of failed sources: %w", err)
+		}
+		s.logger.Warn("Kept last known good IP ranges of failed sources",
+			zap.Strings("rirs", kept),
+			zap.Int64("kept_ranges", count))
 	}
 
 	s.logger.Info("Total statistics",
 		zap.Int("total_ranges", totalStats.TotalRanges),
 		zap.Int("ipv4_ranges", totalStats.IPv4Ranges),
 		zap.Int("ipv6_ranges", totalStats.IPv6Ranges),
+		zap.Int("asn_ranges", totalStats.ASNRanges),
 		zap.Int("skipped_ranges", totalStats.SkippedRanges),
-		zap.Int("parse_errors", totalStats.ParseErrors))
+		zap.Int("parse_errors", totalStats.ParseErrors),
+		zap.Int("split_records", totalStats.SplitRecords),
+		zap.Int("decomposed_blocks", totalStats.Decomposed))
 
-	if err := s.repo.ClearIPRanges(ctx); err != nil {
-		return fmt.Errorf("clearing existing IP ranges: %w", err)
+	// Every source was merged and verified in its own transaction
+	staged, err := s.repo.GetStagedCount(ctx)
+	if err != nil {
+		return fmt.Errorf("counting staged IP ranges: %w", err)
+	}
+	if staged == 0 {
+		return fmt.Errorf("staged dataset is empty")
 	}
 
-	startTime := time.Now()
-	err := s.repo.SaveIPRanges(ctx, allRanges)
+	violations, err := s.checkGuardrails(ctx, append(present, kept...))
 	if err != nil {
-		s.logger.Error("Failed to save IP ranges",
-			zap.Error(err),
-			zap.Duration("duration", time.Since(startTime)))
 		return err
 	}
+	if len(violations) > 0 {
+		for _, violation := range violations {
+			s.logger.Error("Guardrail violated, keeping the published dataset",
+				zap.String("violation", violation))
+		}
+		run.update(func(status *model.UpdateStatus) {
+			status.Violations = violations
+		})
+		return fmt.Errorf("dataset rejected by %d guardrails: %s", len(violations), strings.Join(violations, "; "))
+	}
 
-	// Cache the ranges in Redis
-	if err := s.cache.CacheIPRanges(ctx, allRanges); err != nil {
-		s.logger.Error("Failed to cache IP ranges",
-			zap.Error(err),
-			zap.Duration("duration", time.Since(startTime)))
-		// Don't return error as database update was successful
+	// Failed and unchanged sources keep their AS number delegations like
+	// their ranges
+	if err := s.repo.SaveASNDelegations(ctx, append(kept, unchanged...), asns); err != nil {
+		return fmt.Errorf("saving ASN delegations: %w", err)
+	}
+
+	newVersion, err := s.repo.SwapIPRanges(ctx, version, versionSources)
+	if err != nil {
+		return fmt.Errorf("publishing IP ranges: %w", err)
 	}
 
+	// The new dataset is live; finish serving it even if cancelled now
+	ctx = context.WithoutCancel(ctx)
+
+	if _, err := s.publish(ctx); err != nil {
+		return err
+	}
+	s.version.Store(newVersion)
+
+	if err := s.repo.SaveDatasetHistory(ctx, newVersion, s.config.DatasetHistory); err != nil {
+		s.logger.Error("Failed to save dataset history", zap.Error(err))
+	}
+	s.recordChanges(ctx, run, newVersion)
+
+	s.saveSourceStates(ctx, prevStates, results)
+
 	s.logger.Info("Successfully saved IP ranges",
-		zap.Int("total_ranges", len(allRanges)),
+		zap.Int64("dataset_version", newVersion),
+		zap.Int64("total_ranges", staged),
 		zap.Duration("duration", time.Since(startTime)))
 
 	return nil
 }
 
+// recordChanges reports the changes made to each source's ranges by
+// publishing version.
+func (s *IPService) recordChanges(ctx context.Context, run *updateRun, version int64) {
+	diff, err := s.repo.GetDatasetDiff(ctx, model.DiffQuery{To: version})
+	if err != nil {
+		s.logger.Error("Failed to load dataset changes", zap.Error(err))
+		return
+	}
+
+	for _, source := range diff.Sources {
+		s.logger.Info("Changed IP ranges",
+			zap.String("rir", source.Source),
+			zap.Int64("added", source.Added),
+			zap.Int64("removed", source.Removed),
+			zap.Int64("country_changed", source.CountryChanged))
+	}
+	run.update(func(status *model.UpdateStatus) {
+		status.Changes = diff.Sources
+	})
+}
+
+// saveSourceStates records the state of every source once the dataset it
+// describes is published. Failed sources keep the state of the data kept
+// for them; a dropped source's validators are reset so it is loaded again
+// as soon as it recovers, and so are those of sources removed from the
+// configuration.
+func (s *IPService) saveSourceStates(ctx context.Context, prevStates map[string]model.SourceState, results []SourceResult) {
+	current := make(map[string]model.SourceState, len(prevStates))
+	for name, state := range prevStates {
+		current[name] = state
+	}
+
+	var states []model.SourceState
+	for _, result := range results {
+		if result.Err == nil {
+			states = append(states, result.Result.State)
+			current[result.Name] = result.Result.State
+			continue
+		}
+
+		if published(prevStates, result.Name) && s.config.FailurePolicy == config.PolicyDrop {
+			reset := model.SourceState{Name: result.Name, UpdatedAt: prevStates[result.Name].UpdatedAt}
+			states = append(states, reset)
+			current[result.Name] = reset
+		}
+	}
+	for _, name := range removedSources(prevStates, results) {
+		reset := model.SourceState{Name: name, UpdatedAt: prevStates[name].UpdatedAt}
+		states = append(states, reset)
+		current[name] = reset
+	}
+	s.setSourceStates(current)
+
+	if len(states) > 0 {
+		if err := s.repo.SaveSourceStates(ctx, states); err != nil {
+			// The next update just downloads everything again
+			s.logger.Error("Failed to save RIR source states", zap.Error(err))
+		}
+	}
+
+	if stale := s.StaleSources(); len(stale) > 0 {
+		s.logger.Error("RIR source data is stale",
+			zap.Strings("rirs", stale),
+			zap.Duration("max_staleness", s.config.MaxStaleness))
+	}
+}
+
+// recordSources records the outcome of every source in the status of run.
+func (s *IPService) recordSources(run *updateRun, results []SourceResult, prevStates map[string]model.SourceState) {
+	sources := make([]model.SourceUpdate, 0, len(results))
+	for _, result := range results {
+		source := model.SourceUpdate{Name: result.Name, DurationMS: result.Duration.Milliseconds()}
+		if result.Err != nil {
+			source.Error = result.Err.Error()
+			source.Kept = published(prevStates, result.Name) && s.config.FailurePolicy == config.PolicyKeepStale
+		} else {
+			stats, state := result.Result.Stats, result.Result.State
+			source.Changed = !result.Result.NotModified
+			source.Serial = state.Serial
+			if !state.StartDate.IsZero() {
+				source.StartDate = state.StartDate.Format(time.DateOnly)
+			}
+			if !state.EndDate.IsZero() {
+				source.EndDate = state.EndDate.Format(time.DateOnly)
+			}
+			source.IPv4Ranges = stats.IPv4Count
+			source.IPv6Ranges = stats.IPv6Count
+		}
+		sources = append(sources, source)
+	}
+
+	run.update(func(status *model.UpdateStatus) {
+		status.Sources = sources
+	})
+}
+
+// published reports whether the current dataset holds ranges of the source.
+// A dropped source is recorded without a location.
+func published(states map[string]model.SourceState, name string) bool {
+	return states[name].Location != ""
+}
+
+// keptSources returns the failed sources whose last published ranges are
+// kept by the failure policy.
+func (s *IPService) keptSources(prevStates map[string]model.SourceState, results []SourceResult) []string {
+	var kept []string
+	for _, result := range results {
+		if result.Err != nil && published(prevStates, result.Name) && s.config.FailurePolicy == config.PolicyKeepStale {
+			kept = append(kept, result.Name)
+		}
+	}
+	return kept
+}
+
+// removedSources returns the published sources that were not fetched, having
+// been disabled or removed from the configuration, sorted by name.
+func removedSources(states map[string]model.SourceState, results []SourceResult) []string {
+	fetched := make(map[string]bool, len(results))
+	for _, result := range results {
+		fetched[result.Name] = true
+	}
+
+	var removed []string
+	for name := range states {
+		if !fetched[name] && published(states, name) {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// RollbackIPRanges restores the dataset that was replaced by the last update.
+// It fails with ErrUpdateInProgress or ErrNotLeader rather than waiting for
+// an update to finish.
+func (s *IPService) RollbackIPRanges(ctx context.Context) error {
+	if !s.updateMux.TryLock() {
+		return ErrUpdateInProgress
+	}
+	defer s.updateMux.Unlock()
+
+	lockCtx, release, err := s.locker.TryLock(ctx)
+	if err != nil {
+		return fmt.Errorf("taking update lock: %w", err)
+	}
+	if lockCtx == nil {
+		return ErrNotLeader
+	}
+	defer release()
+	ctx = lockCtx
+
+	if err := s.repo.RollbackIPRanges(ctx); err != nil {
+		return fmt.Errorf("rolling back IP ranges: %w", err)
+	}
+
+	// The recorded source states describe the replaced dataset
+	if err := s.repo.ClearSourceStates(ctx); err != nil {
+		s.logger.Error("Failed to clear RIR source states", zap.Error(err))
+	}
+	s.setSourceStates(nil)
+
+	count, err := s.publish(ctx)
+	if err != nil {
+		return err
+	}
+	if info, err := s.repo.GetDatasetInfo(ctx); err != nil {
+		s.logger.Error("Failed to load dataset metadata", zap.Error(err))
+	} else if info != nil {
+		s.version.Store(info.Version)
+	}
+
+	s.logger.Info("Rolled back to previous IP ranges dataset",
+		zap.Int("total_ranges", count))
+
+	return nil
+}
+
+// publish rebuilds the in-memory and Redis lookup tiers from the dataset in
+// PostgreSQL and returns its size. The index holds the only in-memory copy
+// of the ranges; the Redis cache is streamed from it.
+func (s *IPService) publish(ctx context.Context) (int, error) {
+	ranges, err := s.repo.LoadIPRanges(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("loading IP ranges: %w", err)
+	}
+
+	table := lookup.NewTable(ranges)
+	s.setIndex(table)
+
+	if err := s.cache.CacheIPRanges(ctx, table); err != nil {
+		// Don't return error as database update was successful
+		s.logger.Error("Failed to cache IP ranges", zap.Error(err))
+	}
+
+	if asnTable, err := s.loadASNIndex(ctx); err != nil {
+		s.logger.Error("Failed to build in-memory ASN index", zap.Error(err))
+	} else if err := s.cache.CacheASNDelegations(ctx, asnTable); err != nil {
+		s.logger.Error("Failed to cache ASN delegations", zap.Error(err))
+	}
+
+	return len(ranges), nil
+}
+
+// LookupIP resolves ipStr through the in-memory index, the Redis cache and
+// the database, adding the origin AS of the route to it and the location
+// its geofeed gives when known.
 func (s *IPService) LookupIP(ctx context.Context, ipStr string) (*model.IPResponse, error) {
-	// Try direct IP cache first
-	if countryCode, err := s.cache.GetCountry(ctx, ipStr); err == nil && countryCode != "" {
+	resp, err := s.lookupIP(ctx, ipStr)
+	if err != nil {
+		return nil, err
+	}
+	s.annotate(resp)
+	return resp, nil
+}
+
+func (s *IPService) lookupIP(ctx context.Context, ipStr string) (*model.IPResponse, error) {
+	// A loaded in-memory index holds the whole dataset, so it answers misses
+	// too; Redis and the database are only asked before it is loaded
+	if index := s.currentIndex(); index != nil && index.Len() > 0 {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", ipStr)
+		}
+		if ipRange, ok := index.Lookup(ip); ok {
+			return model.NewIPResponse(ipStr, ipRange), nil
+		}
 		return &model.IPResponse{
-			IP:          ipStr,
-			CountryCode: countryCode,
+			IP:             ipStr,
+			CountryCode:    "ZZ", // ZZ for unknown/not found
+			DatasetVersion: s.version.Load(),
 		}, nil
 	}
 
+	// Try direct IP cache, keyed by the served version so a swap or rollback
+	// never answers from entries cached for another dataset
+	version := s.version.Load()
+	if ipRange, err := s.cache.GetIPRange(ctx, version, ipStr); err == nil && ipRange != nil {
+		return model.NewIPResponse(ipStr, *ipRange), nil
+	}
+
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return nil, fmt.Errorf("invalid IP address: %s", ipStr)
 	}
 
 	// Try cached ranges
-	if countryCode, err := s.cache.GetCachedRange(ctx, ip); err == nil && countryCode != "" {
+	if ipRange, err := s.cache.GetCachedRange(ctx, ip); err == nil && ipRange != nil {
 		// Cache the specific IP for faster future lookups
-		if err := s.cache.SetCountry(ctx, ipStr, countryCode); err != nil {
+		if err := s.cache.SetIPRange(ctx, version, ipStr, *ipRange); err != nil {
 			s.logger.Warn("failed to cache IP lookup result",
 				zap.String("ip", ipStr),
 				zap.Error(err))
 		}
+		return model.NewIPResponse(ipStr, *ipRange), nil
+	}
+
+	// Fall back to database
+	ipRange, err := s.repo.FindRangeForIP(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't cache unknown results
+	if ipRange == nil {
 		return &model.IPResponse{
-			IP:          ipStr,
-			CountryCode: countryCode,
+			IP:             ipStr,
+			CountryCode:    "ZZ", // ZZ for unknown/not found
+			DatasetVersion: s.version.Load(),
 		}, nil
 	}
 
+	if err := s.cache.SetIPRange(ctx, version, ipStr, *ipRange); err != nil {
+		s.logger.Warn("failed to cache IP lookup result",
+			zap.String("ip", ipStr),
+			zap.Error(err))
+	}
+
+	return model.NewIPResponse(ipStr, *ipRange), nil
+}
+
+// LookupASN resolves an AS number through the same tiers as LookupIP: the
+// in-memory index, the Redis cache and the database.
+func (s *IPService) LookupASN(ctx context.Context, asn uint32) (*model.ASNResponse, error) {
+	if index := s.asnIndex.Load(); index != nil && index.Len() > 0 {
+		if delegation, ok := index.Lookup(asn); ok {
+			return model.NewASNResponse(asn, delegation), nil
+		}
+	}
+
+	// Try direct ASN cache
+	if delegation, err := s.cache.GetASN(ctx, asn); err == nil && delegation != nil {
+		return model.NewASNResponse(asn, *delegation), nil
+	}
+
+	// Try cached delegations
+	if delegation, err := s.cache.GetCachedASN(ctx, asn); err == nil && delegation != nil {
+		if err := s.cache.SetASN(ctx, asn, *delegation); err != nil {
+			s.logger.Warn("failed to cache ASN lookup result",
+				zap.Uint32("asn", asn),
+				zap.Error(err))
+		}
+		return model.NewASNResponse(asn, *delegation), nil
+	}
+
 	// Fall back to database
-	countryCode, err := s.repo.FindCountryForIP(ctx, ip)
+	delegation, err := s.repo.FindASNDelegation(ctx, asn)
 	if err != nil {
 		return nil, err
 	}
 
 	// Don't cache unknown results
-	if countryCode != "ZZ" {
-		if err := s.cache.SetCountry(ctx, ipStr, countryCode); err != nil {
-			s.logger.Warn("failed to cache IP lookup result",
-				zap.String("ip", ipStr),
+	if delegation == nil {
+		return &model.ASNResponse{
+			ASN:         asn,
+			CountryCode: "ZZ", // ZZ for unknown/not found
+		}, nil
+	}
+
+	if err := s.cache.SetASN(ctx, asn, *delegation); err != nil {
+		s.logger.Warn("failed to cache ASN lookup result",
+			zap.Uint32("asn", asn),
+			zap.Error(err))
+	}
+
+	return model.NewASNResponse(asn, *delegation), nil
+}
+
+// LookupIPAt resolves ipStr as delegated at the given date, according to
+// the imported delegation archives.
+func (s *IPService) LookupIPAt(ctx context.Context, ipStr string, at time.Time) (*model.IPResponse, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", ipStr)
+	}
+
+	historical, err := s.repo.FindRangeForIPAt(ctx, ip, at)
+	if err != nil {
+		return nil, err
+	}
+	if historical == nil {
+		return &model.IPResponse{
+			IP:          ipStr,
+			CountryCode: "ZZ", // ZZ for unknown/not found
+		}, nil
+	}
+
+	resp := model.NewIPResponse(ipStr, historical.IPRange)
+	resp.ValidFrom = historical.ValidFrom.Format(time.DateOnly)
+	if !historical.ValidTo.IsZero() {
+		resp.ValidTo = historical.ValidTo.Format(time.DateOnly)
+	}
+	return resp, nil
+}
+
+// LookupIPs resolves a batch of addresses. Once the in-memory index is
+// loaded it answers every address; before that, addresses are looked up with
+// one pipelined Redis round trip and the remaining misses with a single
+// database query. Per-address failures are reported in the corresponding
+// result rather than failing the whole batch.
+func (s *IPService) LookupIPs(ctx context.Context, ipStrs []string) ([]model.BatchLookupResult, error) {
+	if s.config.MaxBatchSize > 0 && len(ipStrs) > s.config.MaxBatchSize {
+		return nil, fmt.Errorf("batch too large: %d addresses, maximum is %d", len(ipStrs), s.config.MaxBatchSize)
+	}
+
+	results := make([]model.BatchLookupResult, len(ipStrs))
+	ips := make([]net.IP, len(ipStrs))
+	var pending []int
+
+	index := s.currentIndex()
+	for i, ipStr := range ipStrs {
+		results[i].IP = ipStr
+
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			results[i].Error = fmt.Sprintf("invalid IP address: %s", ipStr)
+			continue
+		}
+		ips[i] = ip
+
+		if index != nil && index.Len() > 0 {
+			if ipRange, ok := index.Lookup(ip); ok {
+				results[i].IPResponse = *model.NewIPResponse(ipStr, ipRange)
+			} else {
+				results[i].Error = "no country information found for this IP"
+			}
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	if len(pending) == 0 {
+		return s.annotateAll(results), nil
+	}
+
+	// Pipelined direct IP cache lookups
+	version := s.version.Load()
+	keys := make([]string, len(pending))
+	for j, i := range pending {
+		keys[j] = ipStrs[i]
+	}
+	if cached, err := s.cache.GetIPRanges(ctx, version, keys); err == nil {
+		misses := pending[:0]
+		for j, i := range pending {
+			if cached[j] != nil {
+				results[i].IPResponse = *model.NewIPResponse(ipStrs[i], *cached[j])
+				continue
+			}
+			misses = append(misses, i)
+		}
+		pending = misses
+	} else {
+		s.logger.Warn("failed to get batch lookup results from cache", zap.Error(err))
+	}
+
+	if len(pending) == 0 {
+		return s.annotateAll(results), nil
+	}
+
+	// Single set-based database query for the remaining misses
+	missIPs := make([]net.IP, len(pending))
+	for j, i := range pending {
+		missIPs[j] = ips[i]
+	}
+	ranges, err := s.repo.FindRangesForIPs(ctx, missIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]model.IPRange, len(pending))
+	for j, i := range pending {
+		if ranges[j] == nil {
+			results[i].Error = "no country information found for this IP"
+			continue
+		}
+		results[i].IPResponse = *model.NewIPResponse(ipStrs[i], *ranges[j])
+		found[ipStrs[i]] = *ranges[j]
+	}
+
+	if len(found) > 0 {
+		if err := s.cache.SetIPRanges(ctx, version, found); err != nil {
+			s.logger.Warn("failed to cache batch lookup results",
+				zap.Int("count", len(found)),
 				zap.Error(err))
 		}
 	}
 
-	return &model.IPResponse{
-		IP:          ipStr,
-		CountryCode: countryCode,
-	}, nil
+	return s.annotateAll(results), nil
 }
 
-func (s *IPService) checkDataExists(ctx context.Context) (bool, error) {
-	count, err := s.repo.GetRangesCount(ctx)
+// annotate adds the origin AS of the most specific route to the address of
+// resp, and layers the most specific geofeed entry containing it over the
+// RIR data. Both are only looked up in memory. Geofeeds only refine answers
+// from a RIR range; they never locate unallocated addresses.
+func (s *IPService) annotate(resp *model.IPResponse) {
+	routes, geofeeds := s.routes.Load(), s.geofeeds.Load()
+	if routes == nil && geofeeds == nil {
+		return
+	}
+	ip := net.ParseIP(resp.IP)
+	if ip == nil {
+		return
+	}
+
+	if routes != nil {
+		if route, ok := routes.Lookup(ip); ok {
+			resp.ASN = route.OriginASN
+			resp.ASPrefix = route.Prefix.String()
+		}
+	}
+	if geofeeds != nil && resp.CountryCode != "ZZ" {
+		if entry, ok := geofeeds.Lookup(ip); ok {
+			// The operator knows better where its addresses are used
+			if entry.CountryCode != "" {
+				resp.CountryCode = entry.CountryCode
+			}
+			resp.Region = entry.Region
+			resp.City = entry.City
+			resp.PostalCode = entry.PostalCode
+		}
+	}
+}
+
+// annotateAll annotates the resolved results of a batch.
+func (s *IPService) annotateAll(results []model.BatchLookupResult) []model.BatchLookupResult {
+	for i := range results {
+		if results[i].Error == "" {
+			s.annotate(&results[i].IPResponse)
+		}
+	}
+	return results
+}
+
+func (s *IPService) loadIndex(ctx context.Context) error {
+	startTime := time.Now()
+
+	ranges, err := s.repo.LoadIPRanges(ctx)
+	if err != nil {
+		return fmt.Errorf("loading IP ranges: %w", err)
+	}
+
+	s.setIndex(lookup.NewTable(ranges))
+
+	s.logger.Info("Built in-memory index",
+		zap.Int("total_ranges", len(ranges)),
+		zap.Duration("duration", time.Since(startTime)))
+
+	return nil
+}
+
+// loadASNIndex builds the in-memory ASN index from the database.
+func (s *IPService) loadASNIndex(ctx context.Context) (*lookup.ASNTable, error) {
+	delegations, err := s.repo.LoadASNDelegations(ctx)
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("loading ASN delegations: %w", err)
+	}
+
+	table := lookup.NewASNTable(delegations)
+	s.asnIndex.Store(table)
+	return table, nil
+}
+
+func (s *IPService) setIndex(index RangeIndex) {
+	s.index.Store(&index)
+}
+
+func (s *IPService) currentIndex() RangeIndex {
+	index := s.index.Load()
+	if index == nil {
+		return nil
+	}
+	return *index
+}
+
+// Status describes the published dataset, the update in progress and the
+// most recent finished update.
+func (s *IPService) Status() model.ServiceStatus {
+	status := model.ServiceStatus{
+		DatasetVersion: s.version.Load(),
+		CurrentUpdate:  s.currentUpdate(),
+		LastUpdate:     s.lastUpdate.Load(),
+		StaleSources:   s.StaleSources(),
+	}
+	if index := s.currentIndex(); index != nil {
+		status.Ranges = index.Len()
+	}
+	return status
+}
+
+// DatasetVersions returns the latest limit published dataset versions,
+// newest first.
+func (s *IPService) DatasetVersions(ctx context.Context, limit int) ([]model.DatasetVersion, error) {
+	return s.repo.ListDatasetVersions(ctx, limit)
+}
+
+// DatasetDiff returns the changes between two dataset versions matching q.
+// Without q.To, it describes the served version.
+func (s *IPService) DatasetDiff(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+	if q.To == 0 {
+		if q.To = s.version.Load(); q.To == 0 {
+			return nil, fmt.Errorf("dataset version not found: no dataset is published")
+		}
+	}
+	return s.repo.GetDatasetDiff(ctx, q)
+}
+
+func (s *IPService) setSourceStates(states map[string]model.SourceState) {
+	s.states.Store(&states)
+}
+
+// StaleSources returns the enabled sources whose published data was last
+// confirmed current longer than MaxStaleness ago, e.g. because failing
+// downloads kept their previous ranges.
+func (s *IPService) StaleSources() []string {
+	if s.config.MaxStaleness <= 0 {
+		return nil
+	}
+	states := s.states.Load()
+	if states == nil {
+		return nil
+	}
+
+	var stale []string
+	for _, rir := range s.config.RIRs {
+		state, ok := (*states)[rir.Name]
+		if rir.Enabled && ok && time.Since(state.UpdatedAt) > s.config.MaxStaleness {
+			stale = append(stale, rir.Name)
+		}
 	}
-	return count > 0, nil
+	return stale
 }
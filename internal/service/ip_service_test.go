@@ -2,12 +2,21 @@ package service
 
 import (
 	"context"
+	"errors"
 	"go.uber.org/zap"
 	"ipservice/internal/config"
+	"ipservice/internal/lookup"
 	"ipservice/internal/model"
 	"ipservice/tests/mocks"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestIPService_LookupIP(t *testing.T) {
@@ -53,6 +62,17 @@ func TestIPService_LookupIP(t *testing.T) {
 				CountryCode: "US",
 			},
 		},
+		{
+			name:          "cache miss, repo miss",
+			ip:            "192.0.2.1",
+			cacheResponse: "",
+			cachedRange:   "",
+			repoResponse:  "",
+			expected: &model.IPResponse{
+				IP:          "192.0.2.1",
+				CountryCode: "ZZ",
+			},
+		},
 		{
 			name:          "invalid ip",
 			ip:            "invalid",
@@ -63,27 +83,27 @@ func TestIPService_LookupIP(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockCache := &mocks.MockCache{
-				GetCountryFunc: func(ctx context.Context, ip string) (string, error) {
-					return tt.cacheResponse, tt.cacheError
+				GetIPRangeFunc: func(ctx context.Context, version int64, ip string) (*model.IPRange, error) {
+					return rangeFor(tt.cacheResponse), tt.cacheError
 				},
-				SetCountryFunc: func(ctx context.Context, ip, countryCode string) error {
+				SetIPRangeFunc: func(ctx context.Context, version int64, ip string, ipRange model.IPRange) error {
 					return nil
 				},
-				GetCachedRangeFunc: func(ctx context.Context, ip net.IP) (string, error) {
-					return tt.cachedRange, tt.rangeError
+				GetCachedRangeFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+					return rangeFor(tt.cachedRange), tt.rangeError
 				},
 			}
 
 			mockRepo := &mocks.MockRepository{
-				FindCountryForIPFunc: func(ctx context.Context, ip net.IP) (string, error) {
-					return tt.repoResponse, tt.repoError
+				FindRangeForIPFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+					return rangeFor(tt.repoResponse), tt.repoError
 				},
 			}
 
 			logger, _ := zap.NewDevelopment()
 			cfg := &config.Config{}
 			rirSvc := NewRIRService(logger)
-			svc := NewIPService(mockRepo, mockCache, rirSvc, cfg, logger)
+			svc := NewIPService(mockRepo, mockCache, rirSvc, NewMemoryLocker(), cfg, logger)
 
 			result, err := svc.LookupIP(context.Background(), tt.ip)
 
@@ -105,3 +125,1417 @@ func TestIPService_LookupIP(t *testing.T) {
 		})
 	}
 }
+
+// rangeFor returns a range for countryCode, or nil when it is empty.
+func rangeFor(countryCode string) *model.IPRange {
+	if countryCode == "" {
+		return nil
+	}
+	return &model.IPRange{CountryCode: countryCode}
+}
+
+func TestIPService_LookupIP_Details(t *testing.T) {
+	_, network, _ := net.ParseCIDR("8.8.8.0/24")
+	ipRange := &model.IPRange{
+		Network:     *network,
+		CountryCode: "US",
+		Version:     4,
+		Registry:    "arin",
+		Status:      "allocated",
+		AllocatedAt: time.Date(1992, 12, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	mockCache := &mocks.MockCache{
+		GetIPRangeFunc: func(ctx context.Context, version int64, ip string) (*model.IPRange, error) {
+			return nil, nil
+		},
+		GetCachedRangeFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+			return nil, nil
+		},
+		SetIPRangeFunc: func(ctx context.Context, version int64, ip string, cached model.IPRange) error {
+			return nil
+		},
+	}
+	mockRepo := &mocks.MockRepository{
+		FindRangeForIPFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+			return ipRange, nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), &config.Config{}, logger)
+
+	result, err := svc.LookupIP(context.Background(), "8.8.8.8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := model.IPResponse{
+		IP:          "8.8.8.8",
+		CountryCode: "US",
+		Network:     "8.8.8.0/24",
+		Registry:    "arin",
+		Status:      "allocated",
+		AllocatedAt: "1992-12-01",
+	}
+	if *result != expected {
+		t.Errorf("expected %+v, got %+v", expected, *result)
+	}
+}
+
+// TestIPService_LookupIP_CacheVersion checks answers cached for one dataset
+// version are not served once another version is published.
+func TestIPService_LookupIP_CacheVersion(t *testing.T) {
+	type cacheKey struct {
+		version int64
+		ip      string
+	}
+	cached := make(map[cacheKey]model.IPRange)
+	key := func(version int64, ip string) cacheKey { return cacheKey{version, ip} }
+
+	mockCache := &mocks.MockCache{
+		GetIPRangeFunc: func(ctx context.Context, version int64, ip string) (*model.IPRange, error) {
+			if ipRange, ok := cached[key(version, ip)]; ok {
+				return &ipRange, nil
+			}
+			return nil, nil
+		},
+		GetCachedRangeFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+			return nil, nil
+		},
+		SetIPRangeFunc: func(ctx context.Context, version int64, ip string, ipRange model.IPRange) error {
+			cached[key(version, ip)] = ipRange
+			return nil
+		},
+	}
+
+	countryCode := "US"
+	var dbLookups int
+	mockRepo := &mocks.MockRepository{
+		FindRangeForIPFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+			dbLookups++
+			return rangeFor(countryCode), nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), &config.Config{}, logger)
+	ctx := context.Background()
+
+	lookupCountry := func() string {
+		t.Helper()
+		result, err := svc.LookupIP(ctx, "192.0.2.1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return result.CountryCode
+	}
+
+	svc.version.Store(1)
+	if got := lookupCountry(); got != "US" || dbLookups != 1 {
+		t.Fatalf("expected US from the database, got %s after %d lookups", got, dbLookups)
+	}
+	if got := lookupCountry(); got != "US" || dbLookups != 1 {
+		t.Fatalf("expected US from the cache, got %s after %d lookups", got, dbLookups)
+	}
+
+	// Version 2 reassigns the range, then is rolled back to version 1
+	countryCode = "CA"
+	svc.version.Store(2)
+	if got := lookupCountry(); got != "CA" || dbLookups != 2 {
+		t.Errorf("expected CA from the database after the swap, got %s after %d lookups", got, dbLookups)
+	}
+	svc.version.Store(1)
+	if got := lookupCountry(); got != "US" || dbLookups != 2 {
+		t.Errorf("expected US cached for version 1 after the rollback, got %s after %d lookups", got, dbLookups)
+	}
+}
+
+func TestIPService_LookupIP_Index(t *testing.T) {
+	_, network, _ := net.ParseCIDR("8.8.8.0/24")
+
+	mockCache := &mocks.MockCache{
+		GetIPRangeFunc: func(ctx context.Context, version int64, ip string) (*model.IPRange, error) {
+			t.Error("unexpected cache lookup")
+			return nil, nil
+		},
+		GetCachedRangeFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+			t.Error("unexpected range cache lookup")
+			return nil, nil
+		},
+		GetIPRangesFunc: func(ctx context.Context, version int64, ips []string) ([]*model.IPRange, error) {
+			t.Error("unexpected batch cache lookup")
+			return make([]*model.IPRange, len(ips)), nil
+		},
+	}
+	mockRepo := &mocks.MockRepository{
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return &model.DatasetInfo{Version: 3, PublishedAt: time.Now(), CheckedAt: time.Now(), Ranges: 1}, nil
+		},
+		LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+			return nil, nil
+		},
+		LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+			return []model.IPRange{{Network: *network, CountryCode: "US", Version: 4}}, nil
+		},
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return nil, nil
+		},
+		FindRangeForIPFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+			t.Error("unexpected database lookup")
+			return nil, nil
+		},
+		FindRangesForIPsFunc: func(ctx context.Context, ips []net.IP) ([]*model.IPRange, error) {
+			t.Error("unexpected batch database lookup")
+			return make([]*model.IPRange, len(ips)), nil
+		},
+		LatestRouteImportFunc: func(ctx context.Context) (*model.RouteImport, error) {
+			return &model.RouteImport{ID: 1, Routes: 1}, nil
+		},
+		LoadRoutesFunc: func(ctx context.Context) ([]model.Route, error) {
+			_, prefix, _ := net.ParseCIDR("8.8.8.0/24")
+			return []model.Route{{Prefix: *prefix, OriginASN: 15169}}, nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), &config.Config{UpdateSchedule: "24h", DatasetPollInterval: time.Minute}, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := svc.Start(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, err := svc.LookupIP(ctx, "8.8.8.8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.CountryCode != "US" {
+		t.Errorf("expected US, got %s", result.CountryCode)
+	}
+	if result.ASN != 15169 || result.ASPrefix != "8.8.8.0/24" {
+		t.Errorf("expected AS15169 for 8.8.8.0/24, got AS%d for %q", result.ASN, result.ASPrefix)
+	}
+
+	// The loaded index answers misses without asking Redis or the database
+	result, err = svc.LookupIP(ctx, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.CountryCode != "ZZ" || result.DatasetVersion != 3 {
+		t.Errorf("expected ZZ from version 3 for an unallocated address, got %+v", result)
+	}
+
+	results, err := svc.LookupIPs(ctx, []string{"8.8.8.8", "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if results[0].ASN != 15169 || results[0].ASPrefix != "8.8.8.0/24" {
+		t.Errorf("expected AS15169 for 8.8.8.0/24 in batch, got %+v", results[0])
+	}
+	if results[1].Error == "" {
+		t.Errorf("expected no country information for 10.0.0.1 in batch, got %+v", results[1])
+	}
+
+	if _, err := svc.LookupIP(ctx, "invalid"); err == nil {
+		t.Error("expected error for invalid IP, got nil")
+	}
+}
+
+func TestIPService_Start_DatasetAge(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    *model.DatasetInfo
+		trigger string // of the update started by Start, if any
+	}{
+		{name: "no dataset", trigger: model.TriggerStartup},
+		{name: "fresh dataset", info: &model.DatasetInfo{CheckedAt: time.Now().Add(-time.Hour), Ranges: 1}},
+		{name: "old dataset", info: &model.DatasetInfo{CheckedAt: time.Now().Add(-48 * time.Hour), Ranges: 1}, trigger: model.TriggerStartup},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo := &mocks.MockRepository{
+				GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+					return tt.info, nil
+				},
+				LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+					return nil, nil
+				},
+				LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+					return nil, nil
+				},
+				GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+					return nil, nil
+				},
+				MarkDatasetCheckedFunc: func(ctx context.Context) error {
+					return nil
+				},
+				LatestRouteImportFunc: func(ctx context.Context) (*model.RouteImport, error) {
+					return nil, nil
+				},
+			}
+
+			cfg := &config.Config{UpdateSchedule: "24h", MaxDatasetAge: 36 * time.Hour, DatasetPollInterval: time.Minute}
+			logger, _ := zap.NewDevelopment()
+			svc := NewIPService(mockRepo, &mocks.MockCache{}, NewRIRService(logger), NewMemoryLocker(), cfg, logger)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := svc.Start(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			update := svc.currentUpdate()
+			if update == nil {
+				update = svc.lastUpdate.Load()
+			}
+			switch {
+			case tt.trigger == "" && update != nil:
+				t.Errorf("expected no update, got %+v", update)
+			case tt.trigger != "" && (update == nil || update.Trigger != tt.trigger):
+				t.Errorf("expected a %s update, got %+v", tt.trigger, update)
+			}
+		})
+	}
+}
+
+// stageInto returns a sink that appends the ranges of every successful load
+// to saved. It is safe for concurrent use.
+func stageInto(saved *[]model.IPRange) RangeSink {
+	var mu sync.Mutex
+	return func(ctx context.Context, load func(emit func(model.IPRange) error) error) error {
+		var attempt []model.IPRange
+		err := load(func(ipRange model.IPRange) error {
+			attempt = append(attempt, ipRange)
+			return nil
+		})
+		if err == nil {
+			mu.Lock()
+			*saved = append(*saved, attempt...)
+			mu.Unlock()
+		}
+		return err
+	}
+}
+
+// saveInto returns a SaveIPRanges mock that stages into saved like
+// stageInto, ignoring the source priority.
+func saveInto(saved *[]model.IPRange) func(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error {
+	sink := stageInto(saved)
+	return func(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error {
+		return sink(ctx, load)
+	}
+}
+
+// guardStaged sets up the guardrail queries of repo to count the ranges in
+// staged and published.
+func guardStaged(repo *mocks.MockRepository, staged *[]model.IPRange, published []model.IPRange) {
+	repo.CountStagedIPRangesFunc = func(ctx context.Context) ([]model.RangeCount, error) {
+		return countRanges(*staged), nil
+	}
+	repo.CountIPRangesFunc = func(ctx context.Context) ([]model.RangeCount, error) {
+		return countRanges(published), nil
+	}
+	repo.FindStagedConflictsFunc = func(ctx context.Context, limit int) ([]model.RangeConflict, error) {
+		return nil, nil
+	}
+}
+
+func countRanges(ranges []model.IPRange) []model.RangeCount {
+	var counts []model.RangeCount
+	for _, ipRange := range ranges {
+		counts = append(counts, model.RangeCount{Source: ipRange.Source, Version: ipRange.Version, CountryCode: ipRange.CountryCode, Count: 1})
+	}
+	return counts
+}
+
+func TestIPService_UpdateIPRanges_StagedSwap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(delegationFile(
+			"arin|US|ipv4|8.8.8.0|256|20100101|allocated",
+			"arin|US|ipv4|8.8.8.0|256|20100101|allocated",
+			"ripencc|DE|ipv6|2001:db8::|32|20100101|allocated")))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		stagedCount   int64
+		saveError     error
+		expectSwap    bool
+		expectedError bool
+	}{
+		{name: "valid staged dataset", stagedCount: 2, expectSwap: true},
+		{name: "empty staged dataset", stagedCount: 0, expectedError: true},
+		{name: "failed load", stagedCount: 2, saveError: errors.New("copy failed"), expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var swapped, cached bool
+			var saved []model.IPRange
+
+			mockRepo := &mocks.MockRepository{
+				BeginStagingFunc: func(ctx context.Context) error {
+					return nil
+				},
+				SaveIPRangesFunc: func(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error {
+					if tt.saveError != nil {
+						return tt.saveError
+					}
+					return stageInto(&saved)(ctx, load)
+				},
+				GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+					return tt.stagedCount, nil
+				},
+				GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+					return nil, nil
+				},
+				SaveASNDelegationsFunc: func(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+					return nil
+				},
+				SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+					swapped = true
+					return base + 1, nil
+				},
+				SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+					return nil
+				},
+				GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+					return &model.DatasetDiff{To: q.To}, nil
+				},
+				LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+					return nil, nil
+				},
+				LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+					return saved, nil
+				},
+				GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+					return nil, nil
+				},
+				SaveSourceStatesFunc: func(ctx context.Context, states []model.SourceState) error {
+					return nil
+				},
+			}
+			guardStaged(mockRepo, &saved, nil)
+			mockCache := &mocks.MockCache{
+				CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+					return nil
+				},
+				CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+					cached = true
+					return nil
+				},
+			}
+
+			logger, _ := zap.NewDevelopment()
+			cfg := &config.Config{RIRs: []config.RIR{{Name: "TEST", URL: server.URL, Enabled: true}}}
+			rirSvc := NewRIRService(logger)
+			rirSvc.retryDelay = time.Millisecond
+			svc := NewIPService(mockRepo, mockCache, rirSvc, NewMemoryLocker(), cfg, logger)
+
+			err := svc.UpdateIPRanges(context.Background())
+			if tt.expectedError != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+			if swapped != tt.expectSwap || cached != tt.expectSwap {
+				t.Errorf("expected swap %v, got swap %v cache %v", tt.expectSwap, swapped, cached)
+			}
+
+			index := svc.currentIndex()
+			if tt.expectSwap && (index == nil || index.Len() != 3) {
+				t.Error("expected index to be rebuilt after swap")
+			}
+			if !tt.expectSwap && index != nil {
+				t.Error("expected index to be untouched")
+			}
+		})
+	}
+}
+
+func TestIPService_UpdateIPRanges_DatasetVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(delegationFile("arin|US|ipv4|8.8.8.0|256|20100101|allocated")))
+	}))
+	defer server.Close()
+
+	var saved []model.IPRange
+	var swappedSources []model.SourceVersion
+	var historyVersion int64
+	var historyKeep int
+
+	mockRepo := &mocks.MockRepository{
+		BeginStagingFunc: func(ctx context.Context) error {
+			return nil
+		},
+		SaveIPRangesFunc: saveInto(&saved),
+		GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+			return int64(len(saved)), nil
+		},
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return &model.DatasetInfo{Version: 6, Ranges: 1}, nil
+		},
+		SaveASNDelegationsFunc: func(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+			return nil
+		},
+		SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+			if base != 6 {
+				t.Errorf("expected base version 6, got %d", base)
+			}
+			swappedSources = sources
+			return 7, nil
+		},
+		SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+			historyVersion, historyKeep = version, keep
+			return nil
+		},
+		GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			if q.From != 0 || q.To != 7 {
+				t.Errorf("expected the changes recorded for version 7, got %+v", q)
+			}
+			return &model.DatasetDiff{From: 6, To: 7, Sources: []model.SourceDiff{{Source: "ARIN", Added: 1}}}, nil
+		},
+		LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+			return nil, nil
+		},
+		LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+			published := make([]model.IPRange, len(saved))
+			for i, ipRange := range saved {
+				ipRange.DatasetVersion = 7
+				published[i] = ipRange
+			}
+			return published, nil
+		},
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return nil, nil
+		},
+		SaveSourceStatesFunc: func(ctx context.Context, states []model.SourceState) error {
+			return nil
+		},
+		FindRangeForIPFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+			return nil, nil
+		},
+	}
+	guardStaged(mockRepo, &saved, nil)
+	mockCache := &mocks.MockCache{
+		CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+			return nil
+		},
+		CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+			return nil
+		},
+		GetIPRangeFunc: func(ctx context.Context, version int64, ip string) (*model.IPRange, error) {
+			return nil, nil
+		},
+		GetCachedRangeFunc: func(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+			return nil, nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	cfg := &config.Config{DatasetHistory: 3, RIRs: []config.RIR{{Name: "ARIN", URL: server.URL, Enabled: true}}}
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), cfg, logger)
+
+	if err := svc.UpdateIPRanges(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(swappedSources) != 1 || swappedSources[0].Name != "ARIN" || swappedSources[0].Serial != 20240101 {
+		t.Errorf("unexpected dataset sources %+v", swappedSources)
+	}
+	if historyVersion != 7 || historyKeep != 3 {
+		t.Errorf("expected version 7 kept in the last 3, got %d in %d", historyVersion, historyKeep)
+	}
+	status := svc.Status()
+	if status.DatasetVersion != 7 {
+		t.Errorf("expected status for version 7, got %d", status.DatasetVersion)
+	}
+	if changes := status.LastUpdate.Changes; len(changes) != 1 || changes[0].Source != "ARIN" || changes[0].Added != 1 {
+		t.Errorf("expected the changes to be reported, got %+v", changes)
+	}
+
+	for _, ip := range []string{"8.8.8.8", "192.0.2.1"} {
+		response, err := svc.LookupIP(context.Background(), ip)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if response.DatasetVersion != 7 {
+			t.Errorf("expected %s to be answered by version 7, got %d", ip, response.DatasetVersion)
+		}
+	}
+}
+
+func TestIPService_DatasetDiff(t *testing.T) {
+	var queried []model.DiffQuery
+	mockRepo := &mocks.MockRepository{
+		GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			queried = append(queried, q)
+			return &model.DatasetDiff{From: q.From, To: q.To}, nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, &mocks.MockCache{}, NewRIRService(logger), NewMemoryLocker(), &config.Config{}, logger)
+	ctx := context.Background()
+
+	// Nothing is served yet
+	if _, err := svc.DatasetDiff(ctx, model.DiffQuery{}); err == nil || len(queried) != 0 {
+		t.Fatalf("expected an error without a published dataset, got %v", err)
+	}
+
+	svc.version.Store(5)
+	for _, q := range []model.DiffQuery{{CountryCode: "DE"}, {From: 2, To: 3}} {
+		if _, err := svc.DatasetDiff(ctx, q); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	want := []model.DiffQuery{{To: 5, CountryCode: "DE"}, {From: 2, To: 3}}
+	if !reflect.DeepEqual(queried, want) {
+		t.Errorf("expected queries %+v, got %+v", want, queried)
+	}
+}
+
+func TestIPService_LookupIPs(t *testing.T) {
+	_, indexed, _ := net.ParseCIDR("1.1.1.0/24")
+
+	var cachedLookups, dbLookups []string
+	var stored map[string]model.IPRange
+
+	mockCache := &mocks.MockCache{
+		GetIPRangesFunc: func(ctx context.Context, version int64, ips []string) ([]*model.IPRange, error) {
+			cachedLookups = ips
+			ranges := make([]*model.IPRange, len(ips))
+			for i, ip := range ips {
+				if ip == "9.9.9.9" {
+					ranges[i] = rangeFor("CH")
+				}
+			}
+			return ranges, nil
+		},
+		SetIPRangesFunc: func(ctx context.Context, version int64, ranges map[string]model.IPRange) error {
+			stored = ranges
+			return nil
+		},
+	}
+	mockRepo := &mocks.MockRepository{
+		FindRangesForIPsFunc: func(ctx context.Context, ips []net.IP) ([]*model.IPRange, error) {
+			ranges := make([]*model.IPRange, len(ips))
+			for i, ip := range ips {
+				dbLookups = append(dbLookups, ip.String())
+				if ip.String() == "8.8.8.8" {
+					ranges[i] = rangeFor("US")
+				}
+			}
+			return ranges, nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), &config.Config{MaxBatchSize: 10}, logger)
+
+	type expectation struct {
+		countryCode string
+		hasError    bool
+	}
+	check := func(results []model.BatchLookupResult, expected []expectation) {
+		t.Helper()
+		for i, e := range expected {
+			if results[i].CountryCode != e.countryCode || (results[i].Error != "") != e.hasError {
+				t.Errorf("result %d: expected %+v, got %+v", i, e, results[i])
+			}
+		}
+	}
+
+	// Without an index, misses go to Redis and then to the database
+	results, err := svc.LookupIPs(context.Background(), []string{"9.9.9.9", "8.8.8.8", "invalid", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	check(results, []expectation{{countryCode: "CH"}, {countryCode: "US"}, {hasError: true}, {hasError: true}})
+
+	if len(cachedLookups) != 3 {
+		t.Errorf("expected 3 cache lookups, got %v", cachedLookups)
+	}
+	if len(dbLookups) != 2 {
+		t.Errorf("expected 2 database lookups, got %v", dbLookups)
+	}
+	if len(stored) != 1 || stored["8.8.8.8"].CountryCode != "US" {
+		t.Errorf("expected only database hits to be cached, got %v", stored)
+	}
+
+	// A loaded index answers every address itself
+	cachedLookups, dbLookups = nil, nil
+	svc.setIndex(lookup.NewTable([]model.IPRange{{Network: *indexed, CountryCode: "AU", Version: 4}}))
+	results, err = svc.LookupIPs(context.Background(), []string{"1.1.1.1", "9.9.9.9", "invalid"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	check(results, []expectation{{countryCode: "AU"}, {hasError: true}, {hasError: true}})
+	if cachedLookups != nil || dbLookups != nil {
+		t.Errorf("expected no cache or database lookups with an index, got %v and %v", cachedLookups, dbLookups)
+	}
+
+	tooMany := make([]string, 11)
+	if _, err := svc.LookupIPs(context.Background(), tooMany); err == nil {
+		t.Error("expected error for oversized batch")
+	}
+}
+
+// TestIPService_UpdateIPRanges_Fixtures runs the whole update flow against
+// the checked-in delegation files, served over HTTP and read from disk.
+func TestIPService_UpdateIPRanges_Fixtures(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	ripeFile, err := filepath.Abs("testdata/delegated-ripencc-latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{FetchConcurrency: 2, RIRs: []config.RIR{
+		{
+			Name:    "ARIN",
+			URL:     server.URL + "/unavailable",
+			Mirrors: []string{server.URL + "/delegated-arin-extended-latest"},
+			Enabled: true,
+			Format:  config.FormatExtended,
+		},
+		{Name: "RIPE", URL: "file://" + ripeFile, Enabled: true, Format: config.FormatStandard},
+		{Name: "LACNIC", URL: server.URL + "/delegated-lacnic-latest", Enabled: true, Format: config.FormatStandard},
+		{Name: "AFRINIC", URL: server.URL + "/delegated-afrinic-latest", Enabled: false},
+	}}
+
+	var saved []model.IPRange
+	var savedASNs []model.ASNDelegation
+	mockRepo := &mocks.MockRepository{
+		BeginStagingFunc: func(ctx context.Context) error {
+			saved = nil
+			return nil
+		},
+		SaveIPRangesFunc: saveInto(&saved),
+		LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+			return savedASNs, nil
+		},
+		LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+			return saved, nil
+		},
+		GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+			return int64(len(saved)), nil
+		},
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return nil, nil
+		},
+		SaveASNDelegationsFunc: func(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+			savedASNs = delegations
+			return nil
+		},
+		SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+			return base + 1, nil
+		},
+		SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+			return nil
+		},
+		GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			return &model.DatasetDiff{To: q.To}, nil
+		},
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return nil, nil
+		},
+		SaveSourceStatesFunc: func(ctx context.Context, states []model.SourceState) error {
+			return nil
+		},
+	}
+	guardStaged(mockRepo, &saved, nil)
+	mockCache := &mocks.MockCache{
+		CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+			return nil
+		},
+		CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+			return nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	rirSvc := NewRIRService(logger)
+	rirSvc.retryDelay = time.Millisecond
+	svc := NewIPService(mockRepo, mockCache, rirSvc, NewMemoryLocker(), cfg, logger)
+
+	if err := svc.UpdateIPRanges(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(saved) != 15 {
+		t.Errorf("expected 15 ranges saved, got %d", len(saved))
+	}
+
+	tests := []struct {
+		ip          string
+		countryCode string
+		registry    string
+		network     string
+	}{
+		{ip: "8.8.8.8", countryCode: "US", registry: "arin", network: "8.0.0.0/9"},
+		{ip: "199.16.158.10", countryCode: "US", registry: "arin", network: "199.16.158.0/24"},
+		{ip: "5.64.4.1", countryCode: "GB", registry: "ripencc", network: "5.64.4.0/24"},
+		{ip: "2a01:e00::1", countryCode: "FR", registry: "ripencc", network: "2a01:e00::/26"},
+		{ip: "200.160.2.1", countryCode: "BR", registry: "lacnic", network: "200.160.0.0/22"},
+		{ip: "2001:12ff::1", countryCode: "BR", registry: "lacnic", network: "2001:12ff::/32"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			result, err := svc.LookupIP(context.Background(), tt.ip)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.CountryCode != tt.countryCode || result.Registry != tt.registry || result.Network != tt.network {
+				t.Errorf("expected %s %s %s, got %+v", tt.countryCode, tt.registry, tt.network, result)
+			}
+		})
+	}
+
+	if len(savedASNs) != 3 {
+		t.Errorf("expected 3 ASN delegations saved, got %+v", savedASNs)
+	}
+	for asn, want := range map[uint32]string{701: "US arin ARIN", 3333: "NL ripencc RIPE", 28571: "BR lacnic LACNIC"} {
+		result, err := svc.LookupASN(context.Background(), asn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		delegation, _ := svc.asnIndex.Load().Lookup(asn)
+		if got := result.CountryCode + " " + result.Registry + " " + delegation.Source; got != want {
+			t.Errorf("AS%d: expected %s, got %s", asn, want, got)
+		}
+	}
+}
+
+func TestIPService_LookupASN(t *testing.T) {
+	delegation := &model.ASNDelegation{FirstASN: 3320, LastASN: 3329, CountryCode: "DE", Registry: "ripencc", Status: "allocated"}
+
+	tests := []struct {
+		name       string
+		indexed    bool
+		cached     *model.ASNDelegation
+		cachedSet  *model.ASNDelegation
+		stored     *model.ASNDelegation
+		expected   string
+		expectSave bool
+	}{
+		{name: "index hit", indexed: true, expected: "DE"},
+		{name: "cache hit", cached: delegation, expected: "DE"},
+		{name: "cached delegation hit", cachedSet: delegation, expected: "DE", expectSave: true},
+		{name: "repo hit", stored: delegation, expected: "DE", expectSave: true},
+		{name: "repo miss", expected: "ZZ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := false
+			mockCache := &mocks.MockCache{
+				GetASNFunc: func(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+					return tt.cached, nil
+				},
+				GetCachedASNFunc: func(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+					return tt.cachedSet, nil
+				},
+				SetASNFunc: func(ctx context.Context, asn uint32, delegation model.ASNDelegation) error {
+					saved = true
+					return nil
+				},
+			}
+			mockRepo := &mocks.MockRepository{
+				FindASNDelegationFunc: func(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+					return tt.stored, nil
+				},
+			}
+
+			logger, _ := zap.NewDevelopment()
+			svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), &config.Config{}, logger)
+			if tt.indexed {
+				svc.asnIndex.Store(lookup.NewASNTable([]model.ASNDelegation{*delegation}))
+			}
+
+			result, err := svc.LookupASN(context.Background(), 3325)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.ASN != 3325 || result.CountryCode != tt.expected {
+				t.Errorf("expected AS3325 in %s, got %+v", tt.expected, result)
+			}
+			if tt.expected != "ZZ" && (result.FirstASN != 3320 || result.LastASN != 3329 || result.Registry != "ripencc") {
+				t.Errorf("expected the delegation details, got %+v", result)
+			}
+			if saved != tt.expectSave {
+				t.Errorf("expected cached %v, got %v", tt.expectSave, saved)
+			}
+		})
+	}
+}
+
+func TestIPService_UpdateIPRanges_Unchanged(t *testing.T) {
+	data := delegationFile("arin|US|ipv4|8.8.8.0|256|20100101|allocated")
+	etags := map[string]string{"/arin": `"a1"`, "/ripe": `"r1"`}
+	var requestsMux sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsMux.Lock()
+		requests[r.URL.Path]++
+		requestsMux.Unlock()
+
+		etag := etags[r.URL.Path]
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		// The content changes with the ETag
+		w.Write([]byte("# " + etag + "\n" + data))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{RIRs: []config.RIR{
+		{Name: "ARIN", URL: server.URL + "/arin", Enabled: true},
+		{Name: "RIPE", URL: server.URL + "/ripe", Enabled: true},
+	}}
+
+	var stored map[string]model.SourceState
+	var saved []model.IPRange
+	var kept, keptASNs []string
+	var staged, checked bool
+	var swaps int
+	mockRepo := &mocks.MockRepository{
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return stored, nil
+		},
+		KeepIPRangesFunc: func(ctx context.Context, sources []string, priority []string) (int64, error) {
+			kept = sources
+			return 1, nil
+		},
+		SaveSourceStatesFunc: func(ctx context.Context, states []model.SourceState) error {
+			stored = make(map[string]model.SourceState)
+			for _, state := range states {
+				stored[state.Name] = state
+			}
+			return nil
+		},
+		BeginStagingFunc: func(ctx context.Context) error {
+			staged = true
+			saved = nil
+			return nil
+		},
+		SaveIPRangesFunc: saveInto(&saved),
+		LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+			return nil, nil
+		},
+		LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+			return saved, nil
+		},
+		GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+			return 1, nil
+		},
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return nil, nil
+		},
+		SaveASNDelegationsFunc: func(ctx context.Context, sources []string, delegations []model.ASNDelegation) error {
+			keptASNs = sources
+			return nil
+		},
+		SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+			swaps++
+			return base + 1, nil
+		},
+		SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+			return nil
+		},
+		GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			return &model.DatasetDiff{To: q.To}, nil
+		},
+		MarkDatasetCheckedFunc: func(ctx context.Context) error {
+			checked = true
+			return nil
+		},
+	}
+	guardStaged(mockRepo, &saved, nil)
+	mockCache := &mocks.MockCache{
+		CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+			return nil
+		},
+		CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+			return nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), cfg, logger)
+	ctx := context.Background()
+
+	if err := svc.UpdateIPRanges(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !staged || stored["ARIN"].ETag != `"a1"` || stored["RIPE"].Location != server.URL+"/ripe" {
+		t.Fatalf("expected initial load to record source states, got %+v", stored)
+	}
+
+	// Nothing changed: the dataset is left alone
+	staged = false
+	if err := svc.UpdateIPRanges(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if staged {
+		t.Error("expected unchanged sources not to be reloaded")
+	}
+	if !checked {
+		t.Error("expected the dataset to be recorded as checked")
+	}
+
+	// One source changed: the unchanged one keeps its published ranges
+	// and is not requested again
+	etags["/arin"] = `"a2"`
+	requests = make(map[string]int)
+	if err := svc.UpdateIPRanges(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !staged || len(saved) != 1 || saved[0].Source != "ARIN" {
+		t.Errorf("expected only the changed source to be staged, got %+v", saved)
+	}
+	if strings.Join(kept, ",") != "RIPE" || strings.Join(keptASNs, ",") != "RIPE" {
+		t.Errorf("expected the RIPE ranges and ASN delegations to be kept, got %v and %v", kept, keptASNs)
+	}
+	if requests["/arin"] != 1 || requests["/ripe"] != 1 {
+		t.Errorf("expected each source to be requested once, got %v", requests)
+	}
+	if stored["ARIN"].ETag != `"a2"` || stored["RIPE"].ETag != `"r1"` || stored["RIPE"].Location != server.URL+"/ripe" {
+		t.Errorf("unexpected source states %+v", stored)
+	}
+
+	// Disabling a source republishes without it although nothing changed
+	cfg.RIRs[1].Enabled = false
+	staged, kept, keptASNs, swaps = false, nil, nil, 0
+	if err := svc.UpdateIPRanges(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !staged || swaps != 1 {
+		t.Fatalf("expected the dataset to be republished, staged %v, swaps %d", staged, swaps)
+	}
+	if strings.Join(kept, ",") != "ARIN" || strings.Join(keptASNs, ",") != "ARIN" {
+		t.Errorf("expected only the ARIN ranges and ASN delegations to be kept, got %v and %v", kept, keptASNs)
+	}
+	if published(stored, "RIPE") {
+		t.Errorf("expected the removed source to be forgotten, got %+v", stored["RIPE"])
+	}
+
+	// Once it is gone, nothing changes any more
+	staged, swaps = false, 0
+	if err := svc.UpdateIPRanges(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if staged || swaps != 0 {
+		t.Errorf("expected the dataset to be left alone, staged %v, swaps %d", staged, swaps)
+	}
+}
+
+func TestIPService_UpdateIPRanges_FailurePolicy(t *testing.T) {
+	data := delegationFile("arin|US|ipv4|8.8.8.0|256|20100101|allocated")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ripe" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	lastGood := time.Now().Add(-96 * time.Hour)
+	published := map[string]model.SourceState{
+		"ARIN": {Name: "ARIN", Location: server.URL + "/arin", Checksum: "old", UpdatedAt: lastGood},
+		"RIPE": {Name: "RIPE", Location: server.URL + "/ripe", ETag: `"r1"`, UpdatedAt: lastGood},
+	}
+
+	tests := []struct {
+		policy       string
+		expectError  bool
+		expectKept   []string
+		expectStale  []string
+		expectedRIPE *model.SourceState
+	}{
+		{policy: config.PolicyKeepStale, expectKept: []string{"RIPE"}, expectStale: []string{"RIPE"}},
+		{policy: config.PolicyDrop, expectedRIPE: &model.SourceState{Name: "RIPE", UpdatedAt: lastGood}, expectStale: []string{"RIPE"}},
+		{policy: config.PolicyFail, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := &config.Config{FailurePolicy: tt.policy, MaxStaleness: 72 * time.Hour, RIRs: []config.RIR{
+				{Name: "ARIN", URL: server.URL + "/arin", Enabled: true},
+				{Name: "RIPE", URL: server.URL + "/ripe", Enabled: true},
+			}}
+
+			var saved []model.IPRange
+			var kept, keptASNs []string
+			var swapped bool
+			var stored []model.SourceState
+			mockRepo := &mocks.MockRepository{
+				GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+					return published, nil
+				},
+				SaveSourceStatesFunc: func(ctx context.Context, states []model.SourceState) error {
+					stored = states
+					return nil
+				},
+				BeginStagingFunc: func(ctx context.Context) error {
+					return nil
+				},
+				SaveIPRangesFunc: saveInto(&saved),
+				KeepIPRangesFunc: func(ctx context.Context, sources []string, priority []string) (int64, error) {
+					kept = sources
+					return 1, nil
+				},
+				LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+					return nil, nil
+				},
+				LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+					return saved, nil
+				},
+				GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+					return int64(len(saved) + len(kept)), nil
+				},
+				GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+					return nil, nil
+				},
+				SaveASNDelegationsFunc: func(ctx context.Context, sources []string, delegations []model.ASNDelegation) error {
+					keptASNs = sources
+					return nil
+				},
+				SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+					swapped = true
+					return base + 1, nil
+				},
+				SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+					return nil
+				},
+				GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+					return &model.DatasetDiff{To: q.To}, nil
+				},
+			}
+			guardStaged(mockRepo, &saved, nil)
+			mockCache := &mocks.MockCache{
+				CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+					return nil
+				},
+				CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+					return nil
+				},
+			}
+
+			logger, _ := zap.NewDevelopment()
+			rirSvc := NewRIRService(logger)
+			rirSvc.retryDelay = time.Millisecond
+			svc := NewIPService(mockRepo, mockCache, rirSvc, NewMemoryLocker(), cfg, logger)
+
+			err := svc.UpdateIPRanges(context.Background())
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if swapped || stored != nil {
+					t.Error("expected the published dataset to be left alone")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !swapped || len(saved) != 1 || saved[0].Source != "ARIN" {
+				t.Errorf("expected the ARIN ranges to be published, got %+v", saved)
+			}
+			if strings.Join(keptASNs, ",") != strings.Join(tt.expectKept, ",") {
+				t.Errorf("expected ASN delegations of %v kept, got %v", tt.expectKept, keptASNs)
+			}
+			if strings.Join(kept, ",") != strings.Join(tt.expectKept, ",") {
+				t.Errorf("expected kept sources %v, got %v", tt.expectKept, kept)
+			}
+
+			var ripe *model.SourceState
+			for _, state := range stored {
+				if state.Name == "RIPE" {
+					ripe = &state
+				}
+			}
+			if tt.expectedRIPE == nil && ripe != nil {
+				t.Errorf("expected the RIPE state to be kept, got %+v", ripe)
+			}
+			if tt.expectedRIPE != nil && (ripe == nil || *ripe != *tt.expectedRIPE) {
+				t.Errorf("expected RIPE state %+v, got %+v", tt.expectedRIPE, ripe)
+			}
+
+			if stale := svc.StaleSources(); strings.Join(stale, ",") != strings.Join(tt.expectStale, ",") {
+				t.Errorf("expected stale sources %v, got %v", tt.expectStale, stale)
+			}
+		})
+	}
+}
+
+// TestIPService_UpdateIPRanges_FailureUnchanged checks a source failing
+// while the others are unchanged is reported as kept rather than as an
+// update that fetched nothing.
+func TestIPService_UpdateIPRanges_FailureUnchanged(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ripe" || r.Header.Get("If-None-Match") != `"a1"` {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	states := map[string]model.SourceState{
+		"ARIN": {Name: "ARIN", Location: server.URL + "/arin", ETag: `"a1"`, UpdatedAt: time.Now()},
+		"RIPE": {Name: "RIPE", Location: server.URL + "/ripe", ETag: `"r1"`, UpdatedAt: time.Now()},
+	}
+	cfg := &config.Config{FailurePolicy: config.PolicyKeepStale, RIRs: []config.RIR{
+		{Name: "ARIN", URL: server.URL + "/arin", Enabled: true},
+		{Name: "RIPE", URL: server.URL + "/ripe", Enabled: true},
+	}}
+
+	var checked bool
+	mockRepo := &mocks.MockRepository{
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return &model.DatasetInfo{Version: 3}, nil
+		},
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return states, nil
+		},
+		SaveSourceStatesFunc: func(ctx context.Context, saved []model.SourceState) error {
+			return nil
+		},
+		MarkDatasetCheckedFunc: func(ctx context.Context) error {
+			checked = true
+			return nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	rirSvc := NewRIRService(logger)
+	rirSvc.retryDelay = time.Millisecond
+	svc := NewIPService(mockRepo, &mocks.MockCache{}, rirSvc, NewMemoryLocker(), cfg, logger)
+
+	if err := svc.UpdateIPRanges(context.Background()); err != nil {
+		t.Fatalf("expected the failed source to be kept, got %v", err)
+	}
+	if !checked {
+		t.Error("expected the dataset to be recorded as checked")
+	}
+	last := svc.Status().LastUpdate
+	if last == nil || last.State != model.UpdateSucceeded || len(last.Sources) != 2 {
+		t.Fatalf("unexpected last update %+v", last)
+	}
+	if ripe := last.Sources[1]; ripe.Name != "RIPE" || !ripe.Kept || ripe.Error == "" {
+		t.Errorf("expected RIPE to be reported as failed and kept, got %+v", ripe)
+	}
+
+	// With every source failing, nothing was fetched at all
+	states["ARIN"] = model.SourceState{Name: "ARIN", Location: server.URL + "/arin", ETag: `"a0"`}
+	if err := svc.UpdateIPRanges(context.Background()); err == nil || !strings.Contains(err.Error(), "no IP ranges fetched") {
+		t.Errorf("expected no IP ranges to be fetched, got %v", err)
+	}
+}
+
+func TestIPService_UpdateIPRanges_SourcePriority(t *testing.T) {
+	// Both registries delegate the same network
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(delegationFile("ripencc|DE|ipv4|8.8.8.0|256|20100101|allocated")))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{FetchConcurrency: 2, RIRs: []config.RIR{
+		{Name: "RIPE", URL: server.URL + "/ripe", Enabled: true},
+		{Name: "APNIC", URL: server.URL + "/apnic", Enabled: false},
+		{Name: "ARIN", URL: server.URL + "/arin", Enabled: true},
+	}}
+
+	var mu sync.Mutex
+	var saved []model.IPRange
+	var priorities [][]string
+	mockRepo := &mocks.MockRepository{
+		BeginStagingFunc: func(ctx context.Context) error {
+			return nil
+		},
+		SaveIPRangesFunc: func(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error {
+			mu.Lock()
+			priorities = append(priorities, priority)
+			mu.Unlock()
+			return stageInto(&saved)(ctx, load)
+		},
+		LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+			return nil, nil
+		},
+		LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+			return saved, nil
+		},
+		GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+			return int64(len(saved)), nil
+		},
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return nil, nil
+		},
+		SaveASNDelegationsFunc: func(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+			return nil
+		},
+		SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+			return base + 1, nil
+		},
+		SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+			return nil
+		},
+		GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			return &model.DatasetDiff{To: q.To}, nil
+		},
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return nil, nil
+		},
+		SaveSourceStatesFunc: func(ctx context.Context, states []model.SourceState) error {
+			return nil
+		},
+	}
+	guardStaged(mockRepo, &saved, nil)
+	mockCache := &mocks.MockCache{
+		CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+			return nil
+		},
+		CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+			return nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), cfg, logger)
+
+	if err := svc.UpdateIPRanges(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every load ranks the enabled sources in configuration order, whichever
+	// download finishes first
+	if len(priorities) != 2 {
+		t.Fatalf("expected both sources to be staged, got %d loads", len(priorities))
+	}
+	for _, priority := range priorities {
+		if strings.Join(priority, ",") != "RIPE,ARIN" {
+			t.Errorf("expected priority RIPE,ARIN, got %v", priority)
+		}
+	}
+}
+
+func TestIPService_RollbackIPRanges(t *testing.T) {
+	_, network, _ := net.ParseCIDR("8.8.8.0/24")
+	type dataset struct {
+		version int64
+		ranges  []model.IPRange
+	}
+	current := &dataset{version: 2, ranges: []model.IPRange{{Network: *network, CountryCode: "CA", Version: 4, DatasetVersion: 2}}}
+	var previous *dataset
+
+	var cleared int
+	var cached *lookup.Table
+	mockRepo := &mocks.MockRepository{
+		RollbackIPRangesFunc: func(ctx context.Context) error {
+			if previous == nil {
+				return errors.New("no previous IP ranges dataset")
+			}
+			current, previous = previous, current
+			return nil
+		},
+		ClearSourceStatesFunc: func(ctx context.Context) error {
+			cleared++
+			return nil
+		},
+		LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+			return current.ranges, nil
+		},
+		LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+			return nil, nil
+		},
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return &model.DatasetInfo{Version: current.version, Ranges: int64(len(current.ranges))}, nil
+		},
+	}
+	mockCache := &mocks.MockCache{
+		CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+			cached = table
+			return nil
+		},
+		CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+			return nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	locker := NewMemoryLocker()
+	svc := NewIPService(mockRepo, mockCache, NewRIRService(logger), locker, &config.Config{}, logger)
+	svc.setIndex(lookup.NewTable(current.ranges))
+	svc.version.Store(current.version)
+	svc.setSourceStates(map[string]model.SourceState{"ARIN": {Name: "ARIN", Serial: 20240102}})
+	ctx := context.Background()
+
+	// Nothing was replaced yet
+	if err := svc.RollbackIPRanges(ctx); err == nil {
+		t.Fatal("expected an error without a previous dataset")
+	}
+	if svc.Status().DatasetVersion != 2 || cached != nil {
+		t.Fatal("expected the served dataset to be left alone")
+	}
+
+	previous = &dataset{version: 1, ranges: []model.IPRange{{Network: *network, CountryCode: "US", Version: 4, DatasetVersion: 1}}}
+
+	// Rolling back twice serves the newer dataset again
+	for _, expected := range []struct {
+		version     int64
+		countryCode string
+	}{{1, "US"}, {2, "CA"}} {
+		if err := svc.RollbackIPRanges(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if status := svc.Status(); status.DatasetVersion != expected.version || status.Ranges != 1 {
+			t.Errorf("expected version %d to be served, got %+v", expected.version, status)
+		}
+		response, err := svc.LookupIP(ctx, "8.8.8.8")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if response.CountryCode != expected.countryCode || response.DatasetVersion != expected.version {
+			t.Errorf("expected %s from version %d, got %+v", expected.countryCode, expected.version, response)
+		}
+		if ipRange, ok := cached.Lookup(net.ParseIP("8.8.8.8")); !ok || ipRange.CountryCode != expected.countryCode {
+			t.Errorf("expected the cache to be rebuilt with %s, got %+v", expected.countryCode, ipRange)
+		}
+	}
+
+	// The next update reloads every source
+	if cleared != 2 || svc.states.Load() != nil && len(*svc.states.Load()) != 0 {
+		t.Errorf("expected the source states to be cleared, got %d clears", cleared)
+	}
+
+	// Updates in progress are not waited for, here or on another instance
+	svc.updateMux.Lock()
+	err := svc.RollbackIPRanges(ctx)
+	svc.updateMux.Unlock()
+	if !errors.Is(err, ErrUpdateInProgress) {
+		t.Errorf("expected an update in progress, got %v", err)
+	}
+	lockCtx, release, err := locker.TryLock(ctx)
+	if err != nil || lockCtx == nil {
+		t.Fatalf("expected to take the update lock, got %v", err)
+	}
+	err = svc.RollbackIPRanges(ctx)
+	release()
+	if !errors.Is(err, ErrNotLeader) {
+		t.Errorf("expected another instance to be updating, got %v", err)
+	}
+	if svc.Status().DatasetVersion != 2 || cleared != 2 {
+		t.Error("expected the served dataset to be left alone")
+	}
+}
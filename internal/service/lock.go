@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrNotLeader is returned by updates while another instance holds the
+// update lock.
+var ErrNotLeader = errors.New("another instance is updating the IP ranges")
+
+// ErrUpdateInProgress is returned by a rollback while this instance is
+// updating or reloading the IP ranges.
+var ErrUpdateInProgress = errors.New("an update of the IP ranges is in progress")
+
+// Locker elects the one instance that updates the shared dataset.
+type Locker interface {
+	// TryLock takes the update lock, or returns a nil context while another
+	// instance holds it. The returned context is cancelled if the lock is
+	// lost, and release gives the lock up.
+	TryLock(ctx context.Context) (lockCtx context.Context, release context.CancelFunc, err error)
+}
+
+// MemoryLocker is a Locker shared by services in the same process, for
+// single-instance deployments and tests.
+type MemoryLocker struct {
+	mu     sync.Mutex
+	holder *memoryLock // nil when free
+}
+
+type memoryLock struct {
+	cancel context.CancelFunc
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{}
+}
+
+func (l *MemoryLocker) TryLock(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holder != nil {
+		return nil, nil, nil
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	lock := &memoryLock{cancel: cancel}
+	l.holder = lock
+
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		cancel()
+		if l.holder == lock {
+			l.holder = nil
+		}
+	}
+	return lockCtx, release, nil
+}
+
+// Revoke takes the lock away from its holder, as if its connection failed.
+func (l *MemoryLocker) Revoke() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holder != nil {
+		l.holder.cancel()
+		l.holder = nil
+	}
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/lookup"
+	"ipservice/internal/model"
+	"ipservice/tests/mocks"
+)
+
+// sharedDatabase stands in for the database of several instances.
+type sharedDatabase struct {
+	mu        sync.Mutex
+	staged    []model.IPRange
+	published []model.IPRange
+	version   int64
+}
+
+// newInstance returns an instance updating from url that shares db and
+// locker with the other instances.
+func (db *sharedDatabase) newInstance(url string, locker Locker) *IPService {
+	mockRepo := &mocks.MockRepository{
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return nil, nil
+		},
+		SaveSourceStatesFunc: func(ctx context.Context, states []model.SourceState) error {
+			return nil
+		},
+		BeginStagingFunc: func(ctx context.Context) error {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			db.staged = nil
+			return nil
+		},
+		SaveIPRangesFunc: func(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			return load(func(ipRange model.IPRange) error {
+				db.staged = append(db.staged, ipRange)
+				return nil
+			})
+		},
+		GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			return int64(len(db.staged)), nil
+		},
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			if db.version == 0 {
+				return nil, nil
+			}
+			return &model.DatasetInfo{Version: db.version, Ranges: int64(len(db.published))}, nil
+		},
+		SaveASNDelegationsFunc: func(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+			return nil
+		},
+		SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			if base != db.version {
+				return 0, errors.New("dataset changed")
+			}
+			db.published, db.staged = db.staged, nil
+			db.version++
+			return db.version, nil
+		},
+		SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+			return nil
+		},
+		GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			return &model.DatasetDiff{To: q.To}, nil
+		},
+		LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+			return nil, nil
+		},
+		LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			return db.published, nil
+		},
+	}
+	guardStaged(mockRepo, &db.staged, nil)
+	mockCache := &mocks.MockCache{
+		CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+			return nil
+		},
+		CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+			return nil
+		},
+	}
+
+	cfg := &config.Config{RIRs: []config.RIR{{Name: "ARIN", URL: url, Enabled: true}}}
+	logger, _ := zap.NewDevelopment()
+	return NewIPService(mockRepo, mockCache, NewRIRService(logger), locker, cfg, logger)
+}
+
+func TestIPService_UpdateIPRanges_SingleLeader(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	var blocked sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blocked.Do(func() {
+			entered <- struct{}{}
+			<-release
+		})
+		w.Write([]byte(delegationFile("arin|US|ipv4|8.8.8.0|256|20100101|allocated")))
+	}))
+	defer server.Close()
+
+	db, locker := &sharedDatabase{}, NewMemoryLocker()
+	leader, follower := db.newInstance(server.URL, locker), db.newInstance(server.URL, locker)
+	ctx := context.Background()
+
+	done := make(chan error, 1)
+	go func() { done <- leader.UpdateIPRanges(ctx) }()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not start")
+	}
+
+	// The follower leaves the update to the leader
+	if err := follower.UpdateIPRanges(ctx); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader, got %v", err)
+	}
+	if last := follower.Status().LastUpdate; last == nil || last.State != model.UpdateSkipped {
+		t.Errorf("expected a skipped update, got %+v", last)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if db.version != 1 || leader.version.Load() != 1 {
+		t.Fatalf("expected the leader to publish version 1, got %d serving %d", db.version, leader.version.Load())
+	}
+
+	// The follower notices the new version and reloads it
+	if err := follower.syncDataset(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if follower.version.Load() != 1 || follower.currentIndex() == nil || follower.currentIndex().Len() != 1 {
+		t.Errorf("expected the follower to serve version 1, got %d", follower.version.Load())
+	}
+
+	// Once released, the lock goes to whoever updates next
+	if err := follower.UpdateIPRanges(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := leader.syncDataset(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if db.version != 2 || leader.version.Load() != 2 {
+		t.Errorf("expected the leader to reload version 2, got %d serving %d", db.version, leader.version.Load())
+	}
+}
+
+func TestIPService_UpdateIPRanges_LockLost(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	db, locker := &sharedDatabase{}, NewMemoryLocker()
+	svc := db.newInstance(server.URL, locker)
+
+	run, _ := svc.startUpdate(context.Background(), false, model.TriggerSchedule)
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not start")
+	}
+
+	locker.Revoke()
+	select {
+	case <-run.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update did not stop")
+	}
+
+	if status := run.snapshot(); status.State != model.UpdateFailed || !strings.Contains(status.Error, "update lock lost") {
+		t.Errorf("expected the update to fail with the lost lock, got %+v", status)
+	}
+	if db.version != 0 {
+		t.Errorf("expected nothing to be published, got version %d", db.version)
+	}
+}
@@ -3,26 +3,39 @@ package service
 import (
 	"bufio"
 	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/bits"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
+	"ipservice/internal/config"
 	"ipservice/internal/model"
 )
 
 type RIRService struct {
-	logger *zap.Logger
-	client *http.Client
+	logger     *zap.Logger
+	client     *http.Client
+	retryDelay time.Duration
 }
 
 func NewRIRService(logger *zap.Logger) *RIRService {
 	return &RIRService{
-		logger: logger,
+		logger:     logger,
+		retryDelay: 5 * time.Second,
 		client: &http.Client{
 			Timeout: 180 * time.Second,
 			Transport: &http.Transport{
@@ -40,71 +53,412 @@ func NewRIRService(logger *zap.Logger) *RIRService {
 type RIRStats struct {
 	IPv4Count    int
 	IPv6Count    int
+	ASNCount     int
 	SkippedCount int
 	ParseErrors  int
+	// SplitRecords counts IPv4 records that were not a single CIDR block,
+	// DecomposedBlocks the number of CIDR blocks produced from them.
+	SplitRecords     int
+	DecomposedBlocks int
+	Header           DelegationHeader
+	// Summary is the declared number of records per type (asn, ipv4, ipv6)
+	Summary map[string]int
 }
 
-func (s *RIRService) FetchIPRanges(ctx context.Context, url string) ([]model.IPRange, RIRStats, error) {
+// DelegationHeader is the version line of a delegation file:
+// "version|registry|serial|records|startdate|enddate|UTCoffset".
+type DelegationHeader struct {
+	Version   string
+	Registry  string
+	Serial    int64
+	Records   int // excluding the header, summary lines and comments
+	StartDate time.Time
+	EndDate   time.Time
+	UTCOffset string
+}
+
+// FetchResult is the outcome of fetching a RIR source.
+type FetchResult struct {
+	Stats RIRStats
+	// State describes the fetched file and is recorded once its data has
+	// been published.
+	State model.SourceState
+	// ASNs are the AS number delegations of the file, when Loaded
+	ASNs []model.ASNDelegation
+	// Loaded reports that the ranges were passed to the sink, which is not
+	// the case when the download was skipped.
+	Loaded bool
+	// NotModified reports that the source is unchanged since the previous
+	// state.
+	NotModified bool
+}
+
+// RangeSink stores the ranges that load passes to emit. Every download
+// attempt is a separate call, and the sink must discard what was emitted
+// when load returns an error. Updates stage ranges through a sink over
+// PostgresRepository.SaveIPRanges.
+type RangeSink func(ctx context.Context, load func(emit func(model.IPRange) error) error) error
+
+// errNotModified is returned by open when a conditional request found the
+// file unchanged.
+var errNotModified = errors.New("not modified")
+
+// FetchIPRangesIfChanged streams the ranges of src into sink without
+// holding them in memory. The primary URL is tried first, then each mirror
+// in order; locations may be http(s):// URLs or file:// paths. prev is the
+// state the source was last published with: the download is skipped when
+// the server answers a conditional request with 304 or the published
+// checksum matches prev, and the result is flagged NotModified when the
+// downloaded file has the same checksum.
+func (s *RIRService) FetchIPRangesIfChanged(ctx context.Context, src config.RIR, prev model.SourceState, sink RangeSink) (*FetchResult, error) {
+	if src.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, src.Budget)
+		defer cancel()
+	}
+
+	locations := append([]string{src.URL}, src.Mirrors...)
+	var errs []error
+
+	for i, location := range locations {
+		result, err := s.fetchLocation(ctx, src, location, prev, sink)
+		if err == nil {
+			if i > 0 {
+				s.logger.Info("Fetched RIR data from mirror",
+					zap.String("rir", src.Name),
+					zap.String("url", location))
+			}
+			return result, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", location, err))
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(locations)-1 {
+			s.logger.Warn("Failed to fetch RIR data, falling back to next mirror",
+				zap.String("rir", src.Name),
+				zap.String("url", location),
+				zap.Error(err))
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (s *RIRService) fetchLocation(ctx context.Context, src config.RIR, location string, prev model.SourceState, sink RangeSink) (*FetchResult, error) {
 	maxRetries := 3
+	// Local files fail the same way every time
+	if strings.HasPrefix(location, "file:") {
+		maxRetries = 1
+	}
+
 	var lastErr error
-	var stats RIRStats
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			delay := time.Duration(attempt) * 5 * time.Second
-			time.Sleep(delay)
+			timer := time.NewTimer(s.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("gave up after %d attempts: %w", attempt, errors.Join(lastErr, ctx.Err()))
+			case <-timer.C:
+			}
 		}
 
-		ranges, stats, err := s.fetchWithTimeout(ctx, url)
+		result, err := s.fetchWithTimeout(ctx, src, location, prev, sink)
 		if err == nil {
-			return ranges, stats, nil
+			return result, nil
 		}
 
 		lastErr = err
 		s.logger.Warn("Failed to fetch RIR data, retrying...",
-			zap.String("url", url),
+			zap.String("rir", src.Name),
+			zap.String("url", location),
 			zap.Int("attempt", attempt+1),
 			zap.Error(err))
 	}
 
-	return nil, stats, fmt.Errorf("failed after %d attempts: %w", maxRetries, lastErr)
+	return nil, fmt.Errorf("failed after %d attempts: %w", maxRetries, lastErr)
 }
 
-func (s *RIRService) fetchWithTimeout(ctx context.Context, url string) ([]model.IPRange, RIRStats, error) {
-	startTime := time.Now()
-	var stats RIRStats
+// maxRetryDelay caps the exponential backoff between attempts.
+const maxRetryDelay = 2 * time.Minute
 
-	s.logger.Info("Starting RIR data fetch", zap.String("url", url))
+// backoff returns the delay before retry number attempt: retryDelay doubled
+// for every earlier retry, with jitter so sources sharing a mirror do not
+// retry in lockstep.
+func (s *RIRService) backoff(attempt int) time.Duration {
+	delay := s.retryDelay << (attempt - 1)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+// SourceResult is the outcome of fetching one source with FetchAll. Exactly
+// one of Result and Err is set.
+type SourceResult struct {
+	Name     string
+	Result   *FetchResult
+	Err      error
+	Duration time.Duration
+}
+
+// FetchAll runs FetchIPRangesIfChanged for every source with at most
+// concurrency downloads in flight, passing each source its state from prev.
+// Results are in the order of sources. sink must be safe for concurrent use.
+func (s *RIRService) FetchAll(ctx context.Context, sources []config.RIR, prev map[string]model.SourceState, concurrency int, sink RangeSink) []SourceResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]SourceResult, len(sources))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src config.RIR) {
+			defer wg.Done()
+
+			results[i].Name = src.Name
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+				return
+			}
+
+			startTime := time.Now()
+			results[i].Result, results[i].Err = s.FetchIPRangesIfChanged(ctx, src, prev[src.Name], sink)
+			results[i].Duration = time.Since(startTime)
+		}(i, src)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// open returns the contents of a delegation file at an http(s):// URL or a
+// file:// path, along with the response headers for URLs. Validators from
+// prev are sent when it was fetched from the same location, and
+// errNotModified is returned when the server reports the file unchanged.
+func (s *RIRService) open(ctx context.Context, location string, prev model.SourceState) (io.ReadCloser, http.Header, error) {
+	u, err := url.Parse(location)
 	if err != nil {
-		return nil, stats, fmt.Errorf("creating request: %w", err)
+		return nil, nil, fmt.Errorf("parsing location: %w", err)
+	}
+
+	if u.Scheme == "file" {
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque // file:relative/path
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening RIR file: %w", err)
+		}
+		return f, nil, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating request: %w", err)
 	}
 
 	req.Header.Set("User-Agent", "IPLocator/1.0")
+	// Validators are only meaningful to the server that issued them
+	if prev.Location == location {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
 
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return nil, stats, fmt.Errorf("fetching RIR data: %w", err)
+		return nil, nil, fmt.Errorf("fetching RIR data: %w", err)
 	}
-	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, nil, errNotModified
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, stats, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return resp.Body, resp.Header, nil
+}
+
+// fetchChecksum reads the MD5 digest published in the "<location>.md5"
+// companion file.
+func (s *RIRService) fetchChecksum(ctx context.Context, location string) (string, error) {
+	body, _, err := s.open(ctx, location+".md5", model.SourceState{})
+	if err != nil {
+		return "", fmt.Errorf("fetching checksum: %w", err)
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("reading checksum: %w", err)
+	}
+	return parseChecksum(string(content))
+}
+
+// parseChecksum extracts the digest from an md5 companion file, which the
+// RIRs publish either in BSD style ("MD5 (file) = <digest>") or in md5sum
+// style ("<digest>  file").
+func parseChecksum(content string) (string, error) {
+	for _, field := range strings.Fields(content) {
+		if len(field) != 2*md5.Size {
+			continue
+		}
+		if _, err := hex.DecodeString(field); err == nil {
+			return strings.ToLower(field), nil
+		}
+	}
+	return "", fmt.Errorf("no MD5 digest found in checksum file")
+}
+
+func (s *RIRService) fetchWithTimeout(ctx context.Context, src config.RIR, location string, prev model.SourceState, sink RangeSink) (*FetchResult, error) {
+	startTime := time.Now()
+
+	if src.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, src.Timeout)
+		defer cancel()
+	}
+
+	var expected string
+	if src.Checksum == config.ChecksumMD5 {
+		var err error
+		if expected, err = s.fetchChecksum(ctx, location); err != nil {
+			return nil, err
+		}
+		// Identical files have identical checksums on every mirror
+		if expected == prev.Checksum {
+			s.logger.Info("RIR data unchanged, skipping download",
+				zap.String("url", location),
+				zap.String("checksum", expected))
+			return &FetchResult{State: confirmed(prev), NotModified: true}, nil
+		}
 	}
 
-	s.logger.Info("Successfully downloaded RIR data",
-		zap.String("url", url),
-		zap.Duration("download_time", time.Since(startTime)))
+	s.logger.Info("Starting RIR data fetch", zap.String("url", location))
 
-	var ranges []model.IPRange
-	scanner := bufio.NewScanner(resp.Body)
+	body, respHeader, err := s.open(ctx, location, prev)
+	if errors.Is(err, errNotModified) {
+		s.logger.Info("RIR data not modified", zap.String("url", location))
+		return &FetchResult{State: confirmed(prev), NotModified: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	s.logger.Info("Successfully opened RIR data",
+		zap.String("url", location),
+		zap.Duration("open_time", time.Since(startTime)))
+
+	hash := md5.New()
+	var (
+		stats     RIRStats
+		header    DelegationHeader
+		lineCount int
+		checksum  string
+		asns      []model.ASNDelegation
+	)
+	parseStartTime := time.Now()
+
+	err = sink(ctx, func(emit func(model.IPRange) error) error {
+		asns = nil
+		collect := func(asn model.ASNDelegation) {
+			asns = append(asns, asn)
+		}
+
+		var err error
+		header, lineCount, err = s.parse(io.TeeReader(body, hash), src, prev, &stats, emit, collect)
+		if err != nil {
+			return err
+		}
+
+		// Reject the data before the sink keeps it
+		checksum = hex.EncodeToString(hash.Sum(nil))
+		if expected != "" && checksum != expected {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, checksum)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Finished parsing RIR data",
+		zap.String("url", location),
+		zap.Int64("serial", header.Serial),
+		zap.Int("total_lines", lineCount),
+		zap.Int("ipv4_ranges", stats.IPv4Count),
+		zap.Int("ipv6_ranges", stats.IPv6Count),
+		zap.Int("asn_ranges", stats.ASNCount),
+		zap.Int("skipped_lines", stats.SkippedCount),
+		zap.Int("parse_errors", stats.ParseErrors),
+		zap.Int("split_records", stats.SplitRecords),
+		zap.Int("decomposed_blocks", stats.DecomposedBlocks),
+		zap.Duration("parse_time", time.Since(parseStartTime)),
+		zap.Duration("total_time", time.Since(startTime)))
+
+	return &FetchResult{
+		Stats: stats,
+		State: model.SourceState{
+			Name:         src.Name,
+			Location:     location,
+			ETag:         respHeader.Get("ETag"),
+			LastModified: respHeader.Get("Last-Modified"),
+			Checksum:     checksum,
+			Serial:       header.Serial,
+			StartDate:    header.StartDate,
+			EndDate:      header.EndDate,
+			UpdatedAt:    time.Now(),
+		},
+		ASNs:        asns,
+		Loaded:      true,
+		NotModified: checksum == prev.Checksum,
+	}, nil
+}
+
+// confirmed returns prev marked as current as of now.
+func confirmed(prev model.SourceState) model.SourceState {
+	prev.UpdatedAt = time.Now()
+	return prev
+}
+
+// parse reads a delegation file and passes each range to emit as soon as it
+// is parsed, so memory use does not depend on the size of the file. AS
+// number delegations, a small part of every file, are passed to emitASN
+// unless it is nil. It returns the version line and the number of lines
+// read once the declared counts have been verified.
+func (s *RIRService) parse(r io.Reader, src config.RIR, prev model.SourceState, stats *RIRStats, emit func(model.IPRange) error, emitASN func(model.ASNDelegation)) (DelegationHeader, int, error) {
+	// Extended files carry an opaque-id column after the status
+	minFields := 7
+	if src.Format == config.FormatExtended {
+		minFields = 8
+	}
+
+	scanner := bufio.NewScanner(r)
 	const maxCapacity = 1024 * 1024 * 20
-	buf := make([]byte, maxCapacity)
-	scanner.Buffer(buf, maxCapacity)
+	scanner.Buffer(make([]byte, 64*1024), maxCapacity)
 
 	lineCount := 0
-	parseStartTime := time.Now()
+	var header *DelegationHeader
+	stats.Summary = make(map[string]int)
+	counted := make(map[string]int)
 
 	for scanner.Scan() {
 		lineCount++
@@ -116,22 +470,71 @@ func (s *RIRService) fetchWithTimeout(ctx context.Context, url string) ([]model.
 		}
 
 		parts := strings.Split(line, "|")
+
+		// The version line precedes everything but comments
+		if header == nil {
+			parsed, err := parseHeader(parts)
+			if err != nil {
+				return DelegationHeader{}, lineCount, err
+			}
+			if err := checkFresh(src, parsed, prev, time.Now()); err != nil {
+				return DelegationHeader{}, lineCount, err
+			}
+			header = &parsed
+			continue
+		}
+
+		if len(parts) == 6 && parts[5] == "summary" {
+			count, err := strconv.Atoi(parts[4])
+			if err != nil {
+				return DelegationHeader{}, lineCount, fmt.Errorf("invalid summary line %q", line)
+			}
+			stats.Summary[parts[2]] = count
+			continue
+		}
+
 		if len(parts) < 7 {
 			stats.SkippedCount++
 			continue
 		}
+		counted[parts[2]]++
 
 		if parts[1] == "*" || (parts[6] != "allocated" && parts[6] != "assigned") {
 			stats.SkippedCount++
 			continue
 		}
 
-		if parts[2] != "ipv4" && parts[2] != "ipv6" {
+		if parts[2] != "ipv4" && parts[2] != "ipv6" && parts[2] != "asn" {
 			stats.SkippedCount++
 			continue
 		}
 
-		ipRange, err := s.parseIPRange(parts)
+		if len(parts) < minFields {
+			stats.ParseErrors++
+			s.logger.Debug("record does not match expected format",
+				zap.String("format", src.Format),
+				zap.String("line", line))
+			continue
+		}
+
+		if parts[2] == "asn" {
+			asn, err := parseASN(parts)
+			if err != nil {
+				stats.ParseErrors++
+				s.logger.Debug("failed to parse ASN range",
+					zap.String("line", line),
+					zap.Error(err))
+				continue
+			}
+			asn.Source = src.Name
+			stats.ASNCount++
+			if emitASN != nil {
+				emitASN(asn)
+			}
+			continue
+		}
+
+		parsed, err := s.parseIPRange(parts)
 		if err != nil {
 			stats.ParseErrors++
 			s.logger.Debug("failed to parse IP range",
@@ -140,71 +543,237 @@ func (s *RIRService) fetchWithTimeout(ctx context.Context, url string) ([]model.
 			continue
 		}
 
-		if ipRange.Version == 4 {
-			stats.IPv4Count++
-		} else {
-			stats.IPv6Count++
+		if len(parsed) > 1 {
+			stats.SplitRecords++
+			stats.DecomposedBlocks += len(parsed)
 		}
 
-		ranges = append(ranges, ipRange)
+		for _, ipRange := range parsed {
+			ipRange.Source = src.Name
+			if ipRange.Version == 4 {
+				stats.IPv4Count++
+			} else {
+				stats.IPv6Count++
+			}
+			if err := emit(ipRange); err != nil {
+				return DelegationHeader{}, lineCount, err
+			}
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, stats, fmt.Errorf("reading RIR data: %w", err)
+		return DelegationHeader{}, lineCount, fmt.Errorf("reading RIR data: %w", err)
 	}
 
-	s.logger.Info("Finished parsing RIR data",
-		zap.String("url", url),
-		zap.Int("total_lines", lineCount),
-		zap.Int("ipv4_ranges", stats.IPv4Count),
-		zap.Int("ipv6_ranges", stats.IPv6Count),
-		zap.Int("skipped_lines", stats.SkippedCount),
-		zap.Int("parse_errors", stats.ParseErrors),
-		zap.Duration("parse_time", time.Since(parseStartTime)),
-		zap.Duration("total_time", time.Since(startTime)))
+	if header == nil {
+		return DelegationHeader{}, lineCount, errors.New("missing version line")
+	}
+	if err := checkCounts(*header, stats.Summary, counted); err != nil {
+		return DelegationHeader{}, lineCount, err
+	}
+	stats.Header = *header
 
-	return ranges, stats, nil
+	return *header, lineCount, nil
 }
 
-func (s *RIRService) parseIPRange(parts []string) (model.IPRange, error) {
-	var ipRange model.IPRange
+// parseHeader parses the version line of a delegation file. Dates that are
+// not published are left zero.
+func parseHeader(parts []string) (DelegationHeader, error) {
+	// Records may have seven fields too, but start with a registry name
+	if _, err := strconv.ParseFloat(parts[0], 64); err != nil || len(parts) != 7 {
+		return DelegationHeader{}, fmt.Errorf("missing version line, got %q", strings.Join(parts, "|"))
+	}
+
+	serial, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return DelegationHeader{}, fmt.Errorf("invalid serial %q", parts[2])
+	}
+	records, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return DelegationHeader{}, fmt.Errorf("invalid record count %q", parts[3])
+	}
 
-	countryCode := parts[1]
+	header := DelegationHeader{
+		Version:   parts[0],
+		Registry:  parts[1],
+		Serial:    serial,
+		Records:   records,
+		UTCOffset: parts[6],
+	}
+	if date, err := time.Parse("20060102", parts[4]); err == nil {
+		header.StartDate = date
+	}
+	if date, err := time.Parse("20060102", parts[5]); err == nil {
+		header.EndDate = date
+	}
+	return header, nil
+}
+
+// checkFresh rejects a file older than the data already published from the
+// source, as served by a lagging mirror, or older than the source's maximum
+// age.
+func checkFresh(src config.RIR, header DelegationHeader, prev model.SourceState, now time.Time) error {
+	if header.Serial < prev.Serial {
+		return fmt.Errorf("stale file: serial %d is older than published serial %d", header.Serial, prev.Serial)
+	}
+	if src.MaxAge > 0 && !header.EndDate.IsZero() && now.Sub(header.EndDate) > src.MaxAge {
+		return fmt.Errorf("stale file: data ends %s, more than %s ago", header.EndDate.Format(time.DateOnly), src.MaxAge)
+	}
+	return nil
+}
+
+// checkCounts compares the records found in a file with the counts declared
+// by its header and summary lines, which catches truncated downloads.
+func checkCounts(header DelegationHeader, summary, counted map[string]int) error {
+	total := 0
+	for _, n := range counted {
+		total += n
+	}
+	if total != header.Records {
+		return fmt.Errorf("header declares %d records, found %d", header.Records, total)
+	}
+
+	for kind, declared := range summary {
+		if counted[kind] != declared {
+			return fmt.Errorf("summary declares %d %s records, found %d", declared, kind, counted[kind])
+		}
+	}
+	return nil
+}
+
+// parseIPRange converts a delegation record into one or more ranges. IPv4
+// records carry a start address and an address count which need not be a
+// power of two nor aligned, so they are decomposed into the minimal set of
+// CIDR blocks covering exactly the delegated addresses.
+func (s *RIRService) parseIPRange(parts []string) ([]model.IPRange, error) {
 	startIP := parts[3]
 
-	var network *net.IPNet
+	details := model.IPRange{
+		Registry:    parts[0],
+		CountryCode: parts[1],
+		Status:      parts[6],
+	}
+	// Records without a known allocation date carry an empty or zero date
+	if date, err := time.Parse("20060102", parts[5]); err == nil {
+		details.AllocatedAt = date
+	}
+	// Only the extended format carries an opaque id
+	if len(parts) > 7 {
+		details.OpaqueID = parts[7]
+	}
 
 	switch parts[2] {
 	case "ipv4":
-		value, err := strconv.ParseInt(parts[4], 10, 64)
+		ip := net.ParseIP(startIP).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address: %s", startIP)
+		}
+
+		value, err := strconv.ParseUint(parts[4], 10, 64)
 		if err != nil {
-			return ipRange, err
+			return nil, err
 		}
 
-		// Convert value to CIDR prefix length
-		prefixLen := 32 - int(math.Log2(float64(value)))
-		network, err = parseCIDR(startIP, prefixLen)
+		networks, err := ipv4RangeToCIDRs(binary.BigEndian.Uint32(ip), value)
 		if err != nil {
-			return ipRange, err
+			return nil, err
+		}
+
+		ranges := make([]model.IPRange, 0, len(networks))
+		for _, network := range networks {
+			ipRange := details
+			ipRange.Network = network
+			ipRange.Version = 4
+			ranges = append(ranges, ipRange)
 		}
-		ipRange.Version = 4
+		return ranges, nil
 
 	case "ipv6":
 		prefixLen, err := strconv.Atoi(parts[4])
 		if err != nil {
-			return ipRange, err
+			return nil, err
 		}
-		network, err = parseCIDR(startIP, prefixLen)
+		network, err := parseCIDR(startIP, prefixLen)
 		if err != nil {
-			return ipRange, err
+			return nil, err
 		}
+		ipRange := details
+		ipRange.Network = *network
 		ipRange.Version = 6
+		return []model.IPRange{ipRange}, nil
 	}
 
-	ipRange.Network = *network
-	ipRange.CountryCode = countryCode
+	return nil, fmt.Errorf("unsupported record type: %s", parts[2])
+}
+
+// parseASN converts an asn record, which carries the first AS number and
+// the number of AS numbers delegated, into a delegation.
+func parseASN(parts []string) (model.ASNDelegation, error) {
+	first, err := strconv.ParseUint(parts[3], 10, 32)
+	if err != nil {
+		return model.ASNDelegation{}, fmt.Errorf("invalid AS number: %s", parts[3])
+	}
+	count, err := strconv.ParseUint(parts[4], 10, 64)
+	if err != nil || count == 0 {
+		return model.ASNDelegation{}, fmt.Errorf("invalid AS number count: %s", parts[4])
+	}
+	if count > math.MaxUint32-first+1 {
+		return model.ASNDelegation{}, fmt.Errorf("AS number range exceeds 32 bits")
+	}
+
+	delegation := model.ASNDelegation{
+		FirstASN:    uint32(first),
+		LastASN:     uint32(first + count - 1),
+		Registry:    parts[0],
+		CountryCode: parts[1],
+		Status:      parts[6],
+	}
+	if date, err := time.Parse("20060102", parts[5]); err == nil {
+		delegation.AllocatedAt = date
+	}
+	if len(parts) > 7 {
+		delegation.OpaqueID = parts[7]
+	}
+	return delegation, nil
+}
+
+// ipv4RangeToCIDRs returns the minimal list of CIDR blocks covering exactly
+// count addresses starting at start.
+func ipv4RangeToCIDRs(start uint32, count uint64) ([]net.IPNet, error) {
+	if count == 0 {
+		return nil, fmt.Errorf("empty address range")
+	}
+	if uint64(start)+count > 1<<32 {
+		return nil, fmt.Errorf("address range exceeds IPv4 space")
+	}
+
+	var networks []net.IPNet
+	current := uint64(start)
+	remaining := count
+
+	for remaining > 0 {
+		// Largest block allowed by the alignment of the current address
+		size := uint64(1) << 32
+		if current != 0 {
+			size = uint64(1) << bits.TrailingZeros64(current)
+		}
+		// ...and by the number of addresses left
+		for size > remaining {
+			size >>= 1
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(current))
+		networks = append(networks, net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(32-bits.TrailingZeros64(size), 32),
+		})
+
+		current += size
+		remaining -= size
+	}
 
-	return ipRange, nil
+	return networks, nil
 }
 
 func parseCIDR(ip string, prefixLen int) (*net.IPNet, error) {
@@ -2,13 +2,54 @@ package service
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
 	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/model"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// delegationFile prefixes records with a version line and summary lines
+// that match them.
+func delegationFile(records ...string) string {
+	counts := make(map[string]int)
+	for _, record := range records {
+		counts[strings.Split(record, "|")[2]]++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "2|test|20240101|%d|19700101|20231231|+0000\n", len(records))
+	for _, kind := range []string{"asn", "ipv4", "ipv6"} {
+		if counts[kind] > 0 {
+			fmt.Fprintf(&b, "test|*|%s|*|%d|summary\n", kind, counts[kind])
+		}
+	}
+	for _, record := range records {
+		b.WriteString(record + "\n")
+	}
+	return b.String()
+}
+
+// fetchRanges fetches src unconditionally and collects its ranges.
+func fetchRanges(ctx context.Context, service *RIRService, src config.RIR) ([]model.IPRange, RIRStats, error) {
+	var ranges []model.IPRange
+	result, err := service.FetchIPRangesIfChanged(ctx, src, model.SourceState{}, stageInto(&ranges))
+	if err != nil {
+		return nil, RIRStats{}, err
+	}
+	return ranges, result.Stats, nil
+}
+
 func TestRIRService_FetchIPRanges(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -18,8 +59,9 @@ func TestRIRService_FetchIPRanges(t *testing.T) {
 	}{
 		{
 			name: "valid response",
-			response: `2|US|ipv4|192.168.0.0|65536|20100101|allocated
-2|CA|ipv6|2001:db8::|32|20100101|allocated`,
+			response: delegationFile(
+				"test|US|ipv4|192.168.0.0|65536|20100101|allocated",
+				"test|CA|ipv6|2001:db8::|32|20100101|allocated"),
 			responseCode:  http.StatusOK,
 			expectedError: false,
 		},
@@ -44,7 +86,7 @@ func TestRIRService_FetchIPRanges(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
 
-			ranges, _, err := service.FetchIPRanges(ctx, server.URL)
+			ranges, _, err := fetchRanges(ctx, service, config.RIR{Name: "TEST", URL: server.URL, Enabled: true})
 
 			if tt.expectedError {
 				if err == nil {
@@ -64,3 +106,731 @@ func TestRIRService_FetchIPRanges(t *testing.T) {
 		})
 	}
 }
+
+func TestRIRService_ParseIPRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected []string
+	}{
+		{
+			name:     "aligned power of two",
+			line:     "arin|US|ipv4|23.0.0.0|4096|20100101|allocated",
+			expected: []string{"23.0.0.0/20"},
+		},
+		{
+			name:     "768 addresses",
+			line:     "arin|US|ipv4|199.16.156.0|768|20100101|assigned",
+			expected: []string{"199.16.156.0/23", "199.16.158.0/24"},
+		},
+		{
+			name:     "1280 addresses",
+			line:     "lacnic|BR|ipv4|200.160.0.0|1280|19980101|allocated",
+			expected: []string{"200.160.0.0/22", "200.160.4.0/24"},
+		},
+		{
+			name:     "unaligned start",
+			line:     "arin|US|ipv4|192.0.2.128|512|20100101|allocated",
+			expected: []string{"192.0.2.128/25", "192.0.3.0/24", "192.0.4.0/25"},
+		},
+		{
+			name:     "single address",
+			line:     "lacnic|AR|ipv4|190.0.0.7|1|20100101|assigned",
+			expected: []string{"190.0.0.7/32"},
+		},
+		{
+			name:     "whole address space",
+			line:     "iana|ZZ|ipv4|0.0.0.0|4294967296|20100101|allocated",
+			expected: []string{"0.0.0.0/0"},
+		},
+		{
+			name:     "ipv6 prefix",
+			line:     "ripencc|DE|ipv6|2001:db8::|32|20100101|allocated",
+			expected: []string{"2001:db8::/32"},
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := service.parseIPRange(strings.Split(tt.line, "|"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, r := range ranges {
+				got = append(got, r.Network.String())
+			}
+
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRIRService_ParseIPRange_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{name: "zero count", line: "arin|US|ipv4|10.0.0.0|0|20100101|allocated"},
+		{name: "beyond address space", line: "arin|US|ipv4|255.255.255.0|512|20100101|allocated"},
+		{name: "invalid start", line: "arin|US|ipv4|10.0.0|256|20100101|allocated"},
+		{name: "invalid count", line: "arin|US|ipv4|10.0.0.0|abc|20100101|allocated"},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := service.parseIPRange(strings.Split(tt.line, "|")); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestRIRService_FetchIPRanges_DecomposedStats(t *testing.T) {
+	response := delegationFile(
+		"arin|US|ipv4|199.16.156.0|768|20100101|assigned",
+		"lacnic|BR|ipv4|200.160.0.0|1280|19980101|allocated",
+		"arin|US|ipv4|23.0.0.0|4096|20100101|allocated")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+
+	ranges, stats, err := fetchRanges(context.Background(), service, config.RIR{Name: "TEST", URL: server.URL, Enabled: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(ranges) != 5 || stats.IPv4Count != 5 {
+		t.Errorf("expected 5 IPv4 ranges, got %d (stats %d)", len(ranges), stats.IPv4Count)
+	}
+	if stats.SplitRecords != 2 {
+		t.Errorf("expected 2 split records, got %d", stats.SplitRecords)
+	}
+	if stats.DecomposedBlocks != 4 {
+		t.Errorf("expected 4 decomposed blocks, got %d", stats.DecomposedBlocks)
+	}
+}
+
+func TestRIRService_ParseIPRange_Details(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+
+	ranges, err := service.parseIPRange(strings.Split(
+		"arin|US|ipv4|199.16.156.0|768|20100521|assigned|ee3c8d4b0b7fb5c2b4c1b5ec1f4d0a6a", "|"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, r := range ranges {
+		if r.Registry != "arin" || r.Status != "assigned" || r.OpaqueID != "ee3c8d4b0b7fb5c2b4c1b5ec1f4d0a6a" {
+			t.Errorf("unexpected details %+v", r)
+		}
+		if !r.AllocatedAt.Equal(time.Date(2010, 5, 21, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected allocation date %v", r.AllocatedAt)
+		}
+	}
+
+	// Non-extended files have no opaque id and may leave the date empty
+	ranges, err = service.parseIPRange(strings.Split("apnic|AU|ipv6|2001:db8::|32||allocated", "|"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ranges[0].OpaqueID != "" || !ranges[0].AllocatedAt.IsZero() {
+		t.Errorf("unexpected details %+v", ranges[0])
+	}
+}
+
+func TestParseASN(t *testing.T) {
+	delegation, err := parseASN(strings.Split("apnic|JP|asn|4608|1024|19940101|allocated|A91A7381", "|"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := model.ASNDelegation{
+		FirstASN:    4608,
+		LastASN:     5631,
+		CountryCode: "JP",
+		Registry:    "apnic",
+		Status:      "allocated",
+		AllocatedAt: time.Date(1994, 1, 1, 0, 0, 0, 0, time.UTC),
+		OpaqueID:    "A91A7381",
+	}
+	if delegation != want {
+		t.Errorf("expected %+v, got %+v", want, delegation)
+	}
+
+	for _, line := range []string{
+		"arin|US|asn|AS701|1|19900803|allocated",
+		"arin|US|asn|701|0|19900803|allocated",
+		"arin|US|asn|4294967295|2|19900803|allocated",
+		"arin|US|asn|4294967296|1|19900803|allocated",
+	} {
+		if _, err := parseASN(strings.Split(line, "|")); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
+
+func TestRIRService_FetchIPRanges_Locations(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	ripeFile, err := filepath.Abs("testdata/delegated-ripencc-latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		src           config.RIR
+		expectedCount int
+		expectedError bool
+	}{
+		{
+			name: "local file",
+			src: config.RIR{
+				Name: "RIPE",
+				URL:  "file://" + ripeFile,
+			},
+			expectedCount: 6,
+		},
+		{
+			name: "relative local file",
+			src: config.RIR{
+				Name: "LACNIC",
+				URL:  "file:testdata/delegated-lacnic-latest",
+			},
+			expectedCount: 4,
+		},
+		{
+			name: "mirror fallback",
+			src: config.RIR{
+				Name:   "ARIN",
+				URL:    server.URL + "/missing",
+				Format: config.FormatExtended,
+				Mirrors: []string{
+					"file:///nonexistent/delegated-arin-extended-latest",
+					server.URL + "/delegated-arin-extended-latest",
+				},
+			},
+			expectedCount: 5,
+		},
+		{
+			name: "all locations fail",
+			src: config.RIR{
+				Name:    "ARIN",
+				URL:     server.URL + "/missing",
+				Mirrors: []string{"file:///nonexistent/delegated-arin-extended-latest"},
+			},
+			expectedError: true,
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+	service.retryDelay = time.Millisecond
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, _, err := fetchRanges(context.Background(), service, tt.src)
+
+			if tt.expectedError {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(ranges) != tt.expectedCount {
+				t.Errorf("expected %d ranges, got %d", tt.expectedCount, len(ranges))
+			}
+		})
+	}
+}
+
+func TestRIRService_FetchIPRangesIfChanged(t *testing.T) {
+	data := delegationFile("arin|US|ipv4|8.8.8.0|256|20100101|allocated")
+	sum := md5.Sum([]byte(data))
+	checksum := hex.EncodeToString(sum[:])
+
+	var downloads int
+	var published string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/delegated.md5":
+			w.Write([]byte("MD5 (delegated) = " + published + "\n"))
+		case "/delegated":
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Last-Modified", "Wed, 01 May 2024 00:00:00 GMT")
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			downloads++
+			w.Write([]byte(data))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	location := server.URL + "/delegated"
+	plain := config.RIR{Name: "TEST", URL: location}
+	verified := config.RIR{Name: "TEST", URL: location, Checksum: config.ChecksumMD5}
+
+	tests := []struct {
+		name              string
+		src               config.RIR
+		prev              model.SourceState
+		published         string
+		expectDownload    bool
+		expectNotModified bool
+		expectedError     bool
+	}{
+		{name: "first fetch", src: plain, expectDownload: true},
+		{
+			name:              "conditional request",
+			src:               plain,
+			prev:              model.SourceState{Location: location, ETag: `"v1"`},
+			expectNotModified: true,
+		},
+		{
+			name:           "validators from another location",
+			src:            plain,
+			prev:           model.SourceState{Location: server.URL + "/mirror", ETag: `"v1"`},
+			expectDownload: true,
+		},
+		{
+			name:              "same content",
+			src:               plain,
+			prev:              model.SourceState{Checksum: checksum},
+			expectDownload:    true,
+			expectNotModified: true,
+		},
+		{name: "checksum verified", src: verified, published: checksum, expectDownload: true},
+		{
+			name:              "checksum unchanged",
+			src:               verified,
+			prev:              model.SourceState{Checksum: checksum},
+			published:         checksum,
+			expectNotModified: true,
+		},
+		{name: "checksum mismatch", src: verified, published: strings.Repeat("0", 32), expectDownload: true, expectedError: true},
+		{name: "checksum file missing", src: config.RIR{Name: "TEST", URL: server.URL + "/missing", Checksum: config.ChecksumMD5}, expectedError: true},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+	service.retryDelay = time.Millisecond
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloads = 0
+			published = tt.published
+
+			var ranges []model.IPRange
+			result, err := service.FetchIPRangesIfChanged(context.Background(), tt.src, tt.prev, stageInto(&ranges))
+			if (downloads > 0) != tt.expectDownload {
+				t.Errorf("expected download %v, got %d downloads", tt.expectDownload, downloads)
+			}
+
+			if tt.expectedError {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if result.NotModified != tt.expectNotModified {
+				t.Errorf("expected not modified %v, got %v", tt.expectNotModified, result.NotModified)
+			}
+			if tt.expectDownload {
+				if !result.Loaded || len(ranges) != 1 {
+					t.Errorf("expected 1 range to be loaded, got %d", len(ranges))
+				}
+				state := result.State
+				if state.Location != location || state.ETag != `"v1"` || state.LastModified == "" || state.Checksum != checksum {
+					t.Errorf("unexpected state %+v", state)
+				}
+			} else if result.Loaded || len(ranges) != 0 {
+				t.Errorf("expected no ranges without a download, got %d", len(ranges))
+			}
+		})
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	const digest = "6b1d0e3b3b4b7a0a9d3c1f2e4a5b6c7d"
+
+	tests := []struct {
+		name          string
+		content       string
+		expectedError bool
+	}{
+		{name: "BSD style", content: "MD5 (delegated-arin-extended-latest) = " + digest + "\n"},
+		{name: "md5sum style", content: digest + "  delegated-apnic-latest\n"},
+		{name: "upper case", content: strings.ToUpper(digest)},
+		{name: "no digest", content: "MD5 (delegated-arin-extended-latest) =\n", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChecksum(tt.content)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != digest {
+				t.Errorf("expected %s, got %s", digest, got)
+			}
+		})
+	}
+}
+
+func TestRIRService_FetchIPRanges_Header(t *testing.T) {
+	records := []string{
+		"test|US|asn|701|1|19900803|allocated",
+		"test|US|ipv4|8.8.8.0|256|20100101|allocated",
+		"test|US|ipv4|9.9.9.0|256|20100101|reserved",
+		"test|DE|ipv6|2001:db8::|32|20100101|allocated",
+	}
+	valid := delegationFile(records...)
+
+	tests := []struct {
+		name          string
+		content       string
+		src           config.RIR
+		prev          model.SourceState
+		errMsg        string
+		expectedCount int
+	}{
+		{name: "valid", content: valid, expectedCount: 2},
+		{name: "comments before header", content: "# generated\n" + valid, expectedCount: 2},
+		{name: "missing header", content: strings.Join(records, "\n"), errMsg: "missing version line"},
+		{name: "empty file", content: "", errMsg: "missing version line"},
+		{name: "truncated", content: strings.TrimSuffix(valid, records[3]+"\n"), errMsg: "header declares 4 records, found 3"},
+		{
+			name:    "summary mismatch",
+			content: strings.Replace(valid, "test|*|ipv4|*|2|summary", "test|*|ipv4|*|3|summary", 1),
+			errMsg:  "summary declares 3 ipv4 records, found 2",
+		},
+		{name: "older serial", content: valid, prev: model.SourceState{Serial: 20240102}, errMsg: "stale file: serial 20240101"},
+		{name: "same serial", content: valid, prev: model.SourceState{Serial: 20240101}, expectedCount: 2},
+		{name: "too old", content: valid, src: config.RIR{MaxAge: 24 * time.Hour}, errMsg: "stale file: data ends 2023-12-31"},
+		{name: "recent enough", content: valid, src: config.RIR{MaxAge: 100 * 365 * 24 * time.Hour}, expectedCount: 2},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "delegated-test-latest")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			src := tt.src
+			src.Name, src.URL = "TEST", "file://"+path
+
+			var ranges []model.IPRange
+			result, err := service.FetchIPRangesIfChanged(context.Background(), src, tt.prev, stageInto(&ranges))
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("expected error containing %q, got %v", tt.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(ranges) != tt.expectedCount {
+				t.Errorf("expected %d ranges, got %d", tt.expectedCount, len(ranges))
+			}
+
+			header := result.Stats.Header
+			if header.Registry != "test" || header.Serial != 20240101 || header.Records != 4 || header.UTCOffset != "+0000" {
+				t.Errorf("unexpected header %+v", header)
+			}
+			if header.EndDate != time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC) {
+				t.Errorf("unexpected end date %v", header.EndDate)
+			}
+			if summary := result.Stats.Summary; summary["asn"] != 1 || summary["ipv4"] != 2 || summary["ipv6"] != 1 {
+				t.Errorf("unexpected summary %v", summary)
+			}
+			if state := result.State; state.Serial != header.Serial || state.EndDate != header.EndDate {
+				t.Errorf("expected header in source state, got %+v", state)
+			}
+			if len(result.ASNs) != 1 || result.ASNs[0].FirstASN != 701 || result.ASNs[0].Source != "TEST" || result.Stats.ASNCount != 1 {
+				t.Errorf("expected the AS701 delegation, got %+v", result.ASNs)
+			}
+		})
+	}
+}
+
+func TestRIRService_FetchIPRanges_RetryDiscardsPartialLoad(t *testing.T) {
+	full := delegationFile(
+		"test|US|ipv4|8.8.8.0|256|20100101|allocated",
+		"test|DE|ipv6|2001:db8::|32|20100101|allocated")
+	truncated := full[:strings.LastIndex(full, "test|DE")]
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Write([]byte(truncated))
+			return
+		}
+		w.Write([]byte(full))
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+	service.retryDelay = time.Millisecond
+
+	var ranges []model.IPRange
+	var loads int
+	sink := func(ctx context.Context, load func(emit func(model.IPRange) error) error) error {
+		loads++
+		return stageInto(&ranges)(ctx, load)
+	}
+
+	if _, err := service.FetchIPRangesIfChanged(context.Background(), config.RIR{Name: "TEST", URL: server.URL}, model.SourceState{}, sink); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loads != 2 {
+		t.Errorf("expected a load per attempt, got %d", loads)
+	}
+	if len(ranges) != 2 {
+		t.Errorf("expected only the complete attempt to be kept, got %d ranges", len(ranges))
+	}
+}
+
+func TestRIRService_Backoff(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+	service.retryDelay = time.Second
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 1, min: 500 * time.Millisecond, max: time.Second},
+		{attempt: 2, min: time.Second, max: 2 * time.Second},
+		{attempt: 4, min: 4 * time.Second, max: 8 * time.Second},
+		{attempt: 20, min: maxRetryDelay / 2, max: maxRetryDelay},
+		{attempt: 70, min: maxRetryDelay / 2, max: maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := service.backoff(tt.attempt); delay < tt.min || delay > tt.max {
+				t.Fatalf("attempt %d: expected delay in [%s, %s], got %s", tt.attempt, tt.min, tt.max, delay)
+			}
+		}
+	}
+}
+
+func TestRIRService_FetchAll(t *testing.T) {
+	content := delegationFile("test|US|ipv4|8.8.8.0|256|20100101|allocated")
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		if r.URL.Path == "/broken" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+	service.retryDelay = time.Millisecond
+
+	var sources []config.RIR
+	for i := 0; i < 6; i++ {
+		sources = append(sources, config.RIR{Name: fmt.Sprintf("SRC%d", i), URL: server.URL + "/ok"})
+	}
+	sources[3].URL = server.URL + "/broken"
+
+	var ranges []model.IPRange
+	results := service.FetchAll(context.Background(), sources, nil, 2, stageInto(&ranges))
+
+	if maxInFlight > 2 {
+		t.Errorf("expected at most 2 downloads in flight, got %d", maxInFlight)
+	}
+	if len(results) != len(sources) {
+		t.Fatalf("expected %d results, got %d", len(sources), len(results))
+	}
+	for i, result := range results {
+		if result.Name != sources[i].Name {
+			t.Errorf("result %d: expected %s, got %s", i, sources[i].Name, result.Name)
+		}
+		if i == 3 {
+			if result.Err == nil || result.Result != nil {
+				t.Errorf("expected only an error for the broken source, got %+v", result)
+			}
+			continue
+		}
+		if result.Err != nil || result.Result == nil || !result.Result.Loaded {
+			t.Errorf("%s: expected a loaded result, got %+v", result.Name, result)
+		}
+	}
+	if len(ranges) != 5 {
+		t.Errorf("expected 5 ranges, got %d", len(ranges))
+	}
+}
+
+func TestRIRService_FetchIPRanges_Cancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	service := NewRIRService(logger)
+	service.retryDelay = time.Hour
+
+	tests := []struct {
+		name string
+		src  config.RIR
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{
+			name: "cancelled during backoff",
+			src:  config.RIR{Name: "TEST", URL: server.URL},
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(50*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+		},
+		{
+			name: "budget exhausted",
+			src:  config.RIR{Name: "TEST", URL: server.URL, Mirrors: []string{server.URL + "/mirror"}, Budget: 50 * time.Millisecond},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			start := time.Now()
+			_, err := service.FetchIPRangesIfChanged(ctx, tt.src, model.SourceState{}, stageInto(new([]model.IPRange)))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("expected to give up promptly, took %s", elapsed)
+			}
+			if !strings.Contains(err.Error(), "503") {
+				t.Errorf("expected the last attempt's error to be kept, got %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkRIRService_Fetch compares collecting a large delegation file into
+// a slice, as every update did before, with streaming it into a sink.
+// peak-heap-MB samples the live heap while the data is held or streamed.
+func BenchmarkRIRService_Fetch(b *testing.B) {
+	const records = 300000
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "2|test|20240101|%d|19700101|20231231|+0000\n", records)
+	fmt.Fprintf(&content, "test|*|ipv4|*|%d|summary\n", records)
+	for i := 0; i < records; i++ {
+		fmt.Fprintf(&content, "test|US|ipv4|%d.%d.%d.0|256|20100101|allocated\n", 1+i>>16, (i>>8)&0xff, i&0xff)
+	}
+	path := filepath.Join(b.TempDir(), "delegated-test-latest")
+	if err := os.WriteFile(path, []byte(content.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	src := config.RIR{Name: "TEST", URL: "file://" + path}
+
+	service := NewRIRService(zap.NewNop())
+
+	peakHeap := func() uint64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+
+	b.Run("collect", func(b *testing.B) {
+		b.ReportAllocs()
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			ranges, _, err := fetchRanges(context.Background(), service, src)
+			if err != nil {
+				b.Fatal(err)
+			}
+			peak = max(peak, peakHeap())
+			runtime.KeepAlive(ranges)
+		}
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+	})
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		var peak uint64
+		sink := func(ctx context.Context, load func(emit func(model.IPRange) error) error) error {
+			n := 0
+			return load(func(ipRange model.IPRange) error {
+				if n++; n%50000 == 0 {
+					peak = max(peak, peakHeap())
+				}
+				return nil
+			})
+		}
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			if _, err := service.FetchIPRangesIfChanged(context.Background(), src, model.SourceState{}, sink); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+	})
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+	"ipservice/internal/model"
+	"ipservice/internal/mrt"
+)
+
+// RouteRepository stores the routes of imported RIB dumps.
+type RouteRepository interface {
+	ReplaceRoutes(ctx context.Context, files []string, load func(emit func(model.Route) error) error) (*model.RouteImport, error)
+}
+
+// RouteImporter imports BGP RIB dumps in MRT format, such as those of
+// RouteViews and RIPE RIS, to map addresses to the AS originating them.
+type RouteImporter struct {
+	repo   RouteRepository
+	logger *zap.Logger
+}
+
+func NewRouteImporter(repo RouteRepository, logger *zap.Logger) *RouteImporter {
+	return &RouteImporter{
+		repo:   repo,
+		logger: logger,
+	}
+}
+
+// routeStats counts what was read from a RIB dump.
+type routeStats struct {
+	Prefixes  int // with at least one origin
+	NoOrigin  int // prefixes no entry has an unambiguous origin for
+	Malformed int // records skipped
+}
+
+// Import replaces the routes with those of the RIB dumps at paths, which
+// may be gzip or bzip2 compressed. Prefixes announced by different origins
+// are attributed to the origin the most peers see.
+func (i *RouteImporter) Import(ctx context.Context, paths []string) error {
+	result, err := i.repo.ReplaceRoutes(ctx, paths, func(emit func(model.Route) error) error {
+		var total int
+		for _, path := range paths {
+			stats, err := i.importFile(ctx, path, emit)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			i.logger.Info("Read RIB dump",
+				zap.String("path", path),
+				zap.Int("prefixes", stats.Prefixes),
+				zap.Int("no_origin", stats.NoOrigin),
+				zap.Int("malformed", stats.Malformed))
+			total += stats.Prefixes
+		}
+		if total == 0 {
+			return errors.New("no routes found")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	i.logger.Info("Imported BGP routes",
+		zap.Int64("import", result.ID),
+		zap.Int64("routes", result.Routes),
+		zap.Strings("files", paths))
+	return nil
+}
+
+func (i *RouteImporter) importFile(ctx context.Context, path string, emit func(model.Route) error) (routeStats, error) {
+	var stats routeStats
+
+	f, err := openArchive(path)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	r := mrt.NewReader(f)
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		rib, err := r.Next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if errors.Is(err, mrt.ErrMalformed) {
+			stats.Malformed++
+			i.logger.Debug("Skipping malformed MRT record", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		// A default route would be the origin of every address
+		if ones, _ := rib.Prefix.Mask.Size(); ones == 0 {
+			continue
+		}
+
+		origins := make(map[uint32]int)
+		for _, entry := range rib.Entries {
+			if asn, ok := entry.OriginAS(); ok {
+				origins[asn]++
+			}
+		}
+		if len(origins) == 0 {
+			stats.NoOrigin++
+			continue
+		}
+		for asn, peers := range origins {
+			if err := emit(model.Route{Prefix: rib.Prefix, OriginASN: asn, Peers: peers}); err != nil {
+				return stats, err
+			}
+		}
+		stats.Prefixes++
+	}
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"ipservice/internal/model"
+	"ipservice/tests/mocks"
+)
+
+func TestRouteImporter_Import(t *testing.T) {
+	var files []string
+	var routes []string
+	mockRepo := &mocks.MockRepository{
+		ReplaceRoutesFunc: func(ctx context.Context, paths []string, load func(emit func(model.Route) error) error) (*model.RouteImport, error) {
+			files = paths
+			err := load(func(route model.Route) error {
+				routes = append(routes, fmt.Sprintf("%s %d %d", route.Prefix.String(), route.OriginASN, route.Peers))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &model.RouteImport{ID: 1, Files: paths, Routes: int64(len(routes))}, nil
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	importer := NewRouteImporter(mockRepo, logger)
+
+	paths := []string{"testdata/rib/rib.synthetic.mrt.gz", "testdata/rib/rib.malformed.mrt"}
+	if err := importer.Import(context.Background(), paths); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(files) != fmt.Sprint(paths) {
+		t.Errorf("expected files %v, got %v", paths, files)
+	}
+
+	// The default route and prefixes without an unambiguous origin are
+	// skipped, as is the malformed record
+	sort.Strings(routes)
+	want := []string{"193.0.0.0/21 3333 1", "193.0.0.0/21 64511 1", "8.8.8.0/24 15169 2"}
+	if fmt.Sprint(routes) != fmt.Sprint(want) {
+		t.Errorf("expected routes %v, got %v", want, routes)
+	}
+}
+
+func TestRouteImporter_Import_Errors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "rib.empty.mrt")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "rib.truncated.mrt")
+	data, err := os.ReadFile("testdata/rib/rib.malformed.mrt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(truncated, data[:len(data)-2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		paths []string
+		err   string
+	}{
+		{name: "missing", paths: []string{filepath.Join(dir, "rib.missing.mrt")}, err: "no such file"},
+		{name: "empty", paths: []string{empty}, err: "no routes found"},
+		{name: "truncated", paths: []string{"testdata/rib/rib.synthetic.mrt.gz", truncated}, err: "unexpected EOF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo := &mocks.MockRepository{
+				ReplaceRoutesFunc: func(ctx context.Context, paths []string, load func(emit func(model.Route) error) error) (*model.RouteImport, error) {
+					return nil, load(func(model.Route) error { return nil })
+				},
+			}
+
+			logger, _ := zap.NewDevelopment()
+			err := NewRouteImporter(mockRepo, logger).Import(context.Background(), tt.paths)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"ipservice/internal/model"
+)
+
+// updateRun is an update in progress. Asking for an update while one runs
+// joins it instead of queueing another.
+type updateRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error // set before done is closed
+
+	mu     sync.Mutex
+	status model.UpdateStatus
+}
+
+func (r *updateRun) update(fn func(status *model.UpdateStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.status)
+}
+
+func (r *updateRun) snapshot() *model.UpdateStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	status.Violations = slices.Clone(status.Violations)
+	status.Sources = slices.Clone(status.Sources)
+	return &status
+}
+
+// startUpdate starts an update under ctx, or returns the one in progress
+// and false.
+func (s *IPService) startUpdate(ctx context.Context, force bool, trigger string) (*updateRun, bool) {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+
+	if s.running != nil {
+		return s.running, false
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	run := &updateRun{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: model.UpdateStatus{
+			State:     model.UpdateRunning,
+			Trigger:   trigger,
+			StartedAt: time.Now(),
+		},
+	}
+	s.running = run
+
+	go func() {
+		err := s.updateIPRanges(ctx, force, run)
+		cancelled := err != nil && ctx.Err() != nil
+		cancel()
+
+		finished := time.Now()
+		run.update(func(status *model.UpdateStatus) {
+			status.FinishedAt = &finished
+			switch {
+			case err == nil:
+				status.State = model.UpdateSucceeded
+			case errors.Is(err, ErrNotLeader):
+				status.State = model.UpdateSkipped
+			case cancelled:
+				status.State = model.UpdateCancelled
+			default:
+				status.State = model.UpdateFailed
+			}
+			if err != nil {
+				status.Error = err.Error()
+			}
+		})
+		run.err = err
+
+		s.runMux.Lock()
+		s.running = nil
+		s.lastUpdate.Store(run.snapshot())
+		s.runMux.Unlock()
+		close(run.done)
+	}()
+
+	return run, true
+}
+
+// update runs an update, or joins the one in progress, and waits for it.
+// Cancelling ctx stops waiting but only cancels an update it started.
+func (s *IPService) update(ctx context.Context, force bool, trigger string) error {
+	run, started := s.startUpdate(ctx, force, trigger)
+	if !started {
+		s.logger.Info("IP ranges update already in progress, waiting for it",
+			zap.String("trigger", trigger))
+	}
+
+	select {
+	case <-run.done:
+		return run.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TriggerUpdate starts an update in the background, or joins the one in
+// progress, and returns its status and whether it was started. Triggered
+// updates are cancelled on shutdown or by CancelUpdate.
+func (s *IPService) TriggerUpdate() (*model.UpdateStatus, bool) {
+	s.runMux.Lock()
+	ctx := s.background
+	s.runMux.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	run, started := s.startUpdate(ctx, false, model.TriggerAdmin)
+	return run.snapshot(), started
+}
+
+// CancelUpdate cancels the update in progress and reports whether there
+// was one. A dataset already swapped in is still published.
+func (s *IPService) CancelUpdate() bool {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+
+	if s.running == nil {
+		return false
+	}
+	s.running.cancel()
+	return true
+}
+
+func (s *IPService) currentUpdate() *model.UpdateStatus {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+
+	if s.running == nil {
+		return nil
+	}
+	return s.running.snapshot()
+}
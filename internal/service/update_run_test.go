@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"ipservice/internal/config"
+	"ipservice/internal/lookup"
+	"ipservice/internal/model"
+	"ipservice/tests/mocks"
+)
+
+// newUpdateService returns a service updating from url whose dataset is
+// swapped in by the returned flag.
+func newUpdateService(t *testing.T, url string) (*IPService, *atomic.Bool) {
+	t.Helper()
+
+	var saved []model.IPRange
+	swapped := new(atomic.Bool)
+	mockRepo := &mocks.MockRepository{
+		GetSourceStatesFunc: func(ctx context.Context) (map[string]model.SourceState, error) {
+			return nil, nil
+		},
+		SaveSourceStatesFunc: func(ctx context.Context, states []model.SourceState) error {
+			return nil
+		},
+		BeginStagingFunc: func(ctx context.Context) error {
+			saved = nil
+			return nil
+		},
+		SaveIPRangesFunc: saveInto(&saved),
+		GetStagedCountFunc: func(ctx context.Context) (int64, error) {
+			return int64(len(saved)), nil
+		},
+		GetDatasetInfoFunc: func(ctx context.Context) (*model.DatasetInfo, error) {
+			return nil, nil
+		},
+		SaveASNDelegationsFunc: func(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+			return nil
+		},
+		SwapIPRangesFunc: func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+			swapped.Store(true)
+			return base + 1, nil
+		},
+		SaveDatasetHistoryFunc: func(ctx context.Context, version int64, keep int) error {
+			return nil
+		},
+		GetDatasetDiffFunc: func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+			return &model.DatasetDiff{To: q.To}, nil
+		},
+		LoadASNDelegationsFunc: func(ctx context.Context) ([]model.ASNDelegation, error) {
+			return nil, nil
+		},
+		LoadIPRangesFunc: func(ctx context.Context) ([]model.IPRange, error) {
+			return saved, nil
+		},
+	}
+	guardStaged(mockRepo, &saved, nil)
+	mockCache := &mocks.MockCache{
+		CacheASNDelegationsFunc: func(ctx context.Context, table *lookup.ASNTable) error {
+			return nil
+		},
+		CacheIPRangesFunc: func(ctx context.Context, table *lookup.Table) error {
+			return nil
+		},
+	}
+
+	cfg := &config.Config{RIRs: []config.RIR{{Name: "ARIN", URL: url, Enabled: true}}}
+	logger, _ := zap.NewDevelopment()
+	return NewIPService(mockRepo, mockCache, NewRIRService(logger), NewMemoryLocker(), cfg, logger), swapped
+}
+
+func TestIPService_TriggerUpdate_Coalesces(t *testing.T) {
+	release := make(chan struct{})
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write([]byte(delegationFile("arin|US|ipv4|8.8.8.0|256|20100101|allocated")))
+	}))
+	defer server.Close()
+
+	svc, swapped := newUpdateService(t, server.URL)
+
+	first, started := svc.TriggerUpdate()
+	if !started || first.State != model.UpdateRunning || first.Trigger != model.TriggerAdmin {
+		t.Fatalf("expected a running admin update, got %+v started %v", first, started)
+	}
+	second, started := svc.TriggerUpdate()
+	if started || !second.StartedAt.Equal(first.StartedAt) {
+		t.Errorf("expected the second trigger to join the first update, got %+v", second)
+	}
+
+	// The scheduler joins it as well instead of queueing
+	run, started := svc.startUpdate(context.Background(), false, model.TriggerSchedule)
+	if started {
+		t.Error("expected the scheduled update to join the running one")
+	}
+
+	if current := svc.Status().CurrentUpdate; current == nil || current.State != model.UpdateRunning {
+		t.Errorf("expected the update in progress in the status, got %+v", current)
+	}
+
+	close(release)
+	select {
+	case <-run.done:
+		if run.err != nil {
+			t.Fatalf("unexpected error: %v", run.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update did not finish")
+	}
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected a single download, got %d", n)
+	}
+	if !swapped.Load() {
+		t.Error("expected the dataset to be published")
+	}
+
+	status := svc.Status()
+	if status.CurrentUpdate != nil {
+		t.Errorf("expected no update in progress, got %+v", status.CurrentUpdate)
+	}
+	last := status.LastUpdate
+	if last == nil || last.State != model.UpdateSucceeded || last.FinishedAt == nil || last.Trigger != model.TriggerAdmin {
+		t.Fatalf("unexpected last update %+v", last)
+	}
+	if len(last.Sources) != 1 || last.Sources[0].Name != "ARIN" || !last.Sources[0].Changed || last.Sources[0].IPv4Ranges != 1 {
+		t.Fatalf("unexpected source outcomes %+v", last.Sources)
+	}
+	if source := last.Sources[0]; source.Serial != 20240101 || source.StartDate != "1970-01-01" || source.EndDate != "2023-12-31" {
+		t.Errorf("expected the serial and dates of the version line, got %+v", source)
+	}
+}
+
+func TestIPService_CancelUpdate(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	svc, swapped := newUpdateService(t, server.URL)
+
+	if svc.CancelUpdate() {
+		t.Error("expected nothing to cancel")
+	}
+
+	svc.TriggerUpdate()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not start")
+	}
+	if !svc.CancelUpdate() {
+		t.Fatal("expected the update to be cancelled")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.Status().LastUpdate == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled update did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if last := svc.Status().LastUpdate; last.State != model.UpdateCancelled || last.Error == "" {
+		t.Errorf("expected a cancelled update, got %+v", last)
+	}
+	if swapped.Load() {
+		t.Error("expected the cancelled update not to publish")
+	}
+}
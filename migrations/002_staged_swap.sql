@@ -0,0 +1,3 @@
+-- ip_ranges is replaced by renaming a staging copy over it, so the id
+-- sequence must not be dropped together with a retired table.
+ALTER SEQUENCE ip_ranges_id_seq OWNED BY NONE;
@@ -0,0 +1,12 @@
+ALTER TABLE ip_ranges
+    ADD COLUMN IF NOT EXISTS registry TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS allocated_at DATE,
+    ADD COLUMN IF NOT EXISTS opaque_id TEXT NOT NULL DEFAULT '';
+
+-- Keep a retained dataset compatible so it can still be rolled back to
+ALTER TABLE IF EXISTS ip_ranges_previous
+    ADD COLUMN IF NOT EXISTS registry TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS allocated_at DATE,
+    ADD COLUMN IF NOT EXISTS opaque_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS rir_sources (
+    name TEXT PRIMARY KEY,
+    location TEXT NOT NULL,
+    etag TEXT NOT NULL DEFAULT '',
+    last_modified TEXT NOT NULL DEFAULT '',
+    checksum TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
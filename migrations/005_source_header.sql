@@ -0,0 +1,4 @@
+ALTER TABLE rir_sources
+    ADD COLUMN IF NOT EXISTS serial BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS start_date DATE,
+    ADD COLUMN IF NOT EXISTS end_date DATE;
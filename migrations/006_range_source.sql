@@ -0,0 +1,17 @@
+ALTER TABLE ip_ranges
+    ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE IF EXISTS ip_ranges_previous
+    ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '';
+
+-- Attribute existing rows to the built-in sources so they can be kept when
+-- a source fails before the next full update tags them.
+UPDATE ip_ranges SET source = CASE registry
+    WHEN 'arin' THEN 'ARIN'
+    WHEN 'ripencc' THEN 'RIPE'
+    WHEN 'apnic' THEN 'APNIC'
+    WHEN 'lacnic' THEN 'LACNIC'
+    WHEN 'afrinic' THEN 'AFRINIC'
+    ELSE ''
+END
+WHERE source = '';
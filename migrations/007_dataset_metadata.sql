@@ -0,0 +1,16 @@
+-- The published dataset's metadata, kept in a single row and replaced
+-- together with ip_ranges.
+CREATE TABLE IF NOT EXISTS dataset_metadata (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    published_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    checked_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ranges BIGINT NOT NULL
+);
+
+-- Date a dataset published before the table existed by its newest range,
+-- or as too old to trust when that is unknown.
+INSERT INTO dataset_metadata (published_at, checked_at, ranges)
+SELECT coalesce(max(created_at), 'epoch'), coalesce(max(created_at), 'epoch'), count(*)
+FROM ip_ranges
+HAVING count(*) > 0
+ON CONFLICT (id) DO NOTHING;
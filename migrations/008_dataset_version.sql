@@ -0,0 +1,4 @@
+-- Every published dataset gets a new version, so instances that did not
+-- run the update notice it and reload.
+ALTER TABLE dataset_metadata
+    ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
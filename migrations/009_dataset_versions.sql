@@ -0,0 +1,46 @@
+-- Every published dataset, with the sources it was built from.
+CREATE TABLE IF NOT EXISTS dataset_versions (
+    id BIGSERIAL PRIMARY KEY,
+    published_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ipv4_ranges BIGINT NOT NULL,
+    ipv6_ranges BIGINT NOT NULL,
+    checksum TEXT NOT NULL -- MD5 of the dataset's ranges
+);
+
+CREATE TABLE IF NOT EXISTS dataset_version_sources (
+    version BIGINT NOT NULL REFERENCES dataset_versions (id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    serial BIGINT NOT NULL,
+    checksum TEXT NOT NULL, -- MD5 of the delegation file
+    ipv4_ranges BIGINT NOT NULL,
+    ipv6_ranges BIGINT NOT NULL,
+    PRIMARY KEY (version, name)
+);
+
+-- Ranges are tagged with the version of the dataset they were published in
+ALTER TABLE ip_ranges
+    ADD COLUMN IF NOT EXISTS dataset_version BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE IF EXISTS ip_ranges_previous
+    ADD COLUMN IF NOT EXISTS dataset_version BIGINT NOT NULL DEFAULT 0;
+
+-- Ranges of the versions kept in the history
+CREATE TABLE IF NOT EXISTS ip_ranges_history (LIKE ip_ranges);
+CREATE INDEX IF NOT EXISTS idx_ip_ranges_history_version ON ip_ranges_history (dataset_version);
+
+-- Record the dataset published before versions were recorded
+INSERT INTO dataset_versions (id, published_at, ipv4_ranges, ipv6_ranges, checksum)
+SELECT m.version, m.published_at,
+    count(*) FILTER (WHERE r.ip_version = 4),
+    count(*) FILTER (WHERE r.ip_version = 6),
+    md5(string_agg(concat_ws('|', r.network, r.country_code, r.registry, r.status, r.allocated_at, r.source), ',' ORDER BY r.network))
+FROM dataset_metadata m CROSS JOIN ip_ranges r
+GROUP BY m.version, m.published_at
+ON CONFLICT (id) DO NOTHING;
+
+UPDATE ip_ranges SET dataset_version = m.version
+FROM dataset_metadata m
+WHERE ip_ranges.dataset_version = 0;
+
+SELECT setval('dataset_versions_id_seq', coalesce((SELECT max(id) FROM dataset_versions), 1),
+    EXISTS (SELECT 1 FROM dataset_versions));
@@ -0,0 +1,15 @@
+-- Version a dataset was published over, NULL for the first one
+ALTER TABLE dataset_versions
+    ADD COLUMN IF NOT EXISTS base_version BIGINT;
+
+-- Ranges added, removed or moved to another country by each published
+-- dataset, compared with the one it replaced.
+CREATE TABLE IF NOT EXISTS dataset_diffs (
+    version BIGINT NOT NULL REFERENCES dataset_versions (id) ON DELETE CASCADE,
+    network CIDR NOT NULL,
+    source TEXT NOT NULL,
+    change TEXT NOT NULL CHECK (change IN ('added', 'removed', 'country_changed')),
+    old_country_code TEXT NOT NULL DEFAULT '',
+    new_country_code TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (version, network)
+);
@@ -0,0 +1,28 @@
+-- Delegations imported from archived delegation files. A range is
+-- delegated the same way from valid_from until valid_to (exclusive), or
+-- until the latest archive of its source when valid_to is NULL.
+CREATE TABLE IF NOT EXISTS ip_ranges_temporal (
+    network CIDR NOT NULL,
+    country_code CHAR(2) NOT NULL,
+    ip_version INT NOT NULL,
+    registry TEXT NOT NULL,
+    status TEXT NOT NULL,
+    allocated_at DATE,
+    source TEXT NOT NULL, -- registry that published the archives
+    valid_from DATE NOT NULL,
+    valid_to DATE,
+    CHECK (valid_to IS NULL OR valid_to > valid_from)
+);
+
+CREATE INDEX IF NOT EXISTS idx_ip_ranges_temporal_network ON ip_ranges_temporal USING gist (network inet_ops);
+CREATE INDEX IF NOT EXISTS idx_ip_ranges_temporal_open ON ip_ranges_temporal (source, network) WHERE valid_to IS NULL;
+
+-- Archives imported into ip_ranges_temporal, in date order per source
+CREATE TABLE IF NOT EXISTS delegation_archives (
+    source TEXT NOT NULL,
+    data_date DATE NOT NULL,
+    serial BIGINT NOT NULL,
+    ranges BIGINT NOT NULL,
+    imported_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (source, data_date)
+);
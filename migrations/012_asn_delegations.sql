@@ -0,0 +1,16 @@
+-- AS number ranges delegated by the RIRs, replaced for every source with
+-- each published dataset.
+CREATE TABLE IF NOT EXISTS asn_delegations (
+    first_asn BIGINT NOT NULL,
+    last_asn BIGINT NOT NULL,
+    country_code CHAR(2) NOT NULL,
+    registry TEXT NOT NULL,
+    status TEXT NOT NULL,
+    allocated_at DATE,
+    opaque_id TEXT NOT NULL DEFAULT '',
+    source TEXT NOT NULL,
+    PRIMARY KEY (source, first_asn),
+    CHECK (first_asn <= last_asn)
+);
+
+CREATE INDEX IF NOT EXISTS idx_asn_delegations_first_asn ON asn_delegations (first_asn);
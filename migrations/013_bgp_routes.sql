@@ -0,0 +1,16 @@
+-- Origin AS of routed prefixes, from BGP RIB dumps. Replaced as a whole by
+-- each import.
+CREATE TABLE IF NOT EXISTS bgp_routes (
+    network CIDR PRIMARY KEY,
+    origin_asn BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_bgp_routes_network ON bgp_routes USING gist (network inet_ops);
+
+-- Imports of RIB dumps into bgp_routes, the latest describing its contents
+CREATE TABLE IF NOT EXISTS bgp_route_imports (
+    id BIGSERIAL PRIMARY KEY,
+    imported_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    files TEXT[] NOT NULL,
+    routes BIGINT NOT NULL
+);
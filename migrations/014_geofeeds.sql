@@ -0,0 +1,18 @@
+-- Entries of RFC 8805 geofeeds, replaced per feed whenever it is fetched
+CREATE TABLE IF NOT EXISTS geofeed_entries (
+    network CIDR NOT NULL,
+    country_code TEXT NOT NULL DEFAULT '',
+    region TEXT NOT NULL DEFAULT '',
+    city TEXT NOT NULL DEFAULT '',
+    postal_code TEXT NOT NULL DEFAULT '',
+    feed TEXT NOT NULL,
+    PRIMARY KEY (feed, network)
+);
+
+-- Refreshes of geofeed_entries, the latest describing its contents
+CREATE TABLE IF NOT EXISTS geofeed_updates (
+    id BIGSERIAL PRIMARY KEY,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    feeds TEXT[] NOT NULL, -- fetched; the other feeds kept their entries
+    entries BIGINT NOT NULL
+);
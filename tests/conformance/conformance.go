@@ -0,0 +1,108 @@
+// Package conformance holds the lookup test suite shared by every lookup
+// tier (in-memory index, Redis range cache and PostgreSQL), so they all give
+// identical answers on overlapping data.
+package conformance
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"ipservice/internal/model"
+)
+
+// LookupFunc resolves ip to a country code, or "" when no range contains it.
+type LookupFunc func(ctx context.Context, ip net.IP) (string, error)
+
+// Loader publishes ranges to the tier under test and returns its lookup.
+type Loader func(t *testing.T, ranges []model.IPRange) LookupFunc
+
+// Fixtures returns overlapping ranges as published by the RIRs, including
+// nested blocks sharing a start address and blocks at both ends of the
+// address space.
+func Fixtures() []model.IPRange {
+	var ranges []model.IPRange
+	for _, f := range []struct {
+		cidr        string
+		countryCode string
+	}{
+		{"10.0.0.0/8", "US"},
+		{"10.0.0.0/16", "GB"},
+		{"10.0.0.0/24", "IE"},
+		{"10.1.0.0/16", "CA"},
+		{"10.1.2.0/24", "MX"},
+		{"10.1.2.128/32", "AR"},
+		{"10.2.0.0/16", "BR"},
+		{"0.0.0.0/24", "AQ"},
+		{"255.255.255.0/24", "AU"},
+		{"2001:db8::/32", "FR"},
+		{"2001:db8::/48", "BE"},
+		{"2001:db8:1::/48", "NL"},
+		{"2001:db8:1:2::/64", "LU"},
+		{"ffff:ffff:ffff:ffff::/64", "JP"},
+	} {
+		_, network, err := net.ParseCIDR(f.cidr)
+		if err != nil {
+			panic(err)
+		}
+		version := 4
+		if network.IP.To4() == nil {
+			version = 6
+		}
+		ranges = append(ranges, model.IPRange{Network: *network, CountryCode: f.countryCode, Version: version})
+	}
+	return ranges
+}
+
+// Cases maps addresses to the country of the most specific fixture range
+// containing them.
+var Cases = []struct {
+	IP          string
+	CountryCode string
+}{
+	{"10.0.0.1", "IE"},
+	{"10.0.1.0", "GB"},
+	{"10.0.255.255", "GB"},
+	{"10.1.0.0", "CA"},
+	{"10.1.2.0", "MX"},
+	{"10.1.2.127", "MX"},
+	{"10.1.2.128", "AR"},
+	{"10.1.2.129", "MX"},
+	{"10.1.3.0", "CA"},
+	{"10.2.255.255", "BR"},
+	{"10.3.0.0", "US"},
+	{"10.255.255.255", "US"},
+	{"11.0.0.0", ""},
+	{"9.255.255.255", ""},
+	{"0.0.0.0", "AQ"},
+	{"255.255.255.255", "AU"},
+	{"::ffff:10.1.2.128", "AR"},
+	{"::ffff:11.0.0.0", ""},
+	{"2001:db8::1", "BE"},
+	{"2001:db8:0:ffff::", "BE"},
+	{"2001:db8:1::1", "NL"},
+	{"2001:db8:1:2::1", "LU"},
+	{"2001:db8:1:3::", "NL"},
+	{"2001:db8:2::", "FR"},
+	{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", "FR"},
+	{"2001:db9::", ""},
+	{"::1", ""},
+	{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "JP"},
+}
+
+// Run loads the fixtures into a tier and checks every case against it.
+func Run(t *testing.T, load Loader) {
+	lookup := load(t, Fixtures())
+
+	for _, tc := range Cases {
+		t.Run(tc.IP, func(t *testing.T) {
+			countryCode, err := lookup(context.Background(), net.ParseIP(tc.IP))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if countryCode != tc.CountryCode {
+				t.Errorf("expected %q, got %q", tc.CountryCode, countryCode)
+			}
+		})
+	}
+}
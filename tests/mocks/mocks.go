@@ -2,52 +2,224 @@ package mocks
 
 import (
 	"context"
+	"ipservice/internal/lookup"
 	"ipservice/internal/model"
 	"net"
+	"time"
 )
 
 type MockRepository struct {
-	SaveIPRangesFunc     func(ctx context.Context, ranges []model.IPRange) error
-	FindCountryForIPFunc func(ctx context.Context, ip net.IP) (string, error)
-	ClearIPRangesFunc    func(ctx context.Context) error
-	GetRangesCountFunc   func(ctx context.Context) (int64, error)
+	BeginStagingFunc        func(ctx context.Context) error
+	SaveIPRangesFunc        func(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error
+	KeepIPRangesFunc        func(ctx context.Context, sources []string, priority []string) (int64, error)
+	CountIPRangesFunc       func(ctx context.Context) ([]model.RangeCount, error)
+	CountStagedIPRangesFunc func(ctx context.Context) ([]model.RangeCount, error)
+	FindStagedConflictsFunc func(ctx context.Context, limit int) ([]model.RangeConflict, error)
+	GetStagedCountFunc      func(ctx context.Context) (int64, error)
+	SwapIPRangesFunc        func(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error)
+	RollbackIPRangesFunc    func(ctx context.Context) error
+	FindRangeForIPFunc      func(ctx context.Context, ip net.IP) (*model.IPRange, error)
+	FindRangesForIPsFunc    func(ctx context.Context, ips []net.IP) ([]*model.IPRange, error)
+	GetDatasetInfoFunc      func(ctx context.Context) (*model.DatasetInfo, error)
+	MarkDatasetCheckedFunc  func(ctx context.Context) error
+	ListDatasetVersionsFunc func(ctx context.Context, limit int) ([]model.DatasetVersion, error)
+	SaveDatasetHistoryFunc  func(ctx context.Context, version int64, keep int) error
+	GetDatasetDiffFunc      func(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error)
+	FindRangeForIPAtFunc    func(ctx context.Context, ip net.IP, at time.Time) (*model.HistoricalRange, error)
+	LatestArchiveDateFunc   func(ctx context.Context, source string) (time.Time, error)
+	ImportArchiveFunc       func(ctx context.Context, archive model.DelegationArchive, load func(emit func(model.IPRange) error) error) (*model.ArchiveImport, error)
+	SaveASNDelegationsFunc  func(ctx context.Context, kept []string, delegations []model.ASNDelegation) error
+	LoadASNDelegationsFunc  func(ctx context.Context) ([]model.ASNDelegation, error)
+	FindASNDelegationFunc   func(ctx context.Context, asn uint32) (*model.ASNDelegation, error)
+	LatestRouteImportFunc   func(ctx context.Context) (*model.RouteImport, error)
+	LoadRoutesFunc          func(ctx context.Context) ([]model.Route, error)
+	ReplaceRoutesFunc       func(ctx context.Context, files []string, load func(emit func(model.Route) error) error) (*model.RouteImport, error)
+	SaveGeofeedsFunc        func(ctx context.Context, kept []string, entries []model.GeofeedEntry) (*model.GeofeedUpdate, error)
+	LatestGeofeedUpdateFunc func(ctx context.Context) (*model.GeofeedUpdate, error)
+	LoadGeofeedsFunc        func(ctx context.Context) ([]model.GeofeedEntry, error)
+	LoadIPRangesFunc        func(ctx context.Context) ([]model.IPRange, error)
+	GetSourceStatesFunc     func(ctx context.Context) (map[string]model.SourceState, error)
+	SaveSourceStatesFunc    func(ctx context.Context, states []model.SourceState) error
+	ClearSourceStatesFunc   func(ctx context.Context) error
 }
 
-func (m *MockRepository) SaveIPRanges(ctx context.Context, ranges []model.IPRange) error {
-	return m.SaveIPRangesFunc(ctx, ranges)
+func (m *MockRepository) BeginStaging(ctx context.Context) error {
+	return m.BeginStagingFunc(ctx)
 }
 
-func (m *MockRepository) FindCountryForIP(ctx context.Context, ip net.IP) (string, error) {
-	return m.FindCountryForIPFunc(ctx, ip)
+func (m *MockRepository) SaveIPRanges(ctx context.Context, priority []string, load func(emit func(model.IPRange) error) error) error {
+	return m.SaveIPRangesFunc(ctx, priority, load)
 }
 
-func (m *MockRepository) ClearIPRanges(ctx context.Context) error {
-	return m.ClearIPRangesFunc(ctx)
+func (m *MockRepository) KeepIPRanges(ctx context.Context, sources []string, priority []string) (int64, error) {
+	return m.KeepIPRangesFunc(ctx, sources, priority)
 }
 
-func (m *MockRepository) GetRangesCount(ctx context.Context) (int64, error) {
-	return m.GetRangesCountFunc(ctx)
+func (m *MockRepository) CountIPRanges(ctx context.Context) ([]model.RangeCount, error) {
+	return m.CountIPRangesFunc(ctx)
+}
+
+func (m *MockRepository) CountStagedIPRanges(ctx context.Context) ([]model.RangeCount, error) {
+	return m.CountStagedIPRangesFunc(ctx)
+}
+
+func (m *MockRepository) FindStagedConflicts(ctx context.Context, limit int) ([]model.RangeConflict, error) {
+	return m.FindStagedConflictsFunc(ctx, limit)
+}
+
+func (m *MockRepository) FindRangeForIP(ctx context.Context, ip net.IP) (*model.IPRange, error) {
+	return m.FindRangeForIPFunc(ctx, ip)
+}
+
+func (m *MockRepository) FindRangesForIPs(ctx context.Context, ips []net.IP) ([]*model.IPRange, error) {
+	return m.FindRangesForIPsFunc(ctx, ips)
+}
+
+func (m *MockRepository) GetStagedCount(ctx context.Context) (int64, error) {
+	return m.GetStagedCountFunc(ctx)
+}
+
+func (m *MockRepository) SwapIPRanges(ctx context.Context, base int64, sources []model.SourceVersion) (int64, error) {
+	return m.SwapIPRangesFunc(ctx, base, sources)
+}
+
+func (m *MockRepository) RollbackIPRanges(ctx context.Context) error {
+	return m.RollbackIPRangesFunc(ctx)
+}
+
+func (m *MockRepository) GetDatasetInfo(ctx context.Context) (*model.DatasetInfo, error) {
+	return m.GetDatasetInfoFunc(ctx)
+}
+
+func (m *MockRepository) MarkDatasetChecked(ctx context.Context) error {
+	return m.MarkDatasetCheckedFunc(ctx)
+}
+
+func (m *MockRepository) ListDatasetVersions(ctx context.Context, limit int) ([]model.DatasetVersion, error) {
+	return m.ListDatasetVersionsFunc(ctx, limit)
+}
+
+func (m *MockRepository) SaveDatasetHistory(ctx context.Context, version int64, keep int) error {
+	return m.SaveDatasetHistoryFunc(ctx, version, keep)
+}
+
+func (m *MockRepository) GetDatasetDiff(ctx context.Context, q model.DiffQuery) (*model.DatasetDiff, error) {
+	return m.GetDatasetDiffFunc(ctx, q)
+}
+
+func (m *MockRepository) FindRangeForIPAt(ctx context.Context, ip net.IP, at time.Time) (*model.HistoricalRange, error) {
+	return m.FindRangeForIPAtFunc(ctx, ip, at)
+}
+
+func (m *MockRepository) LatestArchiveDate(ctx context.Context, source string) (time.Time, error) {
+	return m.LatestArchiveDateFunc(ctx, source)
+}
+
+func (m *MockRepository) ImportArchive(ctx context.Context, archive model.DelegationArchive, load func(emit func(model.IPRange) error) error) (*model.ArchiveImport, error) {
+	return m.ImportArchiveFunc(ctx, archive, load)
+}
+
+func (m *MockRepository) SaveASNDelegations(ctx context.Context, kept []string, delegations []model.ASNDelegation) error {
+	return m.SaveASNDelegationsFunc(ctx, kept, delegations)
+}
+
+func (m *MockRepository) LoadASNDelegations(ctx context.Context) ([]model.ASNDelegation, error) {
+	return m.LoadASNDelegationsFunc(ctx)
+}
+
+func (m *MockRepository) FindASNDelegation(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+	return m.FindASNDelegationFunc(ctx, asn)
+}
+
+func (m *MockRepository) LatestRouteImport(ctx context.Context) (*model.RouteImport, error) {
+	return m.LatestRouteImportFunc(ctx)
+}
+
+func (m *MockRepository) LoadRoutes(ctx context.Context) ([]model.Route, error) {
+	return m.LoadRoutesFunc(ctx)
+}
+
+func (m *MockRepository) ReplaceRoutes(ctx context.Context, files []string, load func(emit func(model.Route) error) error) (*model.RouteImport, error) {
+	return m.ReplaceRoutesFunc(ctx, files, load)
+}
+
+func (m *MockRepository) SaveGeofeeds(ctx context.Context, kept []string, entries []model.GeofeedEntry) (*model.GeofeedUpdate, error) {
+	return m.SaveGeofeedsFunc(ctx, kept, entries)
+}
+
+func (m *MockRepository) LatestGeofeedUpdate(ctx context.Context) (*model.GeofeedUpdate, error) {
+	return m.LatestGeofeedUpdateFunc(ctx)
+}
+
+func (m *MockRepository) LoadGeofeeds(ctx context.Context) ([]model.GeofeedEntry, error) {
+	return m.LoadGeofeedsFunc(ctx)
+}
+
+func (m *MockRepository) LoadIPRanges(ctx context.Context) ([]model.IPRange, error) {
+	return m.LoadIPRangesFunc(ctx)
+}
+
+func (m *MockRepository) GetSourceStates(ctx context.Context) (map[string]model.SourceState, error) {
+	return m.GetSourceStatesFunc(ctx)
+}
+
+func (m *MockRepository) SaveSourceStates(ctx context.Context, states []model.SourceState) error {
+	return m.SaveSourceStatesFunc(ctx, states)
+}
+
+func (m *MockRepository) ClearSourceStates(ctx context.Context) error {
+	return m.ClearSourceStatesFunc(ctx)
 }
 
 type MockCache struct {
-	SetCountryFunc     func(ctx context.Context, ip, countryCode string) error
-	GetCountryFunc     func(ctx context.Context, ip string) (string, error)
-	CacheIPRangesFunc  func(ctx context.Context, ranges []model.IPRange) error
-	GetCachedRangeFunc func(ctx context.Context, ip net.IP) (string, error)
+	SetIPRangeFunc          func(ctx context.Context, version int64, ip string, ipRange model.IPRange) error
+	GetIPRangeFunc          func(ctx context.Context, version int64, ip string) (*model.IPRange, error)
+	GetIPRangesFunc         func(ctx context.Context, version int64, ips []string) ([]*model.IPRange, error)
+	SetIPRangesFunc         func(ctx context.Context, version int64, ranges map[string]model.IPRange) error
+	CacheIPRangesFunc       func(ctx context.Context, table *lookup.Table) error
+	GetCachedRangeFunc      func(ctx context.Context, ip net.IP) (*model.IPRange, error)
+	SetASNFunc              func(ctx context.Context, asn uint32, delegation model.ASNDelegation) error
+	GetASNFunc              func(ctx context.Context, asn uint32) (*model.ASNDelegation, error)
+	CacheASNDelegationsFunc func(ctx context.Context, table *lookup.ASNTable) error
+	GetCachedASNFunc        func(ctx context.Context, asn uint32) (*model.ASNDelegation, error)
+}
+
+func (m *MockCache) SetIPRange(ctx context.Context, version int64, ip string, ipRange model.IPRange) error {
+	return m.SetIPRangeFunc(ctx, version, ip, ipRange)
+}
+
+func (m *MockCache) GetIPRange(ctx context.Context, version int64, ip string) (*model.IPRange, error) {
+	return m.GetIPRangeFunc(ctx, version, ip)
 }
 
-func (m *MockCache) SetCountry(ctx context.Context, ip, countryCode string) error {
-	return m.SetCountryFunc(ctx, ip, countryCode)
+func (m *MockCache) GetIPRanges(ctx context.Context, version int64, ips []string) ([]*model.IPRange, error) {
+	return m.GetIPRangesFunc(ctx, version, ips)
 }
 
-func (m *MockCache) GetCountry(ctx context.Context, ip string) (string, error) {
-	return m.GetCountryFunc(ctx, ip)
+func (m *MockCache) SetIPRanges(ctx context.Context, version int64, ranges map[string]model.IPRange) error {
+	return m.SetIPRangesFunc(ctx, version, ranges)
 }
 
-func (m *MockCache) CacheIPRanges(ctx context.Context, ranges []model.IPRange) error {
-	return m.CacheIPRangesFunc(ctx, ranges)
+func (m *MockCache) CacheIPRanges(ctx context.Context, table *lookup.Table) error {
+	return m.CacheIPRangesFunc(ctx, table)
 }
 
-func (m *MockCache) GetCachedRange(ctx context.Context, ip net.IP) (string, error) {
+func (m *MockCache) GetCachedRange(ctx context.Context, ip net.IP) (*model.IPRange, error) {
 	return m.GetCachedRangeFunc(ctx, ip)
 }
+
+func (m *MockCache) SetASN(ctx context.Context, asn uint32, delegation model.ASNDelegation) error {
+	return m.SetASNFunc(ctx, asn, delegation)
+}
+
+func (m *MockCache) GetASN(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+	return m.GetASNFunc(ctx, asn)
+}
+
+func (m *MockCache) CacheASNDelegations(ctx context.Context, table *lookup.ASNTable) error {
+	return m.CacheASNDelegationsFunc(ctx, table)
+}
+
+func (m *MockCache) GetCachedASN(ctx context.Context, asn uint32) (*model.ASNDelegation, error) {
+	return m.GetCachedASNFunc(ctx, asn)
+}